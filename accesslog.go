@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type AccessLogConfig struct {
+	Enabled bool   `json:"enabled"`
+	Format  string `json:"format"` // "common" (Common Log Format) or "json"
+	Path    string `json:"path"`   // File to append to; empty writes to stdout
+	Text    string `json:"text"`   // Request text in JSON lines: "omit" (default), "hash" or "include"
+}
+
+const (
+	accessLogCommon = "common"
+	accessLogJSON   = "json"
+
+	accessTextOmit    = "omit"
+	accessTextHash    = "hash"
+	accessTextInclude = "include"
+)
+
+// AccessLog writes one line per request in the configured format
+type AccessLog struct {
+	cfg AccessLogConfig
+	mu  sync.Mutex
+	out io.Writer
+}
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Remote    string    `json:"remote"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMs float64   `json:"latency_ms"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	TextHash  string    `json:"text_hash,omitempty"`
+}
+
+// NewAccessLog returns nil when access logging is disabled
+func NewAccessLog(cfg AccessLogConfig) (*AccessLog, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Format == "" {
+		cfg.Format = accessLogCommon
+	}
+	if cfg.Text == "" {
+		cfg.Text = accessTextOmit
+	}
+	if cfg.Format != accessLogCommon && cfg.Format != accessLogJSON {
+		return nil, fmt.Errorf("access log format must be %q or %q", accessLogCommon, accessLogJSON)
+	}
+	if cfg.Text != accessTextOmit && cfg.Text != accessTextHash && cfg.Text != accessTextInclude {
+		return nil, fmt.Errorf("access log text must be %q, %q or %q", accessTextOmit, accessTextHash, accessTextInclude)
+	}
+	var out io.Writer = os.Stdout
+	if cfg.Path != "" {
+		f, err := os.OpenFile(cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	return &AccessLog{cfg: cfg, out: out}, nil
+}
+
+// Access log middleware. It must run inside logRequests, which collects the
+// tenant and text handlers report.
+func (s *server) accessLog(next http.Handler) http.Handler {
+	if s.access == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		entry := accessLogEntry{
+			Time:      start,
+			RequestID: requestIDFrom(r.Context()),
+			Remote:    s.limiter.clientIP(r),
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Proto:     r.Proto,
+			Status:    rec.status,
+			Bytes:     rec.bytes,
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			UserAgent: r.UserAgent(),
+			Referer:   r.Referer(),
+		}
+		if fields := fieldsFrom(r.Context()); fields != nil {
+			fields.mu.Lock()
+			entry.Tenant = fields.tenant
+			switch {
+			case fields.text == "":
+			case s.access.cfg.Text == accessTextInclude:
+				entry.Text = fields.text
+			case s.access.cfg.Text == accessTextHash:
+				entry.TextHash = textHash(fields.text, "")
+			}
+			fields.mu.Unlock()
+		}
+		s.access.write(entry)
+	})
+}
+
+func (a *AccessLog) write(entry accessLogEntry) {
+	var line []byte
+	if a.cfg.Format == accessLogJSON {
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	} else {
+		// host ident authuser [date] "request" status bytes
+		user := entry.Tenant
+		if user == "" || user == anonymousTenant {
+			user = "-"
+		}
+		size := "-"
+		if entry.Bytes > 0 {
+			size = strconv.FormatInt(entry.Bytes, 10)
+		}
+		line = []byte(fmt.Sprintf("%s - %s [%s] %q %d %s\n",
+			entry.Remote, user, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method+" "+entry.Path+" "+entry.Proto, entry.Status, size))
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.out.Write(line)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// apiKeyView is the admin representation of a key; it never includes the secret
+type apiKeyView struct {
+	ID           string    `json:"id"`
+	DailyChars   int64     `json:"daily_chars"`
+	MonthlyChars int64     `json:"monthly_chars"`
+	Revoked      bool      `json:"revoked"`
+	Signed       bool      `json:"signed"`
+	CreatedAt    time.Time `json:"created_at,omitempty"`
+	UsedToday    int64     `json:"used_today"`
+	UsedMonth    int64     `json:"used_this_month"`
+	EgressBytes  int64     `json:"egress_bytes"` // Served since startup; see egress.go
+}
+
+type createKeyRequest struct {
+	ID           string `json:"id"`
+	DailyChars   int64  `json:"daily_chars"`
+	MonthlyChars int64  `json:"monthly_chars"`
+	Signed       bool   `json:"signed"` // Issue a signing secret and require signed requests
+}
+
+type createKeyResponse struct {
+	apiKeyView
+	Key           string `json:"key"` // Secrets are only returned once, at creation
+	SigningSecret string `json:"signing_secret,omitempty"`
+}
+
+type updateKeyRequest struct {
+	DailyChars   *int64 `json:"daily_chars"`
+	MonthlyChars *int64 `json:"monthly_chars"`
+}
+
+// Admin middleware requiring the configured X-Admin-Token; admin routes are disabled without one
+func requireAdmin(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "Not found")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) != 1 {
+			writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *server) keyView(key APIKey) apiKeyView {
+	day, month := s.keys.usageOf(key.ID)
+	return apiKeyView{
+		ID:           key.ID,
+		DailyChars:   key.DailyChars,
+		MonthlyChars: key.MonthlyChars,
+		Revoked:      key.Revoked,
+		Signed:       key.SigningSecret != "",
+		CreatedAt:    key.CreatedAt,
+		UsedToday:    day,
+		UsedMonth:    month,
+		EgressBytes:  s.egress.tenantBytes(key.ID),
+	}
+}
+
+func (s *server) handleListKeys(w http.ResponseWriter, r *http.Request) {
+	views := []apiKeyView{}
+	for _, key := range s.keys.list() {
+		views = append(views, s.keyView(key))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (s *server) handleCreateKey(w http.ResponseWriter, r *http.Request) {
+	var req createKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload")
+		return
+	}
+	newKey := APIKey{ID: req.ID, DailyChars: req.DailyChars, MonthlyChars: req.MonthlyChars}
+	if req.Signed {
+		signingSecret, err := randomSecret("")
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to create API key")
+			return
+		}
+		newKey.SigningSecret = signingSecret
+	}
+	key, secret, err := s.keys.create(newKey)
+	if errors.Is(err, errKeyReserved) {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: /id: " + err.Error(), Pointer: "/id"})
+		return
+	} else if errors.Is(err, errKeyExists) || errors.Is(err, errKeysNotKept) {
+		writeError(w, r, http.StatusConflict, codeConflict, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to create API key")
+		return
+	}
+	writeJSON(w, http.StatusCreated, createKeyResponse{apiKeyView: s.keyView(*key), Key: secret, SigningSecret: key.SigningSecret})
+}
+
+func (s *server) handleUpdateKey(w http.ResponseWriter, r *http.Request) {
+	var req updateKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload")
+		return
+	}
+	key, err := s.keys.update(r.PathValue("id"), func(key *APIKey) {
+		if req.DailyChars != nil {
+			key.DailyChars = *req.DailyChars
+		}
+		if req.MonthlyChars != nil {
+			key.MonthlyChars = *req.MonthlyChars
+		}
+	})
+	s.writeKeyResult(w, r, key, err)
+}
+
+func (s *server) handleRevokeKey(w http.ResponseWriter, r *http.Request) {
+	key, err := s.keys.update(r.PathValue("id"), func(key *APIKey) { key.Revoked = true })
+	s.writeKeyResult(w, r, key, err)
+}
+
+func (s *server) writeKeyResult(w http.ResponseWriter, r *http.Request, key *APIKey, err error) {
+	if errors.Is(err, errKeyNotFound) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to update API key")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.keyView(*key))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type AnalyticsConfig struct {
+	Enabled           bool     `json:"enabled"`
+	StoreTextTenants  []string `json:"store_text_tenants"`   // Tenants whose raw text may be kept; everyone else is hashed
+	MaxTextsPerTenant int      `json:"max_texts_per_tenant"` // Least-requested texts are dropped beyond this
+}
+
+type textStat struct {
+	Hash     string    `json:"hash"`
+	Text     string    `json:"text,omitempty"`
+	Lang     string    `json:"lang"`
+	Count    int64     `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// TextAnalytics counts how often each text is requested per tenant
+type TextAnalytics struct {
+	cfg       AnalyticsConfig
+	storeText map[string]bool
+	mu        sync.Mutex
+	byTenant  map[string]map[string]*textStat
+}
+
+func NewTextAnalytics(cfg AnalyticsConfig) *TextAnalytics {
+	if cfg.MaxTextsPerTenant <= 0 {
+		cfg.MaxTextsPerTenant = 10000
+	}
+	storeText := make(map[string]bool)
+	for _, tenant := range cfg.StoreTextTenants {
+		storeText[tenant] = true
+	}
+	return &TextAnalytics{cfg: cfg, storeText: storeText, byTenant: make(map[string]map[string]*textStat)}
+}
+
+func textHash(text, lang string) string {
+	sum := sha256.Sum256([]byte(lang + "\x00" + text))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (a *TextAnalytics) record(tenant, text, lang string) {
+	if !a.cfg.Enabled {
+		return
+	}
+	hash := textHash(text, lang)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats, exists := a.byTenant[tenant]
+	if !exists {
+		stats = make(map[string]*textStat)
+		a.byTenant[tenant] = stats
+	}
+	stat, exists := stats[hash]
+	if !exists {
+		if len(stats) >= a.cfg.MaxTextsPerTenant {
+			evictLeastRequested(stats)
+		}
+		stat = &textStat{Hash: hash, Lang: lang}
+		if a.storeText[tenant] {
+			stat.Text = text
+		}
+		stats[hash] = stat
+	}
+	stat.Count++
+	stat.LastSeen = time.Now().UTC()
+}
+
+func evictLeastRequested(stats map[string]*textStat) {
+	var victim *textStat
+	for _, stat := range stats {
+		if victim == nil || stat.Count < victim.Count || (stat.Count == victim.Count && stat.LastSeen.Before(victim.LastSeen)) {
+			victim = stat
+		}
+	}
+	if victim != nil {
+		delete(stats, victim.Hash)
+	}
+}
+
+// top returns the n most requested texts for a tenant, or across all tenants when tenant is empty
+func (a *TextAnalytics) top(tenant string, n int) []textStat {
+	a.mu.Lock()
+	merged := make(map[string]*textStat)
+	for name, stats := range a.byTenant {
+		if tenant != "" && name != tenant {
+			continue
+		}
+		for hash, stat := range stats {
+			if m, exists := merged[hash]; exists {
+				m.Count += stat.Count
+				if stat.LastSeen.After(m.LastSeen) {
+					m.LastSeen = stat.LastSeen
+				}
+				if m.Text == "" {
+					m.Text = stat.Text
+				}
+			} else {
+				copied := *stat
+				merged[hash] = &copied
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	result := make([]textStat, 0, len(merged))
+	for _, stat := range merged {
+		result = append(result, *stat)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Hash < result[j].Hash
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+func (s *server) handleTopTexts(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		n = 20
+	}
+	writeJSON(w, http.StatusOK, s.analytics.top(r.URL.Query().Get("tenant"), n))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Read-aloud requests double as batch exports: with output set to zip or
+// tar, the response is an archive of one audio file per chunk plus
+// manifest.json, instead of base64 audio in JSON. Localization teams name
+// chunks after their prompt ids ("checkout.confirm") to get files they can
+// drop into a build; unnamed chunks are named after their index. The archive
+// is streamed once every chunk is synthesized, so a failure still gets a
+// proper error response.
+
+const (
+	outputJSON = "json"
+	outputZip  = "zip"
+	outputTar  = "tar"
+)
+
+var readAloudOutputs = []string{outputJSON, outputZip, outputTar}
+
+// Longest chunk name accepted for archive entries
+const maxArchiveNameLen = 100
+
+// File extensions by output format; the G.711 formats are WAV files
+var audioExtensions = map[string]string{
+	"opus": "opus", "aac": "aac", "mp3": "mp3", "ogg": "ogg", "wav": "wav", "flac": "flac", "mulaw": "wav", "alaw": "wav",
+}
+
+type archiveManifest struct {
+	Engine    string          `json:"engine"`
+	Lang      string          `json:"lang"`
+	Codec     string          `json:"codec"`
+	CreatedAt time.Time       `json:"created_at"`
+	Files     []archiveRecord `json:"files"`
+}
+
+type archiveRecord struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	File  string `json:"file,omitempty"` // Absent for chunks with nothing to speak
+	Text  string `json:"text"`
+	Bytes int    `json:"bytes"`
+}
+
+// checkArchiveName reports why name cannot name an archive entry, or ""
+func checkArchiveName(name string) string {
+	switch {
+	case len(name) > maxArchiveNameLen:
+		return fmt.Sprintf("must be at most %d bytes", maxArchiveNameLen)
+	case strings.Trim(name, ".") == "":
+		return "must not be only dots"
+	case strings.ContainsFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-')
+	}):
+		return "may only contain letters, digits, '.', '_' and '-'"
+	}
+	return ""
+}
+
+// archiveNames returns each chunk's entry name, writing a 400 for invalid
+// or repeated names
+func archiveNames(w http.ResponseWriter, r *http.Request, chunks []ReadAloudChunk) ([]string, bool) {
+	names := make([]string, len(chunks))
+	seen := make(map[string]int)
+	for i, chunk := range chunks {
+		names[i] = chunk.Name
+		if names[i] == "" {
+			names[i] = fmt.Sprintf("%04d", chunk.Index)
+		} else if reason := checkArchiveName(chunk.Name); reason != "" {
+			writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: fmt.Sprintf("Invalid request payload: /chunks/%d/name: %s", i, reason), Pointer: fmt.Sprintf("/chunks/%d/name", i)})
+			return nil, false
+		}
+		if first, exists := seen[names[i]]; exists {
+			writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: fmt.Sprintf("Invalid request payload: /chunks/%d/name: %q is also the name of chunk %d", i, names[i], first), Pointer: fmt.Sprintf("/chunks/%d/name", i)})
+			return nil, false
+		}
+		seen[names[i]] = i
+	}
+	return names, true
+}
+
+// writeArchive streams the chunks' audio, in index order, and manifest.json
+func writeArchive(w http.ResponseWriter, r *http.Request, output string, manifest archiveManifest, audio map[string][]byte) {
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Index < manifest.Files[j].Index })
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to build archive")
+		return
+	}
+	var entries []archiveEntry
+	for _, file := range manifest.Files {
+		if file.File != "" {
+			entries = append(entries, archiveEntry{file.File, audio[file.File]})
+		}
+	}
+	entries = append(entries, archiveEntry{"manifest.json", manifestJSON})
+
+	w.Header().Set("Content-Disposition", `attachment; filename="readaloud.`+output+`"`)
+	if output == outputTar {
+		w.Header().Set("Content-Type", "application/x-tar")
+		err = writeTar(w, entries, manifest.CreatedAt)
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+		err = writeZip(w, entries, manifest.CreatedAt)
+	}
+	if err != nil { // Headers are sent; the client sees a truncated archive
+		slog.Warn("Failed to stream archive", "request_id", requestIDFrom(r.Context()), "error", err)
+	}
+}
+
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+// writeZip stores entries; audio is already compressed, so nothing is deflated
+func writeZip(out io.Writer, entries []archiveEntry, modified time.Time) error {
+	zw := zip.NewWriter(out)
+	for _, e := range entries {
+		entry, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: zip.Store, Modified: modified})
+		if err != nil {
+			return err
+		}
+		if _, err := entry.Write(e.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTar(out io.Writer, entries []archiveEntry, modified time.Time) error {
+	tw := tar.NewWriter(out)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.data)), ModTime: modified, Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
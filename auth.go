@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKey is a client credential with optional character quotas
+type APIKey struct {
+	ID           string    `json:"id"`                 // Stable, non-secret identifier used as the tenant name
+	Key          string    `json:"key,omitempty"`      // Secret sent in the X-API-Key header; only kept in config files
+	KeyHash      string    `json:"key_hash,omitempty"` // SHA-256 of the secret, which is all the database stores
+	DailyChars   int64     `json:"daily_chars"`        // 0 means unlimited
+	MonthlyChars int64     `json:"monthly_chars"`      // 0 means unlimited
+	Revoked      bool      `json:"revoked,omitempty"`
+	CreatedAt    time.Time `json:"created_at,omitempty"`
+
+	SigningSecret string `json:"signing_secret,omitempty"` // HMAC secret; when set, requests from this key must be signed
+}
+
+type AuthConfig struct {
+	AllowAnonymous bool     `json:"allow_anonymous"`
+	Keys           []APIKey `json:"keys"`
+}
+
+// keyUsage counts a key's characters in the current day and month; with -db
+// it is stored on every change, so quotas hold across restarts
+type keyUsage struct {
+	Day        string `json:"day"`
+	DayChars   int64  `json:"day_chars"`
+	Month      string `json:"month"`
+	MonthChars int64  `json:"month_chars"`
+}
+
+var bucketKeyUsage = []byte("key_usage")
+
+// KeyStore validates API keys and tracks their quota usage
+type KeyStore struct {
+	allowAnonymous bool
+	db             *Store
+	mu             sync.Mutex
+	keys           map[string]*APIKey // By secret hash
+	byID           map[string]*APIKey
+	configured     map[string]bool // Ids of keys from the config file, which come back on restart
+	usage          map[string]*keyUsage
+}
+
+var (
+	errDailyQuota   = errors.New("daily character quota exceeded")
+	errMonthlyQuota = errors.New("monthly character quota exceeded")
+	errKeyExists    = errors.New("an API key with this id already exists")
+	errKeyNotFound  = errors.New("API key not found")
+	errKeyReserved  = errors.New("this API key id is reserved")
+	errKeysNotKept  = errors.New("API keys can only be created with a database (-db), or they would be lost on restart")
+)
+
+// principal identifies who is making a request
+type principal struct {
+	tenant string
+	key    *APIKey // nil for anonymous requests
+}
+
+type contextKey int
+
+const (
+	principalContextKey contextKey = iota
+	requestIDContextKey
+	requestFieldsContextKey
+	queuedJobContextKey
+)
+
+const anonymousTenant = "anonymous"
+
+// NewKeyStore loads keys from the config file, then from the database, which
+// wins on conflicts so keys changed through the admin API stay changed
+func NewKeyStore(cfg AuthConfig, db *Store) (*KeyStore, error) {
+	store := &KeyStore{
+		allowAnonymous: cfg.AllowAnonymous,
+		db:             db,
+		keys:           make(map[string]*APIKey),
+		byID:           make(map[string]*APIKey),
+		configured:     make(map[string]bool),
+		usage:          make(map[string]*keyUsage),
+	}
+	for i := range cfg.Keys {
+		key := cfg.Keys[i]
+		if key.KeyHash == "" {
+			key.KeyHash = hashSecret(key.Key)
+		}
+		if key.ID == "" {
+			key.ID = key.KeyHash[:12]
+		}
+		key.Key = ""
+		store.add(&key)
+		store.configured[key.ID] = true
+	}
+	err := db.forEach(bucketAPIKeys, func(_ string, data []byte) error {
+		var key APIKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			return err
+		}
+		store.add(&key)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load API keys: %w", err)
+	}
+	err = db.forEach(bucketKeyUsage, func(id string, data []byte) error {
+		var usage keyUsage
+		if err := json.Unmarshal(data, &usage); err != nil {
+			return err
+		}
+		store.usage[id] = &usage
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load API key usage: %w", err)
+	}
+	return store, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// add indexes a key, replacing any existing key with the same id
+func (s *KeyStore) add(key *APIKey) {
+	if old, exists := s.byID[key.ID]; exists {
+		delete(s.keys, old.KeyHash)
+	}
+	s.byID[key.ID] = key
+	s.keys[key.KeyHash] = key
+}
+
+func (s *KeyStore) lookup(secret string) (*APIKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, exists := s.keys[hashSecret(secret)]
+	if !exists || key.Revoked {
+		return nil, false
+	}
+	return key, true
+}
+
+func (s *KeyStore) lookupID(id string) (*APIKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, exists := s.byID[id]
+	if !exists || key.Revoked {
+		return nil, false
+	}
+	return key, true
+}
+
+// randomSecret returns a URL-safe random token with the given prefix
+func randomSecret(prefix string) (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// create issues a new random secret for the key and returns it; the secret is
+// not stored. Keys are only created with a database, where they persist.
+func (s *KeyStore) create(key APIKey) (*APIKey, string, error) {
+	secret, err := randomSecret("tts_")
+	if err != nil {
+		return nil, "", err
+	}
+	key.Key = ""
+	key.KeyHash = hashSecret(secret)
+	key.Revoked = false
+	key.CreatedAt = time.Now().UTC()
+	if key.ID == "" {
+		key.ID = key.KeyHash[:12]
+	}
+	if key.ID == anonymousTenant {
+		return nil, "", errKeyReserved
+	}
+	if s.db == nil {
+		return nil, "", errKeysNotKept
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.byID[key.ID]; exists {
+		return nil, "", errKeyExists
+	}
+	if err := s.db.put(bucketAPIKeys, key.ID, key); err != nil {
+		return nil, "", err
+	}
+	s.add(&key)
+	return &key, secret, nil
+}
+
+// update applies fn to a copy of the key and persists the result
+func (s *KeyStore) update(id string, fn func(key *APIKey)) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, exists := s.byID[id]
+	if !exists {
+		return nil, errKeyNotFound
+	}
+	key := *existing
+	fn(&key)
+	if err := s.db.put(bucketAPIKeys, key.ID, key); err != nil {
+		return nil, err
+	}
+	*existing = key
+	return &key, nil
+}
+
+// list returns a snapshot of all keys sorted by id
+func (s *KeyStore) list() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]APIKey, 0, len(s.byID))
+	for _, key := range s.byID {
+		keys = append(keys, *key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// usageOf returns the characters a key used today and this month
+func (s *KeyStore) usageOf(id string) (day, month int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	if usage, exists := s.usage[id]; exists {
+		if usage.Day == now.Format("2006-01-02") {
+			day = usage.DayChars
+		}
+		if usage.Month == now.Format("2006-01") {
+			month = usage.MonthChars
+		}
+	}
+	return day, month
+}
+
+// currentUsage returns the key's usage, reset if the day or month has changed
+func (s *KeyStore) currentUsage(id string) *keyUsage {
+	now := time.Now().UTC()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	usage, exists := s.usage[id]
+	if !exists {
+		usage = &keyUsage{}
+		s.usage[id] = usage
+	}
+	if usage.Day != day {
+		usage.Day, usage.DayChars = day, 0
+	}
+	if usage.Month != month {
+		usage.Month, usage.MonthChars = month, 0
+	}
+	return usage
+}
+
+// charge records chars against the key's quotas, rejecting the request if either would be exceeded
+func (s *KeyStore) charge(key *APIKey, chars int64) error {
+	if key == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.currentUsage(key.ID)
+	if key.MonthlyChars > 0 && usage.MonthChars+chars > key.MonthlyChars {
+		return errMonthlyQuota
+	}
+	if key.DailyChars > 0 && usage.DayChars+chars > key.DailyChars {
+		return errDailyQuota
+	}
+	usage.DayChars += chars
+	usage.MonthChars += chars
+	s.storeUsage(key.ID, usage)
+	return nil
+}
+
+// refund gives back chars charged for a request that produced no audio. A
+// charge from a previous day or month has already been reset, so only what
+// is left of the current counters is given back.
+func (s *KeyStore) refund(key *APIKey, chars int64) {
+	if key == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := s.currentUsage(key.ID)
+	usage.DayChars = max(usage.DayChars-chars, 0)
+	usage.MonthChars = max(usage.MonthChars-chars, 0)
+	s.storeUsage(key.ID, usage)
+}
+
+// storeUsage persists a key's usage; a failed write only costs the count
+// since the last one if the server restarts
+func (s *KeyStore) storeUsage(id string, usage *keyUsage) {
+	if err := s.db.put(bucketKeyUsage, id, usage); err != nil {
+		slog.Warn("Failed to store API key usage", "key", id, "error", err)
+	}
+}
+
+func principalFrom(ctx context.Context) *principal {
+	if p, ok := ctx.Value(principalContextKey).(*principal); ok {
+		return p
+	}
+	return &principal{tenant: anonymousTenant}
+}
+
+// Authentication middleware resolving the X-API-Key header or a bearer token into a principal
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := &principal{tenant: anonymousTenant}
+		bearer, hasBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if secret := r.Header.Get("X-API-Key"); secret != "" {
+			key, exists := s.keys.lookup(secret)
+			if !exists {
+				writeError(w, r, http.StatusUnauthorized, codeInvalidAPIKey, "Invalid API key")
+				return
+			}
+			if !s.checkSignature(w, r, key) {
+				return
+			}
+			p = &principal{tenant: key.ID, key: key}
+		} else if clientID := r.Header.Get("X-Client-ID"); clientID != "" {
+			key, exists := s.keys.lookupID(clientID)
+			if !exists || key.SigningSecret == "" {
+				writeError(w, r, http.StatusUnauthorized, codeInvalidAPIKey, "Unknown client")
+				return
+			}
+			if !s.checkSignature(w, r, key) {
+				return
+			}
+			p = &principal{tenant: key.ID, key: key}
+		} else if hasBearer && s.jwt != nil {
+			claims, err := s.jwt.verify(strings.TrimSpace(bearer))
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeError(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid bearer token")
+				return
+			}
+			tenant, ok := s.jwt.tenant(claims)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeError(w, r, http.StatusUnauthorized, codeInvalidToken, "Bearer token has no tenant claim")
+				return
+			}
+			p = &principal{tenant: tenant}
+		} else if !s.keys.allowAnonymous {
+			writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "API key or bearer token required")
+			return
+		}
+		setRequestTenant(r.Context(), p.tenant)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalContextKey, p)))
+	})
+}
+
+// checkSignature enforces request signing for keys that have a signing secret, or
+// for every key when signing is required, writing a 401 and returning false on failure
+func (s *server) checkSignature(w http.ResponseWriter, r *http.Request, key *APIKey) bool {
+	if key.SigningSecret == "" && !s.cfg.Signing.Required {
+		return true
+	}
+	err := errSignatureMissing
+	if key.SigningSecret != "" {
+		err = verifyRequestSignature(r, key.SigningSecret, time.Duration(s.cfg.Signing.MaxSkew))
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeLimitError(w, r, codeBodyTooLarge, "Request body is too large", tooLarge.Limit)
+		return false
+	} else if err != nil {
+		writeError(w, r, http.StatusUnauthorized, codeInvalidSignature, "Invalid request signature: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// writeQuotaError maps quota errors to 429 (daily, retry tomorrow) or 402 (monthly plan exhausted)
+func writeQuotaError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errDailyQuota) {
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		w.Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+		writeError(w, r, http.StatusTooManyRequests, codeDailyQuota, "Daily character quota exceeded")
+		return
+	}
+	writeError(w, r, http.StatusPaymentRequired, codeMonthlyQuota, "Monthly character quota exceeded")
+}
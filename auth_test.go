@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := OpenStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestKeyStoreCreate(t *testing.T) {
+	memory, err := NewKeyStore(AuthConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := memory.create(APIKey{ID: "acme"}); !errors.Is(err, errKeysNotKept) {
+		t.Errorf("create without a database: error = %v, want errKeysNotKept", err)
+	}
+
+	db := openTestStore(t)
+	keys, err := NewKeyStore(AuthConfig{}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := keys.create(APIKey{ID: anonymousTenant}); !errors.Is(err, errKeyReserved) {
+		t.Errorf("create %q: error = %v, want errKeyReserved", anonymousTenant, err)
+	}
+	if _, secret, err := keys.create(APIKey{ID: "acme"}); err != nil {
+		t.Fatalf("create: %v", err)
+	} else if _, ok := keys.lookup(secret); !ok {
+		t.Error("created key does not authenticate")
+	}
+	if _, _, err := keys.create(APIKey{ID: "acme"}); !errors.Is(err, errKeyExists) {
+		t.Errorf("create twice: error = %v, want errKeyExists", err)
+	}
+
+	reloaded, err := NewKeyStore(AuthConfig{}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.lookupID("acme"); !ok {
+		t.Error("created key was not loaded back from the database")
+	}
+}
+
+func TestKeyStoreQuota(t *testing.T) {
+	db := openTestStore(t)
+	keys, err := NewKeyStore(AuthConfig{}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := keys.create(APIKey{ID: "acme", DailyChars: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.charge(key, 80); err != nil {
+		t.Fatalf("charge(80): %v", err)
+	}
+	if err := keys.charge(key, 30); !errors.Is(err, errDailyQuota) {
+		t.Fatalf("charge(30) over quota: error = %v, want errDailyQuota", err)
+	}
+	keys.refund(key, 80)
+	if err := keys.charge(key, 30); err != nil {
+		t.Fatalf("charge(30) after refund: %v", err)
+	}
+
+	reloaded, err := NewKeyStore(AuthConfig{}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if day, month := reloaded.usageOf("acme"); day != 30 || month != 30 {
+		t.Errorf("usage after reload = %d today, %d this month, want 30 and 30", day, month)
+	}
+	reloaded.forgetUsage("acme", time.Time{})
+	if again, err := NewKeyStore(AuthConfig{}, db); err != nil {
+		t.Fatal(err)
+	} else if day, _ := again.usageOf("acme"); day != 0 {
+		t.Errorf("usage after purge and reload = %d, want 0", day)
+	}
+}
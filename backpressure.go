@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Without a bound, a burst of cache misses starts every synthesis at once
+// and latency grows for all of them. With synthesis_queue.concurrency set,
+// only that many syntheses run at a time and up to max_queued more wait for
+// a slot; beyond that requests fail at once with 503 queue_full and a
+// Retry-After estimated from the queue depth and the engine's average
+// synthesis time. Background work, jobs and feed narrations, waits for a
+// slot instead of being rejected, since nobody is holding a connection.
+
+// Estimate used for engines that have not been measured yet
+const defaultSynthesisEstimate = time.Second
+
+type SynthesisQueueConfig struct {
+	Concurrency int `json:"concurrency"` // Syntheses run at once; 0 is unlimited
+	MaxQueued   int `json:"max_queued"`  // Syntheses waiting for a slot before requests are rejected
+}
+
+// queueFullError carries how long the caller should wait before retrying
+type queueFullError struct {
+	retryAfter time.Duration
+}
+
+func (e *queueFullError) Error() string {
+	return fmt.Sprintf("synthesis queue is full; retry after %s", e.retryAfter)
+}
+
+// SynthesisQueue bounds concurrent syntheses; nil when unlimited
+type SynthesisQueue struct {
+	slots     chan struct{}
+	waiting   atomic.Int64
+	maxQueued int64
+}
+
+// synthesisQueue is set from the synthesis_queue setting when the server starts
+var synthesisQueue *SynthesisQueue
+
+func NewSynthesisQueue(cfg SynthesisQueueConfig) *SynthesisQueue {
+	if cfg.Concurrency <= 0 {
+		return nil
+	}
+	return &SynthesisQueue{slots: make(chan struct{}, cfg.Concurrency), maxQueued: int64(cfg.MaxQueued)}
+}
+
+// acquire waits for a slot to synthesize with engine, returning a
+// *queueFullError when too many syntheses are already waiting
+func (q *SynthesisQueue) acquire(ctx context.Context, engine string) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	release := func() { <-q.slots }
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	waiting := q.waiting.Add(1)
+	defer q.waiting.Add(-1)
+	if waiting > q.maxQueued && ctx.Value(queuedJobContextKey) == nil {
+		return nil, &queueFullError{retryAfter: q.estimate(engine, waiting)}
+	}
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// estimate is how long until position syntheses ahead have had a slot
+func (q *SynthesisQueue) estimate(engine string, position int64) time.Duration {
+	avg := engineLatency.get(engine)
+	if avg <= 0 {
+		avg = defaultSynthesisEstimate
+	}
+	return avg * time.Duration(position) / time.Duration(cap(q.slots))
+}
+
+func (q *SynthesisQueue) depth() int {
+	if q == nil {
+		return 0
+	}
+	return int(q.waiting.Load())
+}
+
+func writeQueueFull(w http.ResponseWriter, r *http.Request, err *queueFullError) {
+	seconds := max(1, int(math.Ceil(err.retryAfter.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, r, http.StatusServiceUnavailable, codeQueueFull, "Too many syntheses are waiting; try again later")
+}
@@ -0,0 +1,49 @@
+package main
+
+import "crypto/sha256"
+
+// Options that do not change the audio, such as an engine's unused accent or
+// a loudness setting on silence, still make a new cache key, and mixed or
+// sentence-cached texts often encode to the same bytes as plain ones. The
+// cache keeps one copy of byte-identical audio, shared by every key that
+// produced it, and frees it when the last of those keys is removed.
+
+// audioBlob is audio shared by one or more cache entries
+type audioBlob struct {
+	data []byte
+	refs int
+}
+
+// intern returns the stored copy of data and its digest, adding a reference;
+// c.mu must be held
+func (c *AudioCache) intern(data []byte) ([]byte, [sha256.Size]byte) {
+	digest := sha256.Sum256(data)
+	blob, exists := c.blobs[digest]
+	if !exists {
+		blob = &audioBlob{data: data}
+		c.blobs[digest] = blob
+	}
+	blob.refs++
+	return blob.data, digest
+}
+
+// release drops a reference to a blob, freeing it after the last; c.mu must be held
+func (c *AudioCache) release(digest [sha256.Size]byte) {
+	if blob, exists := c.blobs[digest]; exists {
+		if blob.refs--; blob.refs <= 0 {
+			delete(c.blobs, digest)
+		}
+	}
+}
+
+// footprint returns the bytes of audio held once, and the bytes saved by
+// sharing them between entries
+func (c *AudioCache) footprint() (stored, saved int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, blob := range c.blobs {
+		stored += int64(len(blob.data))
+		saved += int64(len(blob.data) * (blob.refs - 1))
+	}
+	return stored, saved
+}
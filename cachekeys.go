@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Cache keys used to hash text and language with 32-bit FNV, which collides
+// often enough at scale to serve one text's audio for another. Version 2
+// keys are a SHA-256 over every part of the key, with the language
+// canonicalized, so "EN" and "en" share audio. Switching schemes would start
+// every instance, and the shared cache directory, from cold, so cache_keys
+// has a migrate mode: entries are written under v2 keys, and a v2 miss falls
+// back to the v1 key and copies what it finds to the v2 key. Run migrate
+// until the old entries have expired (24 hours), then switch to v2.
+
+const (
+	cacheKeysV1      = "v1"
+	cacheKeysV2      = "v2"
+	cacheKeysMigrate = "migrate"
+)
+
+var cacheKeySchemes = []string{cacheKeysV1, cacheKeysV2, cacheKeysMigrate}
+
+// cacheKeyScheme is set from the cache_keys setting when the server starts
+var cacheKeyScheme = cacheKeysV1
+
+// cacheKeys returns the key to read and write an entry under, and in
+// migrate mode the v1 key to fall back to; rest identifies everything else
+// the entry depends on, such as the encoding
+func cacheKeys(engine, text, lang, rest string) (key, legacy string) {
+	v1 := engine + ":" + hashKey(text, lang) + ":" + rest
+	switch cacheKeyScheme {
+	case cacheKeysV2:
+		return cacheKeyV2(engine, text, lang, rest), ""
+	case cacheKeysMigrate:
+		return cacheKeyV2(engine, text, lang, rest), v1
+	}
+	return v1, ""
+}
+
+func cacheKeyV2(engine, text, lang, rest string) string {
+	h := sha256.New()
+	for _, part := range []string{engine, strings.ToLower(strings.TrimSpace(lang)), rest, text} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return "v2:" + engine + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// lookup returns the entry under key or, while migrating, under legacy,
+// which is then also cached under key
+func (c *AudioCache) lookup(key, legacy string) ([]byte, bool) {
+	if data, exists := c.get(key); exists || legacy == "" {
+		return data, exists
+	}
+	data, exists := c.get(legacy)
+	if exists {
+		c.set(key, data)
+	}
+	return data, exists
+}
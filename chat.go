@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Chat integrations let Slack slash commands and Teams outgoing webhooks
+// synthesize text. The audio is kept as a clip behind an unguessable URL,
+// and the chat gets a link to it.
+
+type ChatConfig struct {
+	SlackSigningSecret string   `json:"slack_signing_secret"` // Enables POST /v1/integrations/slack
+	TeamsSecret        string   `json:"teams_secret"`         // Base64 security token of a Teams outgoing webhook; enables POST /v1/integrations/teams
+	PublicURL          string   `json:"public_url"`           // Base URL clip links point at, e.g. https://tts.example.com
+	ClipDir            string   `json:"clip_dir"`             // Where clips are written
+	ClipTTL            Duration `json:"clip_ttl"`             // Clips older than this are deleted
+	Lang               string   `json:"lang"`                 // Language when the message does not start with one, e.g. "fr: Bonjour"
+}
+
+// ClipStore keeps synthesized clips on disk for a limited time
+type ClipStore struct {
+	dir string
+	ttl time.Duration
+}
+
+// NewClipStore returns nil when no chat integration is enabled
+func NewClipStore(cfg ChatConfig) (*ClipStore, error) {
+	if cfg.SlackSigningSecret == "" && cfg.TeamsSecret == "" {
+		return nil, nil
+	}
+	if cfg.ClipDir == "" || cfg.PublicURL == "" {
+		return nil, errors.New("chat integrations require clip_dir and public_url")
+	}
+	if err := os.MkdirAll(cfg.ClipDir, 0o755); err != nil {
+		return nil, err
+	}
+	ttl := time.Duration(cfg.ClipTTL)
+	if ttl <= 0 {
+		ttl = 7 * 24 * time.Hour
+	}
+	c := &ClipStore{dir: cfg.ClipDir, ttl: ttl}
+	go c.expire()
+	return c, nil
+}
+
+var clipIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func (c *ClipStore) save(audio []byte) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(raw)
+	return id, os.WriteFile(filepath.Join(c.dir, id+".aac"), audio, 0o644)
+}
+
+// expire deletes old clips hourly; while disk space is low, clips are kept a
+// quarter as long and checked every minute
+func (c *ClipStore) expire() {
+	for {
+		ttl, interval := c.ttl, time.Hour
+		if diskGuard.low(c.dir) {
+			ttl, interval = c.ttl/4, time.Minute
+		}
+		entries, _ := os.ReadDir(c.dir)
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > ttl {
+				os.Remove(filepath.Join(c.dir, entry.Name()))
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Serves a clip; knowing its ID is the only authorization needed
+func (s *server) handleClip(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if s.clips == nil || !clipIDPattern.MatchString(id) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Unknown clip")
+		return
+	}
+	path := filepath.Join(s.clips.dir, id+".aac")
+	if _, err := os.Stat(path); err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Unknown clip")
+		return
+	}
+	w.Header().Set("Content-Type", "audio/aac")
+	http.ServeFile(w, r, path)
+}
+
+// parseChatText splits an optional "xx:" language prefix from the text
+func (s *server) parseChatText(text string) (lang, rest string) {
+	text = strings.TrimSpace(text)
+	if first, remainder, ok := strings.Cut(text, " "); ok && strings.HasSuffix(first, ":") && len(first) <= 11 {
+		return strings.TrimSuffix(first, ":"), strings.TrimSpace(remainder)
+	}
+	lang = s.cfg.Chat.Lang
+	if lang == "" {
+		lang = "en"
+	}
+	return lang, text
+}
+
+// synthesizeClip turns chat text into a clip and returns its URL
+func (s *server) synthesizeClip(ctx context.Context, lang, text string) (string, error) {
+	if text == "" {
+		return "", errors.New("nothing to say")
+	}
+	if s.cfg.MaxTextChars > 0 && utf8.RuneCountInString(text) > s.cfg.MaxTextChars {
+		return "", fmt.Errorf("text is longer than %d characters", s.cfg.MaxTextChars)
+	}
+	engine, _ := s.engineFor("")
+	lang, supported := s.canonicalLanguage(engine, lang)
+	if !supported {
+		return "", fmt.Errorf("language %q is not supported", lang)
+	}
+	text, err := s.screen(ctx, GuardrailInput{Text: text, Lang: lang, Engine: engine.Name(), Source: "chat"})
+	if errors.Is(err, errGuardrailUnavailable) {
+		return "", errGuardrailUnavailable // Without the classifier's error, which is for the logs
+	} else if err != nil {
+		return "", err
+	}
+	audio, cached, err := getOrGenerateAudio(ctx, engine, text, lang, s.cache, AudioOptions{})
+	if err != nil {
+		return "", err
+	}
+	s.costs.record(engine.Name(), int64(utf8.RuneCountInString(text)), !cached)
+	id, err := s.clips.save(audio)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(s.cfg.Chat.PublicURL, "/") + "/v1/clips/" + id, nil
+}
+
+// verifySlackSignature checks X-Slack-Signature: v0=hex(HMAC-SHA256("v0:timestamp:body"))
+func verifySlackSignature(r *http.Request, body []byte, secret string, maxSkew time.Duration) error {
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	signature, ok := strings.CutPrefix(r.Header.Get("X-Slack-Signature"), "v0=")
+	if timestamp == "" || !ok {
+		return errSignatureMissing
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errSignatureStale
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew {
+		return errSignatureStale
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(signature)) {
+		return errSignatureInvalid
+	}
+	return nil
+}
+
+type slackMessage struct {
+	ResponseType string `json:"response_type"` // "ephemeral" or "in_channel"
+	Text         string `json:"text"`
+}
+
+// Handles Slack slash commands. Slack expects an answer within three seconds,
+// so the command is acknowledged right away and the link is posted to the
+// command's response_url once the clip is ready.
+func (s *server) handleSlackCommand(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.Chat.SlackSigningSecret == "" {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Slack integration is not enabled")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeLimitError(w, r, codeBodyTooLarge, "Request body is too large", tooLarge.Limit)
+		return
+	} else if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload")
+		return
+	}
+	if err := verifySlackSignature(r, body, s.cfg.Chat.SlackSigningSecret, time.Duration(s.cfg.Signing.MaxSkew)); err != nil {
+		writeError(w, r, http.StatusUnauthorized, codeInvalidSignature, "Invalid Slack signature: "+err.Error())
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload")
+		return
+	}
+	responseURL := form.Get("response_url")
+	if !strings.HasPrefix(responseURL, "https://hooks.slack.com/") {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload: response_url must be a Slack URL")
+		return
+	}
+
+	lang, text := s.parseChatText(form.Get("text"))
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		reply := slackMessage{ResponseType: "in_channel"}
+		if link, err := s.synthesizeClip(ctx, lang, text); err != nil {
+			reply = slackMessage{ResponseType: "ephemeral", Text: "Could not generate audio: " + err.Error()}
+		} else {
+			reply.Text = fmt.Sprintf("<%s|:sound: %s>", link, escapeSlack(text))
+		}
+		if err := postJSON(ctx, responseURL, reply); err != nil {
+			slog.Warn("Slack reply failed", "error", err)
+		}
+	}()
+	writeJSON(w, http.StatusOK, slackMessage{ResponseType: "ephemeral", Text: "Generating audio..."})
+}
+
+// escapeSlack escapes the characters Slack treats as markup in message text
+func escapeSlack(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "|", "¦").Replace(text)
+}
+
+func postJSON(ctx context.Context, target string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+	return nil
+}
+
+type teamsActivity struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// Teams mentions arrive inline as <at>Bot name</at>
+var teamsMention = regexp.MustCompile(`<at>[^<]*</at>`)
+
+// Handles Teams outgoing webhooks. Teams waits for the reply (up to five
+// seconds), so synthesis runs inline with a deadline just under that.
+func (s *server) handleTeamsMessage(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.Chat.TeamsSecret == "" {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Teams integration is not enabled")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeLimitError(w, r, codeBodyTooLarge, "Request body is too large", tooLarge.Limit)
+		return
+	} else if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload")
+		return
+	}
+	if !verifyTeamsSignature(r.Header.Get("Authorization"), body, s.cfg.Chat.TeamsSecret) {
+		writeError(w, r, http.StatusUnauthorized, codeInvalidSignature, "Invalid Teams signature")
+		return
+	}
+	var activity teamsActivity
+	if err := json.Unmarshal(body, &activity); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload")
+		return
+	}
+
+	lang, text := s.parseChatText(plainText(teamsMention.ReplaceAllString(activity.Text, "")))
+	ctx, cancel := context.WithTimeout(r.Context(), 4500*time.Millisecond)
+	defer cancel()
+	reply := teamsActivity{Type: "message"}
+	if link, err := s.synthesizeClip(ctx, lang, text); err != nil {
+		reply.Text = "Could not generate audio: " + err.Error()
+	} else {
+		reply.Text = fmt.Sprintf("[🔊 %s](%s)", text, link)
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// verifyTeamsSignature checks "Authorization: HMAC base64(HMAC-SHA256(body))" keyed with the decoded security token
+func verifyTeamsSignature(header string, body []byte, secret string) bool {
+	signature, ok := strings.CutPrefix(header, "HMAC ")
+	if !ok {
+		return false
+	}
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hmac.Equal([]byte(base64.StdEncoding.EncodeToString(mac.Sum(nil))), []byte(signature))
+}
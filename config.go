@@ -0,0 +1,300 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings. Values come from an optional JSON file
+// (-config) and can be overridden by command-line flags.
+type Config struct {
+	Addr       string          `json:"addr"`
+	LogLevel   string          `json:"log_level"`   // debug, info, warn or error
+	User       string          `json:"user"`        // Unprivileged user to switch to after binding addr when started as root
+	AllowRoot  bool            `json:"allow_root"`  // Keep running as root when no user is set
+	DBPath     string          `json:"db_path"`     // BoltDB file for persistent state; empty keeps everything in memory
+	AdminToken string          `json:"admin_token"` // Enables the /admin API when set
+	Validation string          `json:"validation"`  // "strict" or "lenient" request validation
+	RateLimit  RateLimitConfig `json:"rate_limit"`
+	Auth       AuthConfig      `json:"auth"`
+	OIDC       OIDCConfig      `json:"oidc"`
+	Signing    SigningConfig   `json:"signing"`
+	Analytics  AnalyticsConfig `json:"analytics"`
+	CORS       CORSConfig      `json:"cors"`
+
+	Engines       []EngineConfig  `json:"engines"`
+	DefaultEngine string          `json:"default_engine"`
+	SentenceCache bool            `json:"sentence_cache"` // Also cache audio per sentence so texts sharing sentences only synthesize the new ones
+	CacheKeys     string          `json:"cache_keys"`     // Cache key scheme: v1, the default, v2 or migrate; see cachekeys.go
+	LazyExpiry    bool            `json:"lazy_expiry"`    // Expire cache entries when read, with no background goroutine, for serverless deployments
+	Profanity     ProfanityConfig `json:"profanity"`      // Filter for user-generated content
+	Guardrail     GuardrailConfig `json:"guardrail"`      // Content policy hook run before synthesis
+
+	Preprocessing PreprocessingConfig `json:"preprocessing"` // Order of the text preprocessing stages; see pipeline.go
+
+	SharedCache    SharedCacheConfig    `json:"shared_cache"`    // Cache directory shared between instances
+	Replica        bool                 `json:"replica"`         // Serve cached audio only, never synthesizing; see replica.go
+	Upstream       UpstreamConfig       `json:"upstream"`        // Instance cache misses are forwarded to
+	Role           string               `json:"role"`            // all, the default, api or worker; see workers.go
+	Redis          RedisConfig          `json:"redis"`           // Work queue between roles api and worker
+	SynthesisQueue SynthesisQueueConfig `json:"synthesis_queue"` // Bound on concurrent syntheses; see backpressure.go
+	Serverless     bool                 `json:"serverless"`      // Run as a function, with no background goroutines; see serverless.go
+	ModelsDir      string               `json:"models_dir"`      // Where engine voices are kept; the user cache directory when empty
+	GRPC           GRPCConfig           `json:"grpc"`            // gRPC API next to the HTTP one; see grpc.go
+	Pricing        PricingConfig        `json:"pricing"`         // USD per million characters, by engine name
+	Shadow         ShadowConfig         `json:"shadow"`
+	Quality        QualityConfig        `json:"quality"`
+	Workspace      WorkspaceConfig      `json:"workspace"` // Scratch directories of command engines
+	DiskGuard      DiskGuardConfig      `json:"disk_guard"`
+	FFmpegSandbox  SandboxConfig        `json:"ffmpeg_sandbox"`
+
+	MaxBodyBytes int64 `json:"max_body_bytes"` // Larger request bodies are rejected with 413
+	MaxTextChars int   `json:"max_text_chars"` // Longer texts are rejected with 413
+
+	Ladder []string `json:"ladder"` // Bitrates produced when a request asks for a bitrate ladder
+
+	ResponseEnvelope string `json:"response_envelope"` // Shape of /v1/speak responses: "json", "bare", "jsonapi" or "progressive"
+
+	Feeds     FeedsConfig     `json:"feeds"`     // Sources narrated ahead of time
+	Retention RetentionConfig `json:"retention"` // How long generated audio and request history are kept
+
+	Jobs    JobsConfig    `json:"jobs"` // Asynchronous speak jobs
+	Tracing TracingConfig `json:"tracing"`
+	Chat    ChatConfig    `json:"chat"` // Slack and Teams integrations
+	Twilio  TwilioConfig  `json:"twilio"`
+	MaryTTS MaryTTSConfig `json:"marytts"` // MaryTTS compatible /process for Home Assistant; see marytts.go
+
+	AccessLog AccessLogConfig `json:"access_log"`
+	Realtime  RealtimeConfig  `json:"realtime"` // Low-latency PCM profile for game dialogue
+}
+
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowed_origins"` // Exact origins, "*", or wildcards like "https://*.example.com"
+	AllowedMethods []string `json:"allowed_methods"`
+	AllowedHeaders []string `json:"allowed_headers"`
+	ExposedHeaders []string `json:"exposed_headers"`
+	MaxAge         Duration `json:"max_age"` // How long browsers may cache preflight results
+}
+
+type RateLimitConfig struct {
+	RequestsPerSecond float64  `json:"requests_per_second"` // Per client IP, 2 by default; set 0 to disable rate limiting
+	Burst             int      `json:"burst"`
+	TrustedProxies    []string `json:"trusted_proxies"` // IPs or CIDRs allowed to set X-Forwarded-For
+	IdleTimeout       Duration `json:"idle_timeout"`    // Drop buckets of clients idle this long
+}
+
+// Duration lets config files use strings like "90s" or "24h"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// durationFlag binds a Duration to a flag taking values like "500ms"
+type durationFlag Duration
+
+func (d *durationFlag) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *durationFlag) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = durationFlag(parsed)
+	return nil
+}
+
+// listFlag is a comma-separated flag bound to a string slice
+type listFlag struct{ values *[]string }
+
+func (l listFlag) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l listFlag) Set(s string) error {
+	*l.values = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l.values = append(*l.values, v)
+		}
+	}
+	return nil
+}
+
+// defaultEngines adds the bundled voice, when there is one, to gtts
+func defaultEngines() []EngineConfig {
+	engines := []EngineConfig{{Name: "gtts", Type: "gtts"}}
+	if hasBundledVoice {
+		engines = append(engines, EngineConfig{Name: "piper", Type: "piper"})
+	}
+	return engines
+}
+
+// defaultEngineName prefers the bundled voice, which needs no network
+func defaultEngineName() string {
+	if hasBundledVoice {
+		return "piper"
+	}
+	return "gtts"
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Addr:          ":8080",
+		LogLevel:      "info",
+		Validation:    validationLenient,
+		Engines:       defaultEngines(),
+		DefaultEngine: defaultEngineName(),
+		Pricing:       PricingConfig{"gtts": 0},
+		MaxBodyBytes:  64 << 10,
+		MaxTextChars:  5000,
+		Ladder:        []string{"16k", "32k", "64k"},
+		RateLimit: RateLimitConfig{
+			RequestsPerSecond: 2,
+			Burst:             10,
+			IdleTimeout:       Duration(10 * time.Minute),
+		},
+		Realtime: RealtimeConfig{
+			Timeout:    Duration(2 * time.Second),
+			SampleRate: 22050,
+			Prewarm:    2,
+			Languages:  []string{"en"},
+		},
+		Auth:    AuthConfig{AllowAnonymous: true},
+		Signing: SigningConfig{MaxSkew: Duration(5 * time.Minute)},
+		CORS: CORSConfig{
+			AllowedOrigins: []string{"*"},
+			AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "X-API-Key", "X-Client-ID", "X-Timestamp", "X-Signature", "X-Validation", "X-Response-Envelope", "X-Request-ID", "traceparent"},
+			ExposedHeaders: []string{"Deprecation", "Sunset", "Link", "Retry-After", "X-Request-ID", "X-TTS-Engine", "X-Audio-Duration-Ms", "X-Audio-Codec", "X-Transformed-Text"},
+			MaxAge:         Duration(10 * time.Minute),
+		},
+		ResponseEnvelope: envelopeJSON,
+	}
+}
+
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "listen address")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level of the JSON logs: debug, info, warn or error")
+	fs.BoolVar(&c.SentenceCache, "sentence-cache", c.SentenceCache, "also cache audio per sentence, so templated texts only synthesize the sentences that changed")
+	fs.StringVar(&c.SharedCache.Dir, "shared-cache-dir", c.SharedCache.Dir, "cache directory shared with other instances, e.g. on a network volume (empty disables it)")
+	fs.StringVar(&c.CacheKeys, "cache-keys", c.CacheKeys, "cache key scheme: v1, v2, or migrate to write v2 keys while still reading v1 ones")
+	fs.BoolVar(&c.LazyExpiry, "lazy-expiry", c.LazyExpiry, "expire cache entries when they are read instead of sweeping them from a background goroutine")
+	fs.BoolVar(&c.Replica, "replica", c.Replica, "serve only cached audio from memory and -shared-cache-dir, never synthesizing")
+	fs.StringVar(&c.Role, "role", c.Role, "all serves the API and synthesizes; api queues syntheses to Redis for worker processes to run")
+	fs.StringVar(&c.Redis.URL, "redis-url", c.Redis.URL, "Redis URL of the work queue between roles api and worker, e.g. redis://localhost:6379/0")
+	fs.StringVar(&c.ModelsDir, "models-dir", c.ModelsDir, "where engine voices, such as the bundled Piper voice, are kept")
+	fs.BoolVar(&c.Serverless, "serverless", c.Serverless, "run as a Cloud Run or Lambda function: no background goroutines, $PORT as the address, and an external cache required")
+	fs.StringVar(&c.GRPC.Addr, "grpc-addr", c.GRPC.Addr, "listen address of the gRPC API, served over TLS; empty disables it")
+	fs.StringVar(&c.GRPC.CertFile, "grpc-cert", c.GRPC.CertFile, "PEM certificate for the gRPC API")
+	fs.StringVar(&c.GRPC.KeyFile, "grpc-key", c.GRPC.KeyFile, "PEM private key for the gRPC API")
+	fs.IntVar(&c.SynthesisQueue.Concurrency, "max-concurrent-syntheses", c.SynthesisQueue.Concurrency, "syntheses run at once, 0 for unlimited")
+	fs.IntVar(&c.SynthesisQueue.MaxQueued, "max-queued-syntheses", c.SynthesisQueue.MaxQueued, "syntheses waiting for a slot before requests get 503 with Retry-After")
+	fs.StringVar(&c.Upstream.URL, "upstream", c.Upstream.URL, "base URL of a synthesizing instance /v1/speak cache misses are forwarded to (empty disables forwarding)")
+	fs.StringVar(&c.User, "user", c.User, "unprivileged user (name or uid) to switch to after binding the listen address, when started as root")
+	fs.BoolVar(&c.AllowRoot, "allow-root", c.AllowRoot, "keep running as root when -user is not set")
+	fs.BoolVar(&c.AccessLog.Enabled, "access-log", c.AccessLog.Enabled, "write an access log line per request")
+	fs.StringVar(&c.AccessLog.Format, "access-log-format", c.AccessLog.Format, "access log format: common or json")
+	fs.StringVar(&c.AccessLog.Text, "access-log-text", c.AccessLog.Text, "request text in JSON access logs: omit, hash or include")
+	fs.StringVar(&c.DBPath, "db", c.DBPath, "path to the BoltDB file for persistent state (empty keeps state in memory)")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "token required in X-Admin-Token for /admin endpoints (empty disables them)")
+	fs.StringVar(&c.Validation, "validation", c.Validation, "request validation mode: strict rejects unknown fields, lenient drops them and coerces types")
+	fs.StringVar(&c.ResponseEnvelope, "response-envelope", c.ResponseEnvelope, "default shape of /v1/speak responses: json, bare audio bytes, jsonapi or progressive")
+	fs.Float64Var(&c.RateLimit.RequestsPerSecond, "rate-limit", c.RateLimit.RequestsPerSecond, "requests per second allowed per client IP (0 disables)")
+	fs.IntVar(&c.RateLimit.Burst, "rate-burst", c.RateLimit.Burst, "maximum burst size per client IP")
+	fs.Var(listFlag{&c.RateLimit.TrustedProxies}, "trusted-proxies", "comma-separated IPs or CIDRs of proxies whose X-Forwarded-For is trusted")
+	fs.BoolVar(&c.Auth.AllowAnonymous, "allow-anonymous", c.Auth.AllowAnonymous, "serve requests without an X-API-Key header or bearer token")
+	fs.BoolVar(&c.Signing.Required, "require-signature", c.Signing.Required, "require HMAC-signed requests from every API key")
+	fs.BoolVar(&c.Analytics.Enabled, "analytics", c.Analytics.Enabled, "track the most requested texts per tenant")
+	fs.Int64Var(&c.MaxBodyBytes, "max-body-bytes", c.MaxBodyBytes, "maximum request body size in bytes")
+	fs.IntVar(&c.MaxTextChars, "max-text-chars", c.MaxTextChars, "maximum text length in characters")
+	fs.Float64Var(&c.Quality.SampleRate, "quality-sample-rate", c.Quality.SampleRate, "fraction of fresh syntheses to score for quality (0 disables)")
+	fs.Var((*durationFlag)(&c.Realtime.Timeout), "realtime-timeout", "deadline for /v1/realtime requests")
+	fs.IntVar(&c.Realtime.Prewarm, "prewarm", c.Realtime.Prewarm, "idle gtts-cli and ffmpeg processes kept started for realtime requests (0 disables)")
+	fs.StringVar(&c.DefaultEngine, "engine", c.DefaultEngine, "engine used when a request does not name one")
+	fs.StringVar(&c.Workspace.Dir, "workspace-dir", c.Workspace.Dir, "parent directory of command engines' per-synthesis scratch directories (empty uses the system temp dir)")
+	fs.BoolVar(&c.Workspace.Tmpfs, "workspace-tmpfs", c.Workspace.Tmpfs, "keep command engines' scratch directories in memory under /dev/shm")
+	fs.Int64Var(&c.DiskGuard.MinFreeBytes, "disk-min-free-bytes", c.DiskGuard.MinFreeBytes, "free space below which writes to a data directory are paused (0 disables the guard)")
+	fs.Int64Var(&c.Workspace.QuotaBytes, "workspace-quota-bytes", c.Workspace.QuotaBytes, "total size of scratch directories before new syntheses are refused (0 is unlimited)")
+	fs.Var(listFlag{&c.CORS.AllowedOrigins}, "cors-origins", "comma-separated origins allowed to call the API (\"*\" allows any)")
+	fs.StringVar(&c.OIDC.Issuer, "oidc-issuer", c.OIDC.Issuer, "required issuer of bearer tokens; enables OIDC discovery when -oidc-jwks-url is empty")
+	fs.StringVar(&c.OIDC.Audience, "oidc-audience", c.OIDC.Audience, "required audience of bearer tokens")
+	fs.StringVar(&c.Tracing.Endpoint, "otlp-endpoint", c.Tracing.Endpoint, "OTLP/HTTP endpoint traces are exported to, e.g. http://localhost:4318 (empty disables tracing)")
+	fs.Float64Var(&c.Tracing.SampleRate, "trace-sample-rate", c.Tracing.SampleRate, "fraction of requests to trace when the caller did not decide (0 means all)")
+	fs.StringVar(&c.OIDC.JWKSURL, "oidc-jwks-url", c.OIDC.JWKSURL, "JWKS URL used to verify bearer tokens")
+}
+
+// loadConfig parses flags, then layers the config file underneath any flag
+// that was set explicitly on the command line.
+func loadConfig(args []string) (*Config, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("gtts-service", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to a JSON config file")
+	cfg.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *configPath == "" {
+		if cfg.Serverless {
+			cfg.adaptForServerless()
+		}
+		if problems := cfg.checkSettings(nil); len(problems) > 0 {
+			return nil, &ConfigError{Problems: problems}
+		}
+		return cfg, nil
+	}
+
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		return nil, err
+	}
+	file, syntaxErr := parseConfigFile(data)
+	if syntaxErr != nil {
+		return nil, &ConfigError{File: *configPath, Problems: []ConfigProblem{*syntaxErr}}
+	}
+	var problems []ConfigProblem
+	file.checkType(file.root, reflect.TypeOf(*cfg), "", &problems)
+	if len(problems) > 0 {
+		return nil, &ConfigError{File: *configPath, Problems: problems} // The values cannot be decoded, so settings are not checked
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", *configPath, err)
+	}
+	for name, value := range explicit {
+		if err := fs.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Serverless {
+		cfg.adaptForServerless()
+	}
+	if problems := cfg.checkSettings(file); len(problems) > 0 {
+		return nil, &ConfigError{File: *configPath, Problems: problems}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Config files are checked in full before the server starts: every key must
+// be one Config knows, every value must have the field's type, and the
+// settings must agree with each other. All problems are reported at once,
+// each with the line it is on, rather than the first one at first use. The
+// Config type itself is the schema, so the check cannot drift from it.
+
+// ConfigProblem is one thing wrong with the configuration
+type ConfigProblem struct {
+	Line    int // In the config file; 0 for values that came from flags or defaults
+	Pointer string
+	Message string
+}
+
+// ConfigError lists every problem found in the configuration
+type ConfigError struct {
+	File     string
+	Problems []ConfigProblem
+}
+
+func (e *ConfigError) lines() []string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = (&ValidationError{p.Pointer, p.Message}).Error()
+		if p.Line > 0 {
+			lines[i] = fmt.Sprintf("%s:%d: %s", e.File, p.Line, lines[i])
+		}
+	}
+	return lines
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%d problem(s) in the configuration:\n  %s", len(e.Problems), strings.Join(e.lines(), "\n  "))
+}
+
+// LogValue logs the problems as a list rather than one multi-line string
+func (e *ConfigError) LogValue() slog.Value {
+	return slog.AnyValue(e.lines())
+}
+
+// configNode is a parsed JSON value that remembers where it starts
+type configNode struct {
+	offset int
+	raw    []byte
+	kind   string // "object", "array", "string", "number", "boolean" or "null"
+	keys   []string
+	fields map[string]*configNode
+	items  []*configNode
+}
+
+// configFile is a parsed config file with line lookup by JSON pointer
+type configFile struct {
+	data  []byte
+	root  *configNode
+	nodes map[string]*configNode
+}
+
+// parseConfigFile reports a syntax error as the only problem
+func parseConfigFile(data []byte) (*configFile, *ConfigProblem) {
+	f := &configFile{data: data, nodes: make(map[string]*configNode)}
+	dec := stdjson.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	root, problem := f.parse(dec, "")
+	if problem != nil {
+		return nil, problem
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, &ConfigProblem{Line: f.line(int(dec.InputOffset())), Message: "unexpected data after the top-level object"}
+	}
+	f.root = root
+	return f, nil
+}
+
+func (f *configFile) parse(dec *stdjson.Decoder, pointer string) (*configNode, *ConfigProblem) {
+	node := &configNode{offset: f.skipSeparators(int(dec.InputOffset()))}
+	f.nodes[pointer] = node
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, f.syntaxProblem(err, pointer, dec)
+	}
+	switch t := tok.(type) {
+	case stdjson.Delim:
+		if t == '{' {
+			node.kind, node.fields = "object", make(map[string]*configNode)
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return nil, f.syntaxProblem(err, pointer, dec)
+				}
+				key := keyTok.(string)
+				child, problem := f.parse(dec, pointer+"/"+escapePointer(key))
+				if problem != nil {
+					return nil, problem
+				}
+				node.keys = append(node.keys, key)
+				node.fields[key] = child
+			}
+		} else {
+			node.kind = "array"
+			for dec.More() {
+				child, problem := f.parse(dec, pointer+"/"+strconv.Itoa(len(node.items)))
+				if problem != nil {
+					return nil, problem
+				}
+				node.items = append(node.items, child)
+			}
+		}
+		if _, err := dec.Token(); err != nil { // Closing delimiter
+			return nil, f.syntaxProblem(err, pointer, dec)
+		}
+	case string:
+		node.kind = "string"
+	case stdjson.Number:
+		node.kind = "number"
+	case bool:
+		node.kind = "boolean"
+	case nil:
+		node.kind = "null"
+	}
+	node.raw = f.data[node.offset:dec.InputOffset()]
+	return node, nil
+}
+
+func (f *configFile) syntaxProblem(err error, pointer string, dec *stdjson.Decoder) *ConfigProblem {
+	offset := int(dec.InputOffset())
+	var syntax *stdjson.SyntaxError
+	if errors.As(err, &syntax) {
+		offset = int(syntax.Offset)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errors.New("unexpected end of file")
+	}
+	return &ConfigProblem{Line: f.line(offset), Pointer: pointer, Message: err.Error()}
+}
+
+// skipSeparators moves past the whitespace, commas and colons before a value
+func (f *configFile) skipSeparators(offset int) int {
+	for offset < len(f.data) && strings.IndexByte(" \t\r\n,:", f.data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func (f *configFile) line(offset int) int {
+	return bytes.Count(f.data[:min(offset, len(f.data))], []byte("\n")) + 1
+}
+
+// lineOf returns the line of the value at pointer, or of the closest enclosing
+// value when the file leaves it out; 0 when the file sets none of them
+func (f *configFile) lineOf(pointer string) int {
+	if f == nil {
+		return 0
+	}
+	for ; pointer != ""; pointer = pointer[:strings.LastIndexByte(pointer, '/')] {
+		if node, exists := f.nodes[pointer]; exists {
+			return f.line(node.offset)
+		}
+	}
+	return 0
+}
+
+var jsonUnmarshaler = reflect.TypeOf((*stdjson.Unmarshaler)(nil)).Elem()
+
+// checkType reports every value under node that does not fit t
+func (f *configFile) checkType(node *configNode, t reflect.Type, pointer string, problems *[]ConfigProblem) {
+	report := func(format string, args ...any) {
+		*problems = append(*problems, ConfigProblem{Line: f.line(node.offset), Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+	}
+	if node.kind == "null" {
+		return // Leaves the default in place
+	}
+	if reflect.PointerTo(t).Implements(jsonUnmarshaler) {
+		if err := reflect.New(t).Interface().(stdjson.Unmarshaler).UnmarshalJSON(node.raw); err != nil {
+			report("%v", err)
+		}
+		return
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		f.checkType(node, t.Elem(), pointer, problems)
+	case reflect.Struct:
+		if node.kind != "object" {
+			report("expected object, got %s", node.kind)
+			return
+		}
+		fields := jsonFields(t)
+		for _, key := range node.keys {
+			child := node.fields[key]
+			childPointer := pointer + "/" + escapePointer(key)
+			fieldType, known := fields[key]
+			if !known {
+				message := "unknown key"
+				if suggestion := closestKey(key, fields); suggestion != "" {
+					message += fmt.Sprintf("; did you mean %q?", suggestion)
+				}
+				*problems = append(*problems, ConfigProblem{Line: f.line(child.offset), Pointer: childPointer, Message: message})
+				continue
+			}
+			f.checkType(child, fieldType, childPointer, problems)
+		}
+	case reflect.Map:
+		if node.kind != "object" {
+			report("expected object, got %s", node.kind)
+			return
+		}
+		for _, key := range node.keys {
+			f.checkType(node.fields[key], t.Elem(), pointer+"/"+escapePointer(key), problems)
+		}
+	case reflect.Slice, reflect.Array:
+		if node.kind != "array" {
+			report("expected array, got %s", node.kind)
+			return
+		}
+		for i, item := range node.items {
+			f.checkType(item, t.Elem(), pointer+"/"+strconv.Itoa(i), problems)
+		}
+	case reflect.String:
+		if node.kind != "string" {
+			report("expected string, got %s", node.kind)
+		}
+	case reflect.Bool:
+		if node.kind != "boolean" {
+			report("expected boolean, got %s", node.kind)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := strconv.ParseInt(string(node.raw), 10, t.Bits()); node.kind != "number" || err != nil {
+			report("expected integer, got %s", node.raw)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := strconv.ParseUint(string(node.raw), 10, t.Bits()); node.kind != "number" || err != nil {
+			report("expected non-negative integer, got %s", node.raw)
+		}
+	case reflect.Float32, reflect.Float64:
+		if node.kind != "number" {
+			report("expected number, got %s", node.kind)
+		}
+	}
+}
+
+// closestKey suggests the known key a misspelled one was probably meant to be
+func closestKey(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", 3 // Suggest nothing further than two edits away
+	for candidate := range fields {
+		if d := editDistance(strings.ToLower(key), candidate); d < bestDistance || d == bestDistance && candidate < best {
+			best, bestDistance = candidate, d
+		}
+	}
+	if bestDistance > 2 {
+		return ""
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// checkSettings reports settings that are well-formed but do not work
+// together; file supplies line numbers and may be nil
+func (c *Config) checkSettings(file *configFile) []ConfigProblem {
+	var problems []ConfigProblem
+	report := func(pointer, format string, args ...any) {
+		problems = append(problems, ConfigProblem{Line: file.lineOf(pointer), Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+	}
+	if _, err := newLogger(c.LogLevel); err != nil {
+		report("/log_level", "must be debug, info, warn or error")
+	}
+	if c.Validation != validationStrict && c.Validation != validationLenient {
+		report("/validation", "must be %q or %q", validationStrict, validationLenient)
+	}
+	if !containsString(envelopes, c.ResponseEnvelope) {
+		report("/response_envelope", "must be one of %v", envelopes)
+	}
+	if c.Replica && c.SharedCache.Dir == "" && c.Upstream.URL == "" {
+		report("/replica", "requires /shared_cache/dir or /upstream/url as a source of audio")
+	}
+	if c.Upstream.URL != "" {
+		if u, err := url.Parse(c.Upstream.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			report("/upstream/url", "must be an http or https URL")
+		}
+	}
+	if c.Role != "" && !containsString(roles, c.Role) {
+		report("/role", "must be one of %v", roles)
+	}
+	if (c.Role == roleAPI || c.Role == roleWorker) && c.Redis.URL == "" {
+		report("/redis/url", "is required for role %s", c.Role)
+	}
+	if c.Redis.URL != "" {
+		if _, err := newRedisClient(c.Redis.URL); err != nil {
+			report("/redis/url", "%v", err)
+		}
+	}
+	if c.Serverless {
+		c.checkServerless(report)
+	}
+	if c.GRPC.Addr != "" {
+		if c.GRPC.CertFile == "" || c.GRPC.KeyFile == "" {
+			report("/grpc", "cert_file and key_file are required, since the gRPC API is served over TLS")
+		}
+		if c.GRPC.Addr == c.Addr {
+			report("/grpc/addr", "must differ from addr")
+		}
+		if c.Role == roleWorker {
+			report("/grpc/addr", "workers do not serve the API")
+		}
+	}
+	if c.SynthesisQueue.Concurrency < 0 {
+		report("/synthesis_queue/concurrency", "must not be negative")
+	}
+	if c.SynthesisQueue.MaxQueued < 0 {
+		report("/synthesis_queue/max_queued", "must not be negative")
+	}
+	if c.Role == roleWorker && c.Replica {
+		report("/replica", "workers always synthesize; replica applies to the API tier")
+	}
+	if c.Redis.Timeout < 0 {
+		report("/redis/timeout", "must not be negative")
+	}
+	if c.Redis.Concurrency < 0 {
+		report("/redis/concurrency", "must not be negative")
+	}
+	if c.Guardrail.URL != "" {
+		if u, err := url.Parse(c.Guardrail.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			report("/guardrail/url", "must be an http or https URL")
+		}
+	}
+	if c.Jobs.PublicURL != "" && checkCallbackURL(c.Jobs.PublicURL) != "" {
+		report("/jobs/public_url", "must be an http or https URL")
+	}
+	if c.Guardrail.Timeout < 0 {
+		report("/guardrail/timeout", "must not be negative")
+	}
+	if c.Upstream.Timeout < 0 {
+		report("/upstream/timeout", "must not be negative")
+	}
+	if c.CacheKeys != "" && !containsString(cacheKeySchemes, c.CacheKeys) {
+		report("/cache_keys", "must be one of %v", cacheKeySchemes)
+	}
+	if c.Profanity.Mode != "" && !containsString(profanityModes, c.Profanity.Mode) {
+		report("/profanity/mode", "must be one of %v", profanityModes)
+	}
+	var pipelines []string
+	for name := range c.Preprocessing.Pipelines {
+		pipelines = append(pipelines, name)
+	}
+	slices.Sort(pipelines)
+	for _, name := range pipelines {
+		pointer, stages := "/preprocessing/pipelines/"+name, c.Preprocessing.Pipelines[name]
+		if strings.TrimSpace(name) == "" {
+			report(pointer, "pipeline names must not be empty")
+		}
+		for i, stage := range stages {
+			if !containsString(pipelineStages, stage) {
+				report(pointer+"/"+strconv.Itoa(i), "must be one of %v", pipelineStages)
+			} else if first := slices.Index(stages, stage); first < i {
+				report(pointer+"/"+strconv.Itoa(i), "stage %q is already listed at %d", stage, first)
+			}
+		}
+	}
+	var tenants []string
+	for tenant := range c.Preprocessing.Tenants {
+		tenants = append(tenants, tenant)
+	}
+	slices.Sort(tenants)
+	for _, tenant := range tenants {
+		if name := c.Preprocessing.Tenants[tenant]; name == "" {
+			report("/preprocessing/tenants/"+tenant, "must name a pipeline")
+		} else if _, exists := c.Preprocessing.Pipelines[name]; !exists && name != defaultPipeline {
+			report("/preprocessing/tenants/"+tenant, "pipeline %q is not defined", name)
+		}
+	}
+
+	engines := make(map[string]int)
+	for i, engine := range c.Engines {
+		pointer := "/engines/" + strconv.Itoa(i)
+		if engine.Name == "" {
+			report(pointer+"/name", "is required")
+		} else if first, exists := engines[engine.Name]; exists {
+			report(pointer+"/name", "engine %q is already defined at /engines/%d", engine.Name, first)
+		} else {
+			engines[engine.Name] = i
+		}
+		switch engine.Type {
+		case "gtts":
+			if engine.Sandbox.NoNetwork {
+				report(pointer+"/sandbox/no_network", "gtts engines need the network to reach Google")
+			}
+			if len(engine.Regions) > 0 {
+				report(pointer+"/regions", "only command engines have regions")
+			}
+		case "command":
+			if len(engine.Command) == 0 {
+				report(pointer+"/command", "is required for command engines")
+			}
+			if len(engine.Regions) > 0 && !slices.ContainsFunc(engine.Command, func(arg string) bool { return strings.Contains(arg, "{region}") }) {
+				report(pointer+"/command", "must use the {region} placeholder when regions are set")
+			}
+			for j, region := range engine.Regions {
+				if strings.TrimSpace(region) == "" {
+					report(pointer+"/regions/"+strconv.Itoa(j), "must not be empty")
+				} else if first := slices.Index(engine.Regions, region); first < j {
+					report(pointer+"/regions/"+strconv.Itoa(j), "region %q is already listed at %d", region, first)
+				}
+			}
+		case "piper":
+			downloadsVoice := slices.ContainsFunc(engine.Download, func(f ModelFile) bool { return strings.HasSuffix(f.fileName(), ".onnx") })
+			if engine.Model == "" && !downloadsVoice && !hasBundledVoice {
+				report(pointer+"/model", "is required unless an .onnx file is downloaded, since this binary has no bundled voice (build with -tags embedvoice)")
+			}
+			if len(engine.Regions) > 0 {
+				report(pointer+"/regions", "only command engines have regions")
+			}
+		default:
+			report(pointer+"/type", "must be \"gtts\", \"command\" or \"piper\"")
+		}
+		if engine.Type == "gtts" && len(engine.Download) > 0 {
+			report(pointer+"/download", "gtts engines have no model files")
+		}
+		files := make(map[string]int)
+		for j, file := range engine.Download {
+			filePointer := pointer + "/download/" + strconv.Itoa(j)
+			if u, err := url.Parse(file.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+				report(filePointer+"/url", "must be an http or https URL")
+			}
+			if digest, err := hex.DecodeString(file.SHA256); err != nil || len(digest) != sha256.Size {
+				report(filePointer+"/sha256", "must be a hex SHA-256 digest")
+			}
+			name := file.fileName()
+			if name == "" || name == "." || name == "/" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+				report(filePointer+"/name", "must be a plain file name")
+			} else if first, exists := files[name]; exists {
+				report(filePointer+"/name", "file %q is already downloaded by %s/download/%d", name, pointer, first)
+			} else {
+				files[name] = j
+			}
+		}
+	}
+	engineDefined := func(pointer, name string) {
+		if _, exists := engines[name]; name != "" && !exists {
+			report(pointer, "engine %q is not defined in /engines", name)
+		}
+	}
+	if c.DefaultEngine == "" {
+		report("/default_engine", "is required")
+	}
+	engineDefined("/default_engine", c.DefaultEngine)
+	engineDefined("/shadow/engine", c.Shadow.Engine)
+
+	feeds := make(map[string]int)
+	for i, feed := range c.Feeds.Sources {
+		pointer := "/feeds/sources/" + strconv.Itoa(i)
+		if feed.Name == "" {
+			report(pointer+"/name", "is required")
+		} else if first, exists := feeds[feed.Name]; exists {
+			report(pointer+"/name", "feed %q is already defined at /feeds/sources/%d", feed.Name, first)
+		} else {
+			feeds[feed.Name] = i
+		}
+		engineDefined(pointer+"/engine", feed.Engine)
+	}
+	if len(c.Feeds.Sources) > 0 && c.Feeds.AudioDir == "" {
+		report("/feeds/audio_dir", "is required when feeds are configured")
+	}
+	if c.User != "" {
+		if c.FFmpegSandbox.User != "" {
+			report("/ffmpeg_sandbox/user", "cannot switch users once the service has dropped root to /user")
+		}
+		for i, engine := range c.Engines {
+			if engine.Sandbox.User != "" {
+				report("/engines/"+strconv.Itoa(i)+"/sandbox/user", "cannot switch users once the service has dropped root to /user")
+			}
+		}
+	}
+	if c.Workspace.Dir != "" && c.Workspace.Tmpfs {
+		report("/workspace/tmpfs", "cannot be combined with /workspace/dir")
+	}
+	for _, age := range []struct {
+		name  string
+		value Duration
+	}{
+		{"interval", c.Retention.Interval}, {"narration_max_age", c.Retention.NarrationMaxAge}, {"shadow_max_age", c.Retention.ShadowMaxAge},
+		{"history_max_age", c.Retention.HistoryMaxAge}, {"usage_max_age", c.Retention.UsageMaxAge},
+	} {
+		if age.value < 0 {
+			report("/retention/"+age.name, "must not be negative")
+		}
+	}
+	if c.Retention.NarrationMaxBytes < 0 {
+		report("/retention/narration_max_bytes", "must not be negative")
+	}
+	return problems
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigProblems(t *testing.T) {
+	tests := []struct {
+		name, config string
+		want         []ConfigProblem // Messages are matched by prefix
+	}{
+		{"valid", `{"addr": ":9000", "log_level": "debug"}`, nil},
+		{"syntax error", "{\n  \"addr\": \":9000\",\n  \"log_level\": \n}", []ConfigProblem{
+			{Line: 4, Pointer: "/log_level", Message: "missing value after object key"},
+		}},
+		{"trailing data", `{} {}`, []ConfigProblem{
+			{Line: 1, Message: "unexpected data after the top-level object"},
+		}},
+		{"unknown key", "{\n  \"adr\": \":9000\"\n}", []ConfigProblem{
+			{Line: 2, Pointer: "/adr", Message: `unknown key; did you mean "addr"?`},
+		}},
+		{"wrong types", "{\n  \"addr\": 9000,\n  \"max_text_chars\": \"many\",\n  \"cors\": {\"allowed_origins\": \"*\"}\n}", []ConfigProblem{
+			{Line: 2, Pointer: "/addr", Message: "expected string, got number"},
+			{Line: 3, Pointer: "/max_text_chars", Message: "expected integer, got \"many\""},
+			{Line: 4, Pointer: "/cors/allowed_origins", Message: "expected array, got string"},
+		}},
+		{"bad duration", `{"realtime": {"timeout": "soon"}}`, []ConfigProblem{
+			{Line: 1, Pointer: "/realtime/timeout", Message: ""},
+		}},
+		{"bad settings", "{\n  \"log_level\": \"loud\",\n  \"default_engine\": \"missing\"\n}", []ConfigProblem{
+			{Line: 2, Pointer: "/log_level", Message: "must be debug, info, warn or error"},
+			{Line: 3, Pointer: "/default_engine", Message: `engine "missing" is not defined in /engines`},
+		}},
+		{"duplicate engines", "{\n  \"engines\": [\n    {\"name\": \"a\", \"type\": \"gtts\"},\n    {\"name\": \"a\", \"type\": \"gtts\"}\n  ],\n  \"default_engine\": \"a\"\n}", []ConfigProblem{
+			{Line: 4, Pointer: "/engines/1/name", Message: `engine "a" is already defined at /engines/0`},
+		}},
+		{"unknown pipeline", `{"preprocessing": {"tenants": {"acme": "loud"}}}`, []ConfigProblem{
+			{Line: 1, Pointer: "/preprocessing/tenants/acme", Message: `pipeline "loud" is not defined`},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfig([]string{"-config", path})
+			var configErr *ConfigError
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("loadConfig: %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &configErr) {
+				t.Fatalf("loadConfig error = %v, want a ConfigError", err)
+			}
+			if len(configErr.Problems) != len(tt.want) {
+				t.Fatalf("got problems %+v, want %+v", configErr.Problems, tt.want)
+			}
+			for i, want := range tt.want {
+				got := configErr.Problems[i]
+				if got.Line != want.Line || got.Pointer != want.Pointer || !strings.HasPrefix(got.Message, want.Message) {
+					t.Errorf("problem %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"addr", "addr", 0},
+		{"adr", "addr", 1},
+		{"kitten", "sitting", 3},
+		{"", "abc", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
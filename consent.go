@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Enterprise customers reviewing voice content for compliance need to show
+// why each text was spoken. /v1/speak (and jobs) and /v1/readaloud requests
+// may carry consent metadata: the purpose of the audio, the legal basis for
+// processing the text and the id of the consent record in the customer's own
+// system. The service does not interpret it; each request carrying it leaves
+// a usage record (when, which endpoint, engine and language, how many
+// characters were charged) with the metadata attached, which is included in
+// the tenant's export and deleted with the tenant's other data. Requests
+// without metadata only count towards quota, as before. Usage records are
+// persisted with -db and expire after retention.usage_max_age.
+
+// Usage records kept per tenant; the oldest are dropped beyond this
+const maxUsageRecordsPerTenant = 10000
+
+var bucketUsageRecords = []byte("usage_records")
+
+type ConsentMetadata struct {
+	Purpose    string `json:"purpose,omitempty"`     // What the audio is for, e.g. "IVR prompt"
+	LegalBasis string `json:"legal_basis,omitempty"` // A GDPR article 6 basis, e.g. consent or contract; the schemas list them
+	ConsentID  string `json:"consent_id,omitempty"`  // Reference to the consent record in the customer's system
+}
+
+func (c *ConsentMetadata) empty() bool {
+	return c == nil || *c == ConsentMetadata{}
+}
+
+type UsageRecord struct {
+	Tenant    string          `json:"tenant"`
+	RequestID string          `json:"request_id"`
+	Time      time.Time       `json:"time"`
+	Endpoint  string          `json:"endpoint"`
+	Engine    string          `json:"engine"`
+	Lang      string          `json:"lang"`
+	Chars     int64           `json:"chars"`
+	Consent   ConsentMetadata `json:"consent"`
+}
+
+func usageRecordKey(rec UsageRecord) string {
+	return fmt.Sprintf("%s\x00%020d\x00%s", rec.Tenant, rec.Time.UnixNano(), rec.RequestID)
+}
+
+// UsageLedger keeps usage records by tenant, oldest first
+type UsageLedger struct {
+	db       *Store
+	mu       sync.Mutex
+	byTenant map[string][]UsageRecord
+}
+
+func NewUsageLedger(db *Store) (*UsageLedger, error) {
+	l := &UsageLedger{db: db, byTenant: make(map[string][]UsageRecord)}
+	err := db.forEach(bucketUsageRecords, func(key string, data []byte) error {
+		var rec UsageRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("usage record %q: %w", key, err)
+		}
+		l.byTenant[rec.Tenant] = append(l.byTenant[rec.Tenant], rec) // Keys sort by tenant, then time
+		return nil
+	})
+	return l, err
+}
+
+// record adds a usage record for the request when it carries consent metadata
+func (l *UsageLedger) record(ctx context.Context, endpoint, engine, lang string, chars int64, consent *ConsentMetadata) {
+	if consent.empty() {
+		return
+	}
+	rec := UsageRecord{
+		Tenant:    principalFrom(ctx).tenant,
+		RequestID: requestIDFrom(ctx),
+		Time:      time.Now().UTC(),
+		Endpoint:  endpoint,
+		Engine:    engine,
+		Lang:      lang,
+		Chars:     chars,
+		Consent:   *consent,
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records := append(l.byTenant[rec.Tenant], rec)
+	for len(records) > maxUsageRecordsPerTenant {
+		if err := l.db.delete(bucketUsageRecords, usageRecordKey(records[0])); err != nil {
+			slog.Warn("Failed to drop usage record", "tenant", rec.Tenant, "error", err)
+		}
+		records = records[1:]
+	}
+	l.byTenant[rec.Tenant] = records
+	if err := l.db.put(bucketUsageRecords, usageRecordKey(rec), rec); err != nil {
+		slog.Warn("Failed to store usage record", "request_id", rec.RequestID, "tenant", rec.Tenant, "error", err)
+	}
+}
+
+// list returns a tenant's usage records, newest first
+func (l *UsageLedger) list(tenant string) []UsageRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := append([]UsageRecord{}, l.byTenant[tenant]...)
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.After(result[j].Time) })
+	return result
+}
+
+// forget deletes the usage records of tenant, or of every tenant when
+// empty, from before cutoff, or all of them when cutoff is zero
+func (l *UsageLedger) forget(tenant string, cutoff time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	forgotten := 0
+	for name, records := range l.byTenant {
+		if tenant != "" && name != tenant {
+			continue
+		}
+		kept := records[:0]
+		for _, rec := range records {
+			if !cutoff.IsZero() && !rec.Time.Before(cutoff) {
+				kept = append(kept, rec)
+				continue
+			}
+			if err := l.db.delete(bucketUsageRecords, usageRecordKey(rec)); err != nil {
+				slog.Warn("Failed to delete usage record", "tenant", name, "error", err)
+				kept = append(kept, rec)
+				continue
+			}
+			forgotten++
+		}
+		if len(kept) == 0 {
+			delete(l.byTenant, name)
+		} else {
+			l.byTenant[name] = kept
+		}
+	}
+	return forgotten
+}
@@ -0,0 +1,180 @@
+package main
+
+// API compatibility policy
+//
+// Every public endpoint lives under a version prefix (/v1, /v2, ...). Within a
+// version the following changes are allowed:
+//   - adding endpoints
+//   - adding optional request fields whose absence keeps the old behavior
+//   - adding response fields and headers
+//   - adding error status codes for new failure modes
+//
+// Removing or renaming fields, changing a field's type or meaning, or changing
+// the response encoding requires a new version, served alongside the old one.
+// The published contract for each version lives in contracts/<version>.json
+// and is enforced by `gtts-service check-contract` and by go test (see
+// contract_test.go).
+
+import (
+	"embed"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//go:embed contracts/*.json
+var contractFiles embed.FS
+
+type Contract struct {
+	Version   string             `json:"version"`
+	Endpoints []ContractEndpoint `json:"endpoints"`
+}
+
+type ContractEndpoint struct {
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Request  *ContractSchema `json:"request,omitempty"`
+	Response *ContractSchema `json:"response,omitempty"`
+	Error    *ContractSchema `json:"error,omitempty"` // Body of non-2xx responses
+	Statuses []int           `json:"statuses"`
+}
+
+type ContractSchema struct {
+	Type   string            `json:"type"`
+	Fields map[string]string `json:"fields"` // JSON field name -> string|number|boolean|object|array
+}
+
+// contractTypes maps the type names used in contract files to the Go types that implement them
+var contractTypes = map[string]reflect.Type{
+	"RequestPayload":  reflect.TypeOf(RequestPayload{}),
+	"ResponsePayload": reflect.TypeOf(ResponsePayload{}),
+	"Problem":         reflect.TypeOf(Problem{}),
+
+	"ReadAloudRequest":  reflect.TypeOf(ReadAloudRequest{}),
+	"ReadAloudResponse": reflect.TypeOf(ReadAloudResponse{}),
+	"RealtimeRequest":   reflect.TypeOf(RealtimeRequest{}),
+
+	"OpenAISpeechRequest": reflect.TypeOf(OpenAISpeechRequest{}),
+	"OpenAIErrorResponse": reflect.TypeOf(OpenAIErrorResponse{}),
+
+	"GoogleSynthesizeRequest":  reflect.TypeOf(GoogleSynthesizeRequest{}),
+	"GoogleSynthesizeResponse": reflect.TypeOf(GoogleSynthesizeResponse{}),
+	"GoogleErrorResponse":      reflect.TypeOf(GoogleErrorResponse{}),
+
+	"PollySynthesizeRequest": reflect.TypeOf(PollySynthesizeRequest{}),
+	"PollyErrorResponse":     reflect.TypeOf(PollyErrorResponse{}),
+
+	"PreprocessRequest":  reflect.TypeOf(PreprocessRequest{}),
+	"PreprocessResponse": reflect.TypeOf(PreprocessResponse{}),
+}
+
+func loadContract(version string) (*Contract, error) {
+	data, err := contractFiles.ReadFile("contracts/" + version + ".json")
+	if err != nil {
+		return nil, err
+	}
+	var contract Contract
+	if err := json.Unmarshal(data, &contract); err != nil {
+		return nil, fmt.Errorf("parse %s contract: %w", version, err)
+	}
+	return &contract, nil
+}
+
+// jsonKind returns the contract type name a Go type is encoded as
+func jsonKind(t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// jsonFields lists the JSON-encoded fields of a struct type by name
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// checkSchema reports contract fields that the Go type no longer provides with the same JSON type
+func checkSchema(where string, schema *ContractSchema) []string {
+	if schema == nil {
+		return nil
+	}
+	t, exists := contractTypes[schema.Type]
+	if !exists {
+		return []string{fmt.Sprintf("%s: unknown type %q", where, schema.Type)}
+	}
+	actual := jsonFields(t)
+	var problems []string
+	for name, kind := range schema.Fields {
+		fieldType, exists := actual[name]
+		if !exists {
+			problems = append(problems, fmt.Sprintf("%s: field %q was removed from %s", where, name, schema.Type))
+		} else if got := jsonKind(fieldType); got != kind {
+			problems = append(problems, fmt.Sprintf("%s: field %q changed type from %s to %s", where, name, kind, got))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// checkContract verifies the current code still satisfies a published contract
+func checkContract(version string, mux *http.ServeMux) ([]string, error) {
+	contract, err := loadContract(version)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, endpoint := range contract.Endpoints {
+		where := endpoint.Method + " " + endpoint.Path
+		req, _ := http.NewRequest(endpoint.Method, endpoint.Path, nil)
+		if _, pattern := mux.Handler(req); pattern == "" {
+			problems = append(problems, where+": no route registered")
+		}
+		problems = append(problems, checkSchema(where+" request", endpoint.Request)...)
+		problems = append(problems, checkSchema(where+" response", endpoint.Response)...)
+		problems = append(problems, checkSchema(where+" error", endpoint.Error)...)
+	}
+	return problems, nil
+}
+
+// Serves the published contract so clients can check compatibility themselves
+func serveContract(version string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := contractFiles.ReadFile("contracts/" + version + ".json")
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "Unknown contract version")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// TestContracts runs check-contract for every published version
+func TestContracts(t *testing.T) {
+	srv, err := newServer(defaultConfig())
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	mux := srv.routes()
+	files, err := fs.Glob(contractFiles, "contracts/*.json")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no contracts found: %v", err)
+	}
+	for _, file := range files {
+		version := strings.TrimSuffix(strings.TrimPrefix(file, "contracts/"), ".json")
+		t.Run(version, func(t *testing.T) {
+			problems, err := checkContract(version, mux)
+			if err != nil {
+				t.Fatalf("load contract: %v", err)
+			}
+			for _, problem := range problems {
+				t.Error(problem)
+			}
+		})
+	}
+}
+
+func TestCheckSchemaReportsDrift(t *testing.T) {
+	schema := &ContractSchema{Type: "RequestPayload", Fields: map[string]string{
+		"text":    "string",
+		"lang":    "number",
+		"missing": "string",
+	}}
+	problems := checkSchema("POST /v1/speak request", schema)
+	want := []string{"lang", "missing"}
+	if len(problems) != len(want) {
+		t.Fatalf("got %d problems, want %d: %q", len(problems), len(want), problems)
+	}
+	for i, field := range want {
+		if !strings.Contains(problems[i], field) {
+			t.Errorf("problem %d = %q, want it to name %q", i, problems[i], field)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PricingConfig maps engine names to their price in USD per million characters.
+// Entries for engines that are not deployed still show up in the what-if report.
+type PricingConfig map[string]float64
+
+type engineUsage struct {
+	Requests         int64 `json:"requests"`
+	CharsRequested   int64 `json:"chars_requested"`
+	CharsSynthesized int64 `json:"chars_synthesized"` // Cache misses, which is what paid backends bill for
+}
+
+// CostTracker attributes character usage to engines
+type CostTracker struct {
+	since time.Time
+	mu    sync.Mutex
+	usage map[string]*engineUsage
+}
+
+func NewCostTracker() *CostTracker {
+	return &CostTracker{since: time.Now().UTC(), usage: make(map[string]*engineUsage)}
+}
+
+func (t *CostTracker) record(engine string, chars int64, synthesized bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	usage, exists := t.usage[engine]
+	if !exists {
+		usage = &engineUsage{}
+		t.usage[engine] = usage
+	}
+	usage.Requests++
+	usage.CharsRequested += chars
+	if synthesized {
+		usage.CharsSynthesized += chars
+	}
+}
+
+type engineCost struct {
+	Engine string `json:"engine"`
+	engineUsage
+	PricePerMillionChars float64 `json:"price_per_million_chars"`
+	EstimatedSpend       float64 `json:"estimated_spend"`
+}
+
+type whatIfCost struct {
+	Engine               string  `json:"engine"`
+	PricePerMillionChars float64 `json:"price_per_million_chars"`
+	EstimatedSpend       float64 `json:"estimated_spend"` // Had every synthesized character gone to this engine
+}
+
+type costReport struct {
+	Since    time.Time    `json:"since"`
+	Currency string       `json:"currency"`
+	Engines  []engineCost `json:"engines"`
+	WhatIf   []whatIfCost `json:"what_if"`
+}
+
+func (t *CostTracker) report(pricing PricingConfig) costReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	report := costReport{Since: t.since, Currency: "USD", Engines: []engineCost{}, WhatIf: []whatIfCost{}}
+	var totalSynthesized int64
+	for name, usage := range t.usage {
+		price := pricing[name]
+		report.Engines = append(report.Engines, engineCost{
+			Engine:               name,
+			engineUsage:          *usage,
+			PricePerMillionChars: price,
+			EstimatedSpend:       float64(usage.CharsSynthesized) * price / 1e6,
+		})
+		totalSynthesized += usage.CharsSynthesized
+	}
+	for name, price := range pricing {
+		report.WhatIf = append(report.WhatIf, whatIfCost{
+			Engine:               name,
+			PricePerMillionChars: price,
+			EstimatedSpend:       float64(totalSynthesized) * price / 1e6,
+		})
+	}
+	sort.Slice(report.Engines, func(i, j int) bool { return report.Engines[i].Engine < report.Engines[j].Engine })
+	sort.Slice(report.WhatIf, func(i, j int) bool {
+		if report.WhatIf[i].EstimatedSpend != report.WhatIf[j].EstimatedSpend {
+			return report.WhatIf[i].EstimatedSpend < report.WhatIf[j].EstimatedSpend
+		}
+		return report.WhatIf[i].Engine < report.WhatIf[j].Engine
+	})
+	return report
+}
+
+func (s *server) handleCostReport(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.costs.report(s.cfg.Pricing))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// Debug endpoints for operators chasing leaks. They are mounted under /admin
+// and so require the admin token like the rest of the admin API. CPU profiles
+// and traces must finish within the server's write timeout, so ask for them
+// with e.g. ?seconds=5.
+
+var startTime = time.Now()
+
+type RuntimeStats struct {
+	Uptime        string `json:"uptime"`
+	Goroutines    int    `json:"goroutines"`
+	HeapAlloc     uint64 `json:"heap_alloc_bytes"`
+	HeapInuse     uint64 `json:"heap_inuse_bytes"`
+	HeapObjects   uint64 `json:"heap_objects"`
+	Sys           uint64 `json:"sys_bytes"` // Memory obtained from the OS
+	NumGC         uint32 `json:"num_gc"`
+	GCPauseTotal  string `json:"gc_pause_total"`
+	CacheEntries  int    `json:"cache_entries"`
+	CacheBytes    int64  `json:"cache_bytes"`       // Audio held, each identical blob once
+	CacheSaved    int64  `json:"cache_saved_bytes"` // Saved by sharing identical audio between entries
+	InFlight      int64  `json:"synthesis_in_flight"`
+	WarmProcesses int    `json:"warm_processes"` // Idle pre-warmed subprocesses
+	FeedQueue     int    `json:"feed_queue_depth"`
+}
+
+func (s *server) handleRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stored, saved := s.cache.footprint()
+	writeJSON(w, http.StatusOK, RuntimeStats{
+		Uptime:        time.Since(startTime).Round(time.Second).String(),
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapInuse:     mem.HeapInuse,
+		HeapObjects:   mem.HeapObjects,
+		Sys:           mem.Sys,
+		NumGC:         mem.NumGC,
+		GCPauseTotal:  time.Duration(mem.PauseTotalNs).String(),
+		CacheEntries:  s.cache.len(),
+		CacheBytes:    stored,
+		CacheSaved:    saved,
+		InFlight:      metrics.inFlight.Load(),
+		WarmProcesses: s.warm.idleCount(),
+		FeedQueue:     s.feeds.depth(),
+	})
+}
+
+// pprofHandler serves a net/http/pprof handler under /admin, which expects
+// to see paths starting at /debug/pprof/
+func pprofHandler(h http.HandlerFunc) http.HandlerFunc {
+	return http.StripPrefix("/admin", h).ServeHTTP
+}
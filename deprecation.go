@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Deprecation describes an endpoint or parameter scheduled for removal
+type Deprecation struct {
+	Feature   string    `json:"feature"`
+	Since     time.Time `json:"since"`
+	Sunset    time.Time `json:"sunset,omitempty"` // Zero when no removal date is set yet
+	Successor string    `json:"successor,omitempty"`
+}
+
+// Known deprecations. Entries stay here until their sunset date has passed
+// and the feature is removed.
+var deprecations = map[string]Deprecation{
+	"unversioned-speak": {
+		Feature:   "unversioned-speak",
+		Since:     time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC),
+		Sunset:    time.Date(2027, 4, 15, 0, 0, 0, 0, time.UTC),
+		Successor: "/v1/speak",
+	},
+}
+
+type deprecationUsage struct {
+	Tenant   string    `json:"tenant"`
+	Count    int64     `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// DeprecationTracker counts use of deprecated features per tenant
+type DeprecationTracker struct {
+	mu    sync.Mutex
+	usage map[string]map[string]*deprecationUsage // feature -> tenant -> usage
+}
+
+func NewDeprecationTracker() *DeprecationTracker {
+	return &DeprecationTracker{usage: make(map[string]map[string]*deprecationUsage)}
+}
+
+// use sets the Deprecation, Sunset, and Link headers for a deprecated feature and records who used it
+func (t *DeprecationTracker) use(w http.ResponseWriter, r *http.Request, feature string) {
+	d, exists := deprecations[feature]
+	if !exists {
+		return
+	}
+	w.Header().Add("Deprecation", fmt.Sprintf("@%d", d.Since.Unix()))
+	if !d.Sunset.IsZero() {
+		w.Header().Set("Sunset", d.Sunset.Format(http.TimeFormat))
+	}
+	if d.Successor != "" {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", d.Successor))
+	}
+
+	tenant := principalFrom(r.Context()).tenant
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	byTenant, exists := t.usage[feature]
+	if !exists {
+		byTenant = make(map[string]*deprecationUsage)
+		t.usage[feature] = byTenant
+	}
+	usage, exists := byTenant[tenant]
+	if !exists {
+		usage = &deprecationUsage{Tenant: tenant}
+		byTenant[tenant] = usage
+	}
+	usage.Count++
+	usage.LastSeen = time.Now().UTC()
+}
+
+// Middleware marking every request to the wrapped handler as using a deprecated feature
+func (t *DeprecationTracker) middleware(feature string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.use(w, r, feature)
+		next.ServeHTTP(w, r)
+	})
+}
+
+type deprecationReport struct {
+	Deprecation
+	Usage []deprecationUsage `json:"usage"`
+}
+
+func (t *DeprecationTracker) report() []deprecationReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reports := []deprecationReport{}
+	for feature, d := range deprecations {
+		report := deprecationReport{Deprecation: d, Usage: []deprecationUsage{}}
+		for _, usage := range t.usage[feature] {
+			report.Usage = append(report.Usage, *usage)
+		}
+		sort.Slice(report.Usage, func(i, j int) bool { return report.Usage[i].Count > report.Usage[j].Count })
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Feature < reports[j].Feature })
+	return reports
+}
+
+func (s *server) handleDeprecationReport(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.deprecations.report())
+}
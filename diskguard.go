@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The disk guard watches the volumes that feed narrations, chat clips, shadow
+// pairs and engine workspaces are written to. While one runs low on free
+// space, writers to it back off instead of failing halfway through a file:
+// the feed worker pauses, shadow pairs are not stored, chat clips expire
+// sooner, and command engines get no new workspaces.
+
+type DiskGuardConfig struct {
+	MinFreeBytes int64    `json:"min_free_bytes"` // A volume with less free space than this is low; 0 disables the guard
+	Interval     Duration `json:"interval"`       // How often free space is checked
+}
+
+// DiskGuard tracks free space per watched directory
+type DiskGuard struct {
+	minFree  uint64
+	interval time.Duration
+
+	mu   sync.Mutex
+	free map[string]uint64 // Free bytes by directory, as of the last check; MaxUint64 until known
+}
+
+// diskGuard is set at startup; while nil, no volume is ever low
+var diskGuard *DiskGuard
+
+// NewDiskGuard returns nil when the guard is disabled or nothing is written to disk
+func NewDiskGuard(cfg DiskGuardConfig, dirs []string) *DiskGuard {
+	if cfg.MinFreeBytes <= 0 || len(dirs) == 0 {
+		return nil
+	}
+	interval := time.Duration(cfg.Interval)
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	g := &DiskGuard{minFree: uint64(cfg.MinFreeBytes), interval: interval, free: make(map[string]uint64)}
+	for _, dir := range dirs {
+		g.free[filepath.Clean(dir)] = math.MaxUint64
+	}
+	g.check()
+	go g.watch()
+	return g
+}
+
+func (g *DiskGuard) watch() {
+	for range time.Tick(g.interval) {
+		g.check()
+	}
+}
+
+func (g *DiskGuard) check() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for dir, before := range g.free {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); errors.Is(err, fs.ErrNotExist) {
+			continue // Created by its owner after the guard starts
+		} else if err != nil {
+			slog.Warn("Failed to check free disk space", "dir", dir, "error", err)
+			continue
+		}
+		free := uint64(st.Bavail) * uint64(st.Bsize)
+		if wasLow, isLow := before < g.minFree, free < g.minFree; isLow && !wasLow {
+			slog.Warn("Disk space low, pausing writes", "dir", dir, "free_bytes", free, "min_free_bytes", g.minFree)
+		} else if wasLow && !isLow {
+			slog.Info("Disk space recovered", "dir", dir, "free_bytes", free)
+		}
+		g.free[dir] = free
+	}
+}
+
+// low reports whether the volume holding dir is short of space; unwatched
+// directories never are
+func (g *DiskGuard) low(dir string) bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	free, watched := g.free[filepath.Clean(dir)]
+	return watched && free < g.minFree
+}
+
+// freeBytes returns the free space and low flag per watched directory, for metrics
+func (g *DiskGuard) freeBytes() (free, low map[string]float64) {
+	free, low = make(map[string]float64), make(map[string]float64)
+	if g == nil {
+		return free, low
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for dir, bytes := range g.free {
+		free[labels("dir", dir)] = float64(bytes)
+		low[labels("dir", dir)] = 0
+		if bytes < g.minFree {
+			low[labels("dir", dir)] = 1
+		}
+	}
+	return free, low
+}
+
+// artifactDirs lists the directories the service writes files to
+func artifactDirs(cfg *Config, workspaces *Workspaces) []string {
+	dirs := []string{workspaces.root}
+	for _, dir := range []string{cfg.Feeds.AudioDir, cfg.Chat.ClipDir, cfg.Shadow.OutputDir, cfg.SharedCache.Dir} {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// `gtts-service doctor [flags]` checks a deployment before it takes traffic:
+// that the config loads, the binaries run, ffmpeg was built with every
+// encoder and filter the service uses, remote services are reachable and
+// data directories are writable. It takes the same flags as the server and
+// exits non-zero when any check fails.
+
+// Encoders behind each output format
+var formatEncoders = map[string]string{
+	"opus": "libopus", "aac": "aac", "mp3": "libmp3lame", "ogg": "libvorbis",
+	"wav": "pcm_s16le", "flac": "flac", "mulaw": "pcm_mulaw", "alaw": "pcm_alaw",
+}
+
+// Filters the audio options rely on; rubberband is optional, pitch shifting falls back without it
+var requiredFilters = []string{"atempo", "aresample", "asetrate", "volume", "alimiter", "loudnorm", "silenceremove", "areverse", "adelay", "apad"}
+
+type doctorReport struct {
+	failures int
+}
+
+func (d *doctorReport) pass(check, detail string) { fmt.Printf("PASS  %-28s %s\n", check, detail) }
+func (d *doctorReport) warn(check, detail string) { fmt.Printf("WARN  %-28s %s\n", check, detail) }
+func (d *doctorReport) fail(check, detail string) {
+	d.failures++
+	fmt.Printf("FAIL  %-28s %s\n", check, detail)
+}
+
+func runDoctor(args []string) int {
+	var d doctorReport
+	cfg, err := loadConfig(args)
+	var problems *ConfigError
+	if errors.As(err, &problems) {
+		for _, line := range problems.lines() {
+			d.fail("config", line)
+		}
+		return 1
+	} else if err != nil {
+		d.fail("config", err.Error())
+		return 1
+	}
+	srv, err := newServer(cfg)
+	if err != nil {
+		d.fail("config", err.Error())
+		return 1
+	}
+	defer srv.db.Close()
+	d.pass("config", "loaded and valid")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	d.checkBinaries(ctx, srv)
+	d.checkFFmpeg(ctx)
+	d.checkNetwork(ctx, srv)
+	d.checkWritable(cfg)
+	d.checkPrivileges(cfg)
+
+	if d.failures > 0 {
+		fmt.Printf("\n%d check(s) failed\n", d.failures)
+		return 1
+	}
+	fmt.Println("\nAll checks passed")
+	return 0
+}
+
+// checkBinaries runs the readiness checks, which cover the engines' binaries and ffmpeg
+func (d *doctorReport) checkBinaries(ctx context.Context, srv *server) {
+	report := srv.checkReadiness(ctx)
+	names := make([]string, 0, len(report.Checks))
+	for name := range report.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if result := report.Checks[name]; result == "ok" {
+			d.pass("ready "+name, "ok")
+		} else {
+			d.fail("ready "+name, result)
+		}
+	}
+}
+
+// checkFFmpeg looks for every encoder and filter in ffmpeg's own listings
+func (d *doctorReport) checkFFmpeg(ctx context.Context) {
+	available := func(kind string) (map[string]bool, error) {
+		out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-"+kind).Output()
+		if err != nil {
+			return nil, err
+		}
+		names := make(map[string]bool)
+		for _, line := range strings.Split(string(out), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 {
+				names[fields[1]] = true // " A....D libopus  ..." and " ... atempo  A->A  ..."
+			}
+		}
+		return names, nil
+	}
+	encoders, err := available("encoders")
+	if err != nil {
+		d.fail("ffmpeg encoders", err.Error())
+	} else {
+		for _, format := range audioFormatNames {
+			if encoder := formatEncoders[format]; encoders[encoder] {
+				d.pass("format "+format, "encoder "+encoder)
+			} else {
+				d.fail("format "+format, "ffmpeg lacks encoder "+encoder)
+			}
+		}
+	}
+	filters, err := available("filters")
+	if err != nil {
+		d.fail("ffmpeg filters", err.Error())
+		return
+	}
+	var missing []string
+	for _, filter := range requiredFilters {
+		if !filters[filter] {
+			missing = append(missing, filter)
+		}
+	}
+	if len(missing) > 0 {
+		d.fail("ffmpeg filters", "missing "+strings.Join(missing, ", "))
+	} else {
+		d.pass("ffmpeg filters", strings.Join(requiredFilters, ", "))
+	}
+	if filters["rubberband"] {
+		d.pass("ffmpeg rubberband", "pitch shifts keep formants")
+	} else {
+		d.warn("ffmpeg rubberband", "missing; pitch shifts fall back to resampling")
+	}
+}
+
+// checkNetwork dials the remote services the configuration depends on
+func (d *doctorReport) checkNetwork(ctx context.Context, srv *server) {
+	targets := make(map[string]string) // Check name -> host:port
+	for _, engine := range srv.engines {
+		if _, ok := engine.(*gttsEngine); ok {
+			targets["engine "+engine.Name()] = "translate.google.com:443"
+		}
+	}
+	for check, raw := range map[string]string{"tracing endpoint": srv.cfg.Tracing.Endpoint, "oidc jwks": srv.cfg.OIDC.JWKSURL, "oidc issuer": srv.cfg.OIDC.Issuer} {
+		if u, err := url.Parse(raw); raw != "" && err == nil && u.Host != "" {
+			port := u.Port()
+			if port == "" {
+				port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+			}
+			targets[check] = net.JoinHostPort(u.Hostname(), port)
+		}
+	}
+	checks := make([]string, 0, len(targets))
+	for check := range targets {
+		checks = append(checks, check)
+	}
+	sort.Strings(checks)
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	for _, check := range checks {
+		conn, err := dialer.DialContext(ctx, "tcp", targets[check])
+		if err != nil {
+			d.fail(check, err.Error())
+			continue
+		}
+		conn.Close()
+		d.pass(check, targets[check]+" reachable")
+	}
+}
+
+// checkPrivileges reports whether the service would start as the user it runs as
+func (d *doctorReport) checkPrivileges(cfg *Config) {
+	switch {
+	case os.Geteuid() != 0:
+		d.pass("privileges", fmt.Sprintf("running as uid %d", os.Geteuid()))
+	case cfg.User != "":
+		if _, _, err := lookupUser(cfg.User); err != nil {
+			d.fail("privileges", err.Error())
+		} else {
+			d.pass("privileges", "drops root to user "+cfg.User)
+		}
+	case cfg.AllowRoot:
+		d.warn("privileges", "runs as root")
+	default:
+		d.fail("privileges", "refuses to run as root; set -user or -allow-root")
+	}
+}
+
+// checkWritable creates and removes a file in every directory the service writes to
+func (d *doctorReport) checkWritable(cfg *Config) {
+	workspaces, err := NewWorkspaces(cfg.Workspace)
+	if err != nil {
+		d.fail("workspace", err.Error())
+		return
+	}
+	dirs := artifactDirs(cfg, workspaces)
+	if cfg.DBPath != "" {
+		dirs = append(dirs, filepath.Dir(cfg.DBPath))
+	}
+	for _, dir := range dirs {
+		f, err := os.CreateTemp(dir, ".doctor-*")
+		if err != nil {
+			d.fail("writable "+dir, err.Error())
+			continue
+		}
+		f.Close()
+		os.Remove(f.Name())
+		d.pass("writable "+dir, "ok")
+	}
+}
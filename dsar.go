@@ -0,0 +1,210 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Data subject requests: admins can export, or irreversibly delete,
+// everything the service keeps about one tenant, which for API keys is the
+// key's id. That is the tenant's API key and its quota usage, their usage
+// records with consent metadata, the analytics history of their texts, their
+// lexicon and the cached audio their requests produced or reused. Cached audio shared with other tenants is deleted too
+// and synthesized again on their next request. The service keeps no voices
+// or jobs per tenant: feeds and their narrations belong to the deployment,
+// and their retention is configured in retention.go.
+
+// cachedAudio is an export of one cache entry
+type cachedAudio struct {
+	Key      string    `json:"key"`
+	Bytes    int       `json:"bytes"`
+	CachedAt time.Time `json:"cached_at"`
+	Audio    []byte    `json:"audio"` // Base64 encoded
+}
+
+type tenantExport struct {
+	Tenant      string         `json:"tenant"`
+	ExportedAt  time.Time      `json:"exported_at"`
+	Key         *apiKeyView    `json:"key,omitempty"` // With its usage; absent for tenants from tokens
+	Usage       []UsageRecord  `json:"usage_records"` // Requests that carried consent metadata, newest first
+	History     []textStat     `json:"history"`
+	Lexicon     []LexiconEntry `json:"lexicon"`
+	CachedAudio []cachedAudio  `json:"cached_audio"`
+}
+
+// tenantDeletion reports what a deletion removed
+type tenantDeletion struct {
+	Tenant         string    `json:"tenant"`
+	DeletedAt      time.Time `json:"deleted_at"`
+	Key            string    `json:"key,omitempty"` // "deleted", or "revoked" for keys from the config file, which must be removed there too
+	UsageRecords   int       `json:"usage_records"`
+	HistoryTexts   int       `json:"history_texts"`
+	LexiconEntries int       `json:"lexicon_entries"`
+	CachedAudio    int       `json:"cached_audio"`
+}
+
+// claim records that a tenant's request produced or reused a cache entry
+func (c *AudioCache) claim(key, tenant string) {
+	if tenant == anonymousTenant {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.cache[key]; !exists {
+		return
+	}
+	owners, exists := c.owners[key]
+	if !exists {
+		owners = make(map[string]bool)
+		c.owners[key] = owners
+	}
+	owners[tenant] = true
+}
+
+// claimed returns the entries a tenant produced or reused, newest first
+func (c *AudioCache) claimed(tenant string) []cachedAudio {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := []cachedAudio{}
+	for key, owners := range c.owners {
+		if elem, exists := c.cache[key]; exists && owners[tenant] {
+			entry := elem.Value.(cacheItem).entry
+			result = append(result, cachedAudio{Key: key, Bytes: len(entry.data), CachedAt: entry.timestamp.UTC(), Audio: entry.data})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CachedAt.After(result[j].CachedAt) })
+	return result
+}
+
+// forgetTenant removes the entries a tenant produced or reused
+func (c *AudioCache) forgetTenant(tenant string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, owners := range c.owners {
+		if owners[tenant] {
+			c.remove(key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// history returns a tenant's analytics, most recently requested first
+func (a *TextAnalytics) history(tenant string) []textStat {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := []textStat{}
+	for _, stat := range a.byTenant[tenant] {
+		result = append(result, *stat)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LastSeen.After(result[j].LastSeen) })
+	return result
+}
+
+// removeTenant deletes a tenant's whole lexicon
+func (l *Lexicons) removeTenant(tenant string) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	removed := 0
+	for word := range l.entries[tenant] {
+		if err := l.db.delete(bucketLexicon, lexiconKey(tenant, word)); err != nil {
+			return removed, err
+		}
+		delete(l.entries[tenant], word)
+		removed++
+	}
+	delete(l.entries, tenant)
+	delete(l.compiled, tenant)
+	return removed, nil
+}
+
+// remove deletes a key and reports "deleted", or "revoked" when the key
+// comes from the config file: a revoked record is kept so the key stays
+// disabled after a restart. Either way its secrets are gone from the store.
+func (s *KeyStore) remove(id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, exists := s.byID[id]
+	if !exists {
+		return "", nil
+	}
+	if s.configured[id] {
+		revoked := APIKey{ID: key.ID, KeyHash: key.KeyHash, Revoked: true}
+		if err := s.db.put(bucketAPIKeys, id, revoked); err != nil {
+			return "", err
+		}
+		*key = revoked
+		return "revoked", nil
+	}
+	if err := s.db.delete(bucketAPIKeys, id); err != nil {
+		return "", err
+	}
+	delete(s.keys, key.KeyHash)
+	delete(s.byID, id)
+	return "deleted", nil
+}
+
+// dsarTenant returns the {tenant} path value, writing a 400 for the
+// anonymous tenant, which is shared by every caller without credentials
+func dsarTenant(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tenant := r.PathValue("tenant")
+	if tenant == anonymousTenant || strings.TrimSpace(tenant) == "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "The anonymous tenant is shared and cannot be exported or deleted")
+		return "", false
+	}
+	return tenant, true
+}
+
+func (s *server) handleExportTenant(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := dsarTenant(w, r)
+	if !ok {
+		return
+	}
+	export := tenantExport{
+		Tenant:      tenant,
+		ExportedAt:  time.Now().UTC(),
+		Usage:       s.usage.list(tenant),
+		History:     s.analytics.history(tenant),
+		Lexicon:     s.lexicons.list(tenant),
+		CachedAudio: s.cache.claimed(tenant),
+	}
+	for _, key := range s.keys.list() {
+		if key.ID == tenant {
+			view := s.keyView(key)
+			export.Key = &view
+		}
+	}
+	slog.Info("Exported tenant data", "tenant", tenant)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.ReplaceAll(tenant, `"`, "")+`-export.json"`)
+	writeJSON(w, http.StatusOK, export)
+}
+
+// handleDeleteTenant irreversibly deletes everything kept about the tenant
+func (s *server) handleDeleteTenant(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := dsarTenant(w, r)
+	if !ok {
+		return
+	}
+	report := tenantDeletion{Tenant: tenant}
+	var err error
+	if report.Key, err = s.keys.remove(tenant); err != nil {
+		slog.Error("Failed to delete tenant key", "tenant", tenant, "error", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to delete the API key; nothing else was deleted")
+		return
+	}
+	report.UsageRecords = s.keys.forgetUsage(tenant, time.Time{}) + s.usage.forget(tenant, time.Time{})
+	report.HistoryTexts = s.analytics.forget(tenant, time.Time{})
+	report.CachedAudio = s.cache.forgetTenant(tenant)
+	if report.LexiconEntries, err = s.lexicons.removeTenant(tenant); err != nil {
+		slog.Error("Failed to delete tenant lexicon", "tenant", tenant, "error", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to delete the lexicon; retry to finish the deletion")
+		return
+	}
+	report.DeletedAt = time.Now().UTC()
+	slog.Info("Deleted tenant data", "tenant", tenant, "report", report)
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Durations are read from the containers transcodeAudio produces rather than
+// by running ffprobe: ADTS frames each carry 1024 samples per raw data block,
+// an Ogg Opus stream's last granule position counts 48 kHz samples, and a
+// PCM WAV header gives the byte rate.
+
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// audioDuration returns how long encoded audio plays, or 0 if it cannot tell
+func audioDuration(audio []byte, codec string) time.Duration {
+	switch codec {
+	case "aac":
+		return adtsDuration(audio)
+	case "opus":
+		return oggOpusDuration(audio)
+	case "wav":
+		return wavDuration(audio)
+	}
+	return 0
+}
+
+// wavDuration reads the canonical 44-byte header writeWAV produces
+func wavDuration(audio []byte) time.Duration {
+	pcm, ok := pcmFromWAV(audio)
+	if !ok {
+		return 0
+	}
+	byteRate := int64(binary.LittleEndian.Uint32(audio[28:]))
+	if byteRate == 0 {
+		return 0
+	}
+	return time.Duration(len(pcm)) * time.Second / time.Duration(byteRate)
+}
+
+func adtsDuration(audio []byte) time.Duration {
+	var samples, rate int
+	for i := 0; i+7 <= len(audio); {
+		if audio[i] != 0xFF || audio[i+1]&0xF0 != 0xF0 {
+			return 0
+		}
+		index := int(audio[i+2]>>2) & 0x0F
+		if index >= len(adtsSampleRates) {
+			return 0
+		}
+		rate = adtsSampleRates[index]
+		length := int(audio[i+3]&0x03)<<11 | int(audio[i+4])<<3 | int(audio[i+5])>>5
+		if length < 7 {
+			return 0
+		}
+		samples += 1024 * (int(audio[i+6]&0x03) + 1)
+		i += length
+	}
+	if rate == 0 {
+		return 0
+	}
+	return time.Duration(samples) * time.Second / time.Duration(rate)
+}
+
+func oggOpusDuration(audio []byte) time.Duration {
+	// The OpusHead packet opens the first page; its pre-skip is not played
+	head := bytes.Index(audio, []byte("OpusHead"))
+	last := bytes.LastIndex(audio, []byte("OggS"))
+	if head < 0 || last < 0 || len(audio) < head+12 || len(audio) < last+14 {
+		return 0
+	}
+	preSkip := int64(binary.LittleEndian.Uint16(audio[head+10:]))
+	granule := int64(binary.LittleEndian.Uint64(audio[last+6:]))
+	if granule <= preSkip {
+		return 0
+	}
+	return time.Duration(granule-preSkip) * time.Second / 48000
+}
+
+// Speaking rate assumed until a session has measured its own
+const defaultCharDuration = 65 * time.Millisecond
+
+type WordTiming struct {
+	Word    string `json:"word"`
+	StartMS int64  `json:"start_ms"` // From the start of the chunk's audio
+	EndMS   int64  `json:"end_ms"`
+}
+
+// wordTimings spreads duration over the words of text in proportion to their
+// length, with extra weight for the pause punctuation causes. Engines do not
+// report word boundaries, so these are estimates good enough for highlighting.
+func wordTimings(text string, duration time.Duration) []WordTiming {
+	words := strings.Fields(text)
+	weights := make([]int, len(words))
+	total := 0
+	for i, word := range words {
+		weights[i] = utf8.RuneCountInString(word) + 1
+		switch last, _ := utf8.DecodeLastRuneInString(word); last {
+		case ',', ';', ':':
+			weights[i] += 2
+		case '.', '!', '?', '…', '。', '！', '？':
+			weights[i] += 4
+		}
+		total += weights[i]
+	}
+	timings := make([]WordTiming, len(words))
+	elapsed := 0
+	for i, word := range words {
+		start := duration * time.Duration(elapsed) / time.Duration(total)
+		elapsed += weights[i]
+		end := duration * time.Duration(elapsed) / time.Duration(total)
+		timings[i] = WordTiming{Word: word, StartMS: start.Milliseconds(), EndMS: end.Milliseconds()}
+	}
+	return timings
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Hosting bills by egress, so the bytes of every response are counted by
+// tenant and endpoint. A response counts towards one source: cache when its
+// audio came from the cache, synthesis when an engine spoke it, and other for
+// everything else, such as problems and JSON. WebSocket frames are counted as
+// they are sent, audio frames by where the audio came from. Like costs, the
+// totals are kept in memory since startup: GET /admin/egress reports them,
+// GET /admin/keys shows each key's total and tts_egress_bytes_total has them
+// by route and source.
+
+const (
+	egressCache     = "cache"
+	egressSynthesis = "synthesis"
+	egressOther     = "other"
+)
+
+// egressSource is the source of audio that was or was not cached
+func egressSource(cached bool) string {
+	if cached {
+		return egressCache
+	}
+	return egressSynthesis
+}
+
+type egressUsage struct {
+	Responses      int64 `json:"responses"`
+	Bytes          int64 `json:"bytes"`
+	CacheBytes     int64 `json:"cache_bytes"`
+	SynthesisBytes int64 `json:"synthesis_bytes"`
+	OtherBytes     int64 `json:"other_bytes"`
+}
+
+func (u *egressUsage) add(source string, n int64) {
+	switch source {
+	case egressCache:
+		u.CacheBytes += n
+	case egressSynthesis:
+		u.SynthesisBytes += n
+	default:
+		u.OtherBytes += n
+	}
+	u.Bytes += n
+}
+
+func (u *egressUsage) merge(other egressUsage) {
+	u.Responses += other.Responses
+	u.Bytes += other.Bytes
+	u.CacheBytes += other.CacheBytes
+	u.SynthesisBytes += other.SynthesisBytes
+	u.OtherBytes += other.OtherBytes
+}
+
+type egressKey struct {
+	tenant   string
+	endpoint string
+}
+
+// EgressTracker attributes bytes served to tenants and endpoints
+type EgressTracker struct {
+	since time.Time
+	mu    sync.Mutex
+	usage map[egressKey]*egressUsage
+}
+
+func NewEgressTracker() *EgressTracker {
+	return &EgressTracker{since: time.Now().UTC(), usage: make(map[egressKey]*egressUsage)}
+}
+
+// record adds one response, its bytes keyed by source
+func (t *EgressTracker) record(tenant, endpoint string, bytes map[string]int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := egressKey{tenant: tenant, endpoint: endpoint}
+	usage, exists := t.usage[key]
+	if !exists {
+		usage = &egressUsage{}
+		t.usage[key] = usage
+	}
+	usage.Responses++
+	for source, n := range bytes {
+		usage.add(source, n)
+	}
+}
+
+// tenantBytes returns the bytes served to tenant on every endpoint
+func (t *EgressTracker) tenantBytes(tenant string) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var total int64
+	for key, usage := range t.usage {
+		if key.tenant == tenant {
+			total += usage.Bytes
+		}
+	}
+	return total
+}
+
+type endpointEgress struct {
+	Endpoint string `json:"endpoint"`
+	egressUsage
+}
+
+type tenantEgress struct {
+	Tenant string `json:"tenant"`
+	egressUsage
+	Endpoints []endpointEgress `json:"endpoints"`
+}
+
+type egressReport struct {
+	Since   time.Time      `json:"since"`
+	Tenants []tenantEgress `json:"tenants"`
+}
+
+// report totals the usage of tenant, or of every tenant when it is empty
+func (t *EgressTracker) report(tenant string) egressReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	byTenant := make(map[string]*tenantEgress)
+	for key, usage := range t.usage {
+		if tenant != "" && key.tenant != tenant {
+			continue
+		}
+		entry, exists := byTenant[key.tenant]
+		if !exists {
+			entry = &tenantEgress{Tenant: key.tenant, Endpoints: []endpointEgress{}}
+			byTenant[key.tenant] = entry
+		}
+		entry.merge(*usage)
+		entry.Endpoints = append(entry.Endpoints, endpointEgress{Endpoint: key.endpoint, egressUsage: *usage})
+	}
+	report := egressReport{Since: t.since, Tenants: []tenantEgress{}}
+	for _, entry := range byTenant {
+		sort.Slice(entry.Endpoints, func(i, j int) bool { return entry.Endpoints[i].Endpoint < entry.Endpoints[j].Endpoint })
+		report.Tenants = append(report.Tenants, *entry)
+	}
+	sort.Slice(report.Tenants, func(i, j int) bool {
+		if report.Tenants[i].Bytes != report.Tenants[j].Bytes {
+			return report.Tenants[i].Bytes > report.Tenants[j].Bytes
+		}
+		return report.Tenants[i].Tenant < report.Tenants[j].Tenant
+	})
+	return report
+}
+
+func (s *server) handleEgressReport(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.egress.report(r.URL.Query().Get("tenant")))
+}
+
+// Egress middleware counting the bytes of each response. It must run inside
+// logRequests, which collects the tenant, route and source handlers report.
+func (s *server) meterEgress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		fields := fieldsFrom(r.Context())
+		if fields == nil {
+			return
+		}
+		bytes := make(map[string]int64)
+		fields.mu.Lock()
+		tenant, route, source := fields.tenant, fields.route, fields.source
+		for frameSource, n := range fields.frames {
+			bytes[frameSource] += n
+		}
+		fields.mu.Unlock()
+		if tenant == "" {
+			tenant = anonymousTenant
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+		if source == "" {
+			source = egressOther
+		}
+		bytes[source] += rec.bytes
+		s.egress.record(tenant, route, bytes)
+		for source, n := range bytes {
+			metrics.egress.add(labels("route", route, "source", source), float64(n))
+		}
+	})
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Email feeds narrate incoming mail, either by polling an IMAP mailbox
+// ("imap" feeds) or by accepting messages forwarded by an inbound email
+// provider such as Mailgun, SendGrid or Postmark ("email" feeds).
+
+// EmailRule selects messages by regular expressions on the sender and subject;
+// empty fields match anything
+type EmailRule struct {
+	From    string `json:"from"`
+	Subject string `json:"subject"`
+}
+
+type emailRule struct {
+	from, subject *regexp.Regexp
+}
+
+type emailMessage struct {
+	ID      string
+	From    string
+	Subject string
+	Text    string
+}
+
+func compileEmailRules(rules []EmailRule) ([]emailRule, error) {
+	compiled := make([]emailRule, 0, len(rules))
+	for _, rule := range rules {
+		var c emailRule
+		var err error
+		if rule.From != "" {
+			if c.from, err = regexp.Compile("(?i)" + rule.From); err != nil {
+				return nil, err
+			}
+		}
+		if rule.Subject != "" {
+			if c.subject, err = regexp.Compile("(?i)" + rule.Subject); err != nil {
+				return nil, err
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// matchesEmailRules reports whether any rule matches; without rules every message does
+func matchesEmailRules(rules []emailRule, msg emailMessage) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	for _, rule := range rules {
+		if (rule.from == nil || rule.from.MatchString(msg.From)) && (rule.subject == nil || rule.subject.MatchString(msg.Subject)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m emailMessage) item() FeedItem {
+	text := m.Text
+	if m.Subject != "" {
+		text = strings.TrimSpace(m.Subject + ". " + text)
+	}
+	return FeedItem{ID: m.ID, Title: m.Subject, Text: text}
+}
+
+// parseEmail extracts the sender, subject and readable text of an RFC 5322 message
+func parseEmail(raw []byte) (emailMessage, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return emailMessage{}, err
+	}
+	decoder := new(mime.WordDecoder)
+	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	from := msg.Header.Get("From")
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+	text, err := readableText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return emailMessage{}, err
+	}
+	return emailMessage{
+		ID:      strings.Trim(msg.Header.Get("Message-ID"), "<> "),
+		From:    from,
+		Subject: strings.TrimSpace(subject),
+		Text:    text,
+	}, nil
+}
+
+// readableText returns the text/plain part of a body, falling back to stripped text/html
+func readableText(contentType, transferEncoding string, body io.Reader) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(transferEncoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: body})
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		var html string
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return html, nil
+			} else if err != nil {
+				return "", err
+			}
+			text, err := readableText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", err
+			}
+			if partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); partType == "text/html" {
+				html = text
+			} else if text != "" {
+				return text, nil
+			}
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	switch mediaType {
+	case "text/plain":
+		return strings.Join(strings.Fields(string(data)), " "), nil
+	case "text/html":
+		return plainText(string(data)), nil
+	}
+	return "", nil // Attachments and other media are not narrated
+}
+
+// newlineStripper drops line breaks so base64 bodies can be decoded
+type newlineStripper struct{ r io.Reader }
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	count, err := n.r.Read(p)
+	kept := 0
+	for _, b := range p[:count] {
+		if b != '\r' && b != '\n' {
+			p[kept] = b
+			kept++
+		}
+	}
+	return kept, err
+}
+
+// inboundEmail reads a message forwarded by an inbound email provider, either
+// as the raw MIME message or as the provider's parsed fields
+func inboundEmail(r *http.Request) (emailMessage, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "message/rfc822") {
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			return emailMessage{}, err
+		}
+		return parseEmail(raw)
+	}
+	fields := make(map[string]string)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var payload map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			return emailMessage{}, err
+		}
+		for key, value := range payload {
+			if s, ok := value.(string); ok {
+				fields[strings.ToLower(key)] = s
+			}
+		}
+	} else {
+		if err := r.ParseMultipartForm(1 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			return emailMessage{}, err
+		}
+		for key, values := range r.Form {
+			fields[strings.ToLower(key)] = values[0]
+		}
+	}
+	if raw := fields["email"]; raw != "" { // SendGrid with "post the raw, full MIME message" enabled
+		return parseEmail([]byte(raw))
+	}
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if fields[key] != "" {
+				return fields[key]
+			}
+		}
+		return ""
+	}
+	msg := emailMessage{
+		ID:      strings.Trim(first("message-id", "messageid"), "<> "),
+		From:    first("sender", "from"),
+		Subject: first("subject"),
+		Text:    strings.Join(strings.Fields(first("body-plain", "text", "textbody", "stripped-text")), " "),
+	}
+	if msg.Text == "" {
+		msg.Text = plainText(first("body-html", "html", "htmlbody"))
+	}
+	if addr, err := mail.ParseAddress(msg.From); err == nil {
+		msg.From = addr.Address
+	}
+	return msg, nil
+}
+
+// imapConnector polls a mailbox for new messages. It remembers the highest
+// UID it has seen; on startup it looks back a week and relies on the
+// narration store to skip messages that were already handled.
+type imapConnector struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	mailbox  string
+	rules    []emailRule
+	lastUID  uint64
+}
+
+// Messages fetched per poll, to bound the work after a long outage
+const maxIMAPFetch = 50
+
+func newIMAPConnector(cfg FeedConfig, rules []emailRule) (*imapConnector, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Host == "" || u.Scheme != "imaps" && u.Scheme != "imap" {
+		return nil, fmt.Errorf("feed %q: url must look like imaps://imap.example.com", cfg.Name)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), map[string]string{"imaps": "993", "imap": "143"}[u.Scheme])
+	}
+	mailbox := cfg.Mailbox
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	return &imapConnector{addr: addr, useTLS: u.Scheme == "imaps", username: cfg.Username, password: cfg.Password, mailbox: mailbox, rules: rules}, nil
+}
+
+func (c *imapConnector) Poll(ctx context.Context) ([]FeedItem, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if c.useTLS {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	session := &imapSession{r: bufio.NewReader(conn), w: conn}
+	if _, err := session.r.ReadString('\n'); err != nil { // Greeting
+		return nil, err
+	}
+	if _, err := session.command("LOGIN %s %s", imapQuote(c.username), imapQuote(c.password)); err != nil {
+		return nil, err
+	}
+	defer session.command("LOGOUT")
+	if _, err := session.command("EXAMINE %s", imapQuote(c.mailbox)); err != nil { // Read-only, leaves \Seen alone
+		return nil, err
+	}
+
+	criteria := "SINCE " + time.Now().AddDate(0, 0, -7).Format("2-Jan-2006")
+	if c.lastUID > 0 {
+		criteria = fmt.Sprintf("UID %d:*", c.lastUID+1)
+	}
+	responses, err := session.command("UID SEARCH %s", criteria)
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint64
+	for _, response := range responses {
+		if rest, ok := strings.CutPrefix(response.line, "* SEARCH"); ok {
+			for _, field := range strings.Fields(rest) {
+				if uid, err := strconv.ParseUint(field, 10, 64); err == nil && uid > c.lastUID {
+					uids = append(uids, uid)
+				}
+			}
+		}
+	}
+	if len(uids) > maxIMAPFetch {
+		uids = uids[:maxIMAPFetch]
+	}
+
+	var items []FeedItem
+	for _, uid := range uids {
+		responses, err := session.command("UID FETCH %d BODY.PEEK[]", uid)
+		if err != nil {
+			return items, err
+		}
+		for _, response := range responses {
+			if len(response.literals) == 0 {
+				continue
+			}
+			msg, err := parseEmail(response.literals[0])
+			if err != nil {
+				continue
+			}
+			if msg.ID == "" {
+				msg.ID = fmt.Sprintf("%s/%d", c.mailbox, uid)
+			}
+			if matchesEmailRules(c.rules, msg) && msg.Text != "" {
+				items = append(items, msg.item())
+			}
+		}
+		c.lastUID = uid
+	}
+	return items, nil
+}
+
+// imapSession speaks just enough IMAP4rev1 to log in, search and fetch
+type imapSession struct {
+	r   *bufio.Reader
+	w   io.Writer
+	tag int
+}
+
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+var imapLiteral = regexp.MustCompile(`\{(\d+)\}\r\n$`)
+
+// command sends a tagged command and returns its untagged responses, failing unless it completes with OK
+func (s *imapSession) command(format string, args ...any) ([]imapResponse, error) {
+	s.tag++
+	tag := fmt.Sprintf("a%d", s.tag)
+	if _, err := fmt.Fprintf(s.w, "%s %s\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return nil, err
+	}
+	var responses []imapResponse
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		response := imapResponse{line: line}
+		for {
+			match := imapLiteral.FindStringSubmatch(line)
+			if match == nil {
+				break
+			}
+			size, _ := strconv.Atoi(match[1])
+			literal := make([]byte, size)
+			if _, err := io.ReadFull(s.r, literal); err != nil {
+				return nil, err
+			}
+			response.literals = append(response.literals, literal)
+			if line, err = s.r.ReadString('\n'); err != nil {
+				return nil, err
+			}
+			response.line += line
+		}
+		if status, ok := strings.CutPrefix(response.line, tag+" "); ok {
+			if !strings.HasPrefix(status, "OK") {
+				return nil, fmt.Errorf("imap: %s", strings.TrimSpace(status))
+			}
+			return responses, nil
+		}
+		responses = append(responses, response)
+	}
+}
+
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// SynthesisRequest is what an engine needs to produce speech
+type SynthesisRequest struct {
+	Text     string
+	Lang     string
+	Voice    string // Optional; see EngineFeatures
+	Style    string
+	Previous string // Sentence spoken just before Text, for prosody continuity
+	Slow     bool   // Engine's own slow, clearly articulated mode
+}
+
+// Engine turns text into audio in any container ffmpeg can decode
+type Engine interface {
+	Name() string
+	Synthesize(ctx context.Context, req SynthesisRequest) ([]byte, error)
+}
+
+// LanguageLister is implemented by engines that can report the languages they support
+type LanguageLister interface {
+	Languages(ctx context.Context) ([]string, error)
+}
+
+type EngineConfig struct {
+	Name      string        `json:"name"`
+	Type      string        `json:"type"`      // "gtts", "command" or "piper"
+	Command   []string      `json:"command"`   // For "command" engines: argv with {text}, {lang} and optionally {voice}, {style}, {previous}, {workdir}, {region} and {models} placeholders, audio on stdout
+	Languages []string      `json:"languages"` // For "command" engines: supported language codes, unchecked if empty
+	Sandbox   SandboxConfig `json:"sandbox"`
+	Regions   []string      `json:"regions"`  // For "command" engines: regions or endpoints substituted for {region}, failed over in order
+	Model     string        `json:"model"`    // For "piper" engines: path of the .onnx voice; empty for a downloaded or the bundled voice, see piper.go
+	Download  []ModelFile   `json:"download"` // For "command" and "piper" engines: model files fetched into models_dir; see models.go
+}
+
+// gttsTLDs are the Google domains gtts may speak through, as published for
+// the tld field of /v1/speak
+var gttsTLDs = schemaEnum("speak", "tld")
+
+// gttsEngine shells out to gtts-cli, which returns MP3
+type gttsEngine struct {
+	name string
+}
+
+func (e *gttsEngine) Name() string { return e.name }
+
+func (e *gttsEngine) Synthesize(ctx context.Context, req SynthesisRequest) ([]byte, error) {
+	args := []string{"--lang", req.Lang, "--nocheck"}
+	if req.Voice != "" {
+		args = append(args, "--tld", req.Voice) // Regional accent, e.g. com.au
+	}
+	if req.Slow {
+		args = append(args, "--slow")
+	}
+	cmd := exec.CommandContext(ctx, "gtts-cli", append(args, req.Text)...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := runTimed(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("gtts-cli: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// Languages parses `gtts-cli --all`, which prints one "code: Name" pair per line
+func (e *gttsEngine) Languages(ctx context.Context) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "gtts-cli", "--all").Output()
+	if err != nil {
+		return nil, fmt.Errorf("gtts-cli --all: %w", err)
+	}
+	var codes []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if code, _, ok := strings.Cut(line, ":"); ok && strings.TrimSpace(code) != "" {
+			codes = append(codes, strings.TrimSpace(code))
+		}
+	}
+	return codes, nil
+}
+
+// commandEngine runs an arbitrary TTS command line (espeak-ng, piper, ...)
+type commandEngine struct {
+	name       string
+	argv       []string
+	languages  []string
+	workspaces *Workspaces
+	regions    *regionSet // Nil without regions
+	stdin      bool       // Write the text to the command's stdin, as piper reads it
+	models     *modelSet  // Nil without downloads
+}
+
+func (e *commandEngine) Name() string { return e.name }
+
+func (e *commandEngine) Synthesize(ctx context.Context, req SynthesisRequest) ([]byte, error) {
+	return e.regions.failover(ctx, func(region string) ([]byte, error) {
+		return e.run(ctx, req, region)
+	})
+}
+
+func (e *commandEngine) run(ctx context.Context, req SynthesisRequest, region string) ([]byte, error) {
+	if err := e.models.ready(); err != nil {
+		return nil, fmt.Errorf("%s: %w", e.name, err)
+	}
+	workdir, release, err := e.workspaces.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", e.argv[0], err)
+	}
+	defer release()
+	var models string
+	if e.models != nil {
+		models = e.models.dir
+	}
+	replacer := strings.NewReplacer("{text}", req.Text, "{lang}", req.Lang, "{voice}", req.Voice, "{style}", req.Style, "{previous}", req.Previous, "{workdir}", workdir, "{region}", region, "{models}", models)
+	args := make([]string, len(e.argv))
+	for i, arg := range e.argv {
+		args[i] = replacer.Replace(arg)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = workdir
+	cmd.Env = append(cmd.Environ(), "TMPDIR="+workdir)
+	if e.stdin {
+		cmd.Stdin = strings.NewReader(req.Text)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := runTimed(ctx, cmd); err != nil {
+		if region != "" {
+			return nil, fmt.Errorf("%s (region %s): %w", e.argv[0], region, err)
+		}
+		return nil, fmt.Errorf("%s: %w", e.argv[0], err)
+	}
+	return out.Bytes(), nil
+}
+
+func (e *commandEngine) Languages(ctx context.Context) ([]string, error) {
+	return e.languages, nil
+}
+
+// synthesize calls the engine in its own span, counting the synthesis as in flight while it runs
+func synthesize(ctx context.Context, engine Engine, req SynthesisRequest) ([]byte, error) {
+	if _, ok := engine.(*gttsEngine); ok && utf8.RuneCountInString(req.Text) > longTextChunkChars {
+		return synthesizeChunked(ctx, engine, req)
+	}
+	if readOnlyReplica {
+		return nil, errReplicaMiss
+	}
+	if err := maintenance.admit(ctx); err != nil {
+		return nil, err
+	}
+	release, err := synthesisQueue.acquire(ctx, engine.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	metrics.inFlight.Add(1)
+	defer metrics.inFlight.Add(-1)
+	ctx, done, err := engineGates.enter(ctx, engine.Name())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", engine.Name(), err)
+	}
+	defer done()
+	ctx, span := startSpan(ctx, "synthesize", "tts.engine", engine.Name(), "tts.lang", req.Lang, "tts.chars", len([]rune(req.Text)))
+	start := time.Now()
+	audio, err := engine.Synthesize(ctx, req)
+	if err != nil && errors.Is(context.Cause(ctx), errEngineDisabled) {
+		err = fmt.Errorf("%s: %w", engine.Name(), errEngineDisabled)
+	}
+	if err == nil {
+		engineLatency.observe(engine.Name(), time.Since(start))
+	}
+	span.set("tts.audio_bytes", len(audio))
+	span.end(err)
+	return audio, err
+}
+
+func newEngine(cfg EngineConfig, models string, workspaces *Workspaces) (Engine, error) {
+	var downloads *modelSet
+	if len(cfg.Download) > 0 {
+		dir, err := modelsDir(models)
+		if err != nil {
+			return nil, fmt.Errorf("engine %q: %w", cfg.Name, err)
+		}
+		downloads = newModelSet(cfg.Name, filepath.Join(dir, cfg.Name), cfg.Download)
+	}
+	switch cfg.Type {
+	case "gtts":
+		return &gttsEngine{name: cfg.Name}, nil
+	case "command":
+		if len(cfg.Command) == 0 {
+			return nil, fmt.Errorf("engine %q: command is required", cfg.Name)
+		}
+		return &commandEngine{name: cfg.Name, argv: cfg.Command, languages: cfg.Languages, workspaces: workspaces, regions: newRegionSet(cfg.Name, cfg.Regions), models: downloads}, nil
+	case "piper":
+		model := cfg.Model
+		if model == "" {
+			model = downloads.firstWithSuffix(".onnx")
+		}
+		if model == "" {
+			dir, err := modelsDir(models)
+			if err != nil {
+				return nil, fmt.Errorf("engine %q: %w", cfg.Name, err)
+			}
+			if model, err = extractBundledVoice(dir); err != nil {
+				return nil, fmt.Errorf("engine %q: %w", cfg.Name, err)
+			}
+		}
+		return &commandEngine{name: cfg.Name, argv: piperArgv(model), languages: cfg.Languages, workspaces: workspaces, stdin: true, models: downloads}, nil
+	}
+	return nil, fmt.Errorf("engine %q: unknown type %q", cfg.Name, cfg.Type)
+}
+
+// buildEngines creates the configured engines, keyed by name
+func buildEngines(configs []EngineConfig, defaultEngine, models string, workspaces *Workspaces) (map[string]Engine, error) {
+	engines := make(map[string]Engine)
+	for _, cfg := range configs {
+		if _, exists := engines[cfg.Name]; exists {
+			return nil, fmt.Errorf("engine %q is defined twice", cfg.Name)
+		}
+		engine, err := newEngine(cfg, models, workspaces)
+		if err != nil {
+			return nil, err
+		}
+		engines[cfg.Name] = engine
+	}
+	if _, exists := engines[defaultEngine]; !exists {
+		return nil, fmt.Errorf("default engine %q is not defined", defaultEngine)
+	}
+	return engines, nil
+}
+
+// engineFor picks the requested engine, falling back to the default
+func (s *server) engineFor(name string) (Engine, bool) {
+	if name == "" {
+		name = s.cfg.DefaultEngine
+	}
+	engine, exists := s.engines[name]
+	return engine, exists
+}
+
+// engineNames returns the configured engine names in sorted order
+func (s *server) engineNames() []string {
+	names := make([]string, 0, len(s.engines))
+	for name := range s.engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// languageSet maps lowercased language codes to the engine's spelling
+type languageSet map[string]string
+
+// discoverLanguages asks every engine for its languages. Engines that cannot
+// report them are left out, which disables language validation for them.
+func discoverLanguages(engines map[string]Engine) map[string]languageSet {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	languages := make(map[string]languageSet)
+	for name, engine := range engines {
+		lister, ok := engine.(LanguageLister)
+		if !ok {
+			continue
+		}
+		codes, err := lister.Languages(ctx)
+		if err != nil {
+			slog.Warn("Language discovery failed, accepting any language", "engine", name, "error", err)
+			continue
+		}
+		if len(codes) == 0 {
+			continue
+		}
+		set := make(languageSet)
+		for _, code := range codes {
+			set[strings.ToLower(code)] = code
+		}
+		languages[name] = set
+	}
+	return languages
+}
+
+// codes returns the supported codes in sorted order
+func (l languageSet) codes() []string {
+	codes := make([]string, 0, len(l))
+	for _, code := range l {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// canonicalLanguage resolves lang for the engine, reporting false if the engine does not support it
+func (s *server) canonicalLanguage(engine Engine, lang string) (string, bool) {
+	set, known := s.languages[engine.Name()]
+	if !known {
+		return lang, true
+	}
+	code, ok := set[strings.ToLower(lang)]
+	return code, ok
+}
+
+// baseLanguage drops the region of a code such as en-US when the engine
+// knows only the language, for APIs whose codes always carry one
+func (s *server) baseLanguage(engineName, lang string) string {
+	engine, exists := s.engineFor(engineName)
+	if !exists {
+		return lang
+	}
+	if _, ok := s.canonicalLanguage(engine, lang); ok {
+		return lang
+	}
+	if primary, _, found := strings.Cut(lang, "-"); found {
+		if _, ok := s.canonicalLanguage(engine, primary); ok {
+			return primary
+		}
+	}
+	return lang
+}
+
+func (s *server) writeLanguageError(w http.ResponseWriter, r *http.Request, engine Engine, lang string) {
+	writeProblem(w, r, Problem{
+		Status:    http.StatusBadRequest,
+		Code:      codeUnsupportedLanguage,
+		Detail:    fmt.Sprintf("Engine %s does not support language %q", engine.Name(), lang),
+		Pointer:   "/lang",
+		Supported: s.languages[engine.Name()].codes(),
+	})
+}
+
+// Lists the languages each engine supports
+func (s *server) handleLanguages(w http.ResponseWriter, r *http.Request) {
+	result := make(map[string][]string)
+	for name := range s.engines {
+		if set, known := s.languages[name]; known {
+			result[name] = set.codes()
+		} else {
+			result[name] = nil // Unknown; the engine accepts any code
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
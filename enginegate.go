@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Engines can be taken out of service at runtime, e.g. during an upstream
+// incident. A disabled engine rejects new work and has its in-flight
+// syntheses cancelled; a draining one rejects new work but lets in-flight
+// syntheses finish, then becomes disabled. State is not persisted: a restart
+// brings every configured engine back.
+const (
+	engineEnabled  = "enabled"
+	engineDraining = "draining"
+	engineDisabled = "disabled"
+)
+
+var errEngineDisabled = errors.New("engine is disabled")
+
+type EngineState struct {
+	Name      string        `json:"name"`
+	Status    string        `json:"status"`
+	InFlight  int           `json:"in_flight"`
+	ChangedAt time.Time     `json:"changed_at,omitempty"`
+	AvgMS     int64         `json:"avg_latency_ms"` // Recent synthesis latency
+	Regions   []RegionState `json:"regions,omitempty"`
+	Models    []ModelState  `json:"models,omitempty"`
+}
+
+type gateState struct {
+	status    string
+	changedAt time.Time
+	cancels   map[int]context.CancelCauseFunc // In-flight syntheses
+	nextID    int
+}
+
+type engineGate struct {
+	mu    sync.Mutex
+	state map[string]*gateState
+}
+
+var engineGates = &engineGate{state: make(map[string]*gateState)}
+
+// get returns the engine's state, creating it enabled; g.mu must be held
+func (g *engineGate) get(name string) *gateState {
+	st, exists := g.state[name]
+	if !exists {
+		st = &gateState{status: engineEnabled, cancels: make(map[int]context.CancelCauseFunc)}
+		g.state[name] = st
+	}
+	return st
+}
+
+// available reports whether the engine accepts new work
+func (g *engineGate) available(name string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.get(name).status == engineEnabled
+}
+
+// enter registers a synthesis with the engine. The returned context is
+// cancelled with errEngineDisabled if the engine is disabled; call done when
+// the synthesis ends.
+func (g *engineGate) enter(ctx context.Context, name string) (context.Context, func(), error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := g.get(name)
+	if st.status != engineEnabled {
+		return nil, nil, errEngineDisabled
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	id := st.nextID
+	st.nextID++
+	st.cancels[id] = cancel
+	return ctx, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		delete(st.cancels, id)
+		if st.status == engineDraining && len(st.cancels) == 0 {
+			st.status, st.changedAt = engineDisabled, time.Now()
+		}
+		cancel(nil)
+	}, nil
+}
+
+// set moves the engine to status: enabled, draining or disabled
+func (g *engineGate) set(name, status string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := g.get(name)
+	switch status {
+	case engineDisabled:
+		for _, cancel := range st.cancels {
+			cancel(errEngineDisabled)
+		}
+	case engineDraining:
+		if len(st.cancels) == 0 {
+			status = engineDisabled
+		}
+	}
+	if st.status != status {
+		st.status, st.changedAt = status, time.Now()
+	}
+}
+
+func (g *engineGate) view(name string) EngineState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := g.get(name)
+	return EngineState{Name: name, Status: st.status, InFlight: len(st.cancels), ChangedAt: st.changedAt, AvgMS: engineLatency.get(name).Milliseconds()}
+}
+
+// availableEngineNames returns the names of engines accepting new work
+func (s *server) availableEngineNames() []string {
+	var names []string
+	for _, name := range s.engineNames() {
+		if engineGates.available(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// writeSynthesisError maps synthesis failures caused by disabling the engine,
+// models not yet fetched, maintenance mode, a full queue or workspace or a
+// replica's cache miss to a 503, an upstream's failure to a 502 and
+// everything else to a 500
+func (s *server) writeSynthesisError(w http.ResponseWriter, r *http.Request, engine Engine, err error) {
+	if errors.Is(err, errMaintenance) {
+		writeMaintenance(w, r)
+		return
+	}
+	if errors.Is(err, errReplicaMiss) {
+		writeReplicaMiss(w, r)
+		return
+	}
+	if errors.Is(err, errUpstream) {
+		writeUpstreamError(w, r)
+		return
+	}
+	var full *queueFullError
+	if errors.As(err, &full) {
+		writeQueueFull(w, r, full)
+		return
+	}
+	if errors.Is(err, errTaskTimeout) {
+		w.Header().Set("Retry-After", "5")
+		writeError(w, r, http.StatusServiceUnavailable, codeQueueFull, "No synthesis worker is available; try again later")
+		return
+	}
+	if errors.Is(err, errWorkspaceFull) {
+		w.Header().Set("Retry-After", "30")
+		writeError(w, r, http.StatusServiceUnavailable, codeWorkspaceFull, "Scratch space for the engine is full")
+		return
+	}
+	if errors.Is(err, errEngineDisabled) {
+		s.writeEngineUnavailable(w, r, engine)
+		return
+	}
+	if errors.Is(err, errModelsPending) {
+		w.Header().Set("Retry-After", "30")
+		writeError(w, r, http.StatusServiceUnavailable, codeEngineUnavailable, "Engine "+engine.Name()+" does not have its model files yet")
+		return
+	}
+	writeError(w, r, http.StatusInternalServerError, codeSynthesisFailed, "Failed to generate audio")
+}
+
+func (s *server) writeEngineUnavailable(w http.ResponseWriter, r *http.Request, engine Engine) {
+	w.Header().Set("Retry-After", "60")
+	writeProblem(w, r, Problem{
+		Status:    http.StatusServiceUnavailable,
+		Code:      codeEngineUnavailable,
+		Detail:    "Engine " + engine.Name() + " is temporarily disabled",
+		Pointer:   "/engine",
+		Supported: s.availableEngineNames(),
+	})
+}
+
+func (s *server) handleListEngines(w http.ResponseWriter, r *http.Request) {
+	states := []EngineState{}
+	for _, name := range s.engineNames() {
+		state := engineGates.view(name)
+		if engine, ok := s.engines[name].(*commandEngine); ok {
+			state.Regions = engine.regions.view()
+			state.Models = engine.models.view()
+		}
+		states = append(states, state)
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+// handleSetEngineState returns the handler that moves the engine named in the path to status
+func (s *server) handleSetEngineState(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if _, exists := s.engines[name]; !exists {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "Unknown engine")
+			return
+		}
+		engineGates.set(name, status)
+		writeJSON(w, http.StatusOK, engineGates.view(name))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Response envelopes of /v1/speak. Deployments pick the default with the
+// response_envelope setting; a client can ask for another via X-Response-Envelope.
+//
+//	json     {"audio": "<base64>", "renditions": [...]}
+//	bare     the audio bytes, typed audio/ogg or audio/aac; renditions are left out
+//	jsonapi      a JSON:API document: {"data": {"type": "speech", "id": ..., "attributes": {...}}}
+//	progressive  {"codec": ..., "content_type": ..., "bytes": ..., "duration_ms": ..., "renditions": [...], "audio": "<base64>"}
+//
+// A progressive response is one JSON object whose metadata is flushed before
+// the audio, which follows in pieces, so a UI reading the body as it arrives
+// can draw the player, with its duration, before the audio is complete. The
+// metadata is also sent as X-Audio-Codec and X-Audio-Duration-Ms headers.
+// duration_ms is left out when the format does not tell it (see duration.go).
+const (
+	envelopeJSON        = "json"
+	envelopeBare        = "bare"
+	envelopeJSONAPI     = "jsonapi"
+	envelopeProgressive = "progressive"
+)
+
+var envelopes = []string{envelopeJSON, envelopeBare, envelopeJSONAPI, envelopeProgressive}
+
+// Base64 characters written between flushes of a progressive response
+const progressiveChunk = 64 << 10
+
+type ProgressiveMetadata struct {
+	Codec           string           `json:"codec"`
+	ContentType     string           `json:"content_type"`
+	Bytes           int              `json:"bytes"`
+	DurationMS      int64            `json:"duration_ms,omitempty"`
+	Renditions      []Rendition      `json:"renditions,omitempty"`
+	TransformedText *TransformedText `json:"transformed_text,omitempty"` // With echo_text; see textecho.go
+}
+
+type JSONAPIDocument struct {
+	Data JSONAPIResource `json:"data"`
+}
+
+type JSONAPIResource struct {
+	Type       string         `json:"type"`
+	ID         string         `json:"id"`
+	Attributes SpeechResource `json:"attributes"`
+}
+
+type SpeechResource struct {
+	Audio           string           `json:"audio"` // Base64 encoded audio data
+	Codec           string           `json:"codec"`
+	Renditions      []Rendition      `json:"renditions,omitempty"`
+	TransformedText *TransformedText `json:"transformed_text,omitempty"`
+}
+
+// responseEnvelope picks the configured envelope unless the client asks for another
+func (s *server) responseEnvelope(r *http.Request) string {
+	if envelope := r.Header.Get("X-Response-Envelope"); containsString(envelopes, envelope) {
+		return envelope
+	}
+	return s.cfg.ResponseEnvelope
+}
+
+// writeSpeech sends synthesized audio in the request's envelope
+func (s *server) writeSpeech(w http.ResponseWriter, r *http.Request, audio []byte, opts AudioOptions, renditions []Rendition, echo *TransformedText) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	switch s.responseEnvelope(r) {
+	case envelopeBare:
+		if echo != nil {
+			w.Header().Set("X-Transformed-Text", url.PathEscape(echo.Text))
+		}
+		w.Header().Set("Content-Type", opts.mimeType())
+		w.Header().Set("Content-Length", strconv.Itoa(len(audio)))
+		w.Write(audio)
+	case envelopeJSONAPI:
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		json.NewEncoder(w).Encode(JSONAPIDocument{Data: JSONAPIResource{
+			Type: "speech",
+			ID:   requestIDFrom(r.Context()),
+			Attributes: SpeechResource{
+				Audio:           base64.StdEncoding.EncodeToString(audio),
+				Codec:           opts.codec(),
+				Renditions:      renditions,
+				TransformedText: echo,
+			},
+		}})
+	case envelopeProgressive:
+		writeProgressive(w, audio, opts, renditions, echo)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ResponsePayload{Audio: base64.StdEncoding.EncodeToString(audio), Renditions: renditions, TransformedText: echo})
+	}
+}
+
+// writeProgressive sends the progressive envelope, flushing the metadata
+// before the audio
+func writeProgressive(w http.ResponseWriter, audio []byte, opts AudioOptions, renditions []Rendition, echo *TransformedText) {
+	meta := ProgressiveMetadata{Codec: opts.codec(), ContentType: opts.mimeType(), Bytes: len(audio), Renditions: renditions, TransformedText: echo}
+	if duration := audioDuration(audio, opts.codec()); duration > 0 {
+		meta.DurationMS = duration.Milliseconds()
+		w.Header().Set("X-Audio-Duration-Ms", strconv.FormatInt(meta.DurationMS, 10))
+	}
+	head, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Audio-Codec", meta.Codec)
+	rc := http.NewResponseController(w)
+	w.Write(head[:len(head)-1]) // Left open for the audio
+	io.WriteString(w, `,"audio":"`)
+	rc.Flush()
+	encoded := base64.StdEncoding.EncodeToString(audio)
+	for start := 0; start < len(encoded); start += progressiveChunk {
+		if _, err := io.WriteString(w, encoded[start:min(start+progressiveChunk, len(encoded))]); err != nil {
+			return
+		}
+		rc.Flush()
+	}
+	io.WriteString(w, "\"}\n")
+}
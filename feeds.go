@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feeds turn the service into a push-based narration pipeline: connectors
+// watch a source for new text, and every new item is synthesized once and
+// stored on disk, ready to be fetched through /v1/feeds/{name}/items. Item
+// text is screened and preprocessed as /v1/speak text of the feed's tenant
+// would be, and narrations share the audio cache with it.
+
+type FeedsConfig struct {
+	AudioDir    string       `json:"audio_dir"`    // Where narrated audio is written; feeds are disabled without it
+	PublicURL   string       `json:"public_url"`   // Base URL of this service, used in the audio links sent to deliver_url
+	ManifestKey string       `json:"manifest_key"` // PEM Ed25519 private key; when set, each narration gets a signed manifest
+	Sources     []FeedConfig `json:"sources"`
+}
+
+type FeedConfig struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`     // "rss" (RSS or Atom), "s3", "webhook", "imap" or "email"
+	URL      string   `json:"url"`      // Feed URL for rss; endpoint such as https://s3.eu-west-1.amazonaws.com for s3; imaps://host[:port] for imap
+	Bucket   string   `json:"bucket"`   // s3: bucket name
+	Prefix   string   `json:"prefix"`   // s3: .txt objects under this prefix are narrated
+	Region   string   `json:"region"`   // s3: region used to sign requests
+	Secret   string   `json:"secret"`   // webhook: HMAC secret for X-Signature; email: token the provider passes as ?token=
+	Interval Duration `json:"interval"` // rss, s3 and imap: how often the source is polled
+	Engine   string   `json:"engine"`   // Empty uses the default engine
+	Lang     string   `json:"lang"`     // Language of items that do not carry their own; defaults to "en"
+	Tenant   string   `json:"tenant"`   // Key ID whose lexicon and preprocessing pipeline items get; empty for the anonymous tenant's
+
+	Username string      `json:"username"` // imap: login
+	Password string      `json:"password"`
+	Mailbox  string      `json:"mailbox"` // imap: defaults to INBOX
+	Rules    []EmailRule `json:"rules"`   // imap and email: only matching messages are narrated
+
+	DeliverURL string `json:"deliver_url"` // Receives a JSON notification with the audio link after each narration
+}
+
+// FeedItem is one piece of text a connector found
+type FeedItem struct {
+	ID    string `json:"id"` // Stable per item; a changed ID is narrated again
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	Lang  string `json:"lang"`
+}
+
+// Connector lists the items currently available at a source
+type Connector interface {
+	Poll(ctx context.Context) ([]FeedItem, error)
+}
+
+// Narration records the outcome of synthesizing one feed item
+type Narration struct {
+	ID        string    `json:"id"` // Derived from the feed and item ID, safe to use in URLs
+	Feed      string    `json:"feed"`
+	ItemID    string    `json:"item_id"`
+	Title     string    `json:"title,omitempty"`
+	Lang      string    `json:"lang"`
+	Engine    string    `json:"engine"`
+	Chars     int       `json:"chars"`
+	Bytes     int       `json:"bytes"`
+	File      string    `json:"file,omitempty"`
+	Manifest  string    `json:"manifest,omitempty"` // Signed provenance record of File; see manifest.go
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	Expired   bool      `json:"expired,omitempty"` // Audio deleted by retention; the record stays so the item is not narrated again
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var bucketNarrations = []byte("narrations")
+
+const maxNarrationAttempts = 3
+
+type feed struct {
+	cfg       FeedConfig
+	engine    Engine
+	connector Connector // Nil for pushed feeds
+	rules     []emailRule
+}
+
+// delivery is the notification posted to a feed's deliver_url
+type delivery struct {
+	Feed     string `json:"feed"`
+	ItemID   string `json:"item_id"`
+	Title    string `json:"title,omitempty"`
+	AudioURL string `json:"audio_url"` // Requires the same credentials as the rest of the API
+}
+
+type queuedItem struct {
+	feed *feed
+	item FeedItem
+}
+
+// FeedManager polls connectors and narrates new items one at a time
+type FeedManager struct {
+	audioDir  string
+	publicURL string
+	signer    *ManifestSigner
+	db        *Store
+	feeds     map[string]*feed
+	queue     chan queuedItem
+	s         *server // Set by start; items are screened, preprocessed and cached through it
+
+	mu         sync.Mutex
+	narrations map[string]*Narration
+	pending    map[string]bool
+}
+
+// NewFeedManager returns nil when no feeds are configured
+func NewFeedManager(cfg FeedsConfig, engines map[string]Engine, defaultEngine string, db *Store) (*FeedManager, error) {
+	if len(cfg.Sources) == 0 {
+		return nil, nil
+	}
+	if cfg.AudioDir == "" {
+		return nil, errors.New("feeds: audio_dir is required")
+	}
+	if err := os.MkdirAll(cfg.AudioDir, 0o755); err != nil {
+		return nil, err
+	}
+	signer, err := NewManifestSigner(cfg.ManifestKey)
+	if err != nil {
+		return nil, err
+	}
+	m := &FeedManager{
+		audioDir:   cfg.AudioDir,
+		publicURL:  strings.TrimSuffix(cfg.PublicURL, "/"),
+		signer:     signer,
+		db:         db,
+		feeds:      make(map[string]*feed),
+		queue:      make(chan queuedItem, 100),
+		narrations: make(map[string]*Narration),
+		pending:    make(map[string]bool),
+	}
+	for _, fc := range cfg.Sources {
+		if _, exists := m.feeds[fc.Name]; exists || fc.Name == "" {
+			return nil, fmt.Errorf("feed %q: names must be unique and non-empty", fc.Name)
+		}
+		engineName := fc.Engine
+		if engineName == "" {
+			engineName = defaultEngine
+		}
+		engine, exists := engines[engineName]
+		if !exists {
+			return nil, fmt.Errorf("feed %q: engine %q is not defined", fc.Name, engineName)
+		}
+		if fc.Interval <= 0 {
+			fc.Interval = Duration(5 * time.Minute)
+		}
+		if fc.Lang == "" {
+			fc.Lang = "en"
+		}
+		if fc.DeliverURL != "" && cfg.PublicURL == "" {
+			return nil, fmt.Errorf("feed %q: deliver_url requires feeds.public_url", fc.Name)
+		}
+		rules, err := compileEmailRules(fc.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("feed %q: %w", fc.Name, err)
+		}
+		f := &feed{cfg: fc, engine: engine, rules: rules}
+		switch fc.Type {
+		case "rss":
+			f.connector = &rssConnector{url: fc.URL}
+		case "s3":
+			f.connector = newS3Connector(fc)
+		case "imap":
+			if f.connector, err = newIMAPConnector(fc, rules); err != nil {
+				return nil, err
+			}
+		case "webhook", "email":
+			if fc.Secret == "" {
+				return nil, fmt.Errorf("feed %q: %s feeds require a secret", fc.Name, fc.Type)
+			}
+		default:
+			return nil, fmt.Errorf("feed %q: unknown type %q", fc.Name, fc.Type)
+		}
+		m.feeds[fc.Name] = f
+	}
+	err = db.forEach(bucketNarrations, func(key string, data []byte) error {
+		var n Narration
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("narration %s: %w", key, err)
+		}
+		m.narrations[key] = &n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func narrationID(feedName, itemID string) string {
+	sum := sha256.Sum256([]byte(feedName + "\x00" + itemID))
+	return hex.EncodeToString(sum[:12])
+}
+
+// start launches a poller per polled feed and the narration worker
+func (m *FeedManager) start(ctx context.Context, s *server) {
+	if m == nil {
+		return
+	}
+	m.s = s
+	for _, f := range m.feeds {
+		if f.connector != nil {
+			go m.poll(ctx, f)
+		}
+	}
+	go m.work(ctx)
+}
+
+func (m *FeedManager) poll(ctx context.Context, f *feed) {
+	ticker := time.NewTicker(time.Duration(f.cfg.Interval))
+	defer ticker.Stop()
+	for {
+		pollCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		items, err := f.connector.Poll(pollCtx)
+		cancel()
+		if err != nil {
+			slog.Warn("Feed poll failed", "feed", f.cfg.Name, "error", err)
+		}
+		for _, item := range items {
+			if maintenance.active() {
+				break // Picked up by a poll after maintenance
+			}
+			m.enqueue(f, item) // Items that do not fit are picked up by a later poll
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enqueue schedules an item unless it was already narrated or gave up; it
+// reports false when the queue is full
+func (m *FeedManager) enqueue(f *feed, item FeedItem) bool {
+	id := narrationID(f.cfg.Name, item.ID)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n, exists := m.narrations[id]; m.pending[id] || exists && (n.Error == "" || n.Attempts >= maxNarrationAttempts) {
+		return true
+	}
+	select {
+	case m.queue <- queuedItem{feed: f, item: item}:
+		m.pending[id] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// work narrates queued items one at a time, pausing while the audio volume is short of space
+func (m *FeedManager) work(ctx context.Context) {
+	for {
+		if diskGuard.low(m.audioDir) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case q := <-m.queue:
+			m.narrate(withQueuedJob(ctx), q.feed, q.item) // Queued before any maintenance began
+		}
+	}
+}
+
+// narrate synthesizes an item as AAC, the most widely playable format, and records the outcome
+func (m *FeedManager) narrate(ctx context.Context, f *feed, item FeedItem) {
+	id := narrationID(f.cfg.Name, item.ID)
+	lang := item.Lang
+	if lang == "" {
+		lang = f.cfg.Lang
+	}
+	m.mu.Lock()
+	n := &Narration{ID: id, Feed: f.cfg.Name, ItemID: item.ID}
+	if previous, exists := m.narrations[id]; exists {
+		n.Attempts = previous.Attempts
+	}
+	m.mu.Unlock()
+	n.Title = item.Title
+	n.Lang = lang
+	n.Engine = f.engine.Name()
+	n.Chars = len([]rune(item.Text))
+	n.Attempts++
+	n.Error = ""
+	n.Manifest = ""
+
+	tenant := f.cfg.Tenant
+	if tenant == "" {
+		tenant = anonymousTenant
+	}
+	synthCtx, cancel := context.WithTimeout(context.WithValue(ctx, principalContextKey, &principal{tenant: tenant}), 5*time.Minute)
+	text, err := m.s.screen(synthCtx, GuardrailInput{Text: item.Text, Lang: lang, Engine: f.engine.Name(), Source: "feed"})
+	if err == nil {
+		tp, _ := m.s.pipelineFor(tenant, "") // Tenants' pipelines are checked with the config
+		tp.lang, tp.normalize = lang, true
+		text, err = m.s.preprocess(tp, text, nil)
+	}
+	if errors.Is(err, errGuardrailDenied) || errors.Is(err, errProfanity) {
+		n.Attempts = maxNarrationAttempts // Rejected items are not retried
+	}
+	var audio []byte
+	if err == nil {
+		audio, _, err = getOrGenerateAudio(synthCtx, f.engine, text, lang, m.s.cache, AudioOptions{})
+	}
+	cancel()
+	if err == nil {
+		n.File = filepath.Join(f.cfg.Name, id+".aac")
+		n.Bytes = len(audio)
+		err = m.writeArtifact(n.File, audio)
+	}
+	if err == nil && m.signer != nil {
+		n.Manifest, err = m.signer.write(m, f, n, item.Text, audio)
+	}
+	if err != nil {
+		n.Error = err.Error()
+		slog.Warn("Narration failed", "feed", f.cfg.Name, "item_id", item.ID, "attempt", n.Attempts, "error", err)
+	} else if f.cfg.DeliverURL != "" {
+		m.deliver(ctx, f, n)
+	}
+	n.UpdatedAt = time.Now().UTC()
+
+	m.mu.Lock()
+	m.narrations[id] = n
+	delete(m.pending, id)
+	m.mu.Unlock()
+	if err := m.db.put(bucketNarrations, id, n); err != nil {
+		slog.Error("Failed to persist narration", "feed", f.cfg.Name, "error", err)
+	}
+}
+
+func (m *FeedManager) deliver(ctx context.Context, f *feed, n *Narration) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	err := postJSON(ctx, f.cfg.DeliverURL, delivery{
+		Feed:     n.Feed,
+		ItemID:   n.ItemID,
+		Title:    n.Title,
+		AudioURL: fmt.Sprintf("%s/v1/feeds/%s/items/%s/audio", m.publicURL, url.PathEscape(n.Feed), n.ID),
+	})
+	if err != nil {
+		slog.Warn("Narration delivery failed", "feed", f.cfg.Name, "item_id", n.ItemID, "error", err)
+	}
+}
+
+func (m *FeedManager) writeArtifact(file string, data []byte) error {
+	path := filepath.Join(m.audioDir, file)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// depth returns how many items wait to be narrated
+func (m *FeedManager) depth() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.queue)
+}
+
+// list returns a feed's narrations, newest first
+func (m *FeedManager) list(feedName string) []Narration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := []Narration{}
+	for _, n := range m.narrations {
+		if n.Feed == feedName {
+			result = append(result, *n)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UpdatedAt.After(result[j].UpdatedAt) })
+	return result
+}
+
+func (m *FeedManager) lookup(feedName, id string) (Narration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, exists := m.narrations[id]
+	if !exists || n.Feed != feedName {
+		return Narration{}, false
+	}
+	return *n, true
+}
+
+// feedFor resolves the {name} path value, writing a 404 when feeds are off or the feed is unknown
+func (s *server) feedFor(w http.ResponseWriter, r *http.Request) (*feed, bool) {
+	if s.feeds != nil {
+		if f, exists := s.feeds.feeds[r.PathValue("name")]; exists {
+			return f, true
+		}
+	}
+	writeError(w, r, http.StatusNotFound, codeNotFound, "Unknown feed")
+	return nil, false
+}
+
+// Accepts items pushed to a webhook feed. Requests are signed with the feed's
+// secret the same way signed API key requests are.
+func (s *server) handleFeedWebhook(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.feedFor(w, r)
+	if !ok {
+		return
+	}
+	switch f.cfg.Type {
+	case "email":
+		s.handleInboundEmail(w, r, f)
+		return
+	case "webhook":
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Feed does not accept pushed items")
+		return
+	}
+	err := verifyRequestSignature(r, f.cfg.Secret, time.Duration(s.cfg.Signing.MaxSkew))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeLimitError(w, r, codeBodyTooLarge, "Request body is too large", tooLarge.Limit)
+		return
+	} else if err != nil {
+		writeError(w, r, http.StatusUnauthorized, codeInvalidSignature, "Invalid request signature: "+err.Error())
+		return
+	}
+	var item FeedItem
+	if err := json.NewDecoder(r.Body).Decode(&item); err != nil || item.ID == "" || strings.TrimSpace(item.Text) == "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload: id and text are required")
+		return
+	}
+	s.acceptFeedItem(w, r, f, item)
+}
+
+// Accepts a message forwarded by an inbound email provider. Providers cannot
+// sign requests our way, so the feed secret is passed as a token in the URL.
+func (s *server) handleInboundEmail(w http.ResponseWriter, r *http.Request, f *feed) {
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(f.cfg.Secret)) != 1 {
+		writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "Invalid feed token")
+		return
+	}
+	msg, err := inboundEmail(r)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeLimitError(w, r, codeBodyTooLarge, "Request body is too large", tooLarge.Limit)
+		return
+	} else if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload: "+err.Error())
+		return
+	}
+	if !matchesEmailRules(f.rules, msg) || msg.Text == "" {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored"}) // 2xx so the provider does not retry
+		return
+	}
+	if msg.ID == "" {
+		msg.ID = textHash(msg.From+"\n"+msg.Subject+"\n"+msg.Text, "")
+	}
+	s.acceptFeedItem(w, r, f, msg.item())
+}
+
+func (s *server) acceptFeedItem(w http.ResponseWriter, r *http.Request, f *feed, item FeedItem) {
+	if maintenance.active() {
+		writeMaintenance(w, r)
+		return
+	}
+	if !s.feeds.enqueue(f, item) {
+		w.Header().Set("Retry-After", "60")
+		writeError(w, r, http.StatusServiceUnavailable, codeQueueFull, "Narration queue is full")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": narrationID(f.cfg.Name, item.ID)})
+}
+
+func (s *server) handleListNarrations(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.feedFor(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.feeds.list(f.cfg.Name))
+}
+
+func (s *server) handleNarrationAudio(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.feedFor(w, r)
+	if !ok {
+		return
+	}
+	n, exists := s.feeds.lookup(f.cfg.Name, r.PathValue("id"))
+	if !exists || n.File == "" || n.Error != "" {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No audio for this item")
+		return
+	}
+	w.Header().Set("Content-Type", "audio/aac")
+	http.ServeFile(w, r, filepath.Join(s.feeds.audioDir, n.File))
+}
+
+// rssConnector reads RSS 2.0 and Atom feeds
+type rssConnector struct {
+	url string
+}
+
+type rssDocument struct {
+	Items []struct {
+		GUID        string `xml:"guid"`
+		Link        string `xml:"link"`
+		Title       string `xml:"title"`
+		Description string `xml:"description"`
+		Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	} `xml:"channel>item"`
+	Language string `xml:"channel>language"`
+	Entries  []struct {
+		ID      string `xml:"id"`
+		Title   string `xml:"title"`
+		Summary string `xml:"summary"`
+		Content string `xml:"content"`
+	} `xml:"entry"`
+}
+
+func (c *rssConnector) Poll(ctx context.Context) ([]FeedItem, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", c.url, resp.Status)
+	}
+	var doc rssDocument
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 10<<20)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.url, err)
+	}
+
+	lang, _, _ := strings.Cut(doc.Language, "-") // "en-us" -> "en"
+	var items []FeedItem
+	add := func(id, title, body string) {
+		text := plainText(body)
+		if title = plainText(title); title != "" {
+			text = strings.TrimSpace(title + ". " + text)
+		}
+		if id != "" && text != "" {
+			items = append(items, FeedItem{ID: id, Title: title, Text: text, Lang: strings.ToLower(lang)})
+		}
+	}
+	for _, item := range doc.Items {
+		id := item.GUID
+		if id == "" {
+			id = item.Link
+		}
+		body := item.Content
+		if body == "" {
+			body = item.Description
+		}
+		add(id, item.Title, body)
+	}
+	for _, entry := range doc.Entries {
+		body := entry.Content
+		if body == "" {
+			body = entry.Summary
+		}
+		add(entry.ID, entry.Title, body)
+	}
+	return items, nil
+}
+
+// plainText strips HTML tags and entities and collapses whitespace
+func plainText(s string) string {
+	var b strings.Builder
+	inTag := false
+	for _, r := range s {
+		switch {
+		case r == '<':
+			inTag = true
+			b.WriteByte(' ')
+		case r == '>' && inTag:
+			inTag = false
+		case !inTag:
+			b.WriteRune(r)
+		}
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(b.String())), " ")
+}
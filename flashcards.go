@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Flashcard mode turns a deck's term list into media for Anki. The request
+// body is CSV or TSV with a term and an optional language per row; the
+// response is a zip holding one audio file per distinct term plus
+// mapping.txt, a tab-separated file Anki can import directly whose last
+// column is the [sound:...] tag for the term.
+
+// Rows accepted in one flashcard request
+const maxFlashcardRows = 1000
+
+// Terms synthesized at the same time for one request
+const flashcardConcurrency = 4
+
+type flashcard struct {
+	line   int
+	term   string
+	spoken string // term as the guardrail lets it through
+	lang   string
+	file   string
+}
+
+// flashcardFile names a term's audio after a hash of everything that affects
+// it, so re-running a deck yields the same names and Anki does not collect
+// duplicates in its media folder
+func flashcardFile(engine Engine, term, lang string) string {
+	sum := sha256.Sum256([]byte(engine.Name() + "\x00" + lang + "\x00" + term))
+	return "tts-" + hex.EncodeToString(sum[:16]) + ".aac"
+}
+
+// parseFlashcards reads term[,lang] rows. Tab-separated input is recognized by
+// its content type or by a tab in the first line; a leading "term" header row
+// is skipped.
+func parseFlashcards(r *http.Request, body []byte) ([][]string, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	firstLine, _, _ := bytes.Cut(body, []byte("\n"))
+	if mediaType == "text/tab-separated-values" || bytes.ContainsRune(firstLine, '\t') {
+		reader.Comma = '\t'
+		reader.LazyQuotes = true
+	}
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 && strings.EqualFold(strings.TrimSpace(rows[0][0]), "term") {
+		rows = rows[1:]
+	}
+	return rows, nil
+}
+
+func (s *server) handleFlashcards(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	rows, err := parseFlashcards(r, body)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if len(rows) == 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload: no terms")
+		return
+	}
+	if len(rows) > maxFlashcardRows {
+		writeLimitError(w, r, codeBodyTooLarge, fmt.Sprintf("Deck has %d rows", len(rows)), maxFlashcardRows)
+		return
+	}
+	engine, exists := s.engineFor(r.URL.Query().Get("engine"))
+	if !exists {
+		writeProblem(w, r, Problem{
+			Status:    http.StatusBadRequest,
+			Code:      codeUnknownEngine,
+			Detail:    "Invalid request: unknown engine",
+			Supported: s.engineNames(),
+		})
+		return
+	}
+	defaultLang := r.URL.Query().Get("lang")
+	if defaultLang == "" {
+		defaultLang = "en"
+	}
+
+	var cards []flashcard
+	var chars int64
+	var terms []string
+	for i, row := range rows {
+		line := i + 1
+		term := strings.TrimSpace(row[0])
+		if term == "" {
+			continue
+		}
+		lang := defaultLang
+		if len(row) > 1 && strings.TrimSpace(row[1]) != "" {
+			lang = strings.TrimSpace(row[1])
+		}
+		canonical, supported := s.canonicalLanguage(engine, lang)
+		if !supported {
+			writeError(w, r, http.StatusBadRequest, codeUnsupportedLanguage, fmt.Sprintf("Row %d: language %q is not supported by engine %q", line, lang, engine.Name()))
+			return
+		}
+		n := int64(utf8.RuneCountInString(term))
+		if s.cfg.MaxTextChars > 0 && n > int64(s.cfg.MaxTextChars) {
+			writeLimitError(w, r, codeTextTooLong, fmt.Sprintf("Row %d is %d characters long", line, n), int64(s.cfg.MaxTextChars))
+			return
+		}
+		spoken, err := s.screen(r.Context(), GuardrailInput{Text: term, Lang: canonical, Engine: engine.Name(), Source: "flashcards"})
+		if err != nil {
+			writeGuardrailError(w, r, err, "")
+			return
+		}
+		cards = append(cards, flashcard{line: line, term: term, spoken: spoken, lang: canonical, file: flashcardFile(engine, spoken, canonical)})
+		chars += n
+		terms = append(terms, term)
+	}
+	setRequestText(r.Context(), strings.Join(terms, "\n"))
+	p := principalFrom(r.Context())
+	if err := s.keys.charge(p.key, chars); err != nil {
+		writeQuotaError(w, r, err)
+		return
+	}
+
+	// Repeated terms share one file and are synthesized once
+	unique := make(map[string]flashcard)
+	for _, card := range cards {
+		unique[card.file] = card
+	}
+	audio := make(map[string][]byte, len(unique))
+	var mu sync.Mutex
+	var failed error
+	slots := make(chan struct{}, flashcardConcurrency)
+	var wg sync.WaitGroup
+	for file, card := range unique {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(file string, card flashcard) {
+			defer func() { <-slots; wg.Done() }()
+			data, cached, err := getOrGenerateAudio(r.Context(), engine, card.spoken, card.lang, s.cache, AudioOptions{})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed = fmt.Errorf("row %d: %w", card.line, err)
+				return
+			}
+			s.costs.record(engine.Name(), int64(utf8.RuneCountInString(card.spoken)), !cached)
+			audio[file] = data
+		}(file, card)
+	}
+	wg.Wait()
+	annotate(r.Context(), "engine", engine.Name(), "text_length", chars, "terms", len(cards), "files", len(unique))
+	if failed != nil {
+		annotate(r.Context(), "error", failed.Error())
+		s.keys.refund(p.key, chars)
+		s.writeSynthesisError(w, r, engine, failed)
+		return
+	}
+
+	var archive bytes.Buffer
+	if err := writeFlashcardZip(&archive, cards, audio); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to build archive")
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="flashcards.zip"`)
+	w.Write(archive.Bytes())
+}
+
+// writeFlashcardZip stores the audio files and mapping.txt. Audio is already
+// compressed, so entries are stored rather than deflated.
+func writeFlashcardZip(out io.Writer, cards []flashcard, audio map[string][]byte) error {
+	zw := zip.NewWriter(out)
+	for _, file := range sortedKeys(audio) {
+		entry, err := zw.CreateHeader(&zip.FileHeader{Name: file, Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if _, err := entry.Write(audio[file]); err != nil {
+			return err
+		}
+	}
+
+	mapping, err := zw.Create("mapping.txt")
+	if err != nil {
+		return err
+	}
+	// Anki reads these header lines instead of asking for the separator
+	fmt.Fprint(mapping, "#separator:tab\n#html:false\n#columns:Term\tLanguage\tAudio\n")
+	tsv := csv.NewWriter(mapping)
+	tsv.Comma = '\t'
+	for _, card := range cards {
+		tsv.Write([]string{card.term, card.lang, "[sound:" + card.file + "]"})
+	}
+	tsv.Flush()
+	if err := tsv.Error(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// audioFormat describes how ffmpeg produces one output format
+type audioFormat struct {
+	mimeType string
+	bitrate  string   // Default bitrate; empty for lossless formats, which ignore it
+	args     []string // Encoder and muxer arguments
+}
+
+// Output formats by request name. Opus suits browsers other than Safari,
+// AAC suits Safari and iOS, MP3 plays on nearly anything; WAV and FLAC are
+// lossless for pipelines that process the audio further. WAV is produced as
+// raw PCM and given its header afterwards, since ffmpeg cannot go back and
+// fill in the sizes when writing to a pipe. The G.711 formats are WAV as
+// well, at the 8 kHz mono that Twilio, Asterisk and FreeSWITCH play as is.
+var audioFormats = map[string]audioFormat{
+	"opus":  {"audio/ogg; codecs=opus", "16k", []string{"-c:a", "libopus", "-compression_level", "1", "-preset", "ultrafast", "-f", "opus"}},
+	"aac":   {"audio/aac", "64k", []string{"-c:a", "aac", "-f", "adts"}}, // Bit rate adjusted for compatibility
+	"mp3":   {"audio/mpeg", "64k", []string{"-c:a", "libmp3lame", "-f", "mp3"}},
+	"ogg":   {"audio/ogg; codecs=vorbis", "48k", []string{"-c:a", "libvorbis", "-f", "ogg"}},
+	"wav":   {"audio/wav", "", []string{"-f", "s16le"}},
+	"flac":  {"audio/flac", "", []string{"-c:a", "flac", "-f", "flac"}},
+	"mulaw": {"audio/wav", "", []string{"-f", "mulaw"}},
+	"alaw":  {"audio/wav", "", []string{"-f", "alaw"}},
+}
+
+// WAV format tags of the G.711 formats, which are always 8 kHz mono
+var g711Tags = map[string]uint16{"mulaw": 7, "alaw": 6}
+
+// audioFormatNames lists the formats in the order documented in the schemas
+var audioFormatNames = []string{"opus", "mp3", "ogg", "wav", "aac", "flac", "mulaw", "alaw"}
+
+const g711SampleRate = 8000
+
+// Sample rate of encoded output, unless a request picks one of outputSampleRates
+const outputSampleRate = 16000
+
+// Rates telephony (8k), ASR (16k), and media pipelines (24k, 48k) expect;
+// every output format can encode all of them
+var outputSampleRates = []int{8000, 16000, 24000, 48000}
+
+// defaultFormat keeps the historical choice: Opus, or AAC for Safari, which cannot play Opus
+func defaultFormat(userAgent string) string {
+	if isSafari(userAgent) {
+		return "aac"
+	}
+	return "opus"
+}
+
+// writeG711WAV writes a WAV header for 8 kHz mono G.711 samples, followed by
+// them. Non-PCM WAV carries an 18-byte fmt chunk and a fact chunk with the
+// sample count, which stricter players require.
+func writeG711WAV(w io.Writer, samples []byte, tag uint16) error {
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, uint32(50 + len(samples)), [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(18), tag, uint16(1), // One channel
+		uint32(g711SampleRate), uint32(g711SampleRate), uint16(1), uint16(8), uint16(0), // Byte rate, block align, bits per sample, no extension
+		[4]byte{'f', 'a', 'c', 't'}, uint32(4), uint32(len(samples)),
+		[4]byte{'d', 'a', 't', 'a'}, uint32(len(samples)),
+	}
+	for _, field := range header {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(samples)
+	return err
+}
@@ -3,7 +3,12 @@ module gtts-service
 go 1.22.4
 
 require (
-	github.com/json-iterator/go v1.1.12 // indirect
+	github.com/json-iterator/go v1.1.12
+	go.etcd.io/bbolt v1.3.11
+)
+
+require (
 	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 )
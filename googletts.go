@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// POST /v1/text:synthesize is shaped like Google Cloud Text-to-Speech, so
+// apps written against it can use this server for development and testing.
+// API keys are taken from the key query parameter or X-Goog-Api-Key, as
+// Google's clients send them. The request runs through handleSpeak as a
+// /v1/speak request:
+//
+//	input.text, input.ssml            text, ssml
+//	voice.languageCode                lang
+//	voice.name                        engine, when it names one; ignored otherwise
+//	audioConfig.audioEncoding         LINEAR16 (WAV), MP3, OGG_OPUS, MULAW or ALAW; MP3 when omitted
+//	audioConfig.speakingRate          speed
+//	audioConfig.pitch                 pitch, in semitones as in Google's API
+//	audioConfig.volumeGainDb          gain_db
+//	audioConfig.sampleRateHertz       sample_rate
+//
+// The audio is returned as base64 audioContent. Errors use Google's shape,
+// with the gRPC status Google would have answered (see grpc.go).
+
+var googleAudioEncodings = map[string]string{"LINEAR16": "wav", "MP3": "mp3", "OGG_OPUS": "opus", "MULAW": "mulaw", "ALAW": "alaw"}
+
+var googleAudioEncodingNames = []string{"LINEAR16", "MP3", "OGG_OPUS", "MULAW", "ALAW"}
+
+// googleStatuses names gRPC status codes as Google's JSON errors do
+var googleStatuses = map[int]string{
+	grpcCanceled: "CANCELLED", grpcInvalidArgument: "INVALID_ARGUMENT", grpcDeadlineExceeded: "DEADLINE_EXCEEDED",
+	grpcNotFound: "NOT_FOUND", grpcPermissionDenied: "PERMISSION_DENIED", grpcResourceExhausted: "RESOURCE_EXHAUSTED",
+	grpcFailedPrecondition: "FAILED_PRECONDITION", grpcUnimplemented: "UNIMPLEMENTED", grpcInternal: "INTERNAL",
+	grpcUnavailable: "UNAVAILABLE", grpcUnauthenticated: "UNAUTHENTICATED",
+}
+
+type GoogleSynthesizeRequest struct {
+	Input struct {
+		Text string `json:"text"`
+		SSML string `json:"ssml"`
+	} `json:"input"`
+	Voice struct {
+		LanguageCode string `json:"languageCode"`
+		Name         string `json:"name"`
+		SSMLGender   string `json:"ssmlGender"` // Ignored
+	} `json:"voice"`
+	AudioConfig struct {
+		AudioEncoding   string  `json:"audioEncoding"`
+		SpeakingRate    float64 `json:"speakingRate"`
+		Pitch           float64 `json:"pitch"`
+		VolumeGainDB    float64 `json:"volumeGainDb"`
+		SampleRateHertz int     `json:"sampleRateHertz"`
+	} `json:"audioConfig"`
+}
+
+type GoogleSynthesizeResponse struct {
+	AudioContent string `json:"audioContent"` // Base64 encoded audio
+}
+
+type GoogleErrorResponse struct {
+	Error GoogleError `json:"error"`
+}
+
+type GoogleError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+// writeGoogleError answers problem in Google's error shape
+func writeGoogleError(w http.ResponseWriter, r *http.Request, problem *Problem) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(GoogleErrorResponse{Error: GoogleError{Code: problem.Status, Message: problem.Detail, Status: googleStatuses[grpcCode(problem.Status)]}})
+}
+
+// apiKeyFromGoogle moves an API key sent the way Google's clients send it to
+// X-API-Key before authentication
+func apiKeyFromGoogle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") == "" {
+			if key := r.Header.Get("X-Goog-Api-Key"); key != "" {
+				r.Header.Set("X-API-Key", key)
+			} else if key := r.URL.Query().Get("key"); key != "" {
+				r.Header.Set("X-API-Key", key)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) handleGoogleSynthesize(w http.ResponseWriter, r *http.Request) {
+	var req GoogleSynthesizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if strings.TrimSpace(req.Input.Text) == "" && strings.TrimSpace(req.Input.SSML) == "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: input.text or input.ssml is required", Pointer: "/text"})
+		return
+	}
+	if req.Voice.LanguageCode == "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: voice.languageCode is required", Pointer: "/lang"})
+		return
+	}
+	encoding := req.AudioConfig.AudioEncoding
+	if encoding == "" || encoding == "AUDIO_ENCODING_UNSPECIFIED" {
+		encoding = "MP3"
+	}
+	format, ok := googleAudioEncodings[encoding]
+	if !ok {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: unsupported audioConfig.audioEncoding", Pointer: "/format", Supported: googleAudioEncodingNames})
+		return
+	}
+	payload := RequestPayload{
+		Text:       req.Input.Text,
+		SSML:       req.Input.SSML,
+		Lang:       req.Voice.LanguageCode,
+		Format:     format,
+		Speed:      req.AudioConfig.SpeakingRate,
+		Pitch:      req.AudioConfig.Pitch,
+		GainDB:     req.AudioConfig.VolumeGainDB,
+		SampleRate: req.AudioConfig.SampleRateHertz,
+	}
+	if _, exists := s.engineFor(req.Voice.Name); exists && req.Voice.Name != "" {
+		payload.Engine = req.Voice.Name
+	}
+	payload.Lang = s.baseLanguage(payload.Engine, payload.Lang)
+	speakReq, err := speakRequest(r, payload)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to build the speak request")
+		return
+	}
+
+	rec := &jobRecorder{header: make(http.Header), status: http.StatusOK}
+	s.handleSpeak(rec, speakReq)
+	if rec.status != http.StatusOK {
+		rec.replay(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, GoogleSynthesizeResponse{AudioContent: base64.StdEncoding.EncodeToString(rec.body.Bytes())})
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The gRPC API (proto/tts/v1/tts.proto) is served on grpc.addr, next to the
+// HTTP API, for backends that prefer typed clients and streaming. It is
+// plain gRPC over HTTP/2, spoken by net/http rather than a gRPC library:
+// messages are length-prefixed protobuf, decoded and encoded by the few
+// helpers below, and the status travels in the grpc-status trailer. Go's
+// server speaks HTTP/2 only over TLS, so the port needs a certificate.
+// Requests run through handleSpeak like jobs do, behind the same
+// authentication and rate limits as /v1/speak; its problems become gRPC
+// statuses. Compressed messages are not supported, and messages longer than
+// max_body_bytes (maxGRPCMessageBytes when it is 0) are refused before they
+// are read.
+
+type GRPCConfig struct {
+	Addr     string `json:"addr"`      // Listen address of the gRPC API, e.g. ":9090"; empty disables it
+	CertFile string `json:"cert_file"` // PEM certificate chain
+	KeyFile  string `json:"key_file"`  // PEM private key
+}
+
+// Longest message accepted when max_body_bytes does not limit it, as in gRPC's own servers
+const maxGRPCMessageBytes = 4 << 20
+
+var errGRPCMessageTooLarge = errors.New("message is larger than the server accepts")
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcCode maps the HTTP status of a problem to a gRPC status code
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusPaymentRequired, http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusUnprocessableEntity, http.StatusConflict:
+		return grpcFailedPrecondition
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	}
+	return grpcInternal
+}
+
+func (s *server) grpcRoutes() *http.ServeMux {
+	protect := func(h http.Handler) http.Handler { return grpcErrors(s.limiter.middleware(s.authenticate(h))) }
+	mux := http.NewServeMux()
+	mux.Handle("POST /tts.v1.Synthesizer/Synthesize", protect(s.handleGRPCSynthesize(false)))
+	mux.Handle("POST /tts.v1.Synthesizer/SynthesizeStream", protect(s.handleGRPCSynthesize(true)))
+	return mux
+}
+
+// SynthesizeRequest mirrors the proto message
+type SynthesizeRequest struct {
+	Text, SSML, Lang, Engine, Format, TLD string
+	Speed, Pitch                          float64
+	Slow                                  bool
+}
+
+func (s *server) handleGRPCSynthesize(stream bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			writeError(w, r, http.StatusUnsupportedMediaType, codeInvalidPayload, "Expected application/grpc")
+			return
+		}
+		if encoding := r.Header.Get("Grpc-Encoding"); encoding != "" && encoding != "identity" {
+			writeGRPCStatus(w, grpcUnimplemented, "compressed messages are not supported")
+			return
+		}
+		limit := s.cfg.MaxBodyBytes
+		if limit <= 0 {
+			limit = maxGRPCMessageBytes
+		}
+		data, err := readGRPCMessage(r.Body, limit)
+		if errors.Is(err, errGRPCMessageTooLarge) {
+			writeGRPCStatus(w, grpcResourceExhausted, err.Error())
+			return
+		} else if err != nil {
+			writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		req, err := decodeSynthesizeRequest(data)
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalidArgument, "invalid SynthesizeRequest: "+err.Error())
+			return
+		}
+		body, err := json.Marshal(RequestPayload{Text: req.Text, SSML: req.SSML, Lang: req.Lang, Engine: req.Engine, Format: req.Format, Speed: req.Speed, Pitch: req.Pitch, TLD: req.TLD, Slow: req.Slow})
+		if err != nil {
+			writeGRPCStatus(w, grpcInternal, err.Error())
+			return
+		}
+
+		timeout := speakEventsTimeout
+		if deadline, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok {
+			timeout = min(timeout, deadline)
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		speakReq := r.Clone(ctx)
+		speakReq.Header.Set("Content-Type", "application/json")
+		updates, progress := s.startSpeak(ctx, speakReq, body)
+
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Now().Add(timeout))
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		send := func(message []byte) {
+			writeGRPCMessage(w, message)
+			rc.Flush()
+		}
+		order := pieceOrder{pending: make(map[int][]byte)}
+		for {
+			var update speakUpdate
+			select {
+			case update = <-updates:
+			case <-ctx.Done():
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					setGRPCStatus(w, grpcDeadlineExceeded, "synthesis took too long")
+				} else {
+					setGRPCStatus(w, grpcCanceled, "canceled")
+				}
+				return
+			}
+			if rec := update.rec; rec != nil {
+				if rec.status != http.StatusOK {
+					problem := rec.problem()
+					setGRPCStatus(w, grpcCode(problem.Status), problem.Detail)
+					return
+				}
+				contentType := rec.header.Get("Content-Type")
+				if stream {
+					send(encodeAudioChunk(rec.body.Bytes(), contentType, order.next, int(progress.total.Load()), true))
+				} else {
+					send(encodeSynthesizeResponse(rec.body.Bytes(), contentType))
+				}
+				setGRPCStatus(w, grpcOK, "")
+				return
+			}
+			if stream && update.pcm != nil {
+				order.add(update.piece, update.pcm, func(index int, wav []byte) {
+					send(encodeAudioChunk(wav, "audio/wav", index, int(progress.total.Load()), false))
+				})
+			}
+		}
+	}
+}
+
+// writeGRPCStatus ends a call that sent no messages
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+	setGRPCStatus(w, code, message)
+}
+
+// setGRPCStatus sets the trailers that end a call
+func setGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(message))
+	}
+}
+
+// grpcPercentEncode escapes what the grpc-message trailer cannot carry
+func grpcPercentEncode(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseGRPCTimeout reads a grpc-timeout header such as "500m" or "10S"
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	unit := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}[value[len(value)-1]]
+	if unit == 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// grpcErrors turns the problems of the middleware in front of a gRPC
+// handler, such as a failed authentication, into gRPC statuses
+func grpcErrors(next http.Handler) http.Handler {
+	return rewriteProblems(next, func(w http.ResponseWriter, r *http.Request, problem *Problem) {
+		writeGRPCStatus(w, grpcCode(problem.Status), problem.Detail)
+	})
+}
+
+// readGRPCMessage reads the one message of a unary or server-streaming call,
+// checking its length against limit before allocating it
+func readGRPCMessage(r io.Reader, limit int64) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("reading message: %w", err)
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if int64(size) > limit {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d", errGRPCMessageTooLarge, size, limit)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("reading message: %w", err)
+	}
+	return data, nil
+}
+
+func writeGRPCMessage(w io.Writer, message []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(message)
+	return err
+}
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func decodeSynthesizeRequest(data []byte) (SynthesizeRequest, error) {
+	var req SynthesizeRequest
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return req, errors.New("truncated field key")
+		}
+		data = data[n:]
+		field, wire := key>>3, key&7
+		var value []byte
+		var number uint64
+		switch wire {
+		case wireVarint:
+			if number, n = binary.Uvarint(data); n <= 0 {
+				return req, errors.New("truncated varint")
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return req, errors.New("truncated fixed64")
+			}
+			number, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return req, errors.New("truncated fixed32")
+			}
+			number, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return req, errors.New("truncated length-delimited field")
+			}
+			value, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			return req, fmt.Errorf("unsupported wire type %d", wire)
+		}
+		switch {
+		case field == 1 && wire == wireBytes:
+			req.Text = string(value)
+		case field == 2 && wire == wireBytes:
+			req.SSML = string(value)
+		case field == 3 && wire == wireBytes:
+			req.Lang = string(value)
+		case field == 4 && wire == wireBytes:
+			req.Engine = string(value)
+		case field == 5 && wire == wireBytes:
+			req.Format = string(value)
+		case field == 6 && wire == wireFixed64:
+			req.Speed = math.Float64frombits(number)
+		case field == 7 && wire == wireFixed64:
+			req.Pitch = math.Float64frombits(number)
+		case field == 8 && wire == wireBytes:
+			req.TLD = string(value)
+		case field == 9 && wire == wireVarint:
+			req.Slow = number != 0
+		}
+	}
+	return req, nil
+}
+
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	if len(value) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendProtoVarint(b []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireVarint)
+	return binary.AppendUvarint(b, value)
+}
+
+func encodeSynthesizeResponse(audio []byte, contentType string) []byte {
+	b := appendProtoBytes(nil, 1, audio)
+	return appendProtoBytes(b, 2, []byte(contentType))
+}
+
+func encodeAudioChunk(audio []byte, contentType string, index, chunks int, final bool) []byte {
+	b := appendProtoBytes(nil, 1, audio)
+	b = appendProtoBytes(b, 2, []byte(contentType))
+	b = appendProtoVarint(b, 3, uint64(index))
+	b = appendProtoVarint(b, 4, uint64(chunks))
+	if final {
+		b = appendProtoVarint(b, 5, 1)
+	}
+	return b
+}
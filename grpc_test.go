@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReadGRPCMessageRefusesOversizedLength(t *testing.T) {
+	// Only the prefix is sent: the length must be refused before the body is awaited or allocated
+	prefix := []byte{0, 0xff, 0xff, 0xff, 0xff}
+	if _, err := readGRPCMessage(bytes.NewReader(prefix), 64<<10); !errors.Is(err, errGRPCMessageTooLarge) {
+		t.Fatalf("readGRPCMessage() error = %v, want errGRPCMessageTooLarge", err)
+	}
+
+	srv, err := newServer(defaultConfig())
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/tts.v1.Synthesizer/Synthesize", bytes.NewReader(prefix))
+	req.Header.Set("Content-Type", "application/grpc")
+	rec := httptest.NewRecorder()
+	srv.grpcRoutes().ServeHTTP(rec, req)
+	if got := rec.Result().Trailer.Get("Grpc-Status"); got != strconv.Itoa(grpcResourceExhausted) {
+		t.Errorf("grpc-status = %q, want %d (RESOURCE_EXHAUSTED)", got, grpcResourceExhausted)
+	}
+}
+
+func TestGRPCMessageFraming(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeGRPCMessage(&buf, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.Bytes(), []byte{0, 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}; !bytes.Equal(got, want) {
+		t.Fatalf("writeGRPCMessage wrote % x, want % x", got, want)
+	}
+	if got, err := readGRPCMessage(&buf, 64); err != nil || string(got) != "hello" {
+		t.Fatalf("readGRPCMessage() = %q, %v, want hello", got, err)
+	}
+
+	for name, framed := range map[string][]byte{
+		"compressed":     {1, 0, 0, 0, 1, 'x'},
+		"short prefix":   {0, 0, 0},
+		"short message":  {0, 0, 0, 0, 5, 'x'},
+		"empty stream":   {},
+		"over the limit": {0, 0, 0, 0, 65},
+	} {
+		if _, err := readGRPCMessage(bytes.NewReader(framed), 64); err == nil {
+			t.Errorf("%s: readGRPCMessage succeeded, want an error", name)
+		}
+	}
+}
+
+func TestDecodeSynthesizeRequest(t *testing.T) {
+	appendFixed64 := func(b []byte, field int, value float64) []byte {
+		b = binary.AppendUvarint(b, uint64(field)<<3|wireFixed64)
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(value))
+	}
+	var msg []byte
+	msg = appendProtoBytes(msg, 1, []byte("Hello"))
+	msg = appendProtoBytes(msg, 3, []byte("en"))
+	msg = appendProtoBytes(msg, 4, []byte("gtts"))
+	msg = appendProtoBytes(msg, 5, []byte("mp3"))
+	msg = appendFixed64(msg, 6, 1.25)
+	msg = appendFixed64(msg, 7, -2)
+	msg = appendProtoBytes(msg, 8, []byte("co.uk"))
+	msg = appendProtoVarint(msg, 9, 1)
+	// Fields from a newer schema are skipped, whatever their wire type
+	msg = appendProtoVarint(msg, 20, 300)
+	msg = appendProtoBytes(msg, 21, []byte("future"))
+	msg = binary.LittleEndian.AppendUint32(binary.AppendUvarint(msg, 22<<3|wireFixed32), 7)
+	msg = appendFixed64(msg, 23, 3)
+	// A field with the wrong wire type is ignored rather than misread
+	msg = appendProtoVarint(msg, 1, 5)
+
+	got, err := decodeSynthesizeRequest(msg)
+	if err != nil {
+		t.Fatalf("decodeSynthesizeRequest: %v", err)
+	}
+	want := SynthesizeRequest{Text: "Hello", Lang: "en", Engine: "gtts", Format: "mp3", TLD: "co.uk", Speed: 1.25, Pitch: -2, Slow: true}
+	if got != want {
+		t.Errorf("decodeSynthesizeRequest() = %+v, want %+v", got, want)
+	}
+	if got, err := decodeSynthesizeRequest(nil); err != nil || got != (SynthesizeRequest{}) {
+		t.Errorf("decodeSynthesizeRequest(empty) = %+v, %v, want the zero request", got, err)
+	}
+
+	for name, data := range map[string][]byte{
+		"truncated key":     {0x80},
+		"truncated varint":  {9 << 3, 0x80},
+		"truncated fixed64": {6<<3 | wireFixed64, 0, 0, 0},
+		"truncated fixed32": {22<<3 | wireFixed32, 0},
+		"truncated bytes":   {1<<3 | wireBytes, 5, 'a'},
+		"huge length":       {1<<3 | wireBytes, 0xff, 0xff, 0xff, 0xff, 0x0f},
+		"group":             {1<<3 | 3},
+	} {
+		if _, err := decodeSynthesizeRequest(data); err == nil {
+			t.Errorf("%s: decodeSynthesizeRequest succeeded, want an error", name)
+		}
+	}
+}
+
+func TestGRPCSynthesizeErrors(t *testing.T) {
+	srv, err := newServer(defaultConfig())
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	frame := func(message []byte) []byte {
+		var buf bytes.Buffer
+		writeGRPCMessage(&buf, message)
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        []byte
+		wantStatus  int
+	}{
+		{"malformed message", "application/grpc", "", frame([]byte{0x80}), grpcInvalidArgument},
+		{"missing lang", "application/grpc+proto", "", frame(appendProtoBytes(nil, 1, []byte("Hello"))), grpcInvalidArgument},
+		{"truncated frame", "application/grpc", "", []byte{0, 0, 0, 0, 9, 1}, grpcInvalidArgument},
+		{"compressed", "application/grpc", "gzip", frame(nil), grpcUnimplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/tts.v1.Synthesizer/Synthesize", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.encoding != "" {
+				req.Header.Set("Grpc-Encoding", tt.encoding)
+			}
+			rec := httptest.NewRecorder()
+			srv.grpcRoutes().ServeHTTP(rec, req)
+			result := rec.Result()
+			if got := result.Trailer.Get("Grpc-Status"); got != strconv.Itoa(tt.wantStatus) {
+				t.Errorf("grpc-status = %q (%s), want %d", got, result.Trailer.Get("Grpc-Message"), tt.wantStatus)
+			}
+			if result.StatusCode != http.StatusOK || result.Header.Get("Content-Type") != "application/grpc" {
+				t.Errorf("response %d %s, want 200 application/grpc", result.StatusCode, result.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestGRPCPercentEncode(t *testing.T) {
+	if got, want := grpcPercentEncode("100% done\nnaïve"), "100%25 done%0Ana%C3%AFve"; got != want {
+		t.Errorf("grpcPercentEncode() = %q, want %q", got, want)
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"500m", 500 * time.Millisecond, true},
+		{"10S", 10 * time.Second, true},
+		{"1H", time.Hour, true},
+		{"20u", 20 * time.Microsecond, true},
+		{"5", 0, false},
+		{"5s", 0, false},
+		{"-1S", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := parseGRPCTimeout(tt.value); got != tt.want || ok != tt.ok {
+			t.Errorf("parseGRPCTimeout(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Operators can put a content policy in front of synthesis, e.g. to refuse
+// phone scam scripts: every text is first given to a Guardrail, which allows
+// it, denies it (422 content_policy) or returns a modified text to speak
+// instead. The built-in guardrail calls out to an HTTP classifier; other
+// implementations, such as an in-process WASM module, only need to satisfy
+// the interface. Every decision is logged. A classifier that cannot be
+// reached fails the request with 503, unless fail_open lets the text through.
+//
+// Guardrails see text as sent, before the preprocessing pipeline (see
+// pipeline.go), wherever text is synthesized: /v1/speak and everything built
+// on it (jobs, speak events and the Google, Polly, OpenAI and MaryTTS
+// compatible endpoints), read-aloud chunks, streaming sessions, /v1/realtime
+// and the OpenAI realtime socket, a sentence at a time, flashcard terms,
+// TwiML, Slack and Teams clips, and feed items, whose denials are recorded on
+// the narration and not retried.
+
+const defaultGuardrailTimeout = 2 * time.Second
+
+const (
+	guardrailAllow  = "allow"
+	guardrailDeny   = "deny"
+	guardrailModify = "modify"
+)
+
+var (
+	errGuardrailDenied      = errors.New("text was denied by the content policy")
+	errGuardrailUnavailable = errors.New("content policy check failed")
+)
+
+type GuardrailConfig struct {
+	URL      string   `json:"url"`       // Classifier endpoint; empty disables the guardrail
+	Token    string   `json:"token"`     // Sent as a bearer token
+	Timeout  Duration `json:"timeout"`   // Per check
+	FailOpen bool     `json:"fail_open"` // Allow texts when the classifier fails, instead of rejecting them
+}
+
+// GuardrailInput is what a guardrail is asked about; also the callout's body
+type GuardrailInput struct {
+	Text   string `json:"text"`
+	SSML   bool   `json:"ssml,omitempty"`
+	Lang   string `json:"lang"`
+	Engine string `json:"engine"`
+	Tenant string `json:"tenant,omitempty"`
+	Source string `json:"source"` // speak, readaloud, session, realtime, openai_realtime, flashcards, twilio, chat or feed
+}
+
+// GuardrailDecision is a guardrail's verdict; also the callout's response
+type GuardrailDecision struct {
+	Decision string `json:"decision"`         // allow, deny or modify
+	Text     string `json:"text,omitempty"`   // Replacement text, for modify
+	Reason   string `json:"reason,omitempty"` // Logged, and returned to the client on deny
+}
+
+// Guardrail screens texts before they are synthesized
+type Guardrail interface {
+	Check(ctx context.Context, in GuardrailInput) (GuardrailDecision, error)
+}
+
+// httpGuardrail POSTs each input as JSON and expects a decision back
+type httpGuardrail struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewGuardrail returns the configured guardrail, or nil when there is none
+func NewGuardrail(cfg GuardrailConfig) Guardrail {
+	if cfg.URL == "" {
+		return nil
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = defaultGuardrailTimeout
+	}
+	return &httpGuardrail{url: cfg.URL, token: cfg.Token, client: &http.Client{Timeout: timeout}}
+}
+
+func (g *httpGuardrail) Check(ctx context.Context, in GuardrailInput) (GuardrailDecision, error) {
+	var decision GuardrailDecision
+	body, err := json.Marshal(in)
+	if err != nil {
+		return decision, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.url, bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", requestIDFrom(ctx))
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return decision, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decision, fmt.Errorf("classifier returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&decision); err != nil {
+		return decision, fmt.Errorf("classifier response: %w", err)
+	}
+	return decision, nil
+}
+
+// screen runs in through the guardrail, returning the text to speak; errors
+// wrap errGuardrailDenied or errGuardrailUnavailable
+func (s *server) screen(ctx context.Context, in GuardrailInput) (string, error) {
+	if s.guardrail == nil || in.Text == "" {
+		return in.Text, nil
+	}
+	in.Tenant = principalFrom(ctx).tenant
+	ctx, span := startSpan(ctx, "guardrail.check", "tts.source", in.Source)
+	decision, err := s.guardrail.Check(ctx, in)
+	if err == nil && decision.Decision != guardrailAllow && decision.Decision != guardrailDeny && decision.Decision != guardrailModify {
+		err = fmt.Errorf("classifier returned unknown decision %q", decision.Decision)
+	}
+	span.end(err)
+	if err != nil {
+		slog.Warn("Guardrail check failed", "request_id", requestIDFrom(ctx), "source", in.Source, "fail_open", s.cfg.Guardrail.FailOpen, "error", err)
+		if s.cfg.Guardrail.FailOpen {
+			return in.Text, nil
+		}
+		return "", fmt.Errorf("%w: %v", errGuardrailUnavailable, err)
+	}
+	slog.Info("Guardrail decision", "request_id", requestIDFrom(ctx), "tenant", in.Tenant, "source", in.Source, "engine", in.Engine, "lang", in.Lang, "decision", decision.Decision, "reason", decision.Reason)
+	annotate(ctx, "guardrail", decision.Decision)
+	switch decision.Decision {
+	case guardrailDeny:
+		if decision.Reason != "" {
+			return "", fmt.Errorf("%w: %s", errGuardrailDenied, decision.Reason)
+		}
+		return "", errGuardrailDenied
+	case guardrailModify:
+		return decision.Text, nil
+	}
+	return in.Text, nil
+}
+
+// writeGuardrailError reports a failed screen for the field at pointer
+func writeGuardrailError(w http.ResponseWriter, r *http.Request, err error, pointer string) {
+	if errors.Is(err, errGuardrailDenied) {
+		writeProblem(w, r, Problem{Status: http.StatusUnprocessableEntity, Code: codeContentPolicy, Detail: "Text was denied by the content policy" + guardrailReason(err), Pointer: pointer})
+		return
+	}
+	w.Header().Set("Retry-After", "5")
+	writeError(w, r, http.StatusServiceUnavailable, codeGuardrailUnavailable, "The content policy check is unavailable; try again later")
+}
+
+// guardrailReason returns ": reason" for denials that carry one
+func guardrailReason(err error) string {
+	if msg, prefix := err.Error(), errGuardrailDenied.Error(); len(msg) > len(prefix) {
+		return msg[len(prefix):]
+	}
+	return ""
+}
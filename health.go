@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Probes for orchestrators. /healthz only says the process is serving;
+// /readyz also checks that the binaries synthesis depends on can be run.
+
+// How long a readiness result is reused, so frequent probes do not keep
+// spawning subprocesses
+const readinessTTL = 15 * time.Second
+
+type ReadinessReport struct {
+	Status string            `json:"status"` // "ok" or "unavailable"
+	Checks map[string]string `json:"checks"` // Check name -> "ok" or the failure
+}
+
+type readiness struct {
+	mu      sync.Mutex
+	checked time.Time
+	report  ReadinessReport
+}
+
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := s.readiness.get(r.Context(), s)
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func (rd *readiness) get(ctx context.Context, s *server) ReadinessReport {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if time.Since(rd.checked) < readinessTTL {
+		return rd.report
+	}
+	rd.report = s.checkReadiness(ctx)
+	rd.checked = time.Now()
+	return rd.report
+}
+
+// checkReadiness runs every binary the configured engines and the transcoder
+// need; replicas, which never synthesize, only need the shared cache
+func (s *server) checkReadiness(ctx context.Context) ReadinessReport {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	commands := make(map[string][]string)
+	if !s.cfg.Replica {
+		commands["ffmpeg"] = []string{"ffmpeg", "-version"}
+		for _, engine := range s.engines {
+			switch engine := engine.(type) {
+			case *gttsEngine:
+				commands["gtts-cli"] = []string{"gtts-cli", "--help"}
+			case *commandEngine:
+				commands[engine.argv[0]] = nil // Arbitrary commands cannot be run safely, so only look them up
+			}
+		}
+	}
+
+	report := ReadinessReport{Status: "ok", Checks: make(map[string]string)}
+	fail := func(check, reason string) {
+		report.Status = "unavailable"
+		report.Checks[check] = reason
+	}
+	for name, argv := range commands {
+		if _, err := exec.LookPath(name); err != nil {
+			fail(name, err.Error())
+			continue
+		}
+		if argv != nil {
+			if err := exec.CommandContext(ctx, argv[0], argv[1:]...).Run(); err != nil {
+				fail(name, err.Error())
+				continue
+			}
+		}
+		report.Checks[name] = "ok"
+	}
+	if s.cache == nil {
+		fail("cache", "not initialized")
+	} else {
+		report.Checks["cache"] = "ok"
+	}
+	if s.upstream != nil {
+		if err := s.upstream.healthy(ctx); err != nil {
+			fail("upstream", err.Error())
+		} else {
+			report.Checks["upstream"] = "ok"
+		}
+	}
+	if s.work != nil {
+		if err := s.work.ping(ctx); err != nil {
+			fail("redis", err.Error())
+		} else {
+			report.Checks["redis"] = "ok"
+		}
+	}
+	for name, engine := range s.engines {
+		if engine, ok := engine.(*commandEngine); ok && engine.models != nil && !s.cfg.Replica {
+			if err := engine.models.ready(); err != nil {
+				fail("models/"+name, err.Error())
+			} else {
+				report.Checks["models/"+name] = "ok"
+			}
+		}
+	}
+	if dir := s.cfg.SharedCache.Dir; dir != "" {
+		if _, err := os.ReadDir(dir); err != nil {
+			fail("shared_cache", err.Error())
+		} else {
+			report.Checks["shared_cache"] = "ok"
+		}
+	}
+	return report
+}
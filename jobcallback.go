@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Clients that would rather not poll pass ?callback_url= when creating a job:
+// once the job finishes, its status (the body of GET /v1/jobs/{id}) is
+// POSTed there. Callbacks are signed like client requests (see signing.go),
+// with X-Timestamp and X-Signature covering the callback URL's path and
+// query, using a secret generated for the job and returned only in the
+// creation response. Failed deliveries are retried with exponential backoff;
+// result_url is absolute when jobs.public_url is set.
+//
+// Whoever creates a job picks the URL, so callbacks only go to public
+// addresses, checked on the address actually dialed so a DNS name cannot
+// point inside the network, and redirects are not followed. Operators whose
+// receivers are on their own network set jobs.private_callbacks.
+
+const (
+	jobCallbackAttempts = 6
+	jobCallbackBackoff  = 2 * time.Second // Doubled after each failed attempt
+	jobCallbackTimeout  = 10 * time.Second
+)
+
+type JobsConfig struct {
+	PublicURL        string `json:"public_url"`        // Base URL of this service, e.g. https://tts.example.com, for result links in callbacks
+	PrivateCallbacks bool   `json:"private_callbacks"` // Allow callbacks to loopback, private and link-local addresses
+}
+
+// Ranges that are not reachable on the internet beyond what net.IP reports:
+// shared address space, IETF protocol assignments, benchmarking, reserved,
+// and NAT64, which can embed any IPv4 address
+var nonPublicNetworks, _ = parseNetworks([]string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96"})
+
+// publicIP reports whether ip is a unicast address on the internet
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newCallbackClient returns the client callbacks are delivered with; unless
+// allowPrivate is set it refuses to connect to addresses that are not public
+func newCallbackClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: jobCallbackTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("callback address %s is not public", host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil // A proxy would dial the receiver on our behalf, unchecked
+	return &http.Client{
+		Timeout:   jobCallbackTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse // Reported as a failed delivery
+		},
+	}
+}
+
+// checkCallbackURL reports why target cannot receive callbacks, or ""
+func checkCallbackURL(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "must be an absolute http or https URL"
+	}
+	return ""
+}
+
+// notify delivers the job's callback, if it asked for one, retrying until it
+// is accepted or the attempts run out
+func (q *JobQueue) notify(ctx context.Context, j *job) {
+	if j.callbackURL == "" {
+		return
+	}
+	view := j.view()
+	if view.ResultURL != "" && q.publicURL != "" {
+		view.ResultURL = q.publicURL + view.ResultURL
+	}
+	body, err := json.Marshal(view)
+	if err != nil {
+		slog.Warn("Job callback failed", "job", j.id, "error", err)
+		return
+	}
+	backoff := jobCallbackBackoff
+	for attempt := 1; ; attempt++ {
+		err = deliverCallback(ctx, q.callbacks, j.callbackURL, j.callbackSecret, body)
+		if err == nil {
+			slog.Info("Job callback delivered", "request_id", requestIDFrom(j.req.Context()), "job", j.id, "attempt", attempt)
+			return
+		}
+		if attempt == jobCallbackAttempts {
+			break
+		}
+		slog.Info("Job callback failed, retrying", "job", j.id, "attempt", attempt, "retry_in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	slog.Warn("Job callback failed", "request_id", requestIDFrom(j.req.Context()), "job", j.id, "attempts", jobCallbackAttempts, "error", err)
+}
+
+func deliverCallback(ctx context.Context, client *http.Client, target, secret string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Timestamp", timestamp)
+	path := req.URL.Path
+	if path == "" {
+		path = "/" // As the receiving server sees it
+	}
+	req.Header.Set("X-Signature", "sha256="+signRequest(secret, timestamp, http.MethodPost, path, req.URL.RawQuery, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", strings.SplitN(target, "?", 2)[0], resp.Status)
+	}
+	return nil
+}
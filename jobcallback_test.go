@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("publicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCallbackClientRefusesPrivateAddresses(t *testing.T) {
+	var delivered bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered = true
+	}))
+	defer receiver.Close()
+	if err := deliverCallback(context.Background(), newCallbackClient(false), receiver.URL, "", []byte(`{}`)); err == nil {
+		t.Error("deliverCallback to a loopback receiver succeeded, want it refused")
+	}
+	if delivered {
+		t.Error("loopback receiver was reached")
+	}
+}
+
+func TestCallbackClientDoesNotFollowRedirects(t *testing.T) {
+	var followed bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed = true
+	}))
+	defer target.Close()
+	redirector := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer redirector.Close()
+	if err := deliverCallback(context.Background(), newCallbackClient(true), redirector.URL, "", []byte(`{}`)); err == nil {
+		t.Error("deliverCallback treated a redirect as delivered")
+	}
+	if followed {
+		t.Error("redirect was followed")
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Jobs speak long texts without holding a connection open: POST /v1/jobs
+// takes a /v1/speak request and returns a job id at once, GET /v1/jobs/{id}
+// reports its status and progress, and GET /v1/jobs/{id}/result returns the
+// audio. A job is the speak request run in the background against a
+// recorder, so it is validated, normalized, charged and cached exactly like
+// one; errors found before it runs, such as an invalid payload, are returned
+// right away, the rest become the job's error. Jobs are only visible to the
+// tenant that created them. With -db, pending jobs are stored and resumed
+// after a restart, see jobstore.go; finished jobs stay in memory only.
+// Progress counts the pieces of the text that long-text chunking and the
+// sentence cache speak separately.
+//
+// With ?wait=2s, POST /v1/jobs waits up to that long for the job and, if it
+// finishes, answers like /v1/speak would, with the audio or the job's
+// problem, saving the client a poll for medium-sized texts; X-Job-ID and
+// Location still name the job. Jobs that take longer, and jobs with a
+// callback_url, whose secret only the 202 response carries, are answered
+// with 202 as usual.
+
+const (
+	jobQueueSize   = 100
+	jobConcurrency = 2
+	jobTimeout     = 30 * time.Minute
+	jobRetention   = time.Hour // Finished jobs and their audio are kept this long
+	maxJobWait     = 30 * time.Second
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+type JobView struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Progress   float64    `json:"progress"` // From 0 to 1
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Bytes      int        `json:"bytes,omitempty"`
+	ResultURL  string     `json:"result_url,omitempty"` // Once succeeded
+	Error      *Problem   `json:"error,omitempty"`      // Once failed
+
+	CallbackSecret string `json:"callback_secret,omitempty"` // Only in the creation response, with ?callback_url=
+}
+
+type job struct {
+	id     string
+	tenant string
+	req    *http.Request // The speak request, with a context that outlives the POST
+	body   []byte        // Its body, for the job store; see jobstore.go
+
+	callbackURL    string // Notified when the job finishes; see jobcallback.go
+	callbackSecret string
+
+	mu          sync.Mutex
+	status      string
+	createdAt   time.Time
+	startedAt   time.Time
+	finishedAt  time.Time
+	contentType string
+	audio       []byte
+	problem     *Problem
+	progress    jobProgress
+	done        chan struct{} // Closed once the job has finished
+}
+
+// jobProgress counts the pieces of a job's text as they are spoken
+type jobProgress struct {
+	total atomic.Int64
+	done  atomic.Int64
+
+	observe func(piece int, pcm []byte) // Called as each piece is spoken, when set; see speakevents.go
+}
+
+type progressContextKey struct{}
+
+func progressFrom(ctx context.Context) *jobProgress {
+	progress, _ := ctx.Value(progressContextKey{}).(*jobProgress)
+	return progress
+}
+
+// expect adds pieces to be spoken and returns the index of the first;
+// nil-safe, like finished
+func (p *jobProgress) expect(pieces int) int {
+	if p == nil {
+		return 0
+	}
+	return int(p.total.Add(int64(pieces))) - pieces
+}
+
+// finished records that a piece was spoken; pcm is its audio, or nil for
+// pieces of a piece, whose audio is part of the piece's own
+func (p *jobProgress) finished(piece int, pcm []byte) {
+	if p == nil {
+		return
+	}
+	p.done.Add(1)
+	if p.observe != nil {
+		p.observe(piece, pcm)
+	}
+}
+
+type JobQueue struct {
+	mu        sync.Mutex
+	jobs      map[string]*job
+	queue     chan *job
+	publicURL string
+	callbacks *http.Client
+	db        *Store // Pending jobs, when persistent
+}
+
+func NewJobQueue(cfg JobsConfig, db *Store) *JobQueue {
+	return &JobQueue{
+		jobs:      make(map[string]*job),
+		queue:     make(chan *job, jobQueueSize),
+		publicURL: strings.TrimSuffix(cfg.PublicURL, "/"),
+		callbacks: newCallbackClient(cfg.PrivateCallbacks),
+		db:        db,
+	}
+}
+
+// start runs jobs with handler until ctx is done
+func (q *JobQueue) start(ctx context.Context, handler http.HandlerFunc) {
+	for i := 0; i < jobConcurrency; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-q.queue:
+					j.run(handler)
+					if err := q.db.delete(bucketJobs, j.id); err != nil {
+						slog.Warn("Failed to delete stored job", "job", j.id, "error", err)
+					}
+					go q.notify(ctx, j)
+				}
+			}
+		}()
+	}
+}
+
+// add queues a job, reporting false when the queue is full
+func (q *JobQueue) add(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, old := range q.jobs {
+		if old.expired() {
+			delete(q.jobs, id)
+		}
+	}
+	select {
+	case q.queue <- j:
+		q.jobs[j.id] = j
+		if err := q.db.put(bucketJobs, j.id, j.record()); err != nil {
+			slog.Warn("Failed to store job", "job", j.id, "error", err)
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// lookup returns the tenant's job
+func (q *JobQueue) lookup(tenant, id string) (*job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, exists := q.jobs[id]
+	if !exists || j.tenant != tenant || j.expired() {
+		return nil, false
+	}
+	return j, true
+}
+
+func (q *JobQueue) depth() int {
+	return len(q.queue)
+}
+
+func (j *job) expired() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finishedAt.IsZero() && time.Since(j.finishedAt) > jobRetention
+}
+
+func (j *job) run(handler http.HandlerFunc) {
+	j.mu.Lock()
+	j.status, j.startedAt = jobRunning, time.Now()
+	j.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithValue(j.req.Context(), progressContextKey{}, &j.progress), jobTimeout)
+	defer cancel()
+	rec := &jobRecorder{header: make(http.Header), status: http.StatusOK}
+	handler(rec, j.req.WithContext(ctx))
+
+	defer close(j.done)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finishedAt = time.Now()
+	if rec.status == http.StatusOK {
+		j.status, j.contentType, j.audio = jobSucceeded, rec.header.Get("Content-Type"), rec.body.Bytes()
+		return
+	}
+	j.status, j.problem = jobFailed, rec.problem()
+	slog.Info("Job failed", "request_id", requestIDFrom(ctx), "job", j.id, "status", rec.status, "code", j.problem.Code)
+}
+
+func (j *job) view() JobView {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	view := JobView{ID: j.id, Status: j.status, CreatedAt: j.createdAt, Error: j.problem}
+	if total := j.progress.total.Load(); total > 0 {
+		view.Progress = float64(j.progress.done.Load()) / float64(total)
+	}
+	if !j.startedAt.IsZero() {
+		started := j.startedAt.UTC()
+		view.StartedAt = &started
+	}
+	if !j.finishedAt.IsZero() {
+		finished := j.finishedAt.UTC()
+		view.FinishedAt = &finished
+	}
+	if j.status == jobSucceeded {
+		view.Progress, view.Bytes, view.ResultURL = 1, len(j.audio), "/v1/jobs/"+j.id+"/result"
+	}
+	return view
+}
+
+// jobRecorder keeps what the speak handler writes
+type jobRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *jobRecorder) Header() http.Header         { return r.header }
+func (r *jobRecorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *jobRecorder) WriteHeader(status int)      { r.status = status }
+
+// replay writes the recorded response to w
+func (r *jobRecorder) replay(w http.ResponseWriter) {
+	for name, values := range r.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(r.status)
+	w.Write(r.body.Bytes())
+}
+
+// speakRequest turns r into a /v1/speak request for payload answered with
+// bare audio, for endpoints that translate another API's requests
+func speakRequest(r *http.Request, payload RequestPayload) (*http.Request, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req := r.Clone(r.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Response-Envelope", envelopeBare)
+	return req, nil
+}
+
+// problem returns the problem the handler wrote, or a generic one
+func (r *jobRecorder) problem() *Problem {
+	problem := &Problem{}
+	if err := json.Unmarshal(r.body.Bytes(), problem); err != nil || problem.Code == "" {
+		problem = &Problem{Status: r.status, Code: codeSynthesisFailed, Detail: "Failed to generate audio"}
+	}
+	return problem
+}
+
+func (s *server) handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	if maintenance.active() { // Queued jobs run through maintenance, so none are taken during it
+		writeMaintenance(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	// Validated now so mistakes are reported to the caller, not the job
+	if !s.checkSpeakBody(w, r, body) {
+		return
+	}
+
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		if wait, err = time.ParseDuration(value); err != nil || wait < 0 || wait > maxJobWait {
+			writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid wait: must be a duration such as 2s, up to "+maxJobWait.String())
+			return
+		}
+	}
+	callbackURL := r.URL.Query().Get("callback_url")
+	if reason := checkCallbackURL(callbackURL); callbackURL != "" && reason != "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid callback_url: "+reason)
+		return
+	}
+
+	id := make([]byte, 12)
+	rand.Read(id)
+	req := r.Clone(withQueuedJob(context.WithoutCancel(r.Context())))
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.Header.Set("X-Response-Envelope", envelopeBare)
+	j := &job{id: hex.EncodeToString(id), tenant: principalFrom(r.Context()).tenant, req: req, body: body, status: jobQueued, createdAt: time.Now().UTC(), done: make(chan struct{})}
+	if callbackURL != "" {
+		secret, err := randomSecret("")
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to create job")
+			return
+		}
+		j.callbackURL, j.callbackSecret = callbackURL, secret
+	}
+	if !s.jobs.add(j) {
+		w.Header().Set("Retry-After", "30")
+		writeError(w, r, http.StatusServiceUnavailable, codeQueueFull, "Too many jobs are waiting; try again later")
+		return
+	}
+	annotate(r.Context(), "job", j.id)
+	w.Header().Set("Location", "/v1/jobs/"+j.id)
+	if wait > 0 && j.callbackURL == "" {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+		select {
+		case <-j.done:
+			w.Header().Set("X-Job-ID", j.id)
+			j.mu.Lock()
+			status, contentType, audio, problem := j.status, j.contentType, j.audio, j.problem
+			j.mu.Unlock()
+			if status == jobSucceeded {
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("Content-Length", strconv.Itoa(len(audio)))
+				w.Write(audio)
+			} else {
+				writeProblem(w, r, *problem)
+			}
+			return
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	view := j.view()
+	view.CallbackSecret = j.callbackSecret
+	writeJSON(w, http.StatusAccepted, view)
+}
+
+// checkSpeakBody validates a speak request run apart from its own request,
+// by a job or an event stream, which return a single rendition
+func (s *server) checkSpeakBody(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	var payload RequestPayload
+	probe := r.Clone(r.Context())
+	probe.Body = io.NopCloser(bytes.NewReader(body))
+	if err := s.decodeValidated(probe, "speak", &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return false
+	}
+	if (payload.Text == "") == (payload.SSML == "") {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: exactly one of text and ssml is required", Pointer: "/text"})
+		return false
+	}
+	if payload.Ladder {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: a single rendition is returned, not a ladder", Pointer: "/ladder"})
+		return false
+	}
+	return true
+}
+
+func (s *server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	j, exists := s.jobs.lookup(principalFrom(r.Context()).tenant, r.PathValue("id"))
+	if !exists {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Job not found")
+		return
+	}
+	view := j.view()
+	if view.Status == jobQueued || view.Status == jobRunning {
+		w.Header().Set("Retry-After", "5")
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (s *server) handleJobResult(w http.ResponseWriter, r *http.Request) {
+	j, exists := s.jobs.lookup(principalFrom(r.Context()).tenant, r.PathValue("id"))
+	if !exists {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Job not found")
+		return
+	}
+	j.mu.Lock()
+	status, contentType, audio := j.status, j.contentType, j.audio
+	j.mu.Unlock()
+	switch status {
+	case jobSucceeded:
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(audio)))
+		w.Write(audio)
+	case jobFailed:
+		writeError(w, r, http.StatusConflict, codeConflict, "The job failed; its status has the error")
+	default:
+		w.Header().Set("Retry-After", "5")
+		writeError(w, r, http.StatusConflict, codeConflict, "The job has not finished yet")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestJobLifecycle runs jobs with a stand-in for the speak handler, which
+// answers "fail" texts with a problem and anything else with audio
+func TestJobLifecycle(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RateLimit.RequestsPerSecond = 0
+	srv, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv.jobs.start(ctx, func(w http.ResponseWriter, r *http.Request) {
+		var payload RequestPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		if strings.Contains(payload.Text, "fail") {
+			writeError(w, r, http.StatusBadGateway, codeSynthesisFailed, "Failed to generate audio")
+			return
+		}
+		w.Header().Set("Content-Type", "audio/mpeg")
+		io.WriteString(w, "audio of "+payload.Text)
+	})
+	mux := srv.routes()
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for name, tt := range map[string]struct{ target, body string }{
+		"invalid payload": {"/v1/jobs", `{"text":"hi"}`},
+		"text and ssml":   {"/v1/jobs", `{"text":"hi","ssml":"<speak>hi</speak>","lang":"en"}`},
+		"long wait":       {"/v1/jobs?wait=1h", `{"text":"hi","lang":"en"}`},
+		"bad callback":    {"/v1/jobs?callback_url=ftp://example.com/", `{"text":"hi","lang":"en"}`},
+	} {
+		if rec := do("POST", tt.target, tt.body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d %s, want 400 before queueing", name, rec.Code, rec.Body)
+		}
+	}
+	if depth := srv.jobs.depth(); depth != 0 {
+		t.Errorf("%d jobs queued by invalid requests", depth)
+	}
+
+	rec := do("POST", "/v1/jobs", `{"text":"hello","lang":"en"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("create: status %d %s, want 202", rec.Code, rec.Body)
+	}
+	var created JobView
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil || created.ID == "" {
+		t.Fatalf("create: body %s, want a job view", rec.Body)
+	}
+	if location := rec.Header().Get("Location"); location != "/v1/jobs/"+created.ID {
+		t.Errorf("Location = %q, want /v1/jobs/%s", location, created.ID)
+	}
+	var view JobView
+	for deadline := time.Now().Add(5 * time.Second); view.Status != jobSucceeded && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		json.Unmarshal(do("GET", "/v1/jobs/"+created.ID, "").Body.Bytes(), &view)
+	}
+	if view.Status != jobSucceeded || view.Progress != 1 || view.ResultURL != "/v1/jobs/"+created.ID+"/result" || view.FinishedAt == nil {
+		t.Fatalf("job view = %+v, want it succeeded with a result URL", view)
+	}
+	if rec := do("GET", view.ResultURL, ""); rec.Code != http.StatusOK || rec.Body.String() != "audio of hello" || rec.Header().Get("Content-Type") != "audio/mpeg" {
+		t.Errorf("result: %d %s %q, want the audio", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	if _, visible := srv.jobs.lookup("acme", created.ID); visible {
+		t.Error("job is visible to another tenant")
+	}
+
+	rec = do("POST", "/v1/jobs?wait=5s", `{"text":"please fail","lang":"en"}`)
+	failedID := rec.Header().Get("X-Job-ID")
+	if rec.Code != http.StatusBadGateway || failedID == "" || !strings.Contains(rec.Body.String(), codeSynthesisFailed) {
+		t.Fatalf("failing job with wait: %d %s, want its 502 problem and X-Job-ID", rec.Code, rec.Body)
+	}
+	json.Unmarshal(do("GET", "/v1/jobs/"+failedID, "").Body.Bytes(), &view)
+	if view.Status != jobFailed || view.Error == nil || view.Error.Code != codeSynthesisFailed {
+		t.Errorf("failed job view = %+v, want its problem", view)
+	}
+	if rec := do("GET", "/v1/jobs/"+failedID+"/result", ""); rec.Code != http.StatusConflict {
+		t.Errorf("failed job result: status %d, want 409", rec.Code)
+	}
+
+	rec = do("POST", "/v1/jobs?wait=5s", `{"text":"quick","lang":"en"}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != "audio of quick" || rec.Header().Get("X-Job-ID") == "" {
+		t.Errorf("job with wait: %d %s, want the audio and X-Job-ID", rec.Code, rec.Body)
+	}
+	if rec := do("GET", "/v1/jobs/0123456789abcdef01234567", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// With -db, jobs survive a crash or deploy: each job is stored when it is
+// accepted and deleted once it finishes, so on startup every stored job is
+// one that was queued or running, and it is queued again. A job interrupted
+// while running starts over, so its characters are charged again unless its
+// audio was cached. Finished jobs and their audio stay in memory only, as
+// before. A stored job runs as the API key that created it; if that key has
+// since been deleted or revoked, the job is dropped with a warning.
+
+var bucketJobs = []byte("jobs")
+
+// Request headers a job needs to run as it would have when created
+var jobHeaders = []string{"Content-Type", "User-Agent", "Accept-Language"}
+
+// jobRecord is a pending job as stored
+type jobRecord struct {
+	ID             string            `json:"id"`
+	Tenant         string            `json:"tenant"`
+	KeyID          string            `json:"key_id,omitempty"` // Empty for anonymous and token tenants
+	RequestID      string            `json:"request_id"`
+	Body           []byte            `json:"body"`
+	Header         map[string]string `json:"header,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	CallbackURL    string            `json:"callback_url,omitempty"`
+	CallbackSecret string            `json:"callback_secret,omitempty"`
+}
+
+func (j *job) record() jobRecord {
+	rec := jobRecord{
+		ID:             j.id,
+		Tenant:         j.tenant,
+		RequestID:      requestIDFrom(j.req.Context()),
+		Body:           j.body,
+		Header:         make(map[string]string),
+		CreatedAt:      j.createdAt,
+		CallbackURL:    j.callbackURL,
+		CallbackSecret: j.callbackSecret,
+	}
+	if key := principalFrom(j.req.Context()).key; key != nil {
+		rec.KeyID = key.ID
+	}
+	for _, name := range jobHeaders {
+		if value := j.req.Header.Get(name); value != "" {
+			rec.Header[name] = value
+		}
+	}
+	return rec
+}
+
+// restore rebuilds a stored job, with the principal that created it
+func restoreJob(rec jobRecord, keys *KeyStore) (*job, error) {
+	p := &principal{tenant: rec.Tenant}
+	if rec.KeyID != "" {
+		key, exists := keys.lookupID(rec.KeyID)
+		if !exists {
+			return nil, fmt.Errorf("API key %q no longer exists", rec.KeyID)
+		}
+		p.key = key
+	}
+	ctx := context.WithValue(context.Background(), principalContextKey, p)
+	ctx = withQueuedJob(context.WithValue(ctx, requestIDContextKey, rec.RequestID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/jobs", io.NopCloser(bytes.NewReader(rec.Body)))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range rec.Header {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("X-Response-Envelope", envelopeBare)
+	return &job{
+		done:           make(chan struct{}),
+		id:             rec.ID,
+		tenant:         rec.Tenant,
+		req:            req,
+		body:           rec.Body,
+		callbackURL:    rec.CallbackURL,
+		callbackSecret: rec.CallbackSecret,
+		status:         jobQueued,
+		createdAt:      rec.CreatedAt,
+	}, nil
+}
+
+// resume queues the jobs stored before the last shutdown, oldest first
+func (q *JobQueue) resume(keys *KeyStore) error {
+	var records []jobRecord
+	err := q.db.forEach(bucketJobs, func(key string, data []byte) error {
+		var rec jobRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return fmt.Errorf("job %q: %w", key, err)
+		}
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	for _, rec := range records {
+		j, err := restoreJob(rec, keys)
+		if err == nil && !q.add(j) {
+			err = errors.New("the queue is full")
+		}
+		if err != nil {
+			slog.Warn("Failed to resume job", "request_id", rec.RequestID, "job", rec.ID, "error", err)
+			q.db.delete(bucketJobs, rec.ID)
+			continue
+		}
+		slog.Info("Resumed job", "request_id", rec.RequestID, "job", rec.ID)
+	}
+	return nil
+}
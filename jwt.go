@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OIDCConfig struct {
+	Issuer      string   `json:"issuer"`       // Required iss claim; also used for discovery when jwks_url is empty
+	Audience    string   `json:"audience"`     // Required aud claim, if set
+	JWKSURL     string   `json:"jwks_url"`     // Where signing keys are published
+	TenantClaim string   `json:"tenant_claim"` // Claim naming the tenant, "sub" by default
+	CacheTTL    Duration `json:"cache_ttl"`    // How long fetched keys are trusted before a refresh
+}
+
+// JWTVerifier validates bearer tokens against keys published at a JWKS URL
+type JWTVerifier struct {
+	cfg        OIDCConfig
+	client     *http.Client
+	mu         sync.Mutex
+	jwksURL    string
+	keys       map[string]crypto.PublicKey
+	fetchedAt  time.Time
+	refreshing chan struct{} // Closed when the fetch in flight ends; nil when there is none
+	refreshErr error         // Outcome of the last fetch, for callers that waited on it
+}
+
+var errInvalidToken = errors.New("invalid bearer token")
+
+const jwtLeeway = time.Minute
+
+// NewJWTVerifier returns nil when bearer tokens are not configured
+func NewJWTVerifier(cfg OIDCConfig) *JWTVerifier {
+	if cfg.JWKSURL == "" && cfg.Issuer == "" {
+		return nil
+	}
+	if cfg.TenantClaim == "" {
+		cfg.TenantClaim = "sub"
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = Duration(time.Hour)
+	}
+	return &JWTVerifier{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		jwksURL: cfg.JWKSURL,
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func (v *JWTVerifier) getJSON(url string, out any) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// fetchKeys fetches the key set, discovering its URL from the issuer if
+// jwksURL is empty, and returns the URL it used
+func (v *JWTVerifier) fetchKeys(jwksURL string) (string, map[string]crypto.PublicKey, error) {
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(strings.TrimSuffix(v.cfg.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return "", nil, fmt.Errorf("OIDC discovery: %w", err)
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(jwksURL, &set); err != nil {
+		return "", nil, fmt.Errorf("fetch JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	return jwksURL, keys, nil
+}
+
+// refresh replaces the key set with a freshly fetched one. Caller holds v.mu,
+// which is released during the fetch so tokens signed with cached keys are
+// verified meanwhile; callers arriving then wait for that fetch instead of
+// starting another.
+func (v *JWTVerifier) refresh() error {
+	if done := v.refreshing; done != nil {
+		v.mu.Unlock()
+		<-done
+		v.mu.Lock()
+		return v.refreshErr
+	}
+	done := make(chan struct{})
+	v.refreshing = done
+	jwksURL := v.jwksURL
+	v.mu.Unlock()
+	jwksURL, keys, err := v.fetchKeys(jwksURL)
+	v.mu.Lock()
+	if err == nil {
+		v.jwksURL, v.keys, v.fetchedAt = jwksURL, keys, time.Now()
+	}
+	v.refreshing, v.refreshErr = nil, err
+	close(done)
+	return err
+}
+
+// key returns the signing key for kid, refetching the set when it is stale or
+// the kid is unknown (keys rotate), but at most once a minute
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	age := time.Since(v.fetchedAt)
+	if key, exists := v.keys[kid]; exists && age < time.Duration(v.cfg.CacheTTL) {
+		return key, nil
+	}
+	if age > time.Minute {
+		if err := v.refresh(); err != nil {
+			// Keep serving with the previous key set while the provider is unreachable
+			if key, exists := v.keys[kid]; exists {
+				return key, nil
+			}
+			return nil, err
+		}
+	}
+	if key, exists := v.keys[kid]; exists {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key id %q", errInvalidToken, kid)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		case "PS":
+			return rsa.VerifyPSS(pub, hash, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if alg[:2] == "ES" && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(pub, digest, r, s) {
+				return nil
+			}
+			return errors.New("signature mismatch")
+		}
+	}
+	return fmt.Errorf("algorithm %q does not match key type", alg)
+}
+
+// numericClaim reads a NumericDate claim such as exp or nbf
+func numericClaim(claims map[string]any, name string) (time.Time, bool) {
+	if n, ok := claims[name].(float64); ok {
+		return time.Unix(int64(n), 0), true
+	}
+	return time.Time{}, false
+}
+
+func hasAudience(claims map[string]any, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verify checks the token's signature and standard claims and returns its claims
+func (v *JWTVerifier) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if data, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(data, &header) != nil {
+		return nil, errInvalidToken
+	}
+	if len(header.Alg) != 5 {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", errInvalidToken, header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+
+	var claims map[string]any
+	if data, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(data, &claims) != nil {
+		return nil, errInvalidToken
+	}
+	now := time.Now()
+	if exp, ok := numericClaim(claims, "exp"); !ok || now.After(exp.Add(jwtLeeway)) {
+		return nil, fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Before(nbf.Add(-jwtLeeway)) {
+		return nil, fmt.Errorf("%w: not yet valid", errInvalidToken)
+	}
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return nil, fmt.Errorf("%w: wrong issuer", errInvalidToken)
+	}
+	if v.cfg.Audience != "" && !hasAudience(claims, v.cfg.Audience) {
+		return nil, fmt.Errorf("%w: wrong audience", errInvalidToken)
+	}
+	return claims, nil
+}
+
+// tenant returns the tenant named by the configured claim
+func (v *JWTVerifier) tenant(claims map[string]any) (string, bool) {
+	tenant, ok := claims[v.cfg.TenantClaim].(string)
+	return tenant, ok && tenant != ""
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken builds an RS256 or ES256 token, depending on the key
+func signToken(t *testing.T, key crypto.Signer, kid string, claims map[string]any) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	signed := encodeSegment(t, map[string]string{"alg": alg, "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func publicJWK(kid string, key crypto.Signer) jwk {
+	encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jwk{Kty: "RSA", Kid: kid, N: encode(k.N), E: encode(big.NewInt(int64(k.E)))}
+	case *ecdsa.PrivateKey:
+		return jwk{Kty: "EC", Kid: kid, Crv: "P-256", X: encode(k.X), Y: encode(k.Y)}
+	}
+	return jwk{}
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []jwk{publicJWK("rsa", rsaKey), publicJWK("ec", ecKey)}})
+	}))
+	defer jwks.Close()
+	v := NewJWTVerifier(OIDCConfig{Issuer: "https://id.example", Audience: "tts", JWKSURL: jwks.URL})
+
+	valid := func() map[string]any {
+		return map[string]any{"iss": "https://id.example", "aud": "tts", "sub": "acme", "exp": time.Now().Add(time.Hour).Unix()}
+	}
+	with := func(name string, value any) map[string]any {
+		claims := valid()
+		claims[name] = value
+		return claims
+	}
+	tampered := signToken(t, rsaKey, "rsa", valid())
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"RS256", signToken(t, rsaKey, "rsa", valid()), false},
+		{"ES256", signToken(t, ecKey, "ec", valid()), false},
+		{"audience list", signToken(t, rsaKey, "rsa", with("aud", []string{"other", "tts"})), false},
+		{"expired", signToken(t, rsaKey, "rsa", with("exp", time.Now().Add(-time.Hour).Unix())), true},
+		{"no expiry", signToken(t, rsaKey, "rsa", with("exp", nil)), true},
+		{"not yet valid", signToken(t, rsaKey, "rsa", with("nbf", time.Now().Add(time.Hour).Unix())), true},
+		{"wrong issuer", signToken(t, rsaKey, "rsa", with("iss", "https://evil.example")), true},
+		{"wrong audience", signToken(t, rsaKey, "rsa", with("aud", "other")), true},
+		{"key of another kid", signToken(t, rsaKey, "ec", valid()), true},
+		{"unknown kid", signToken(t, rsaKey, "gone", valid()), true},
+		{"bad signature", tampered, true},
+		{"unsigned", encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, valid()) + ".", true},
+		{"malformed", "not-a-token", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.verify(tt.token)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidToken) {
+					t.Errorf("verify() error = %v, want errInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verify(): %v", err)
+			}
+			if tenant, ok := v.tenant(claims); !ok || tenant != "acme" {
+				t.Errorf("tenant = %q, %v, want acme", tenant, ok)
+			}
+		})
+	}
+}
+
+// A slow key set fetch holds up neither tokens signed with cached keys nor
+// other callers after a fetch of their own
+func TestJWTKeyRefreshOutsideLock(t *testing.T) {
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []jwk{publicJWK("old", oldKey)}
+		if fetches.Add(1) > 1 {
+			<-release
+			keys = append(keys, publicJWK("new", newKey))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	defer jwks.Close()
+	v := NewJWTVerifier(OIDCConfig{JWKSURL: jwks.URL})
+	claims := map[string]any{"sub": "acme", "exp": time.Now().Add(time.Hour).Unix()}
+	oldToken, newToken := signToken(t, oldKey, "old", claims), signToken(t, newKey, "new", claims)
+	if _, err := v.verify(oldToken); err != nil {
+		t.Fatalf("verify with the first key set: %v", err)
+	}
+	v.mu.Lock()
+	v.fetchedAt = time.Now().Add(-2 * time.Minute) // Allow a refetch for the rotated key
+	v.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = v.verify(newToken)
+		}(i)
+	}
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	verified := make(chan error)
+	go func() {
+		_, err := v.verify(oldToken)
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Errorf("verify with a cached key during a refresh: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("verify with a cached key waited for the refresh")
+	}
+	close(release)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("verify with the rotated key (caller %d): %v", i, err)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("key set fetched %d times, want 2", n)
+	}
+}
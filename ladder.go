@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"sync"
+)
+
+// Rendition is one bitrate of a bitrate ladder
+type Rendition struct {
+	Bitrate string `json:"bitrate"`
+	Codec   string `json:"codec"`
+	Bytes   int    `json:"bytes"`
+	Audio   string `json:"audio"` // Base64 encoded audio data
+}
+
+// renderLadder encodes a single synthesis at every ladder bitrate plus the
+// default one, reusing cached renditions and only calling the engine if at
+// least one is missing. It returns the renditions, the default-bitrate audio,
+// and whether everything came from the cache.
+func (s *server) renderLadder(ctx context.Context, engine Engine, text, lang string, base AudioOptions) ([]Rendition, []byte, bool, error) {
+	bitrates := append([]string{}, s.cfg.Ladder...)
+	defaultBitrate := base.bitrate()
+	if defaultBitrate == "" {
+		bitrates = nil // Lossless formats have a single rendition
+	}
+	if !containsString(bitrates, defaultBitrate) {
+		bitrates = append(bitrates, defaultBitrate)
+	}
+
+	encoded := make([][]byte, len(bitrates))
+	var missing []int
+	_, span := startSpan(ctx, "cache.lookup", "cache.keys", len(bitrates))
+	for i, bitrate := range bitrates {
+		opts := base
+		opts.Bitrate = bitrate
+		if data, exists := s.cache.lookup(audioCacheKey(engine, text, lang, opts)); exists {
+			encoded[i] = data
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	span.set("cache.misses", len(missing))
+	span.end(nil)
+
+	if len(missing) > 0 {
+		rawAudio, err := synthesize(ctx, engine, base.synthesisRequest(text, lang))
+		if err != nil {
+			return nil, nil, false, err
+		}
+		errs := make([]error, len(bitrates))
+		var wg sync.WaitGroup
+		for _, i := range missing {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				opts := base
+				opts.Bitrate = bitrates[i]
+				encoded[i], errs[i] = transcodeAudio(ctx, rawAudio, opts)
+				if errs[i] == nil {
+					key, _ := audioCacheKey(engine, text, lang, opts)
+					s.cache.set(key, encoded[i])
+				}
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return nil, nil, false, err
+			}
+		}
+	}
+
+	var renditions []Rendition
+	var defaultAudio []byte
+	for i, bitrate := range bitrates {
+		if bitrate == defaultBitrate {
+			defaultAudio = encoded[i]
+		}
+		if containsString(s.cfg.Ladder, bitrate) {
+			renditions = append(renditions, Rendition{
+				Bitrate: bitrate,
+				Codec:   base.codec(),
+				Bytes:   len(encoded[i]),
+				Audio:   base64.StdEncoding.EncodeToString(encoded[i]),
+			})
+		}
+	}
+	return renditions, defaultAudio, len(missing) == 0, nil
+}
+
+func containsString(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
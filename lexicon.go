@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tenants keep a pronunciation lexicon of words the engines get wrong, such
+// as brand names and acronyms, each with the respelling to speak instead
+// ("nginx" → "engine x"). Replacements are applied to whole words, ignoring
+// case, before synthesis, so the cache keys follow the lexicon and clients
+// send their text unchanged.
+
+const (
+	maxLexiconEntries     = 1000 // Per tenant
+	maxLexiconWordLen     = 100
+	maxLexiconReplacement = 200
+)
+
+var bucketLexicon = []byte("lexicon")
+
+var errLexiconFull = fmt.Errorf("lexicon is limited to %d entries", maxLexiconEntries)
+
+type LexiconEntry struct {
+	Word        string    `json:"word"`
+	Replacement string    `json:"replacement"`    // Spoken instead of the word, e.g. a phonetic respelling
+	Lang        string    `json:"lang,omitempty"` // Only applied to requests in this language; all languages when empty
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type lexiconRecord struct {
+	Tenant string `json:"tenant"`
+	LexiconEntry
+}
+
+// Lexicons holds every tenant's lexicon
+type Lexicons struct {
+	db *Store
+
+	mu       sync.Mutex
+	entries  map[string]map[string]LexiconEntry // By tenant, then lowercased word
+	compiled map[string]*regexp.Regexp          // By tenant; rebuilt after changes
+}
+
+func NewLexicons(db *Store) (*Lexicons, error) {
+	l := &Lexicons{db: db, entries: make(map[string]map[string]LexiconEntry), compiled: make(map[string]*regexp.Regexp)}
+	err := db.forEach(bucketLexicon, func(key string, data []byte) error {
+		var record lexiconRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("lexicon entry %s: %w", key, err)
+		}
+		l.tenant(record.Tenant)[strings.ToLower(record.Word)] = record.LexiconEntry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// tenant returns the tenant's entries, creating the map; call with mu held
+func (l *Lexicons) tenant(tenant string) map[string]LexiconEntry {
+	entries, exists := l.entries[tenant]
+	if !exists {
+		entries = make(map[string]LexiconEntry)
+		l.entries[tenant] = entries
+	}
+	return entries
+}
+
+func lexiconKey(tenant, word string) string {
+	return tenant + "\x00" + strings.ToLower(word)
+}
+
+func (l *Lexicons) list(tenant string) []LexiconEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := []LexiconEntry{}
+	for _, entry := range l.entries[tenant] {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return strings.ToLower(result[i].Word) < strings.ToLower(result[j].Word) })
+	return result
+}
+
+// put adds or replaces an entry and reports whether it was new
+func (l *Lexicons) put(tenant string, entry LexiconEntry) (LexiconEntry, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := l.tenant(tenant)
+	word := strings.ToLower(entry.Word)
+	_, exists := entries[word]
+	if !exists && len(entries) >= maxLexiconEntries {
+		return entry, false, errLexiconFull
+	}
+	entry.UpdatedAt = time.Now().UTC()
+	if err := l.db.put(bucketLexicon, lexiconKey(tenant, word), lexiconRecord{Tenant: tenant, LexiconEntry: entry}); err != nil {
+		return entry, false, err
+	}
+	entries[word] = entry
+	delete(l.compiled, tenant)
+	return entry, !exists, nil
+}
+
+// remove deletes an entry and reports whether it existed
+func (l *Lexicons) remove(tenant, word string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	word = strings.ToLower(word)
+	if _, exists := l.entries[tenant][word]; !exists {
+		return false, nil
+	}
+	if err := l.db.delete(bucketLexicon, lexiconKey(tenant, word)); err != nil {
+		return false, err
+	}
+	delete(l.entries[tenant], word)
+	delete(l.compiled, tenant)
+	return true, nil
+}
+
+// apply replaces the tenant's lexicon words in text
+func (l *Lexicons) apply(tenant, lang, text string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := l.entries[tenant]
+	if len(entries) == 0 {
+		return text
+	}
+	pattern, exists := l.compiled[tenant]
+	if !exists {
+		words := make([]string, 0, len(entries))
+		for word := range entries {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+		// Longest first, so "New York Times" wins over "New York"
+		sort.Slice(words, func(i, j int) bool { return len(words[i]) > len(words[j]) })
+		pattern = regexp.MustCompile("(?i)" + strings.Join(words, "|"))
+		l.compiled[tenant] = pattern
+	}
+
+	base, _, _ := strings.Cut(strings.ToLower(lang), "-")
+	var out strings.Builder
+	last := 0
+	for _, match := range pattern.FindAllStringIndex(text, -1) {
+		start, end := match[0], match[1]
+		if !wordBoundary(text, start, end) {
+			continue
+		}
+		entry, exists := entries[strings.ToLower(text[start:end])]
+		entryBase, _, _ := strings.Cut(strings.ToLower(entry.Lang), "-")
+		if !exists || entry.Lang != "" && entryBase != base {
+			continue
+		}
+		out.WriteString(text[last:start])
+		out.WriteString(entry.Replacement)
+		last = end
+	}
+	if last == 0 {
+		return text
+	}
+	out.WriteString(text[last:])
+	return out.String()
+}
+
+// wordBoundary reports whether text[start:end] is not part of a longer word
+func wordBoundary(text string, start, end int) bool {
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	if before, _ := utf8.DecodeLastRuneInString(text[:start]); start > 0 && isWord(before) {
+		return false
+	}
+	if after, _ := utf8.DecodeRuneInString(text[end:]); end < len(text) && isWord(after) {
+		return false
+	}
+	return true
+}
+
+// lexiconTenant returns the caller's tenant, writing a 403 for anonymous
+// callers, who share one tenant and so cannot have a lexicon of their own
+func lexiconTenant(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tenant := principalFrom(r.Context()).tenant
+	if tenant == anonymousTenant {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "A lexicon requires an API key or token")
+		return "", false
+	}
+	return tenant, true
+}
+
+func (s *server) handleListLexicon(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := lexiconTenant(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.lexicons.list(tenant))
+}
+
+type putLexiconRequest struct {
+	Replacement string `json:"replacement"`
+	Lang        string `json:"lang"`
+}
+
+// handlePutLexicon creates or replaces the entry for the {word} path value
+func (s *server) handlePutLexicon(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := lexiconTenant(w, r)
+	if !ok {
+		return
+	}
+	var req putLexiconRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload")
+		return
+	}
+	word := strings.TrimSpace(r.PathValue("word"))
+	switch {
+	case word == "" || utf8.RuneCountInString(word) > maxLexiconWordLen:
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, fmt.Sprintf("Invalid request payload: the word must be 1 to %d characters long", maxLexiconWordLen))
+		return
+	case strings.TrimSpace(req.Replacement) == "" || utf8.RuneCountInString(req.Replacement) > maxLexiconReplacement:
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: fmt.Sprintf("Invalid request payload: /replacement: must be 1 to %d characters long", maxLexiconReplacement), Pointer: "/replacement"})
+		return
+	}
+	entry, created, err := s.lexicons.put(tenant, LexiconEntry{Word: word, Replacement: req.Replacement, Lang: req.Lang})
+	if errors.Is(err, errLexiconFull) {
+		writeProblem(w, r, Problem{Status: http.StatusConflict, Code: codeLexiconFull, Detail: "Lexicon is full; delete entries first", Limit: maxLexiconEntries})
+		return
+	} else if err != nil {
+		slog.Error("Failed to store lexicon entry", "tenant", tenant, "error", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to store the lexicon entry")
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, entry)
+}
+
+func (s *server) handleDeleteLexicon(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := lexiconTenant(w, r)
+	if !ok {
+		return
+	}
+	removed, err := s.lexicons.remove(tenant, r.PathValue("word"))
+	if err != nil {
+		slog.Error("Failed to delete lexicon entry", "tenant", tenant, "error", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to delete the lexicon entry")
+		return
+	}
+	if !removed {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No lexicon entry for this word")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
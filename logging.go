@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// newLogger returns a JSON logger writing to stdout at the given level
+func newLogger(level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level must be debug, info, warn or error: %w", err)
+	}
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: l})), nil
+}
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// requestFields collects what handlers learn about a request for its log lines
+type requestFields struct {
+	mu     sync.Mutex
+	attrs  []any
+	tenant string
+	text   string // Only ever written to the access log, and only if configured
+	route  string
+	source string           // Where the response's audio came from; see egress.go
+	frames map[string]int64 // WebSocket bytes sent, by source
+}
+
+// annotate adds key-value pairs to the log line of the request in ctx
+func annotate(ctx context.Context, args ...any) {
+	if fields := fieldsFrom(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.attrs = append(fields.attrs, args...)
+		fields.mu.Unlock()
+	}
+}
+
+func fieldsFrom(ctx context.Context) *requestFields {
+	fields, _ := ctx.Value(requestFieldsContextKey).(*requestFields)
+	return fields
+}
+
+// setRequestTenant records who made the request in ctx
+func setRequestTenant(ctx context.Context, tenant string) {
+	if fields := fieldsFrom(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.tenant = tenant
+		fields.mu.Unlock()
+	}
+}
+
+// setRequestText records the text the request asked to synthesize
+func setRequestText(ctx context.Context, text string) {
+	if fields := fieldsFrom(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.text = text
+		fields.mu.Unlock()
+	}
+}
+
+// setRequestRoute records the route pattern that matched the request in ctx
+func setRequestRoute(ctx context.Context, route string) {
+	if fields := fieldsFrom(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.route = route
+		fields.mu.Unlock()
+	}
+}
+
+// setRequestSource records whether the audio of the response was cached
+func setRequestSource(ctx context.Context, cached bool) {
+	if fields := fieldsFrom(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.source = egressSource(cached)
+		fields.mu.Unlock()
+	}
+}
+
+// Logging middleware writing one structured line per request
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		fields := &requestFields{}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestFieldsContextKey, fields)))
+
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []any{
+			"request_id", requestIDFrom(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+		fields.mu.Lock()
+		if fields.tenant != "" {
+			attrs = append(attrs, "tenant", fields.tenant)
+		}
+		attrs = append(attrs, fields.attrs...)
+		fields.mu.Unlock()
+		slog.Log(r.Context(), level, "request", attrs...)
+	})
+}
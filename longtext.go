@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// gTTS gets slow and unreliable on long inputs: gtts-cli fetches them one
+// short piece at a time and a single failed request sinks the whole text.
+// Long texts are instead split on sentence boundaries, the chunks synthesized
+// in parallel, and their audio decoded to PCM and joined like SSML segments.
+const (
+	longTextChunkChars  = 400 // Chunks stay at or under this many characters where possible
+	longTextConcurrency = 4
+)
+
+// chunkText groups whole sentences into chunks of at most max characters.
+// Sentences longer than that are split between words.
+func chunkText(text string, max int) []string {
+	var chunks []string
+	var current strings.Builder
+	flush := func() {
+		if chunk := strings.TrimSpace(current.String()); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		current.Reset()
+	}
+	for text != "" {
+		end := sentenceEnd(text)
+		if end < 0 {
+			end = len(text)
+		}
+		sentence := text[:end]
+		text = text[end:]
+		if utf8.RuneCountInString(current.String())+utf8.RuneCountInString(sentence) > max {
+			flush()
+		}
+		for utf8.RuneCountInString(sentence) > max {
+			cut := cutAtSpace(sentence, runeOffset(sentence, max))
+			current.WriteString(sentence[:cut])
+			flush()
+			sentence = sentence[cut:]
+		}
+		current.WriteString(sentence)
+	}
+	flush()
+	return chunks
+}
+
+// synthesizeChunked speaks a long text chunk by chunk and returns WAV
+func synthesizeChunked(ctx context.Context, engine Engine, req SynthesisRequest) ([]byte, error) {
+	chunks := chunkText(req.Text, longTextChunkChars)
+	ctx, span := startSpan(ctx, "synthesize.chunked", "tts.chunks", len(chunks))
+	wav, _, err := speakPieces(ctx, engine, pieceRequests(req, chunks), nil)
+	span.end(err)
+	return wav, err
+}
+
+// pieceRequests asks for each piece of text as req asks for the whole
+func pieceRequests(req SynthesisRequest, pieces []string) []SynthesisRequest {
+	reqs := make([]SynthesisRequest, len(pieces))
+	for i, piece := range pieces {
+		reqs[i] = req
+		reqs[i].Text = piece
+	}
+	return reqs
+}
+
+// piecesContextKey marks synthesis for a piece, which may be split again
+type piecesContextKey struct{}
+
+// speakPieces speaks the pieces of one text in parallel and joins their
+// audio as WAV. With a cache, each piece's PCM is looked up and stored on its
+// own; cached counts the pieces found there.
+func speakPieces(ctx context.Context, engine Engine, reqs []SynthesisRequest, cache *AudioCache) (wav []byte, cached int, err error) {
+	pcm := make([][]byte, len(reqs))
+	errs := make([]error, len(reqs))
+	progress := progressFrom(ctx) // Of a job or event stream; see jobs.go
+	first := progress.expect(len(reqs))
+	nested := ctx.Value(piecesContextKey{}) != nil
+	ctx = context.WithValue(ctx, piecesContextKey{}, true)
+	spoken := func(i int) {
+		if nested {
+			progress.finished(first+i, nil)
+		} else {
+			progress.finished(first+i, pcm[i])
+		}
+	}
+	var hits atomic.Int64
+	slots := make(chan struct{}, longTextConcurrency)
+	var wg sync.WaitGroup
+	for i, pieceReq := range reqs {
+		wg.Add(1)
+		go func(i int, pieceReq SynthesisRequest) {
+			defer wg.Done()
+			var key string
+			if cache != nil {
+				var legacy string
+				key, legacy = sentenceCacheKey(engine, pieceReq)
+				if data, exists := cache.lookup(key, legacy); exists {
+					cache.claim(key, principalFrom(ctx).tenant)
+					pcm[i] = data
+					hits.Add(1)
+					spoken(i)
+					return
+				}
+			}
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			raw, err := synthesize(ctx, engine, pieceReq)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			cmd := exec.CommandContext(ctx, "ffmpeg", "-loglevel", "error", "-i", "pipe:0",
+				"-ac", "1", "-ar", strconv.Itoa(ssmlSampleRate), "-f", "s16le", "pipe:1")
+			cmd.Stdin = bytes.NewReader(raw)
+			var out bytes.Buffer
+			cmd.Stdout = &out
+			if err := runTimed(ctx, cmd); err != nil {
+				errs[i] = fmt.Errorf("ffmpeg: %w", err)
+				return
+			}
+			pcm[i] = out.Bytes()
+			spoken(i)
+			if cache != nil {
+				cache.set(key, pcm[i])
+				cache.claim(key, principalFrom(ctx).tenant)
+			}
+		}(i, pieceReq)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	var out bytes.Buffer
+	if err := writeWAV(&out, bytes.Join(pcm, nil), ssmlSampleRate, 1); err != nil {
+		return nil, 0, err
+	}
+	return out.Bytes(), int(hits.Load()), nil
+}
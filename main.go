@@ -3,30 +3,68 @@ package main
 import (
 	"bytes"
 	"container/list"
-	"encoding/base64"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"hash/fnv"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	jsoniter "github.com/json-iterator/go"
 )
 
 type RequestPayload struct {
-	Text string `json:"text"`
-	Lang string `json:"lang"`
+	Text            string  `json:"text,omitempty"`
+	InputType       string  `json:"input_type,omitempty"` // text, the default, html or markdown; see markup.go
+	SSML            string  `json:"ssml,omitempty"`       // Alternative to text; see ssml.go for the supported subset
+	Lang            string  `json:"lang"`
+	DetectLanguages bool    `json:"detect_languages,omitempty"` // Speak sentences in other languages with their own voice; see mixedlang.go
+	PreNormalized   bool    `json:"pre_normalized,omitempty"`   // Numbers, dates and abbreviations are already spelled out; see textnorm.go
+	Expressive      bool    `json:"expressive,omitempty"`       // Prosody from punctuation and capitals; see prosody.go
+	Symbols         string  `json:"symbols,omitempty"`          // keep, the default, speak or strip emoji and symbols; see symbols.go
+	Pipeline        string  `json:"pipeline,omitempty"`         // Preprocessing pipeline; the tenant's when omitted, see pipeline.go
+	EchoText        bool    `json:"echo_text,omitempty"`        // Also return the text the engine is given; see textecho.go
+	SentenceCache   bool    `json:"sentence_cache,omitempty"`   // Cache each sentence even when the server does not; see sentencecache.go
+	Engine          string  `json:"engine,omitempty"`           // Defaults to the configured default engine
+	Ladder          bool    `json:"ladder,omitempty"`           // Also return every bitrate of the configured ladder
+	Speed           float64 `json:"speed,omitempty"`            // Speaking rate multiplier; 1 is the engine's own pace
+	Pitch           float64 `json:"pitch,omitempty"`            // Shift in semitones, keeping the speaking rate
+	GainDB          float64 `json:"gain_db,omitempty"`          // Volume change in decibels
+	Limit           bool    `json:"limit,omitempty"`            // Apply a peak limiter so gain cannot clip
+	Normalize       bool    `json:"normalize,omitempty"`        // EBU R128 loudness normalization
+	TrimSilence     bool    `json:"trim_silence,omitempty"`     // Cut leading and trailing silence
+	PadStartMS      int     `json:"pad_start_ms,omitempty"`     // Silence added before the speech
+	PadEndMS        int     `json:"pad_end_ms,omitempty"`       // Silence added after it
+	Slow            bool    `json:"slow,omitempty"`             // The engine's slow mode, for language learners
+	TLD             string  `json:"tld,omitempty"`              // Google domain gtts speaks through, which picks the regional accent
+	Format          string  `json:"format,omitempty"`           // Output format; Opus, or AAC for Safari, when omitted
+	SampleRate      int     `json:"sample_rate,omitempty"`      // Output sample rate in Hz; see outputSampleRates
+	Channels        int     `json:"channels,omitempty"`         // 1 for mono, the default, or 2 for stereo
+
+	Consent *ConsentMetadata `json:"consent,omitempty"` // Kept with the request's usage record; see consent.go
 }
 
 type ResponsePayload struct {
-	Audio string `json:"audio"` // Base64 encoded audio data
+	Audio           string           `json:"audio"`                      // Base64 encoded audio data
+	Renditions      []Rendition      `json:"renditions,omitempty"`       // Bitrate ladder manifest, when requested
+	TransformedText *TransformedText `json:"transformed_text,omitempty"` // With echo_text
 }
 
 type AudioCacheEntry struct {
 	data      []byte
+	digest    [sha256.Size]byte // Of data, shared with identical entries; see cachededup.go
 	timestamp time.Time
 }
 
@@ -35,8 +73,13 @@ type AudioCache struct {
 	cache      map[string]*list.Element
 	expiration time.Duration
 	maxSize    int
+	sentences  bool // Also cache each sentence; see sentencecache.go
+	lazy       bool // Expire entries when read instead of from a background sweep
 	mu         sync.Mutex
 	lruList    *list.List
+	owners     map[string]map[string]bool // Tenants whose requests produced or reused each entry; see dsar.go
+	blobs      map[[sha256.Size]byte]*audioBlob
+	shared     *sharedCache // Directory shared with other instances; see replica.go
 }
 
 type cacheItem struct {
@@ -46,15 +89,25 @@ type cacheItem struct {
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
-// NewAudioCache creates a cache with a specified max size and expiration time
-func NewAudioCache(maxSize int, expiration time.Duration) *AudioCache {
+// NewAudioCache creates a cache with a specified max size and expiration time.
+// A lazy cache starts no goroutine, which suits serverless instances whose
+// lifetime a sleeping sweeper would only keep alive; expired entries it never
+// reads again stay until the LRU pushes them out.
+func NewAudioCache(maxSize int, expiration time.Duration, sentences, lazy bool, shared *sharedCache) *AudioCache {
 	cache := &AudioCache{
 		cache:      make(map[string]*list.Element),
 		expiration: expiration,
 		maxSize:    maxSize,
+		sentences:  sentences,
+		lazy:       lazy,
 		lruList:    list.New(),
+		owners:     make(map[string]map[string]bool),
+		blobs:      make(map[[sha256.Size]byte]*audioBlob),
+		shared:     shared,
+	}
+	if !lazy {
+		go cache.evictExpiredEntries()
 	}
-	go cache.evictExpiredEntries()
 	return cache
 }
 
@@ -73,20 +126,44 @@ func (c *AudioCache) evictExpiredEntries() {
 
 func (c *AudioCache) get(key string) ([]byte, bool) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if elem, exists := c.cache[key]; exists {
+	if elem, exists := c.cache[key]; exists && c.lazy && time.Since(elem.Value.(cacheItem).entry.timestamp) > c.expiration {
+		c.remove(key)
+	} else if exists {
 		c.lruList.MoveToFront(elem)
-		return elem.Value.(cacheItem).entry.data, true
+		data := elem.Value.(cacheItem).entry.data
+		c.mu.Unlock()
+		metrics.cacheLookup(true)
+		return data, true
 	}
-	return nil, false
+	c.mu.Unlock()
+	data, exists := c.shared.read(key)
+	if exists {
+		c.store(key, data)
+	}
+	metrics.cacheLookup(exists)
+	return data, exists
+}
+
+func (c *AudioCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lruList.Len()
 }
 
 func (c *AudioCache) set(key string, data []byte) {
+	c.store(key, data)
+	c.shared.write(key, data)
+}
+
+// store caches an entry in memory only
+func (c *AudioCache) store(key string, data []byte) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	data, digest := c.intern(data)
 	if elem, exists := c.cache[key]; exists {
+		c.release(elem.Value.(cacheItem).entry.digest)
 		c.lruList.MoveToFront(elem)
-		elem.Value = cacheItem{key: key, entry: AudioCacheEntry{data: data, timestamp: time.Now()}}
+		elem.Value = cacheItem{key: key, entry: AudioCacheEntry{data: data, digest: digest, timestamp: time.Now()}}
 	} else {
 		if c.lruList.Len() >= c.maxSize {
 			oldest := c.lruList.Back()
@@ -94,7 +171,7 @@ func (c *AudioCache) set(key string, data []byte) {
 				c.remove(oldest.Value.(cacheItem).key)
 			}
 		}
-		entry := AudioCacheEntry{data: data, timestamp: time.Now()}
+		entry := AudioCacheEntry{data: data, digest: digest, timestamp: time.Now()}
 		elem := c.lruList.PushFront(cacheItem{key: key, entry: entry})
 		c.cache[key] = elem
 	}
@@ -102,7 +179,9 @@ func (c *AudioCache) set(key string, data []byte) {
 
 func (c *AudioCache) remove(key string) {
 	if elem, exists := c.cache[key]; exists {
+		c.release(elem.Value.(cacheItem).entry.digest)
 		delete(c.cache, key)
+		delete(c.owners, key)
 		c.lruList.Remove(elem)
 	}
 }
@@ -120,132 +199,916 @@ func isSafari(userAgent string) bool {
 	return strings.Contains(userAgent, "Safari") && !strings.Contains(userAgent, "Chrome")
 }
 
-func getOrGenerateAudio(text, lang string, cache *AudioCache, useOpus bool) ([]byte, error) {
-	cacheKey := fmt.Sprintf("%s:%t", hashKey(text, lang), useOpus)
+// AudioOptions controls how engine output is encoded, and the few synthesis
+// settings that are part of the same cache key
+type AudioOptions struct {
+	Format      string  // One of audioFormats; empty means AAC
+	Bitrate     string  // e.g. "32k"; empty uses the codec default
+	Speed       float64 // Tempo multiplier; 0 and 1 keep the engine's pace
+	Pitch       float64 // Semitones up or down
+	GainDB      float64 // Volume change in decibels
+	Limit       bool    // Peak-limit the output below full scale
+	Normalize   bool    // Normalize loudness to ebuR128Target
+	TrimSilence bool    // Cut the engine's leading and trailing silence
+	PadStartMS  int     // Milliseconds of silence before the speech
+	PadEndMS    int     // and after it
+	Slow        bool    // Passed on to the engine
+	Voice       string  // Passed on to the engine; for gtts the accent's domain, e.g. co.uk
+	SampleRate  int     // Output rate in Hz; 0 means outputSampleRate
+	Channels    int     // 1 or 2; 0 means mono
+	Sentences   bool    // Cache each sentence, like the sentence_cache setting; the result is the same
+}
+
+// synthesisRequest is what the engine is asked for under these options
+func (o AudioOptions) synthesisRequest(text, lang string) SynthesisRequest {
+	return SynthesisRequest{Text: text, Lang: lang, Slow: o.Slow, Voice: o.Voice}
+}
+
+// codec names the output format
+func (o AudioOptions) codec() string {
+	if o.Format == "" {
+		return "aac"
+	}
+	return o.Format
+}
+
+// mimeType is the Content-Type of the encoded audio
+func (o AudioOptions) mimeType() string {
+	return audioFormats[o.codec()].mimeType
+}
+
+// bitrate returns the requested bitrate or the format default; lossless formats have none
+func (o AudioOptions) bitrate() string {
+	format := audioFormats[o.codec()]
+	if o.Bitrate != "" && format.bitrate != "" {
+		return o.Bitrate
+	}
+	return format.bitrate
+}
+
+func (o AudioOptions) sampleRate() int {
+	if g711Tags[o.codec()] != 0 {
+		return g711SampleRate
+	}
+	if o.SampleRate == 0 {
+		return outputSampleRate
+	}
+	return o.SampleRate
+}
+
+func (o AudioOptions) channels() int {
+	if o.Channels == 0 || g711Tags[o.codec()] != 0 {
+		return 1
+	}
+	return o.Channels
+}
+
+// cacheKey identifies the encoding within an audio cache key
+func (o AudioOptions) cacheKey() string {
+	key := fmt.Sprintf("%s:%s", o.codec(), o.bitrate())
+	if o.Speed != 0 && o.Speed != 1 {
+		key += fmt.Sprintf(":x%g", o.Speed)
+	}
+	if o.Pitch != 0 {
+		key += fmt.Sprintf(":p%g", o.Pitch)
+	}
+	if o.GainDB != 0 {
+		key += fmt.Sprintf(":g%g", o.GainDB)
+	}
+	if o.Normalize {
+		key += ":n"
+	}
+	if o.TrimSilence {
+		key += ":t"
+	}
+	if o.PadStartMS != 0 || o.PadEndMS != 0 {
+		key += fmt.Sprintf(":pad%d-%d", o.PadStartMS, o.PadEndMS)
+	}
+	if o.Limit {
+		key += ":l"
+	}
+	if o.Slow {
+		key += ":slow"
+	}
+	if o.sampleRate() != outputSampleRate {
+		key += fmt.Sprintf(":r%d", o.sampleRate())
+	}
+	if o.channels() != 1 {
+		key += fmt.Sprintf(":c%d", o.channels())
+	}
+	if o.Voice != "" {
+		key += ":v" + o.Voice
+	}
+	return key
+}
+
+// atempoFilters changes tempo by factor, chaining atempo filters since each
+// accepts only 0.5 to 2
+func atempoFilters(factor float64) []string {
+	var filters []string
+	for ; factor > 2; factor /= 2 {
+		filters = append(filters, "atempo=2")
+	}
+	for ; factor < 0.5; factor /= 0.5 {
+		filters = append(filters, "atempo=0.5")
+	}
+	if factor != 1 {
+		filters = append(filters, "atempo="+strconv.FormatFloat(factor, 'f', 4, 64))
+	}
+	return filters
+}
+
+// Sample rate pitch shifting by resampling works at
+const pitchSampleRate = 24000
+
+// pitchFilters shifts pitch by semitones and returns the tempo factor still to
+// apply. The rubberband filter keeps tempo by itself; without it ffmpeg
+// resamples, which also speeds up or slows down the audio by the same factor.
+func pitchFilters(semitones float64) ([]string, float64) {
+	factor := math.Pow(2, semitones/12)
+	if rubberbandAvailable() {
+		return []string{"rubberband=pitch=" + strconv.FormatFloat(factor, 'f', 4, 64)}, 1
+	}
+	return []string{
+		"aresample=" + strconv.Itoa(pitchSampleRate),
+		fmt.Sprintf("asetrate=%d", int(pitchSampleRate*factor)),
+		"aresample=" + strconv.Itoa(pitchSampleRate),
+	}, 1 / factor
+}
+
+var (
+	rubberbandOnce sync.Once
+	rubberband     bool
+)
+
+// rubberbandAvailable reports whether ffmpeg was built with librubberband
+func rubberbandAvailable() bool {
+	rubberbandOnce.Do(func() {
+		out, err := exec.Command("ffmpeg", "-hide_banner", "-filters").Output()
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 && fields[1] == "rubberband" {
+				rubberband = true
+			}
+		}
+	})
+	return rubberband
+}
+
+// Integrated loudness, true peak and loudness range for normalized output;
+// -16 LUFS is the usual target for spoken word on the web and in podcasts
+const ebuR128Target = "loudnorm=I=-16:TP=-1.5:LRA=11"
+
+// trimSilenceFilters cut silence below -50 dB from the start, then from the
+// end by trimming the reversed audio
+var trimSilenceFilters = []string{
+	"silenceremove=start_periods=1:start_threshold=-50dB",
+	"areverse", "silenceremove=start_periods=1:start_threshold=-50dB", "areverse",
+}
+
+// filterArgs returns the ffmpeg -af arguments for the options, if any
+func (o AudioOptions) filterArgs() []string {
+	var filters []string
+	if o.TrimSilence {
+		filters = append(filters, trimSilenceFilters...)
+	}
+	tempo := 1.0
+	if o.Speed != 0 {
+		tempo = o.Speed
+	}
+	if o.Pitch != 0 {
+		shift, correction := pitchFilters(o.Pitch)
+		filters = append(filters, shift...)
+		tempo *= correction
+	}
+	filters = append(filters, atempoFilters(tempo)...)
+	if o.Normalize {
+		filters = append(filters, ebuR128Target) // Before gain, so gain_db offsets the normalized level
+	}
+	if o.GainDB != 0 {
+		filters = append(filters, fmt.Sprintf("volume=%gdB", o.GainDB))
+	}
+	if o.Limit {
+		// Peaks are held at -1 dBFS; level=0 stops alimiter from renormalizing the result
+		filters = append(filters, "alimiter=limit=0.891:level=0")
+	}
+	if o.PadStartMS > 0 {
+		filters = append(filters, fmt.Sprintf("adelay=%d:all=1", o.PadStartMS))
+	}
+	if o.PadEndMS > 0 {
+		filters = append(filters, fmt.Sprintf("apad=pad_dur=%dms", o.PadEndMS))
+	}
+	if len(filters) == 0 {
+		return nil
+	}
+	return []string{"-af", strings.Join(filters, ",")}
+}
+
+// getOrGenerateAudio returns the encoded audio and whether it came from the cache
+func getOrGenerateAudio(ctx context.Context, engine Engine, text, lang string, cache *AudioCache, opts AudioOptions) ([]byte, bool, error) {
+	cacheKey, legacyKey := audioCacheKey(engine, text, lang, opts)
 
 	// Check in-memory cache first
-	if data, exists := cache.get(cacheKey); exists {
-		return data, nil
+	_, span := startSpan(ctx, "cache.lookup")
+	data, exists := cache.lookup(cacheKey, legacyKey)
+	span.set("cache.hit", exists)
+	span.end(nil)
+	if exists {
+		cache.claim(cacheKey, principalFrom(ctx).tenant)
+		return data, true, nil
 	}
 
-	// Generate audio if not cached
-	audioData, err := generateAudioData(text, lang, useOpus)
+	// Generate audio if not cached, reusing cached sentences where enabled;
+	// edge nodes forward the request instead, see upstream.go
+	var audioData []byte
+	var err error
+	if forward := forwardFrom(ctx); forward != nil {
+		audioData, err = forward(ctx)
+	} else if sentences := cache.cacheableSentences(engine, text, opts); sentences != nil {
+		audioData, err = generateFromSentences(ctx, engine, sentences, lang, cache, opts)
+	} else {
+		audioData, err = generateAudioData(ctx, engine, text, lang, opts)
+	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	// Cache the generated audio
 	cache.set(cacheKey, audioData)
-	return audioData, nil
+	cache.claim(cacheKey, principalFrom(ctx).tenant)
+	return audioData, false, nil
+}
+
+// audioCacheKey returns the key of encoded audio, and the legacy key to fall back to; see cachekeys.go
+func audioCacheKey(engine Engine, text, lang string, opts AudioOptions) (string, string) {
+	return cacheKeys(engine.Name(), text, lang, opts.cacheKey())
 }
 
-func generateAudioData(text, lang string, useOpus bool) ([]byte, error) {
-	// Generate raw audio with gTTS
-	gttsCmd := exec.Command("gtts-cli", "--lang", lang, "--nocheck", text)
-	var gttsOut bytes.Buffer
-	gttsCmd.Stdout = &gttsOut
-	if err := gttsCmd.Run(); err != nil {
+func generateAudioData(ctx context.Context, engine Engine, text, lang string, opts AudioOptions) ([]byte, error) {
+	if workQueue != nil && dispatchable(engine) { // See workers.go
+		if readOnlyReplica {
+			return nil, errReplicaMiss
+		}
+		return workQueue.synthesize(ctx, engine, text, lang, opts)
+	}
+
+	// Generate raw audio with the engine
+	rawAudio, err := synthesize(ctx, engine, opts.synthesisRequest(text, lang))
+	if err != nil {
 		return nil, err
 	}
+	return transcodeAudio(ctx, rawAudio, opts)
+}
+
+// transcodeAudio encodes engine output with ffmpeg
+func transcodeAudio(ctx context.Context, rawAudio []byte, opts AudioOptions) ([]byte, error) {
+	// Prepare FFmpeg command based on the format
+	format := audioFormats[opts.codec()]
+	args := append([]string{"-i", "pipe:0"}, opts.filterArgs()...)
+	args = append(args, format.args...)
+	if bitrate := opts.bitrate(); bitrate != "" {
+		args = append(args, "-b:a", bitrate)
+	}
+	args = append(args, metadataArgs(ctx)...)
+	args = append(args, "-ar", strconv.Itoa(opts.sampleRate()), "-ac", strconv.Itoa(opts.channels()), "pipe:1")
+	ffmpegCmd := exec.CommandContext(ctx, "ffmpeg", args...)
 
-	// Prepare FFmpeg command based on the codec
-	var ffmpegCmd *exec.Cmd
-	if useOpus {
-		ffmpegCmd = exec.Command(
-			"ffmpeg",
-			"-i", "pipe:0",
-			"-c:a", "libopus",
-			"-b:a", "16k",
-			"-compression_level", "1",
-			"-preset", "ultrafast",
-			"-ar", "16000",
-			"-f", "opus",
-			"pipe:1",
-		)
-	} else {
-		ffmpegCmd = exec.Command(
-			"ffmpeg",
-			"-i", "pipe:0",
-			"-c:a", "aac",
-			"-b:a", "64k", // AAC bit rate, adjusted for compatibility
-			"-ar", "16000",
-			"-f", "adts", // ADTS format for AAC
-			"pipe:1",
-		)
-	}
-
-	ffmpegCmd.Stdin = &gttsOut
+	ffmpegCmd.Stdin = bytes.NewReader(rawAudio)
 	var ffmpegOut bytes.Buffer
 	ffmpegCmd.Stdout = &ffmpegOut
 
-	if err := ffmpegCmd.Run(); err != nil {
+	if err := runTimed(ctx, ffmpegCmd); err != nil {
 		return nil, err
 	}
 
+	var wav bytes.Buffer
+	switch {
+	case opts.codec() == "wav":
+		if err := writeWAV(&wav, ffmpegOut.Bytes(), opts.sampleRate(), opts.channels()); err != nil {
+			return nil, err
+		}
+		return wav.Bytes(), nil
+	case g711Tags[opts.codec()] != 0:
+		if err := writeG711WAV(&wav, ffmpegOut.Bytes(), g711Tags[opts.codec()]); err != nil {
+			return nil, err
+		}
+		return wav.Bytes(), nil
+	}
 	return ffmpegOut.Bytes(), nil
 }
 
-// CORS middleware to allow cross-origin requests
-func enableCors(next http.Handler) http.Handler {
+// originAllowed matches an Origin against the allowlist, which may contain "*"
+// or wildcard subdomains such as "https://*.example.com"
+func originAllowed(origin string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(pattern, "*"); ok &&
+			len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) &&
+			strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS middleware to allow cross-origin requests from the configured origins
+func enableCors(cfg CORSConfig, next http.Handler) http.Handler {
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+	exposed := strings.Join(cfg.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(time.Duration(cfg.MaxAge).Seconds()))
+	anyOrigin := len(cfg.AllowedOrigins) == 1 && cfg.AllowedOrigins[0] == "*"
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Only set CORS headers for /speak endpoint and POST requests
-		if r.Method == http.MethodOptions || r.Method == http.MethodPost {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		origin := r.Header.Get("Origin")
+		if origin != "" && originAllowed(origin, cfg.AllowedOrigins) {
+			if anyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			w.Header().Set("Access-Control-Expose-Headers", exposed)
 			if r.Method == http.MethodOptions {
-				w.WriteHeader(http.StatusNoContent)
-				return
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+				if cfg.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", maxAge)
+				}
 			}
 		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody caps how much of a request body handlers may read
+func limitBody(maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-func handleSpeak(w http.ResponseWriter, r *http.Request, cache *AudioCache) {
+func writeLimitError(w http.ResponseWriter, r *http.Request, code, message string, limit int64) {
+	writeProblem(w, r, Problem{Status: http.StatusRequestEntityTooLarge, Code: code, Detail: message, Limit: limit})
+}
+
+// server holds the dependencies shared by the HTTP handlers
+type server struct {
+	cfg       *Config
+	cache     *AudioCache
+	db        *Store
+	engines   map[string]Engine
+	languages map[string]languageSet // Per engine; engines missing here accept any code
+	keys      *KeyStore
+	jwt       *JWTVerifier
+	limiter   *RateLimiter
+
+	deprecations *DeprecationTracker
+	analytics    *TextAnalytics
+	costs        *CostTracker
+	egress       *EgressTracker
+	shadow       *ShadowRunner
+	quality      *QualityScorer
+	feeds        *FeedManager
+	lexicons     *Lexicons
+	usage        *UsageLedger
+	profanity    *ProfanityFilter
+	guardrail    Guardrail
+	upstream     *Upstream
+	work         *WorkQueue // Redis queue of roles api and worker
+	jobs         *JobQueue
+	clips        *ClipStore
+	access       *AccessLog
+	readiness    readiness
+	warm         *WarmPool
+}
+
+func newServer(cfg *Config) (*server, error) {
+	serverless = cfg.Serverless // Before anything that would start a goroutine
+	if cfg.Validation != validationStrict && cfg.Validation != validationLenient {
+		return nil, fmt.Errorf("validation must be %q or %q", validationStrict, validationLenient)
+	}
+	if !containsString(envelopes, cfg.ResponseEnvelope) {
+		return nil, fmt.Errorf("response_envelope must be one of %v", envelopes)
+	}
+	limiter, err := NewRateLimiter(cfg.RateLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit config: %w", err)
+	}
+	workspaces, err := NewWorkspaces(cfg.Workspace)
+	if err != nil {
+		return nil, err
+	}
+	if sandboxes, err = buildSandboxes(cfg.FFmpegSandbox, cfg.Engines); err != nil {
+		return nil, err
+	}
+	engines, err := buildEngines(cfg.Engines, cfg.DefaultEngine, cfg.ModelsDir, workspaces)
+	if err != nil {
+		return nil, err
+	}
+	shadow, err := NewShadowRunner(cfg.Shadow, engines)
+	if err != nil {
+		return nil, err
+	}
+	db, err := OpenStore(cfg.DBPath)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	keys, err := NewKeyStore(cfg.Auth, db)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AdminToken != "" && db == nil {
+		slog.Warn("Admin API enabled without -db: keys cannot be created, and updates and revocations last until restart")
+	}
+	feeds, err := NewFeedManager(cfg.Feeds, engines, cfg.DefaultEngine, db)
+	if err != nil {
+		return nil, err
+	}
+	lexicons, err := NewLexicons(db)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := NewUsageLedger(db)
+	if err != nil {
+		return nil, err
+	}
+	work, err := NewWorkQueue(cfg.Role, cfg.Redis)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Role == roleAPI {
+		workQueue = work
+	}
+	jobs := NewJobQueue(cfg.Jobs, db)
+	if !serverless {
+		if err := jobs.resume(keys); err != nil {
+			return nil, err
+		}
+	}
+	profanity, err := NewProfanityFilter(cfg.Profanity)
+	if err != nil {
+		return nil, err
+	}
+	readOnlyReplica = cfg.Replica
+	synthesisQueue = NewSynthesisQueue(cfg.SynthesisQueue)
+	if cfg.CacheKeys != "" {
+		cacheKeyScheme = cfg.CacheKeys
+	}
+	diskGuard = NewDiskGuard(cfg.DiskGuard, artifactDirs(cfg, workspaces)) // Before the clip store starts expiring clips
+	clips, err := NewClipStore(cfg.Chat)
+	if err != nil {
+		return nil, err
+	}
+	access, err := NewAccessLog(cfg.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+	return &server{
+		cfg:     cfg,
+		cache:   NewAudioCache(200, 24*time.Hour, cfg.SentenceCache, cfg.LazyExpiry, newSharedCache(cfg.SharedCache, 24*time.Hour, cfg.Replica)), // Max 200 items, 24-hour expiration
+		db:      db,
+		engines: engines,
+		keys:    keys,
+		jwt:     NewJWTVerifier(cfg.OIDC),
+		limiter: limiter,
+
+		languages:    discoverLanguages(engines),
+		deprecations: NewDeprecationTracker(),
+		analytics:    NewTextAnalytics(cfg.Analytics),
+		costs:        NewCostTracker(),
+		egress:       NewEgressTracker(),
+		shadow:       shadow,
+		quality:      NewQualityScorer(cfg.Quality),
+		feeds:        feeds,
+		lexicons:     lexicons,
+		usage:        usage,
+		profanity:    profanity,
+		guardrail:    NewGuardrail(cfg.Guardrail),
+		upstream:     NewUpstream(cfg.Upstream),
+		work:         work,
+		jobs:         jobs,
+		clips:        clips,
+		access:       access,
+		warm:         NewWarmPool(cfg.Realtime, engines),
+	}, nil
+}
+
+func (s *server) routes() *http.ServeMux {
+	protect := func(h http.Handler) http.Handler { return s.limiter.middleware(s.authenticate(h)) }
+	speak := http.HandlerFunc(s.handleSpeak)
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/speak", protect(speak))
+	mux.Handle("POST /v1/speak/events", protect(http.HandlerFunc(s.handleSpeakEvents)))
+	mux.Handle("POST /v1/readaloud", protect(http.HandlerFunc(s.handleReadAloud)))
+	if !serverless { // Jobs run after the response; see serverless.go
+		mux.Handle("POST /v1/jobs", protect(http.HandlerFunc(s.handleCreateJob)))
+		mux.Handle("GET /v1/jobs/{id}", protect(http.HandlerFunc(s.handleGetJob)))
+		mux.Handle("GET /v1/jobs/{id}/result", protect(http.HandlerFunc(s.handleJobResult)))
+	}
+	mux.Handle("GET /v1/sessions", protect(http.HandlerFunc(s.handleSession)))
+	mux.Handle("GET /ws/speak", protect(http.HandlerFunc(s.handleWSSpeak)))
+	mux.Handle("POST /v1/realtime", protect(http.HandlerFunc(s.handleRealtime)))
+	mux.Handle("GET /v1/realtime", s.apiKeyFromBearer(protect(http.HandlerFunc(s.handleOpenAIRealtime))))                                            // OpenAI Realtime compatible WebSocket
+	mux.Handle("POST /v1/audio/speech", s.apiKeyFromBearer(rewriteProblems(protect(http.HandlerFunc(s.handleAudioSpeech)), writeOpenAIError)))       // OpenAI speech API compatible
+	mux.Handle("POST /v1/text:synthesize", apiKeyFromGoogle(rewriteProblems(protect(http.HandlerFunc(s.handleGoogleSynthesize)), writeGoogleError))) // Google Cloud TTS compatible
+	mux.Handle("POST /v1/speech", s.apiKeyFromSigV4(rewriteProblems(protect(http.HandlerFunc(s.handlePollySynthesize)), writePollyError)))           // Amazon Polly SynthesizeSpeech compatible
+	mux.Handle("POST /v1/flashcards", protect(http.HandlerFunc(s.handleFlashcards)))
+	mux.Handle("POST /v1/preprocess", protect(http.HandlerFunc(s.handlePreprocess))) // Dry run of the preprocessing pipeline
+	mux.Handle("GET /v1/lexicon", protect(http.HandlerFunc(s.handleListLexicon)))
+	mux.Handle("PUT /v1/lexicon/{word}", protect(http.HandlerFunc(s.handlePutLexicon)))
+	mux.Handle("DELETE /v1/lexicon/{word}", protect(http.HandlerFunc(s.handleDeleteLexicon)))
+	mux.HandleFunc("GET /v1/contract", serveContract("v1"))
+	mux.HandleFunc("GET /v1/schemas/{name}", serveSchema)
+	mux.HandleFunc("GET /v1/languages", s.handleLanguages)
+	mux.HandleFunc("POST /v1/feeds/{name}/items", s.handleFeedWebhook) // Authenticated by the feed's signing secret
+	mux.Handle("GET /v1/feeds/{name}/items", protect(http.HandlerFunc(s.handleListNarrations)))
+	mux.Handle("GET /v1/feeds/{name}/items/{id}/audio", protect(http.HandlerFunc(s.handleNarrationAudio)))
+	mux.Handle("GET /v1/feeds/{name}/items/{id}/manifest", protect(http.HandlerFunc(s.handleNarrationManifest)))
+	mux.HandleFunc("GET /v1/manifests/key", s.handleManifestKey)        // Public, so anyone can verify manifests
+	mux.HandleFunc("POST /v1/integrations/slack", s.handleSlackCommand) // Authenticated by the platform's signature
+	mux.HandleFunc("POST /v1/integrations/teams", s.handleTeamsMessage)
+	mux.HandleFunc("GET /twiml", s.handleTwiML) // Twilio voice webhook
+	mux.HandleFunc("GET /twiml/audio", s.handleTwiMLAudio)
+	maryTTS := s.maryTTSKey(rewriteProblems(protect(http.HandlerFunc(s.handleMaryTTSProcess)), writeMaryTTSError))
+	mux.Handle("GET /process", maryTTS) // MaryTTS compatible, for Home Assistant
+	mux.Handle("POST /process", maryTTS)
+	mux.HandleFunc("GET /v1/clips/{id}", s.handleClip)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.HandleFunc("GET /version", s.handleVersion)
+	mux.Handle("/speak", protect(s.deprecations.middleware("unversioned-speak", speak))) // Kept for existing clients until its sunset
+
+	admin := func(h http.HandlerFunc) http.Handler { return requireAdmin(s.cfg.AdminToken, h) }
+	mux.Handle("GET /admin/keys", admin(s.handleListKeys))
+	mux.Handle("POST /admin/keys", admin(s.handleCreateKey))
+	mux.Handle("PATCH /admin/keys/{id}", admin(s.handleUpdateKey))
+	mux.Handle("DELETE /admin/keys/{id}", admin(s.handleRevokeKey))
+	mux.Handle("GET /admin/deprecations", admin(s.handleDeprecationReport))
+	mux.Handle("GET /admin/analytics/top-texts", admin(s.handleTopTexts))
+	mux.Handle("GET /admin/tenants/{tenant}/export", admin(s.handleExportTenant))
+	mux.Handle("DELETE /admin/tenants/{tenant}", admin(s.handleDeleteTenant))
+	mux.Handle("POST /admin/tenants/{tenant}/purge", admin(s.handlePurgeTenant))
+	mux.Handle("POST /admin/retention/run", admin(s.handleRunRetention))
+	mux.Handle("GET /admin/costs", admin(s.handleCostReport))
+	mux.Handle("GET /admin/egress", admin(s.handleEgressReport))
+	mux.Handle("GET /admin/shadow", admin(s.handleShadowReport))
+	mux.Handle("GET /admin/quality", admin(s.handleQualityReport))
+	mux.Handle("GET /admin/engines", admin(s.handleListEngines))
+	mux.Handle("POST /admin/engines/{name}/enable", admin(s.handleSetEngineState(engineEnabled)))
+	mux.Handle("POST /admin/engines/{name}/disable", admin(s.handleSetEngineState(engineDisabled)))
+	mux.Handle("POST /admin/engines/{name}/drain", admin(s.handleSetEngineState(engineDraining)))
+	mux.Handle("GET /admin/maintenance", admin(s.handleGetMaintenance))
+	mux.Handle("POST /admin/maintenance", admin(s.handleEnableMaintenance))
+	mux.Handle("DELETE /admin/maintenance", admin(s.handleDisableMaintenance))
+	mux.Handle("GET /admin/debug/runtime", admin(s.handleRuntimeStats))
+	mux.Handle("GET /admin/debug/pprof/", admin(pprofHandler(pprof.Index)))
+	mux.Handle("GET /admin/debug/pprof/cmdline", admin(pprofHandler(pprof.Cmdline)))
+	mux.Handle("GET /admin/debug/pprof/profile", admin(pprofHandler(pprof.Profile)))
+	mux.Handle("GET /admin/debug/pprof/symbol", admin(pprofHandler(pprof.Symbol)))
+	mux.Handle("GET /admin/debug/pprof/trace", admin(pprofHandler(pprof.Trace)))
+	return mux
+}
+
+// writeDecodeError reports a decodeValidated failure as 413 or 400
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeLimitError(w, r, codeBodyTooLarge, "Request body is too large", tooLarge.Limit)
+		return
+	}
+	problem := Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: " + err.Error()}
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		problem.Pointer = invalid.Pointer
+	}
+	writeProblem(w, r, problem)
+}
+
+// resolveEngine picks the requested engine and canonicalizes lang for it,
+// writing a 400 and returning false when either is not available
+func (s *server) resolveEngine(w http.ResponseWriter, r *http.Request, name, lang string) (Engine, string, bool) {
+	engine, exists := s.engineFor(name)
+	if !exists {
+		writeProblem(w, r, Problem{
+			Status:    http.StatusBadRequest,
+			Code:      codeUnknownEngine,
+			Detail:    "Invalid request payload: /engine: unknown engine",
+			Pointer:   "/engine",
+			Supported: s.engineNames(),
+		})
+		return nil, "", false
+	}
+	if !engineGates.available(engine.Name()) {
+		s.writeEngineUnavailable(w, r, engine)
+		return nil, "", false
+	}
+	canonical, supported := s.canonicalLanguage(engine, lang)
+	if !supported {
+		s.writeLanguageError(w, r, engine, lang)
+		return nil, "", false
+	}
+	return engine, canonical, true
+}
+
+func (s *server) handleSpeak(w http.ResponseWriter, r *http.Request) {
 	var payload RequestPayload
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+	if err := s.decodeValidated(r, "speak", &payload); err != nil {
+		writeDecodeError(w, r, err)
 		return
 	}
 
+	if (payload.Text == "") == (payload.SSML == "") {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: exactly one of text and ssml is required", Pointer: "/text"})
+		return
+	}
+	if payload.InputType != "" && !containsString(inputTypes, payload.InputType) {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: unsupported input_type", Pointer: "/input_type", Supported: inputTypes})
+		return
+	}
+	if payload.InputType != "" && payload.InputType != inputText && payload.SSML != "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: input_type applies to text, not ssml", Pointer: "/input_type"})
+		return
+	}
+	if payload.Symbols != "" && !containsString(symbolModes, payload.Symbols) {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: unsupported symbols", Pointer: "/symbols", Supported: symbolModes})
+		return
+	}
+	if payload.Symbols != "" && payload.Symbols != symbolsKeep && payload.SSML != "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: symbols applies to text, not ssml", Pointer: "/symbols"})
+		return
+	}
+	engine, lang, ok := s.resolveEngine(w, r, payload.Engine, payload.Lang)
+	if !ok {
+		return
+	}
+	payload.Lang = lang
+	pipeline, ok := s.resolvePipeline(w, r, payload.Pipeline)
+	if !ok {
+		return
+	}
+	pipeline.lang, pipeline.symbols, pipeline.normalize = lang, payload.Symbols, !payload.PreNormalized
+	forwarded := payload // As received, for the upstream
+	forwarded.Engine = engine.Name()
+	screened := GuardrailInput{Text: payload.Text, Lang: lang, Engine: engine.Name(), Source: "speak"}
+	pointer := "/text"
+	if payload.SSML != "" {
+		screened.Text, screened.SSML, pointer = payload.SSML, true, "/ssml"
+	}
+	var err error
+	if screened.Text, err = s.screen(r.Context(), screened); err != nil {
+		writeGuardrailError(w, r, err, pointer)
+		return
+	}
+	if screened.SSML {
+		payload.SSML = screened.Text
+	} else {
+		payload.Text = screened.Text
+	}
+
+	// Only the profanity filter applies to SSML, which has <sub> and <say-as>
+	// for what the other stages do. SSML is rendered by a wrapper engine and
+	// cached under its source. Markup with pauses is preprocessed per line.
+	p := principalFrom(r.Context())
+	if payload.SSML != "" && pipeline.has(stageProfanity) {
+		payload.SSML, err = s.profanity.apply(payload.SSML, lang)
+	}
+	if err == nil && (payload.InputType == inputHTML || payload.InputType == inputMarkdown) {
+		markup := parseMarkup(payload.Text, payload.InputType)
+		if markup.pauses() {
+			payload.Text, payload.SSML = "", markup.ssml(func(line string) string {
+				if err == nil {
+					line, err = s.preprocess(pipeline, line, nil)
+				}
+				return line
+			})
+		} else if payload.Text = markup.text(); payload.Text == "" {
+			writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: text has nothing to speak once its markup is removed", Pointer: "/text"})
+			return
+		}
+	}
+	pipeline, expand := pipeline.deferNormalize()
+	var text string
+	if err == nil {
+		text, err = s.preprocess(pipeline, payload.Text, nil)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, codeProfanity, "Text contains words that are not allowed")
+		return
+	}
+	if text == "" && payload.SSML == "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: text has nothing to speak once symbols and filtered words are removed", Pointer: "/text"})
+		return
+	}
+	spoken, cacheText := payload.Text, text
+	if payload.SSML != "" {
+		doc, err := parseSSML(payload.SSML)
+		if err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		spoken, cacheText = doc.text(), ssmlCachePrefix+payload.SSML
+		engine, expand = ssmlEngine{Engine: engine, doc: doc}, false
+	} else if payload.DetectLanguages {
+		if spans := s.languageSpans(engine, text, payload.Lang); len(spans) > 1 {
+			mixed := mixedEngine{Engine: engine, spans: spans}
+			if expand {
+				mixed = mixed.expanded()
+			}
+			cacheText = mixedCachePrefix + mixed.source()
+			engine, expand = mixed, false
+		}
+	}
+	if expand {
+		text = expandText(text, payload.Lang)
+		cacheText = text
+	}
+	if payload.Expressive && cacheText == text {
+		if doc, expressive := expressiveDocument(text, payload.Lang); expressive {
+			cacheText = expressiveCachePrefix + text
+			engine = ssmlEngine{Engine: engine, doc: doc}
+		}
+	}
+	setRequestText(r.Context(), spoken)
+
+	chars := int64(utf8.RuneCountInString(spoken))
+	if s.cfg.MaxTextChars > 0 && chars > int64(s.cfg.MaxTextChars) {
+		writeLimitError(w, r, codeTextTooLong, fmt.Sprintf("Text is %d characters long", chars), int64(s.cfg.MaxTextChars))
+		return
+	}
+	if err := s.keys.charge(p.key, chars); err != nil {
+		writeQuotaError(w, r, err)
+		return
+	}
+	s.usage.record(r.Context(), r.URL.Path, engine.Name(), payload.Lang, chars, payload.Consent)
+
 	// Detect Safari from User-Agent
 	userAgent := r.Header.Get("User-Agent")
-	useOpus := !isSafari(userAgent)
+	format := payload.Format
+	if format == "" {
+		format = defaultFormat(userAgent)
+	}
+	opts := AudioOptions{Format: format, Speed: payload.Speed, Pitch: payload.Pitch, GainDB: payload.GainDB, Limit: payload.Limit, Normalize: payload.Normalize, TrimSilence: payload.TrimSilence, PadStartMS: payload.PadStartMS, PadEndMS: payload.PadEndMS, Slow: payload.Slow, Voice: payload.TLD, SampleRate: payload.SampleRate, Channels: payload.Channels, Sentences: payload.SentenceCache}
+	if !checkEngineOptions(w, r, engine, opts) {
+		s.keys.refund(p.key, chars)
+		return
+	}
+	var echo *TransformedText
+	if payload.EchoText {
+		echo = transformedText(engine, text, payload.Lang, cacheText == text, s.cache, opts)
+	}
 
-	audioData, err := getOrGenerateAudio(payload.Text, payload.Lang, cache, useOpus)
+	start := time.Now()
+	var audioData []byte
+	var renditions []Rendition
+	var cached bool
+	if payload.Ladder {
+		renditions, audioData, cached, err = s.renderLadder(r.Context(), engine, cacheText, payload.Lang, opts)
+	} else {
+		ctx := r.Context()
+		if s.upstream != nil {
+			forwarded.Format = format
+			ctx = withForward(ctx, func(ctx context.Context) ([]byte, error) { return s.upstream.speak(ctx, forwarded) })
+		}
+		audioData, cached, err = getOrGenerateAudio(ctx, engine, cacheText, payload.Lang, s.cache, opts)
+	}
+	annotate(r.Context(), "engine", engine.Name(), "lang", payload.Lang, "text_length", chars, "cache_hit", cached)
+	setRequestSource(r.Context(), cached)
 	if err != nil {
-		http.Error(w, "Failed to generate audio", http.StatusInternalServerError)
+		annotate(r.Context(), "error", err.Error())
+		s.keys.refund(p.key, chars)
+		s.writeSynthesisError(w, r, engine, err)
 		return
 	}
+	s.costs.record(engine.Name(), chars, !cached)
+	var synthesisTime time.Duration
+	if !cached {
+		synthesisTime = time.Since(start)
+		s.quality.maybeScore(engine.Name(), audioData)
+	}
+	if cacheText == text { // Plain text only; the shadow engine could not render wrapped requests
+		s.shadow.maybeRun(engine, text, payload.Lang, opts, audioData, synthesisTime)
+	}
+	s.analytics.record(p.tenant, spoken, payload.Lang)
+	s.writeSpeech(w, r, audioData, opts, renditions, echo)
+}
 
-	// Convert audio data to Base64 string
-	base64Audio := base64.StdEncoding.EncodeToString(audioData)
-
-	// Send the Base64-encoded audio in JSON format
-	responsePayload := ResponsePayload{Audio: base64Audio}
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "public, max-age=86400")
-	json.NewEncoder(w).Encode(responsePayload)
+// Verifies the code still satisfies every published API contract
+func runCheckContract() int {
+	srv, err := newServer(defaultConfig())
+	if err != nil {
+		fatal("Failed to create server", err)
+	}
+	problems, err := checkContract("v1", srv.routes())
+	if err != nil {
+		fatal("Failed to load contract", err)
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Println("v1 contract OK")
+	return 0
 }
 
 func main() {
-	audioCache := NewAudioCache(200, 24*time.Hour) // Max 200 items, 24-hour expiration
+	if len(os.Args) > 1 && os.Args[1] == "check-contract" {
+		os.Exit(runCheckContract())
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor(os.Args[2:]))
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/speak", func(w http.ResponseWriter, r *http.Request) {
-		handleSpeak(w, r, audioCache)
-	})
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	logger, err := newLogger(cfg.LogLevel)
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	slog.SetDefault(logger)
+
+	// Bind before giving up root, so ports below 1024 work; everything the
+	// server creates afterwards belongs to the unprivileged user
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		fatal("Failed to listen", err)
+	}
+	var grpcListener net.Listener
+	if cfg.GRPC.Addr != "" { // The key may be readable by root only
+		cert, err := tls.LoadX509KeyPair(cfg.GRPC.CertFile, cfg.GRPC.KeyFile)
+		if err != nil {
+			fatal("Failed to load the gRPC certificate", err)
+		}
+		l, err := net.Listen("tcp", cfg.GRPC.Addr)
+		if err != nil {
+			fatal("Failed to listen", err)
+		}
+		grpcListener = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}})
+	}
+	if err := dropPrivileges(cfg.User, cfg.AllowRoot); err != nil {
+		fatal("Failed to drop privileges", err)
+	}
+
+	srv, err := newServer(cfg)
+	if err != nil {
+		fatal("Failed to start", err)
+	}
+	defer srv.db.Close()
+	tracer = NewTracer(cfg.Tracing)
+	if cfg.Serverless {
+		srv.fetchModels(context.Background())
+	} else {
+		go srv.fetchModels(context.Background())
+	}
+	mux := srv.routes()
+	if cfg.Role == roleWorker {
+		srv.work.work(context.Background(), srv.engines, cfg.Redis.Concurrency)
+		mux = srv.workerRoutes()
+	} else if !cfg.Serverless {
+		srv.feeds.start(context.Background(), srv)
+		srv.jobs.start(context.Background(), srv.handleSpeak)
+		go srv.runJanitor(cfg.Retention)
+		srv.warm.start()
+	}
 
 	// Create a custom HTTP server with optimized keep-alive and timeouts
 	server := &http.Server{
-		Addr:         ":8080",
-		Handler:      enableCors(mux),
+		Addr:         cfg.Addr,
+		Handler:      withRequestID(logRequests(srv.meterEgress(srv.accessLog(enableCors(cfg.CORS, limitBody(cfg.MaxBodyBytes, instrument(mux))))))),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second, // Keep connection open for reuse
 	}
 
-	log.Println("Server starting on port 8080...")
-	log.Fatal(server.ListenAndServe())
+	if grpcListener != nil {
+		grpcServer := &http.Server{
+			Handler:      withRequestID(logRequests(srv.meterEgress(srv.accessLog(limitBody(cfg.MaxBodyBytes, instrument(srv.grpcRoutes())))))),
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second, // Calls extend it to speakEventsTimeout
+			IdleTimeout:  120 * time.Second,
+		}
+		slog.Info("gRPC API starting", "addr", cfg.GRPC.Addr)
+		go func() { fatal("gRPC server stopped", grpcServer.Serve(grpcListener)) }()
+	}
+
+	slog.Info("Server starting", "addr", cfg.Addr, "role", cfg.Role, "serverless", cfg.Serverless)
+	fatal("Server stopped", server.Serve(listener))
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Maintenance mode lets an operator quiesce the service before an upgrade:
+// new syntheses are refused with a 503, while cache hits keep being served and
+// narrations already queued run to completion. Like engine states it is not
+// persisted.
+var errMaintenance = errors.New("service is in maintenance mode")
+
+const defaultMaintenanceRetryAfter = 300 // Seconds
+
+type MaintenanceState struct {
+	Enabled    bool       `json:"enabled"`
+	Since      *time.Time `json:"since,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	RetryAfter int        `json:"retry_after_seconds,omitempty"`
+	InFlight   int64      `json:"in_flight"`
+	Queued     int        `json:"queued"`
+	Drained    bool       `json:"drained"` // Nothing in flight or queued: safe to stop
+}
+
+type maintenanceMode struct {
+	mu         sync.Mutex
+	enabled    bool
+	since      time.Time
+	message    string
+	retryAfter int
+}
+
+var maintenance = &maintenanceMode{}
+
+// admit returns errMaintenance for new work while maintenance mode is on;
+// queued jobs are let through
+func (m *maintenanceMode) admit(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.enabled && ctx.Value(queuedJobContextKey) == nil {
+		return errMaintenance
+	}
+	return nil
+}
+
+func (m *maintenanceMode) active() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.enabled
+}
+
+func (m *maintenanceMode) set(enabled bool, message string, retryAfter int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if enabled && !m.enabled {
+		m.since = time.Now()
+	}
+	m.enabled, m.message, m.retryAfter = enabled, message, retryAfter
+	if !enabled {
+		m.since, m.message, m.retryAfter = time.Time{}, "", 0
+	}
+}
+
+func (m *maintenanceMode) view() MaintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := MaintenanceState{Enabled: m.enabled, Message: m.message, RetryAfter: m.retryAfter}
+	if m.enabled {
+		since := m.since
+		state.Since = &since
+	}
+	return state
+}
+
+// withQueuedJob marks ctx as belonging to work accepted before maintenance began
+func withQueuedJob(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queuedJobContextKey, true)
+}
+
+func writeMaintenance(w http.ResponseWriter, r *http.Request) {
+	state := maintenance.view()
+	detail := "The service is in maintenance mode; only cached audio is available"
+	if state.Message != "" {
+		detail = state.Message
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfter))
+	writeError(w, r, http.StatusServiceUnavailable, codeMaintenance, detail)
+}
+
+func (s *server) maintenanceState() MaintenanceState {
+	state := maintenance.view()
+	state.InFlight = metrics.inFlight.Load()
+	state.Queued = s.feeds.depth() + s.jobs.depth() + synthesisQueue.depth()
+	state.Drained = state.InFlight == 0 && state.Queued == 0
+	return state
+}
+
+func (s *server) handleGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.maintenanceState())
+}
+
+func (s *server) handleEnableMaintenance(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Message    string `json:"message"`
+		RetryAfter *int   `json:"retry_after_seconds"`
+	}
+	if r.ContentLength != 0 { // The body is optional
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request payload")
+			return
+		}
+	}
+	retryAfter := defaultMaintenanceRetryAfter
+	if payload.RetryAfter != nil {
+		if *payload.RetryAfter < 1 || *payload.RetryAfter > 86400 {
+			writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: /retry_after_seconds: must be from 1 to 86400", Pointer: "/retry_after_seconds"})
+			return
+		}
+		retryAfter = *payload.RetryAfter
+	}
+	maintenance.set(true, payload.Message, retryAfter)
+	writeJSON(w, http.StatusOK, s.maintenanceState())
+}
+
+func (s *server) handleDisableMaintenance(w http.ResponseWriter, r *http.Request) {
+	maintenance.set(false, "", 0)
+	writeJSON(w, http.StatusOK, s.maintenanceState())
+}
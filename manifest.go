@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Narrations can be accompanied by a manifest recording how the audio was
+// made: its hash, the parameters, the software versions and when it was
+// generated. Manifests are signed with an Ed25519 key so the provenance of
+// audio can be checked long after the fact, by anyone holding the public key
+// from /v1/manifests/key:
+//
+//	base64 -d item.manifest.sig > item.sig
+//	openssl pkeyutl -verify -pubin -inkey key.pem -rawin -in item.manifest.json -sigfile item.sig
+//	sha256sum item.aac
+//
+// The signature covers the manifest file byte for byte, so it is stored
+// next to it rather than inside it.
+
+// Bumped whenever fields change meaning or are removed
+const manifestVersion = 1
+
+// ArtifactManifest describes one generated audio file
+type ArtifactManifest struct {
+	ManifestVersion int                `json:"manifest_version"`
+	Artifact        string             `json:"artifact"` // File name, in the manifest's directory
+	SHA256          string             `json:"sha256"`
+	Bytes           int                `json:"bytes"`
+	MimeType        string             `json:"mime_type"`
+	TextSHA256      string             `json:"text_sha256"` // The text itself is not recorded
+	Chars           int                `json:"chars"`
+	Feed            string             `json:"feed"`
+	ItemID          string             `json:"item_id"`
+	Parameters      ManifestParameters `json:"parameters"`
+	Software        map[string]string  `json:"software"` // This service and the tools that produced the audio
+	CreatedAt       time.Time          `json:"created_at"`
+	KeyID           string             `json:"key_id"` // Of the key that signed the manifest
+}
+
+type ManifestParameters struct {
+	Engine string `json:"engine"`
+	Lang   string `json:"lang"`
+	Format string `json:"format"`
+}
+
+// ManifestSigner signs artifact manifests
+type ManifestSigner struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+// NewManifestSigner loads a PEM-encoded Ed25519 private key, as written by
+// `openssl genpkey -algorithm ed25519`; it returns nil when path is empty
+func NewManifestSigner(path string) (*ManifestSigner, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("manifest key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("manifest key: no PEM block found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("manifest key: %w", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("manifest key: not an Ed25519 key")
+	}
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	return &ManifestSigner{key: key, keyID: hex.EncodeToString(sum[:8])}, nil
+}
+
+// write stores the manifest of the narration's audio and its signature next
+// to the audio, returning the manifest's file name
+func (s *ManifestSigner) write(m *FeedManager, f *feed, n *Narration, text string, audio []byte) (string, error) {
+	audioSum := sha256.Sum256(audio)
+	textSum := sha256.Sum256([]byte(text))
+	tools := detectToolVersions()
+	manifest := ArtifactManifest{
+		ManifestVersion: manifestVersion,
+		Artifact:        filepath.Base(n.File),
+		SHA256:          hex.EncodeToString(audioSum[:]),
+		Bytes:           len(audio),
+		MimeType:        "audio/aac",
+		TextSHA256:      hex.EncodeToString(textSum[:]),
+		Chars:           n.Chars,
+		Feed:            n.Feed,
+		ItemID:          n.ItemID,
+		Parameters:      ManifestParameters{Engine: n.Engine, Lang: n.Lang, Format: "aac"},
+		Software: map[string]string{
+			"gtts-service": strings.TrimSuffix(version+" "+buildInfo().Commit, " "),
+			"ffmpeg":       tools["ffmpeg"],
+		},
+		CreatedAt: time.Now().UTC(),
+		KeyID:     s.keyID,
+	}
+	if _, ok := f.engine.(*gttsEngine); ok { // Command engines do not report versions
+		manifest.Software["gtts-cli"] = tools["gtts-cli"]
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	file := strings.TrimSuffix(n.File, filepath.Ext(n.File)) + ".manifest.json"
+	if err := m.writeArtifact(file, data); err != nil {
+		return "", err
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, data))
+	if err := m.writeArtifact(strings.TrimSuffix(file, ".json")+".sig", []byte(signature+"\n")); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// publicKeyPEM returns the key manifests are verified with
+func (s *ManifestSigner) publicKeyPEM() ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func (s *server) handleManifestKey(w http.ResponseWriter, r *http.Request) {
+	if s.feeds == nil || s.feeds.signer == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Manifests are not signed")
+		return
+	}
+	key, err := s.feeds.signer.publicKeyPEM()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to encode the manifest key")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("X-Key-Id", s.feeds.signer.keyID)
+	w.Write(key)
+}
+
+// handleNarrationManifest serves a narration's manifest with its signature in X-Signature
+func (s *server) handleNarrationManifest(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.feedFor(w, r)
+	if !ok {
+		return
+	}
+	n, exists := s.feeds.lookup(f.cfg.Name, r.PathValue("id"))
+	if !exists || n.Manifest == "" || n.Error != "" {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No manifest for this item")
+		return
+	}
+	path := filepath.Join(s.feeds.audioDir, n.Manifest)
+	manifest, err := os.ReadFile(path)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No manifest for this item")
+		return
+	}
+	signature, err := os.ReadFile(strings.TrimSuffix(path, ".json") + ".sig")
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "No manifest for this item")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Signature", "ed25519="+strings.TrimSpace(string(signature)))
+	w.Write(manifest)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// CMS content can be sent as HTML or Markdown with input_type, instead of
+// being sanitized by the client first. Markup is stripped down to lines of
+// text grouped in paragraphs: line breaks (<br>, or a Markdown line ending
+// in two spaces) become short pauses, and paragraph ends (block elements,
+// blank lines, headings and list items) longer ones. Text with pauses is
+// spoken through the SSML renderer; text without them as plain text.
+
+const (
+	inputText     = "text"
+	inputHTML     = "html"
+	inputMarkdown = "markdown"
+)
+
+var inputTypes = []string{inputText, inputHTML, inputMarkdown}
+
+// Elements that end a paragraph; any other tag is dropped, keeping its text
+var htmlBlockElements = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "header": true, "footer": true, "aside": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "blockquote": true, "pre": true,
+	"ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true, "table": true, "tr": true, "hr": true,
+	"figure": true, "figcaption": true, "main": true, "nav": true,
+}
+
+// Elements whose content is never spoken
+var htmlSkippedElements = map[string]bool{"script": true, "style": true, "template": true, "noscript": true, "head": true}
+
+var (
+	htmlTagPattern = regexp.MustCompile(`^</?([a-zA-Z][a-zA-Z0-9]*)`)
+
+	markdownHeading    = regexp.MustCompile(`^#{1,6}\s+`)
+	markdownListItem   = regexp.MustCompile(`^(?:[-*+]|\d{1,9}[.)])\s+`)
+	markdownQuote      = regexp.MustCompile(`^(?:>\s?)+`)
+	markdownRule       = regexp.MustCompile(`^(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	markdownImage      = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink       = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	markdownAutolink   = regexp.MustCompile(`<(?:https?|mailto):[^>]*>`)
+	markdownInlineHTML = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+	markdownEmphasis   = regexp.MustCompile("\\*{1,3}|_{2,3}|~~|`+|\\b_|_\\b")
+)
+
+// markupText is stripped markup: paragraphs of lines
+type markupText [][]string
+
+// parseHTML strips tags, comments and scripts and decodes entities
+func parseHTML(source string) markupText {
+	var doc markupText
+	var line strings.Builder
+	var lines []string
+	endLine := func() {
+		if text := strings.Join(strings.Fields(html.UnescapeString(line.String())), " "); text != "" {
+			lines = append(lines, text)
+		}
+		line.Reset()
+	}
+	endParagraph := func() {
+		endLine()
+		if len(lines) > 0 {
+			doc = append(doc, lines)
+			lines = nil
+		}
+	}
+
+	for source != "" {
+		start := strings.IndexByte(source, '<')
+		if start < 0 {
+			line.WriteString(source)
+			break
+		}
+		line.WriteString(source[:start])
+		source = source[start:]
+		if strings.HasPrefix(source, "<!--") {
+			end := strings.Index(source, "-->")
+			if end < 0 {
+				break
+			}
+			source = source[end+3:]
+			continue
+		}
+		end := strings.IndexByte(source, '>')
+		match := htmlTagPattern.FindStringSubmatch(source)
+		if end < 0 || match == nil {
+			line.WriteByte('<') // A literal "<", as in "a < b"
+			source = source[1:]
+			continue
+		}
+		tag := strings.ToLower(match[1])
+		closing := strings.HasPrefix(source, "</")
+		source = source[end+1:]
+		switch {
+		case htmlSkippedElements[tag] && !closing:
+			if end := strings.Index(strings.ToLower(source), "</"+tag); end >= 0 {
+				source = source[end:]
+			} else {
+				source = ""
+			}
+		case tag == "br":
+			endLine()
+		case htmlBlockElements[tag]:
+			endParagraph()
+		case tag == "td" || tag == "th":
+			line.WriteString(" ")
+		}
+	}
+	endParagraph()
+	return doc
+}
+
+// parseMarkdown strips CommonMark syntax; fenced code blocks are not spoken
+func parseMarkdown(source string) markupText {
+	var doc markupText
+	var lines []string
+	var line []string // Source lines joined into the current spoken line
+	endLine := func() {
+		if text := strings.Join(strings.Fields(stripMarkdownInline(strings.Join(line, " "))), " "); text != "" {
+			lines = append(lines, text)
+		}
+		line = nil
+	}
+	endParagraph := func() {
+		endLine()
+		if len(lines) > 0 {
+			doc = append(doc, lines)
+			lines = nil
+		}
+	}
+
+	fenced := false
+	for _, raw := range strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(raw)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fenced = !fenced
+			endParagraph()
+			continue
+		}
+		if fenced {
+			continue
+		}
+		trimmed = markdownQuote.ReplaceAllString(trimmed, "")
+		switch {
+		case trimmed == "" || markdownRule.MatchString(trimmed):
+			endParagraph()
+			continue
+		case markdownHeading.MatchString(trimmed):
+			endParagraph()
+			line = append(line, strings.TrimRight(markdownHeading.ReplaceAllString(trimmed, ""), "# "))
+			endParagraph()
+			continue
+		case markdownListItem.MatchString(trimmed):
+			endLine()
+			trimmed = markdownListItem.ReplaceAllString(trimmed, "")
+		}
+		hardBreak := strings.HasSuffix(raw, "  ") || strings.HasSuffix(trimmed, "\\")
+		line = append(line, strings.TrimSuffix(trimmed, "\\"))
+		if hardBreak {
+			endLine()
+		}
+	}
+	endParagraph()
+	return doc
+}
+
+func stripMarkdownInline(text string) string {
+	text = markdownImage.ReplaceAllString(text, "$1")
+	text = markdownLink.ReplaceAllString(text, "$1")
+	text = markdownAutolink.ReplaceAllString(text, "")
+	text = markdownInlineHTML.ReplaceAllString(text, "")
+	text = markdownEmphasis.ReplaceAllString(text, "")
+	return html.UnescapeString(text)
+}
+
+func parseMarkup(source, inputType string) markupText {
+	if inputType == inputHTML {
+		return parseHTML(source)
+	}
+	return parseMarkdown(source)
+}
+
+// text returns all lines joined, for markup without pauses
+func (m markupText) text() string {
+	var lines []string
+	for _, paragraph := range m {
+		lines = append(lines, paragraph...)
+	}
+	return strings.Join(lines, " ")
+}
+
+func (m markupText) pauses() bool {
+	return len(m) > 1 || len(m) == 1 && len(m[0]) > 1
+}
+
+// ssml renders the lines as SSML with breaks between them, after passing
+// each through prepare
+func (m markupText) ssml(prepare func(string) string) string {
+	var b strings.Builder
+	b.WriteString("<speak>")
+	for i, paragraph := range m {
+		if i > 0 {
+			b.WriteString(`<break strength="strong"/>`)
+		}
+		for j, line := range paragraph {
+			if j > 0 {
+				b.WriteString(`<break strength="medium"/>`)
+			}
+			b.WriteString(html.EscapeString(prepare(line)))
+		}
+	}
+	b.WriteString("</speak>")
+	return b.String()
+}
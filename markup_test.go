@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHTML(t *testing.T) {
+	tests := []struct {
+		name, source string
+		want         markupText
+	}{
+		{"inline tags", "<b>Bold</b> and <a href=\"/x\">link</a>", markupText{{"Bold and link"}}},
+		{"paragraphs", "<p>One</p><p>Two</p>", markupText{{"One"}, {"Two"}}},
+		{"line breaks", "First<br>second<br/>third", markupText{{"First", "second", "third"}}},
+		{"list items", "<ul><li>Milk</li><li>Eggs</li></ul>", markupText{{"Milk"}, {"Eggs"}}},
+		{"entities", "Fish &amp; chips &lt;3", markupText{{"Fish & chips <3"}}},
+		{"literal less-than", "a < b", markupText{{"a < b"}}},
+		{"comments", "Kept<!-- dropped -->", markupText{{"Kept"}}},
+		{"skipped elements", "<script>alert(1)</script><STYLE>p{}</STYLE>Text", markupText{{"Text"}}},
+		{"table cells", "<table><tr><td>A</td><td>B</td></tr></table>", markupText{{"A B"}}},
+		{"whitespace", "  Spread\n\tout  ", markupText{{"Spread out"}}},
+		{"empty", "<div> </div>", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseHTML(tt.source); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHTML(%q) = %q, want %q", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMarkdown(t *testing.T) {
+	tests := []struct {
+		name, source string
+		want         markupText
+	}{
+		{"paragraph", "One line\ncontinues", markupText{{"One line continues"}}},
+		{"paragraphs", "One\n\nTwo", markupText{{"One"}, {"Two"}}},
+		{"hard breaks", "First  \nsecond\\\nthird", markupText{{"First", "second", "third"}}},
+		{"heading", "# Title #\nBody", markupText{{"Title"}, {"Body"}}},
+		{"list", "- Milk\n- Eggs\n1. First", markupText{{"Milk", "Eggs", "First"}}},
+		{"emphasis", "**Bold**, *it*, __under__ and `code`", markupText{{"Bold, it, under and code"}}},
+		{"snake case", "call snake_case_name", markupText{{"call snake_case_name"}}},
+		{"links and images", "See [the docs](https://x) ![a chart](c.png) <https://x>", markupText{{"See the docs a chart"}}},
+		{"quote", "> Quoted\n> text", markupText{{"Quoted text"}}},
+		{"rule", "Above\n---\nBelow", markupText{{"Above"}, {"Below"}}},
+		{"fenced code", "Before\n```\ncode()\n```\nAfter", markupText{{"Before"}, {"After"}}},
+		{"crlf", "One\r\n\r\nTwo", markupText{{"One"}, {"Two"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseMarkdown(tt.source); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMarkdown(%q) = %q, want %q", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkupRendering(t *testing.T) {
+	tests := []struct {
+		name   string
+		markup markupText
+		text   string
+		pauses bool
+		ssml   string
+	}{
+		{"one line", markupText{{"Hello"}}, "Hello", false, "<speak>HELLO</speak>"},
+		{"lines", markupText{{"A", "B"}}, "A B", true, `<speak>A<break strength="medium"/>B</speak>`},
+		{"paragraphs", markupText{{"A"}, {"B & C"}}, "A B & C", true, `<speak>A<break strength="strong"/>B &amp; C</speak>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.markup.text(); got != tt.text {
+				t.Errorf("text() = %q, want %q", got, tt.text)
+			}
+			if got := tt.markup.pauses(); got != tt.pauses {
+				t.Errorf("pauses() = %v, want %v", got, tt.pauses)
+			}
+			if got := tt.markup.ssml(strings.ToUpper); got != tt.ssml {
+				t.Errorf("ssml() = %q, want %q", got, tt.ssml)
+			}
+		})
+	}
+}
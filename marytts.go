@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"net/http"
+	"strings"
+)
+
+// /process answers like a MaryTTS server, so Home Assistant's MaryTTS
+// integration, and other MaryTTS clients, can use this server as their voice
+// backend by pointing host and port here. Parameters come from the query or
+// a form body, as MaryTTS takes them, and run through handleSpeak:
+//
+//	INPUT_TEXT     text, or ssml when INPUT_TYPE is SSML
+//	INPUT_TYPE     TEXT, the default, or SSML
+//	OUTPUT_TYPE    AUDIO, the default; nothing else is produced
+//	LOCALE         lang, e.g. en_US
+//	AUDIO          WAVE_FILE, the default, AU_FILE or AIFF_FILE (16-bit mono PCM)
+//	VOICE          engine, when it names one; ignored otherwise
+//
+// Effect parameters are ignored. Errors are plain text, as MaryTTS sends
+// them. Home Assistant sends no credentials, so requests without any
+// authenticate with marytts.api_key when it is set; only set it where
+// /process is reachable from trusted networks alone.
+
+type MaryTTSConfig struct {
+	APIKey string `json:"api_key"` // Used by /process requests that send no credentials
+}
+
+// Sample rate of the audio /process returns
+const maryTTSSampleRate = 16000
+
+var maryTTSAudioTypes = []string{"WAVE_FILE", "AU_FILE", "AIFF_FILE"}
+
+// writeMaryTTSError answers problem in plain text, as MaryTTS does
+func writeMaryTTSError(w http.ResponseWriter, r *http.Request, problem *Problem) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(problem.Status)
+	io.WriteString(w, problem.Detail+"\n")
+}
+
+// maryTTSKey authenticates requests that send no credentials with the
+// configured key, before authentication
+func (s *server) maryTTSKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.MaryTTS.APIKey != "" && r.Header.Get("X-API-Key") == "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("X-API-Key", s.cfg.MaryTTS.APIKey)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) handleMaryTTSProcess(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	text := r.Form.Get("INPUT_TEXT")
+	if strings.TrimSpace(text) == "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "INPUT_TEXT is required", Pointer: "/text"})
+		return
+	}
+	if output := r.Form.Get("OUTPUT_TYPE"); output != "" && output != "AUDIO" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "OUTPUT_TYPE must be AUDIO", Supported: []string{"AUDIO"}})
+		return
+	}
+	audioType := r.Form.Get("AUDIO")
+	if audioType == "" {
+		audioType = "WAVE_FILE"
+	}
+	if !containsString(maryTTSAudioTypes, audioType) {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "AUDIO must be one of " + strings.Join(maryTTSAudioTypes, ", "), Pointer: "/format", Supported: maryTTSAudioTypes})
+		return
+	}
+	locale := r.Form.Get("LOCALE")
+	if locale == "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "LOCALE is required", Pointer: "/lang"})
+		return
+	}
+
+	payload := RequestPayload{Lang: strings.ReplaceAll(locale, "_", "-"), Format: "wav", SampleRate: maryTTSSampleRate}
+	switch r.Form.Get("INPUT_TYPE") {
+	case "", "TEXT":
+		payload.Text = text
+	case "SSML":
+		payload.SSML = text
+	default:
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "INPUT_TYPE must be TEXT or SSML", Pointer: "/input_type", Supported: []string{"TEXT", "SSML"}})
+		return
+	}
+	if voice := r.Form.Get("VOICE"); voice != "" {
+		if _, exists := s.engineFor(voice); exists {
+			payload.Engine = voice
+		}
+	}
+	payload.Lang = s.baseLanguage(payload.Engine, payload.Lang)
+	speakReq, err := speakRequest(r, payload)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to build the speak request")
+		return
+	}
+
+	rec := &jobRecorder{header: make(http.Header), status: http.StatusOK}
+	s.handleSpeak(rec, speakReq)
+	if rec.status != http.StatusOK {
+		rec.replay(w)
+		return
+	}
+	if audioType == "WAVE_FILE" {
+		w.Header().Set("Content-Type", "audio/x-wav")
+		w.Write(rec.body.Bytes())
+		return
+	}
+	pcm, ok := pcmFromWAV(rec.body.Bytes())
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, codeSynthesisFailed, "Failed to generate audio")
+		return
+	}
+	if audioType == "AU_FILE" {
+		w.Header().Set("Content-Type", "audio/basic")
+		writeAU(w, pcm, maryTTSSampleRate)
+	} else {
+		w.Header().Set("Content-Type", "audio/x-aiff")
+		writeAIFF(w, pcm, maryTTSSampleRate)
+	}
+}
+
+// bigEndianPCM returns little-endian 16-bit samples in big-endian order, as
+// AU and AIFF store them
+func bigEndianPCM(pcm []byte) []byte {
+	swapped := make([]byte, len(pcm)&^1)
+	for i := 0; i+1 < len(pcm); i += 2 {
+		swapped[i], swapped[i+1] = pcm[i+1], pcm[i]
+	}
+	return swapped
+}
+
+// writeAU writes 16-bit mono PCM as a Sun AU file
+func writeAU(w io.Writer, pcm []byte, sampleRate int) error {
+	samples := bigEndianPCM(pcm)
+	header := []any{
+		[4]byte{'.', 's', 'n', 'd'}, uint32(24), uint32(len(samples)), // Header size, data size
+		uint32(3), uint32(sampleRate), uint32(1), // 16-bit linear PCM, one channel
+	}
+	for _, field := range header {
+		if err := binary.Write(w, binary.BigEndian, field); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(samples)
+	return err
+}
+
+// writeAIFF writes 16-bit mono PCM as an AIFF file, whose sample rate is an
+// 80-bit extended precision float
+func writeAIFF(w io.Writer, pcm []byte, sampleRate int) error {
+	samples := bigEndianPCM(pcm)
+	shift := bits.Len32(uint32(sampleRate)) - 1
+	header := []any{
+		[4]byte{'F', 'O', 'R', 'M'}, uint32(46 + len(samples)), [4]byte{'A', 'I', 'F', 'F'},
+		[4]byte{'C', 'O', 'M', 'M'}, uint32(18), uint16(1), uint32(len(samples) / 2), uint16(16), // One channel, frames, bits per sample
+		uint16(16383 + shift), uint64(sampleRate) << (63 - shift), // Sample rate: exponent, mantissa
+		[4]byte{'S', 'S', 'N', 'D'}, uint32(8 + len(samples)), uint32(0), uint32(0), // Offset, block size
+	}
+	for _, field := range header {
+		if err := binary.Write(w, binary.BigEndian, field); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(samples)
+	return err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are kept in-process and written in the Prometheus text exposition
+// format at /metrics. Only counters, gauges and histograms are needed, so
+// this avoids pulling in the client library.
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Quality scores run from 1 to 5; see quality.go
+var qualityBuckets = []float64{1, 1.5, 2, 2.5, 3, 3.5, 4, 4.5, 5}
+
+// counterVec is a counter partitioned by label values
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]float64 // Keyed by the rendered label set
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{values: make(map[string]float64)}
+}
+
+func (c *counterVec) add(labels string, v float64) {
+	c.mu.Lock()
+	c.values[labels] += v
+	c.mu.Unlock()
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram partitioned by label values
+type histogramVec struct {
+	mu      sync.Mutex
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramVec(buckets []float64) *histogramVec {
+	return &histogramVec{buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(labels string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, exists := h.values[labels]
+	if !exists {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[labels] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+// Metrics holds every metric the service exports
+type Metrics struct {
+	requests        *counterVec
+	requestDuration *histogramVec
+	cacheLookups    *counterVec
+	subprocess      *histogramVec
+	egress          *counterVec
+	qualityScores   *histogramVec
+	qualityLow      *counterVec
+	inFlight        atomic.Int64
+}
+
+var metrics = &Metrics{
+	requests:        newCounterVec(),
+	requestDuration: newHistogramVec(latencyBuckets),
+	cacheLookups:    newCounterVec(),
+	subprocess:      newHistogramVec(latencyBuckets),
+	egress:          newCounterVec(),
+	qualityScores:   newHistogramVec(qualityBuckets),
+	qualityLow:      newCounterVec(),
+}
+
+// labels renders label pairs such as labels("route", "/v1/speak") as `route="/v1/speak"`
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *Metrics) cacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.add(labels("result", result), 1)
+}
+
+func (m *Metrics) cacheHitRatio() float64 {
+	m.cacheLookups.mu.Lock()
+	defer m.cacheLookups.mu.Unlock()
+	hits, misses := m.cacheLookups.values[labels("result", "hit")], m.cacheLookups.values[labels("result", "miss")]
+	if hits+misses == 0 {
+		return 0
+	}
+	return hits / (hits + misses)
+}
+
+// runTimed runs cmd in its own span and records how long the subprocess took
+func runTimed(ctx context.Context, cmd *exec.Cmd) error {
+	command := filepath.Base(cmd.Args[0])
+	_, span := startSpan(ctx, command, "process.command", command)
+	tagProcess(ctx, cmd, span)
+	release, err := sandboxProcess(cmd)
+	if err != nil {
+		span.end(err)
+		return err
+	}
+	defer release()
+	start := time.Now()
+	err = cmd.Run()
+	metrics.subprocess.observe(labels("command", command), time.Since(start).Seconds())
+	span.end(err)
+	return err
+}
+
+// statusRecorder captures the status code and body size written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Instrumentation middleware counting requests and their latency by route
+// pattern and starting the request's server span. Unmatched paths share one
+// label so scanners cannot blow up cardinality.
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		setRequestRoute(r.Context(), route)
+		ctx, span := tracer.startRequestSpan(r, route)
+		span.set("http.request.method", r.Method, "http.route", route, "url.path", r.URL.Path, "http.request_id", requestIDFrom(ctx))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(rec, r.WithContext(ctx))
+		metrics.requests.add(labels("route", route, "code", strconv.Itoa(rec.status)), 1)
+		metrics.requestDuration.observe(labels("route", route), time.Since(start).Seconds())
+		span.set("http.response.status_code", rec.status)
+		var err error
+		if rec.status >= 500 {
+			err = fmt.Errorf("HTTP %d", rec.status)
+		}
+		span.end(err)
+	})
+}
+
+func writeCounter(w io.Writer, name, help string, c *counterVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, key, formatFloat(c.values[key]))
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, key := range sortedKeys(values) {
+		if key == "" {
+			fmt.Fprintf(w, "%s %s\n", name, formatFloat(values[key]))
+		} else {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, key, formatFloat(values[key]))
+		}
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogramVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, key, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, key, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, key, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, key, hist.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Serves all metrics in the Prometheus text format
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeCounter(w, "tts_http_requests_total", "HTTP requests by route and status code.", metrics.requests)
+	writeHistogram(w, "tts_http_request_duration_seconds", "HTTP request latency by route.", metrics.requestDuration)
+	writeCounter(w, "tts_egress_bytes_total", "Response bytes by route and source (cache, synthesis or other); per tenant at /admin/egress.", metrics.egress)
+	writeCounter(w, "tts_cache_lookups_total", "Audio cache lookups by result (hit or miss).", metrics.cacheLookups)
+	writeGauge(w, "tts_cache_hit_ratio", "Fraction of audio cache lookups that hit since startup.", map[string]float64{"": metrics.cacheHitRatio()})
+	writeGauge(w, "tts_cache_entries", "Entries in the in-memory audio cache.", map[string]float64{"": float64(s.cache.len())})
+	stored, saved := s.cache.footprint()
+	writeGauge(w, "tts_cache_bytes", "Audio held by the in-memory cache, counting identical audio once.", map[string]float64{"": float64(stored)})
+	writeGauge(w, "tts_cache_deduplicated_bytes", "Bytes saved by sharing identical audio between cache entries.", map[string]float64{"": float64(saved)})
+	writeHistogram(w, "tts_subprocess_duration_seconds", "Duration of engine, ffmpeg and predictor subprocesses.", metrics.subprocess)
+	writeGauge(w, "tts_synthesis_in_flight", "Syntheses currently running.", map[string]float64{"": float64(metrics.inFlight.Load())})
+	writeGauge(w, "tts_queue_depth", "Items waiting in work queues.", map[string]float64{labels("queue", "feeds"): float64(s.feeds.depth()), labels("queue", "jobs"): float64(s.jobs.depth()), labels("queue", "synthesis"): float64(synthesisQueue.depth())})
+	free, low := diskGuard.freeBytes()
+	writeGauge(w, "tts_disk_free_bytes", "Free space on the volume of each data directory.", free)
+	writeGauge(w, "tts_disk_low", "Whether writes to a data directory are paused for lack of space.", low)
+	writeHistogram(w, "tts_quality_score", "Quality scores (1-5) of sampled fresh syntheses by engine.", metrics.qualityScores)
+	writeCounter(w, "tts_quality_low_total", "Sampled syntheses scored under quality.alert_below, by engine.", metrics.qualityLow)
+}
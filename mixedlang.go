@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// Texts often switch language between sentences, e.g. an English
+// announcement followed by its Indonesian translation. Spoken with one voice
+// the foreign sentences are mangled, so on request each sentence's language
+// is detected and runs of sentences in the same language are spoken with
+// that language's voice. Detection is deliberately simple: a sentence's
+// script decides for scripts used by one language, and common function words
+// decide between languages written in Latin script. Sentences that give no
+// clear answer, including most very short ones, keep the request language.
+
+// Marks mixed-language sources in cache keys so they never collide with the same text spoken in one language
+const mixedCachePrefix = "\x00mixed:"
+
+// Languages identified by their script alone, with the codes engines may
+// know them by, in order of preference
+var scriptLanguages = []struct {
+	script *unicode.RangeTable
+	codes  []string
+}{
+	{unicode.Hiragana, []string{"ja"}},
+	{unicode.Katakana, []string{"ja"}},
+	{unicode.Hangul, []string{"ko"}},
+	{unicode.Han, []string{"zh-CN", "zh"}},
+	{unicode.Cyrillic, []string{"ru"}},
+	{unicode.Arabic, []string{"ar"}},
+	{unicode.Devanagari, []string{"hi"}},
+	{unicode.Thai, []string{"th"}},
+	{unicode.Greek, []string{"el"}},
+	{unicode.Hebrew, []string{"he", "iw"}},
+}
+
+// Frequent words that set Latin-script languages apart
+var functionWords = map[string]map[string]bool{
+	"en": wordSet("the and is are of to with this that you for it was have not what be will your"),
+	"id": wordSet("yang dan di ke dari ini itu dengan untuk tidak saya anda adalah akan ada kami bisa sudah kita"),
+	"es": wordSet("el los las que y en es por con para una del no muy está pero como su"),
+	"fr": wordSet("le les des est et un une du que pour avec dans pas je vous nous sur ce"),
+	"de": wordSet("der die das und ist nicht ich ein eine mit zu auf für sie wir den es"),
+	"pt": wordSet("o os que e é não um uma com para do da em você mas muito são"),
+	"it": wordSet("il lo gli che di è non un una per con del della sono ma anche"),
+	"nl": wordSet("de het een en is niet van ik je dat met voor op zijn ook"),
+}
+
+func wordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+// languageSpan is a run of sentences in one language
+type languageSpan struct {
+	text string
+	lang string
+}
+
+// languageSpans splits text into runs of sentences by detected language.
+// Detected languages the engine does not support are spoken in lang.
+func (s *server) languageSpans(engine Engine, text, lang string) []languageSpan {
+	var spans []languageSpan
+	for _, sentence := range splitSentences(text) {
+		spoken := lang
+		for _, code := range detectLanguage(sentence, lang) {
+			if canonical, supported := s.canonicalLanguage(engine, code); supported {
+				spoken = canonical
+				break
+			}
+		}
+		if n := len(spans); n > 0 && spans[n-1].lang == spoken {
+			spans[n-1].text += " " + sentence
+			continue
+		}
+		spans = append(spans, languageSpan{text: sentence, lang: spoken})
+	}
+	return spans
+}
+
+// detectLanguage returns candidate codes for the language of sentence, or
+// nil when it is lang or cannot be told
+func detectLanguage(sentence, lang string) []string {
+	base, _, _ := strings.Cut(strings.ToLower(lang), "-")
+
+	counts := make([]int, len(scriptLanguages))
+	latin, best := 0, -1
+	for _, r := range sentence {
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for i, sl := range scriptLanguages {
+			if unicode.Is(sl.script, r) {
+				counts[i]++
+				break
+			}
+		}
+	}
+	if counts[0]+counts[1] > 0 {
+		counts[0] += counts[1] + counts[3] // Kanji in a sentence with kana is Japanese
+		counts[1], counts[3] = 0, 0
+	}
+	for i, count := range counts {
+		if count > latin && (best < 0 || count > counts[best]) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		if codes := scriptLanguages[best].codes; !strings.HasPrefix(codes[0], base) {
+			return codes
+		}
+		return nil
+	}
+
+	scores := make(map[string]int)
+	for _, word := range strings.FieldsFunc(strings.ToLower(sentence), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		for code, words := range functionWords {
+			if words[word] {
+				scores[code]++
+			}
+		}
+	}
+	detected, top, runnerUp := "", 0, 0
+	for code, score := range scores {
+		if score > top {
+			detected, top, runnerUp = code, score, top
+		} else if score > runnerUp {
+			runnerUp = score
+		}
+	}
+	// A switch needs two function words and a clear lead, also over lang
+	if detected == "" || detected == base || top < 2 || top == runnerUp || top <= scores[base] {
+		return nil
+	}
+	return []string{detected}
+}
+
+// mixedEngine speaks each span in its own language. Like ssmlEngine it
+// stands in for the underlying engine, so caching and metrics work as usual.
+type mixedEngine struct {
+	Engine
+	spans []languageSpan
+}
+
+func (e mixedEngine) Features() EngineFeatures { return engineFeatures(e.Engine) }
+
+// expanded normalizes each span in its own language
+func (e mixedEngine) expanded() mixedEngine {
+	spans := make([]languageSpan, len(e.spans))
+	for i, span := range e.spans {
+		spans[i] = languageSpan{text: expandText(span.text, span.lang), lang: span.lang}
+	}
+	return mixedEngine{Engine: e.Engine, spans: spans}
+}
+
+// source identifies the spoken spans for cache keys
+func (e mixedEngine) source() string {
+	var b strings.Builder
+	for _, span := range e.spans {
+		b.WriteString(span.lang + "\x00" + span.text + "\x00")
+	}
+	return b.String()
+}
+
+// Synthesize ignores req.Text, which only carries the source for cache keys,
+// and returns the joined spans as WAV. Voice, a regional accent, is kept for
+// spans in the request language only.
+func (e mixedEngine) Synthesize(ctx context.Context, req SynthesisRequest) ([]byte, error) {
+	reqs := make([]SynthesisRequest, len(e.spans))
+	for i, span := range e.spans {
+		reqs[i] = SynthesisRequest{Text: span.text, Lang: span.lang, Slow: req.Slow}
+		if span.lang == req.Lang {
+			reqs[i].Voice = req.Voice
+		}
+	}
+	wav, _, err := speakPieces(ctx, e.Engine, reqs, nil)
+	return wav, err
+}
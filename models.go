@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Piper and command engines can list the model files they need under
+// download, instead of having them provisioned by hand. On startup each file
+// is fetched into models_dir/<engine>/ unless a copy with the configured
+// SHA-256 is already there; a download whose digest differs is discarded.
+// Until all of an engine's files are in place it fails syntheses with 503
+// engine_unavailable and readiness reports it; GET /admin/engines shows each
+// file's status. Command engines find the files through the {models}
+// placeholder, and piper engines without a model use the first .onnx file.
+
+const (
+	modelPending     = "pending"
+	modelDownloading = "downloading"
+	modelReady       = "ready"
+	modelFailed      = "failed"
+)
+
+const (
+	modelAttempts   = 3
+	modelRetryDelay = 10 * time.Second
+)
+
+var errModelsPending = errors.New("engine models are not ready")
+
+// ModelFile is a file an engine needs, fetched into the models directory
+type ModelFile struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"` // Hex digest the file must have
+	Name   string `json:"name"`   // File name; the last element of the URL path when empty
+}
+
+func (f ModelFile) fileName() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return path.Base(strings.SplitN(f.URL, "?", 2)[0])
+}
+
+type ModelState struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"` // pending, downloading, ready or failed
+	Bytes     int64     `json:"bytes,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// modelSet holds the files of one engine; nil when it downloads none
+type modelSet struct {
+	engine string
+	dir    string
+	files  []ModelFile
+	mu     sync.Mutex
+	states []ModelState
+}
+
+func newModelSet(engine, dir string, files []ModelFile) *modelSet {
+	if len(files) == 0 {
+		return nil
+	}
+	m := &modelSet{engine: engine, dir: dir, files: files, states: make([]ModelState, len(files))}
+	for i, file := range files {
+		m.states[i] = ModelState{Name: file.fileName(), Status: modelPending, UpdatedAt: time.Now().UTC()}
+	}
+	return m
+}
+
+// path returns where the named file is kept
+func (m *modelSet) path(name string) string {
+	return filepath.Join(m.dir, name)
+}
+
+// firstWithSuffix returns the path of the first file named with suffix, or ""
+func (m *modelSet) firstWithSuffix(suffix string) string {
+	if m == nil {
+		return ""
+	}
+	for _, file := range m.files {
+		if strings.HasSuffix(file.fileName(), suffix) {
+			return m.path(file.fileName())
+		}
+	}
+	return ""
+}
+
+// ready returns errModelsPending until every file is in place
+func (m *modelSet) ready() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, state := range m.states {
+		if state.Status != modelReady {
+			return errModelsPending
+		}
+	}
+	return nil
+}
+
+func (m *modelSet) view() []ModelState {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ModelState(nil), m.states...)
+}
+
+func (m *modelSet) update(i int, status string, bytes int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states[i].Status, m.states[i].Bytes, m.states[i].Error, m.states[i].UpdatedAt = status, bytes, "", time.Now().UTC()
+	if err != nil {
+		m.states[i].Error = err.Error()
+	}
+}
+
+// fetch puts every file in place, downloading those missing or altered
+func (m *modelSet) fetch(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		for i := range m.files {
+			m.update(i, modelFailed, 0, err)
+		}
+		return
+	}
+	for i, file := range m.files {
+		target := m.path(file.fileName())
+		if size, err := verifyModel(target, file.SHA256); err == nil {
+			m.update(i, modelReady, size, nil)
+			continue
+		}
+		m.update(i, modelDownloading, 0, nil)
+		var size int64
+		var err error
+		for attempt := 1; attempt <= modelAttempts; attempt++ {
+			if size, err = downloadModel(ctx, file, target); err == nil || ctx.Err() != nil {
+				break
+			}
+			slog.Warn("Model download failed", "engine", m.engine, "file", file.fileName(), "attempt", attempt, "error", err)
+			if attempt < modelAttempts {
+				select {
+				case <-time.After(modelRetryDelay):
+				case <-ctx.Done():
+				}
+			}
+		}
+		if err != nil {
+			m.update(i, modelFailed, 0, err)
+			continue
+		}
+		m.update(i, modelReady, size, nil)
+		slog.Info("Model ready", "engine", m.engine, "file", file.fileName(), "bytes", size)
+	}
+}
+
+// verifyModel returns the size of the file at path if it has the digest
+func verifyModel(path, digest string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, err
+	}
+	if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), digest) {
+		return 0, fmt.Errorf("checksum mismatch")
+	}
+	return size, nil
+}
+
+// downloadModel fetches file to target, which is only replaced once the
+// download is complete and has the expected digest
+func downloadModel(ctx context.Context, file ModelFile, target string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, file.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: %s", file.URL, resp.Status)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".partial-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, file.SHA256) {
+		return 0, fmt.Errorf("checksum mismatch: got %s", got)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil { // Readable by engines sandboxed as another user
+		return 0, err
+	}
+	return size, os.Rename(tmp.Name(), target)
+}
+
+// fetchModels fetches the files of every engine, each engine on its own
+func (s *server) fetchModels(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, engine := range s.engines {
+		if engine, ok := engine.(*commandEngine); ok && engine.models != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				engine.models.fetch(ctx)
+			}()
+		}
+	}
+	wg.Wait()
+}
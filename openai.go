@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// A compatibility shim for the audio-out half of the OpenAI Realtime
+// WebSocket protocol, so voice-agent frameworks built on it can use this
+// server as their TTS leg: GET /v1/realtime?lang=en (optionally &engine=...;
+// model is accepted and ignored). There is no model behind it, so a response
+// speaks the text of the conversation items created since the previous one,
+// or its instructions when there are none. Handled client events:
+//
+//	session.update            output_audio_format pcm16 (24 kHz), g711_ulaw or g711_alaw; voice is echoed only
+//	conversation.item.create  message items with text, input_text or audio transcript content
+//	response.create           starts speaking; one response at a time
+//	response.cancel           stops the active response
+//
+// Audio input events are answered with an error.
+
+var openAIAudioFormats = map[string]int{"pcm16": 24000, "g711_ulaw": 8000, "g711_alaw": 8000}
+
+type openAIEvent map[string]any
+
+// with returns a copy of the event with one more field
+func (e openAIEvent) with(key string, value any) openAIEvent {
+	event := openAIEvent{key: value}
+	for k, v := range e {
+		event[k] = v
+	}
+	return event
+}
+
+type openAIClientEvent struct {
+	EventID  string          `json:"event_id"`
+	Type     string          `json:"type"`
+	Session  *openAISession  `json:"session"`
+	Item     *openAIItem     `json:"item"`
+	Response *openAIResponse `json:"response"`
+}
+
+type openAISession struct {
+	ID                string   `json:"id"`
+	Object            string   `json:"object"`
+	Model             string   `json:"model"`
+	Modalities        []string `json:"modalities"`
+	Voice             string   `json:"voice"`
+	OutputAudioFormat string   `json:"output_audio_format"`
+}
+
+type openAIItem struct {
+	ID      string          `json:"id"`
+	Object  string          `json:"object"`
+	Type    string          `json:"type"`
+	Role    string          `json:"role,omitempty"`
+	Status  string          `json:"status,omitempty"`
+	Content []openAIContent `json:"content"`
+}
+
+type openAIContent struct {
+	Type       string `json:"type"`
+	Text       string `json:"text,omitempty"`
+	Transcript string `json:"transcript,omitempty"`
+}
+
+type openAIResponse struct {
+	ID            string       `json:"id,omitempty"`
+	Object        string       `json:"object,omitempty"`
+	Status        string       `json:"status,omitempty"` // "in_progress", "completed", "cancelled" or "failed"
+	StatusDetails any          `json:"status_details"`
+	Output        []openAIItem `json:"output"`
+	Instructions  string       `json:"instructions,omitempty"` // Client side only
+	Input         []openAIItem `json:"input,omitempty"`        // Client side only
+}
+
+type openAIRealtime struct {
+	s       *server
+	conn    *wsConn
+	ctx     context.Context
+	key     *APIKey
+	engine  Engine
+	lang    string
+	session openAISession
+	texts   []string // Of items created since the last response
+	lastID  string   // Of the last conversation item
+	spoken  int
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // Of the active response, nil when idle
+	done   chan struct{}
+}
+
+func (s *server) handleOpenAIRealtime(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	lang := query.Get("lang")
+	if lang == "" {
+		lang = "en"
+	}
+	engine, lang, ok := s.resolveEngine(w, r, query.Get("engine"), lang)
+	if !ok {
+		return
+	}
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request: "+err.Error())
+		return
+	}
+	model := query.Get("model")
+	if model == "" {
+		model = engine.Name()
+	}
+	rt := &openAIRealtime{
+		s:      s,
+		conn:   conn,
+		ctx:    r.Context(),
+		key:    principalFrom(r.Context()).key,
+		engine: engine,
+		lang:   lang,
+		session: openAISession{
+			ID: "sess_" + newRequestID(), Object: "realtime.session", Model: model,
+			Modalities: []string{"text", "audio"}, Voice: "alloy", OutputAudioFormat: "pcm16",
+		},
+	}
+	rt.run()
+	annotate(r.Context(), "engine", engine.Name(), "lang", lang, "sentences", rt.spoken)
+}
+
+func (rt *openAIRealtime) emit(eventType string, fields openAIEvent) {
+	event := fields.with("type", eventType)
+	event["event_id"] = "event_" + newRequestID()
+	rt.conn.writeJSON(event)
+}
+
+// emitAudio sends a response.audio.delta, counted as egress of its audio
+func (rt *openAIRealtime) emitAudio(fields openAIEvent, cached bool) {
+	event := fields.with("type", "response.audio.delta")
+	event["event_id"] = "event_" + newRequestID()
+	if data, err := json.Marshal(event); err == nil {
+		rt.conn.writeAudio(wsText, data, cached)
+	}
+}
+
+func (rt *openAIRealtime) emitError(clientEventID, code, message string) {
+	rt.emit("error", openAIEvent{"error": openAIEvent{
+		"type": "invalid_request_error", "code": code, "message": message, "param": nil, "event_id": clientEventID,
+	}})
+}
+
+func (rt *openAIRealtime) run() {
+	rt.emit("session.created", openAIEvent{"session": rt.session})
+	for {
+		opcode, data, err := rt.conn.readMessage(sessionIdleTimeout)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				rt.conn.close(wsClosePolicy, "idle timeout")
+			} else {
+				rt.conn.close(wsCloseNormal, "")
+			}
+			break
+		}
+		if opcode != wsText {
+			rt.conn.close(wsCloseUnsupported, "expected JSON text messages")
+			break
+		}
+		var event openAIClientEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			rt.emitError("", "invalid_json", "Message is not valid JSON")
+			continue
+		}
+		rt.handle(event)
+	}
+	rt.cancelResponse()
+}
+
+func (rt *openAIRealtime) handle(event openAIClientEvent) {
+	switch event.Type {
+	case "session.update":
+		if event.Session == nil {
+			rt.emitError(event.EventID, "missing_required_parameter", "session is required")
+			return
+		}
+		if format := event.Session.OutputAudioFormat; format != "" {
+			if _, ok := openAIAudioFormats[format]; !ok {
+				rt.emitError(event.EventID, "invalid_value", "output_audio_format must be pcm16, g711_ulaw or g711_alaw")
+				return
+			}
+			rt.session.OutputAudioFormat = format
+		}
+		if event.Session.Voice != "" {
+			rt.session.Voice = event.Session.Voice
+		}
+		if len(event.Session.Modalities) > 0 {
+			rt.session.Modalities = event.Session.Modalities
+		}
+		rt.emit("session.updated", openAIEvent{"session": rt.session})
+	case "conversation.item.create":
+		if event.Item == nil {
+			rt.emitError(event.EventID, "missing_required_parameter", "item is required")
+			return
+		}
+		item := *event.Item
+		if item.ID == "" {
+			item.ID = "item_" + newRequestID()
+		}
+		item.Object, item.Status = "realtime.item", "completed"
+		if text := openAIItemText(item); text != "" {
+			rt.texts = append(rt.texts, text)
+		}
+		rt.emit("conversation.item.created", openAIEvent{"previous_item_id": nilIfEmpty(rt.lastID), "item": item})
+		rt.lastID = item.ID
+	case "response.create":
+		text := strings.Join(rt.texts, " ")
+		if event.Response != nil {
+			for _, item := range event.Response.Input {
+				text = strings.TrimSpace(text + " " + openAIItemText(item))
+			}
+			if text == "" {
+				text = event.Response.Instructions
+			}
+		}
+		rt.texts = nil
+		if strings.TrimSpace(text) == "" {
+			rt.emitError(event.EventID, "missing_required_parameter", "Nothing to speak: create a conversation item with text first")
+			return
+		}
+		rt.startResponse(text)
+	case "response.cancel":
+		if !rt.cancelResponse() {
+			rt.emitError(event.EventID, "response_cancel_not_active", "There is no active response to cancel")
+		}
+	case "input_audio_buffer.append", "input_audio_buffer.commit", "input_audio_buffer.clear":
+		rt.emitError(event.EventID, "unsupported_event", "Audio input is not supported; this server only speaks")
+	default:
+		rt.emitError(event.EventID, "unknown_event", "Unknown event type "+event.Type)
+	}
+}
+
+// openAIItemText returns the text a message item carries
+func openAIItemText(item openAIItem) string {
+	var parts []string
+	for _, content := range item.Content {
+		switch content.Type {
+		case "text", "input_text":
+			parts = append(parts, content.Text)
+		case "audio", "input_audio":
+			parts = append(parts, content.Transcript)
+		}
+	}
+	return strings.TrimSpace(strings.Join(parts, " "))
+}
+
+func nilIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (rt *openAIRealtime) startResponse(text string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.cancel != nil {
+		rt.emitError("", "conversation_already_has_active_response", "A response is already in progress")
+		return
+	}
+	var ctx context.Context
+	ctx, rt.cancel = context.WithCancel(rt.ctx)
+	rt.done = make(chan struct{})
+	go func(done chan struct{}, format string) {
+		defer close(done)
+		response := rt.respond(ctx, text, format)
+		rt.mu.Lock()
+		rt.cancel()
+		rt.cancel = nil
+		rt.mu.Unlock()
+		// Sent once idle, so a client may create the next response right away
+		rt.emit("response.done", openAIEvent{"response": response})
+	}(rt.done, rt.session.OutputAudioFormat)
+}
+
+// cancelResponse stops the active response and waits for it; false if there was none
+func (rt *openAIRealtime) cancelResponse() bool {
+	rt.mu.Lock()
+	cancel, done := rt.cancel, rt.done
+	rt.mu.Unlock()
+	if cancel == nil {
+		return false
+	}
+	cancel()
+	<-done
+	return true
+}
+
+// respond speaks text a sentence at a time, following the event sequence of
+// an audio response up to response.done, and returns the finished response
+func (rt *openAIRealtime) respond(ctx context.Context, text, format string) openAIResponse {
+	s := rt.s
+	response := openAIResponse{ID: "resp_" + newRequestID(), Object: "realtime.response", Status: "in_progress", Output: []openAIItem{}}
+	item := openAIItem{ID: "item_" + newRequestID(), Object: "realtime.item", Type: "message", Role: "assistant", Status: "in_progress", Content: []openAIContent{}}
+	rt.emit("response.created", openAIEvent{"response": response})
+	rt.emit("response.output_item.added", openAIEvent{"response_id": response.ID, "output_index": 0, "item": item})
+	part := openAIEvent{"response_id": response.ID, "item_id": item.ID, "output_index": 0, "content_index": 0}
+	rt.emit("response.content_part.added", part.with("part", openAIContent{Type: "audio"}))
+
+	var transcript []string
+	var failure any
+	for text = strings.TrimSpace(text); text != "" && ctx.Err() == nil; {
+		end := sentenceEnd(text)
+		if end < 0 {
+			end = len(text)
+		}
+		sentence := strings.TrimSpace(text[:end])
+		text = strings.TrimSpace(text[end:])
+		if sentence == "" {
+			continue
+		}
+		chars := int64(utf8.RuneCountInString(sentence))
+		spoken, err := s.screen(ctx, GuardrailInput{Text: sentence, Lang: rt.lang, Engine: rt.engine.Name(), Source: "openai_realtime"})
+		if errors.Is(err, errGuardrailDenied) {
+			failure = openAIEvent{"type": "failed", "error": openAIEvent{"type": "invalid_request_error", "code": codeContentPolicy, "message": "Text was denied by the content policy"}}
+			break
+		} else if err != nil {
+			failure = openAIEvent{"type": "failed", "error": openAIEvent{"type": "server_error", "code": codeGuardrailUnavailable, "message": "The content policy check is unavailable"}}
+			break
+		}
+		if err := s.keys.charge(rt.key, chars); err != nil {
+			code := codeMonthlyQuota
+			if errors.Is(err, errDailyQuota) {
+				code = codeDailyQuota
+			}
+			failure = openAIEvent{"type": "failed", "error": openAIEvent{"type": "insufficient_quota", "code": code, "message": "Character quota exceeded"}}
+			break
+		}
+		pcm, cached, err := s.realtimeAudio(ctx, rt.engine, spoken, rt.lang, openAIAudioFormats[format])
+		if err != nil {
+			s.keys.refund(rt.key, chars)
+			if ctx.Err() == nil {
+				slog.Warn("Realtime synthesis failed", "request_id", requestIDFrom(rt.ctx), "error", err)
+				failure = openAIEvent{"type": "failed", "error": openAIEvent{"type": "server_error", "code": codeSynthesisFailed, "message": "Failed to generate audio"}}
+				if errors.Is(err, errMaintenance) {
+					failure = openAIEvent{"type": "failed", "error": openAIEvent{"type": "server_error", "code": codeMaintenance, "message": "The service is in maintenance mode"}}
+				}
+				if errors.As(err, new(*queueFullError)) {
+					failure = openAIEvent{"type": "failed", "error": openAIEvent{"type": "server_error", "code": codeQueueFull, "message": "Too many syntheses are waiting; try again later"}}
+				}
+				if errors.Is(err, errReplicaMiss) {
+					failure = openAIEvent{"type": "failed", "error": openAIEvent{"type": "server_error", "code": codeNotCached, "message": "This replica serves cached audio only"}}
+				}
+			}
+			break
+		}
+		s.costs.record(rt.engine.Name(), chars, !cached)
+		rt.spoken++
+
+		transcript = append(transcript, spoken)
+		rt.emit("response.audio_transcript.delta", part.with("delta", spoken))
+		audio := encodeOpenAIAudio(pcm, format)
+		chunk := openAIAudioFormats[format] / 10 // 100ms of one-byte G.711 samples
+		if format == "pcm16" {
+			chunk *= 2
+		}
+		for start := 0; start < len(audio) && ctx.Err() == nil; start += chunk {
+			rt.emitAudio(part.with("delta", base64.StdEncoding.EncodeToString(audio[start:min(start+chunk, len(audio))])), cached)
+		}
+	}
+
+	switch {
+	case failure != nil:
+		response.Status, response.StatusDetails = "failed", failure
+	case ctx.Err() != nil:
+		response.Status, response.StatusDetails = "cancelled", openAIEvent{"type": "cancelled", "reason": "client_cancelled"}
+	default:
+		response.Status = "completed"
+	}
+	item.Status = "completed"
+	if response.Status != "completed" {
+		item.Status = "incomplete"
+	}
+	spoken := strings.Join(transcript, " ")
+	item.Content = []openAIContent{{Type: "audio", Transcript: spoken}}
+	response.Output = []openAIItem{item}
+	if response.Status == "completed" {
+		rt.emit("response.audio.done", part)
+		rt.emit("response.audio_transcript.done", part.with("transcript", spoken))
+		rt.emit("response.content_part.done", part.with("part", item.Content[0]))
+		rt.emit("response.output_item.done", openAIEvent{"response_id": response.ID, "output_index": 0, "item": item})
+	}
+	return response
+}
+
+// encodeOpenAIAudio turns 16-bit PCM into the session's output format
+func encodeOpenAIAudio(pcm []byte, format string) []byte {
+	encode := linearToULaw
+	switch format {
+	case "pcm16":
+		return pcm
+	case "g711_alaw":
+		encode = linearToALaw
+	}
+	out := make([]byte, len(pcm)/2)
+	for i := range out {
+		out[i] = encode(int16(binary.LittleEndian.Uint16(pcm[2*i:])))
+	}
+	return out
+}
+
+// G.711 segment end points, after the encoders' initial shift
+var (
+	ulawSegments = [8]int{0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF, 0x1FFF}
+	alawSegments = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+)
+
+func g711Segment(value int, segments [8]int) int {
+	for i, end := range segments {
+		if value <= end {
+			return i
+		}
+	}
+	return len(segments)
+}
+
+func linearToULaw(sample int16) byte {
+	value, mask := int(sample)>>2, 0xFF
+	if value < 0 {
+		value, mask = -value, 0x7F
+	}
+	value = min(value, 8159) + 0x21
+	seg := g711Segment(value, ulawSegments)
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	return byte((seg<<4 | (value>>(seg+1))&0x0F) ^ mask)
+}
+
+func linearToALaw(sample int16) byte {
+	value, mask := int(sample)>>3, 0xD5
+	if value < 0 {
+		value, mask = -value-1, 0x55
+	}
+	seg := g711Segment(value, alawSegments)
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	shift := seg
+	if seg < 2 {
+		shift = 1
+	}
+	return byte((seg<<4 | (value>>shift)&0x0F) ^ mask)
+}
+
+// apiKeyFromBearer lets clients written for OpenAI send an API key as a bearer
+// token: a bearer that is a known key is moved to X-API-Key before authentication
+func (s *server) apiKeyFromBearer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && r.Header.Get("X-API-Key") == "" {
+			if _, known := s.keys.lookup(strings.TrimSpace(bearer)); known {
+				r.Header.Set("X-API-Key", strings.TrimSpace(bearer))
+				r.Header.Del("Authorization")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
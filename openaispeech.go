@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// POST /v1/audio/speech is shaped like OpenAI's speech API, so the tools and
+// SDKs written for it work against this server by changing their base URL;
+// API keys can be sent as bearer tokens. The request runs through
+// handleSpeak as a /v1/speak request:
+//
+//	model            an engine name, or the default engine for anything else (tts-1, tts-1-hd, ...)
+//	input            text
+//	voice            accepted and ignored: OpenAI voices are multilingual, so
+//	                 each sentence is spoken in its detected language (see mixedlang.go)
+//	response_format  mp3 (the default), opus, aac, flac, wav, or pcm: 24 kHz 16-bit mono little-endian
+//	speed            speed
+//	instructions     accepted and ignored
+//
+// lang, not part of OpenAI's API, sets the language and turns detection off.
+// Errors use OpenAI's shape, with the problem's code as code.
+
+var openAIResponseFormats = []string{"mp3", "opus", "aac", "flac", "wav", "pcm"}
+
+// Sample rate of OpenAI's pcm format
+const openAIPCMRate = 24000
+
+type OpenAISpeechRequest struct {
+	Model          string  `json:"model"`
+	Input          string  `json:"input"`
+	Voice          string  `json:"voice"`
+	ResponseFormat string  `json:"response_format,omitempty"`
+	Speed          float64 `json:"speed,omitempty"`
+	Instructions   string  `json:"instructions,omitempty"`
+	Lang           string  `json:"lang,omitempty"` // Extension; see above
+}
+
+type OpenAIErrorResponse struct {
+	Error OpenAIError `json:"error"`
+}
+
+type OpenAIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
+
+// openAISpeechParams names the request fields behind speak pointers
+var openAISpeechParams = map[string]string{"/text": "input", "/engine": "model", "/format": "response_format", "/speed": "speed", "/lang": "lang"}
+
+// writeOpenAIError answers problem in OpenAI's error shape
+func writeOpenAIError(w http.ResponseWriter, r *http.Request, problem *Problem) {
+	errorType := "invalid_request_error"
+	switch {
+	case problem.Status == http.StatusUnauthorized:
+		errorType = "authentication_error"
+	case problem.Code == codeDailyQuota || problem.Code == codeMonthlyQuota:
+		errorType = "insufficient_quota"
+	case problem.Status == http.StatusTooManyRequests:
+		errorType = "rate_limit_error"
+	case problem.Status >= 500:
+		errorType = "server_error"
+	}
+	var param *string
+	if name, ok := openAISpeechParams[problem.Pointer]; ok {
+		param = &name
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(OpenAIErrorResponse{Error: OpenAIError{Message: problem.Detail, Type: errorType, Param: param, Code: problem.Code}})
+}
+
+func (s *server) handleAudioSpeech(w http.ResponseWriter, r *http.Request) {
+	var req OpenAISpeechRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if strings.TrimSpace(req.Input) == "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: input is required", Pointer: "/text"})
+		return
+	}
+	if req.ResponseFormat == "" {
+		req.ResponseFormat = "mp3"
+	}
+	if !containsString(openAIResponseFormats, req.ResponseFormat) {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: unsupported response_format", Pointer: "/format", Supported: openAIResponseFormats})
+		return
+	}
+	payload := RequestPayload{Text: req.Input, Lang: req.Lang, Speed: req.Speed, Format: req.ResponseFormat}
+	if _, exists := s.engineFor(req.Model); exists && req.Model != "" {
+		payload.Engine = req.Model
+	}
+	if payload.Lang == "" {
+		payload.Lang, payload.DetectLanguages = "en", true
+	}
+	if req.ResponseFormat == "pcm" {
+		payload.Format, payload.SampleRate = "wav", openAIPCMRate
+	}
+	speakReq, err := speakRequest(r, payload)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to build the speak request")
+		return
+	}
+	if req.ResponseFormat != "pcm" {
+		s.handleSpeak(w, speakReq)
+		return
+	}
+
+	rec := &jobRecorder{header: make(http.Header), status: http.StatusOK}
+	s.handleSpeak(rec, speakReq)
+	if rec.status != http.StatusOK {
+		rec.replay(w)
+		return
+	}
+	pcm, ok := pcmFromWAV(rec.body.Bytes())
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, codeSynthesisFailed, "Failed to generate audio")
+		return
+	}
+	w.Header().Set("Content-Type", "audio/pcm")
+	w.Write(pcm)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Text goes through preprocessing stages before it reaches an engine: the
+// profanity filter (profanity.go), the tenant's lexicon (lexicon.go), emoji
+// and symbols (symbols.go) and normalization (textnorm.go), in that order by
+// default. Operators can declare other orders as named pipelines, e.g. to
+// normalize before the lexicon so entries can match spelled-out numbers, or
+// to leave a stage out, and give tenants one of them. Requests to /v1/speak,
+// /v1/readaloud and streaming sessions choose a pipeline with pipeline, and
+// otherwise get their tenant's; feed items get the feed's tenant's. The
+// request options still apply: symbols picks what the symbols stage does and
+// pre_normalized skips normalization.
+//
+// Guardrails see text before the pipeline runs. When normalization is the
+// last stage, mixed-language text is normalized per span (see mixedlang.go);
+// elsewhere it is normalized in the request's language. POST /v1/preprocess
+// runs a pipeline without synthesizing anything and returns the text after
+// each stage.
+
+const (
+	stageProfanity = "profanity"
+	stageLexicon   = "lexicon"
+	stageSymbols   = "symbols"
+	stageNormalize = "normalize"
+)
+
+var pipelineStages = []string{stageProfanity, stageLexicon, stageSymbols, stageNormalize}
+
+// Name of the pipeline used when neither the request nor its tenant names one
+const defaultPipeline = "default"
+
+type PreprocessingConfig struct {
+	Pipelines map[string][]string `json:"pipelines"` // Stages in order, by name; "default" replaces the built-in order
+	Tenants   map[string]string   `json:"tenants"`   // Pipeline of each tenant's requests that name none, by key ID
+}
+
+type PreprocessRequest struct {
+	Text          string `json:"text"`
+	Lang          string `json:"lang"`
+	Engine        string `json:"engine,omitempty"` // Whose language codes lang is canonicalized for
+	Pipeline      string `json:"pipeline,omitempty"`
+	Symbols       string `json:"symbols,omitempty"`
+	PreNormalized bool   `json:"pre_normalized,omitempty"`
+}
+
+type PreprocessResponse struct {
+	Pipeline string            `json:"pipeline"`
+	Stages   []PreprocessStage `json:"stages"`
+	Text     string            `json:"text"` // As the engine would be given it
+}
+
+type PreprocessStage struct {
+	Stage string `json:"stage"`
+	Text  string `json:"text"` // After the stage
+}
+
+// textPipeline is the preprocessing of one request
+type textPipeline struct {
+	name      string
+	stages    []string
+	tenant    string
+	lang      string
+	symbols   string // Symbols mode; see symbols.go
+	normalize bool   // False with pre_normalized
+}
+
+// pipelineNames lists the pipelines requests can choose
+func (s *server) pipelineNames() []string {
+	names := []string{defaultPipeline}
+	for name := range s.cfg.Preprocessing.Pipelines {
+		if name != defaultPipeline {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// pipelineFor picks the named pipeline, or the tenant's when name is empty;
+// false when there is no such pipeline
+func (s *server) pipelineFor(tenant, name string) (textPipeline, bool) {
+	if name == "" {
+		if name = s.cfg.Preprocessing.Tenants[tenant]; name == "" {
+			name = defaultPipeline
+		}
+	}
+	stages, exists := s.cfg.Preprocessing.Pipelines[name]
+	if !exists && name == defaultPipeline {
+		stages, exists = pipelineStages, true
+	}
+	if !exists {
+		return textPipeline{}, false
+	}
+	return textPipeline{name: name, stages: stages, tenant: tenant}, true
+}
+
+// resolvePipeline picks the pipeline of a request from its tenant, writing a
+// 400 and returning false when there is no such pipeline
+func (s *server) resolvePipeline(w http.ResponseWriter, r *http.Request, name string) (textPipeline, bool) {
+	tp, ok := s.pipelineFor(principalFrom(r.Context()).tenant, name)
+	if !ok {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request: unknown pipeline", Pointer: "/pipeline", Supported: s.pipelineNames()})
+	}
+	return tp, ok
+}
+
+func (tp textPipeline) has(stage string) bool {
+	return containsString(tp.stages, stage)
+}
+
+// deferNormalize removes a last normalize stage, so the caller can normalize
+// once it knows the text's languages, and reports whether it should
+func (tp textPipeline) deferNormalize() (textPipeline, bool) {
+	if len(tp.stages) == 0 || tp.stages[len(tp.stages)-1] != stageNormalize {
+		return tp, false
+	}
+	tp.stages = tp.stages[:len(tp.stages)-1]
+	return tp, tp.normalize
+}
+
+// preprocess runs the stages over text, giving trace the text after each
+// when it is not nil. It fails with errProfanity when the filter rejects it.
+func (s *server) preprocess(tp textPipeline, text string, trace func(stage, text string)) (string, error) {
+	for _, stage := range tp.stages {
+		switch stage {
+		case stageProfanity:
+			var err error
+			if text, err = s.profanity.apply(text, tp.lang); err != nil {
+				return "", err
+			}
+		case stageLexicon:
+			text = s.lexicons.apply(tp.tenant, tp.lang, text)
+		case stageSymbols:
+			text = verbalizeSymbols(text, tp.lang, tp.symbols)
+		case stageNormalize:
+			if tp.normalize {
+				text = expandText(text, tp.lang)
+			}
+		}
+		if trace != nil {
+			trace(stage, text)
+		}
+	}
+	return text, nil
+}
+
+func (s *server) handlePreprocess(w http.ResponseWriter, r *http.Request) {
+	var req PreprocessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: text is required", Pointer: "/text"})
+		return
+	}
+	if req.Lang == "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: lang is required", Pointer: "/lang"})
+		return
+	}
+	if req.Symbols != "" && !containsString(symbolModes, req.Symbols) {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: unsupported symbols", Pointer: "/symbols", Supported: symbolModes})
+		return
+	}
+	_, lang, ok := s.resolveEngine(w, r, req.Engine, req.Lang)
+	if !ok {
+		return
+	}
+	tp, ok := s.resolvePipeline(w, r, req.Pipeline)
+	if !ok {
+		return
+	}
+	tp.lang, tp.symbols, tp.normalize = lang, req.Symbols, !req.PreNormalized
+
+	resp := PreprocessResponse{Pipeline: tp.name, Stages: []PreprocessStage{}}
+	text, err := s.preprocess(tp, req.Text, func(stage, text string) {
+		resp.Stages = append(resp.Stages, PreprocessStage{Stage: stage, Text: text})
+	})
+	if err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, codeProfanity, "Text contains words that are not allowed")
+		return
+	}
+	resp.Text = text
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Piper engines run the piper command line with a local .onnx voice, the
+// text on stdin and WAV on stdout. Binaries built with -tags embedvoice
+// carry a default voice (see piper_embed.go) and, unless configured
+// otherwise, speak with it through a "piper" engine, so nothing but the
+// piper executable has to be provisioned. The voice is written to the models
+// directory on startup; a copy already there is reused only when its
+// SHA-256 matches the bundled one, so a truncated or altered file is
+// replaced rather than loaded.
+
+const bundledVoiceName = "default.onnx"
+
+// piperArgv runs piper with model; piper writes the whole WAV at once, so
+// the header needs no seeking and stdout works as the output file
+func piperArgv(model string) []string {
+	return []string{"piper", "--model", model, "--output_file", "/dev/stdout"}
+}
+
+// modelsDir is where voices are kept: dir, or the user's cache directory
+func modelsDir(dir string) (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("models_dir is not set and there is no cache directory: %w", err)
+	}
+	return filepath.Join(cache, "gtts-service", "models"), nil
+}
+
+// extractBundledVoice writes the bundled voice and its config to dir and
+// returns the path of the model
+func extractBundledVoice(dir string) (string, error) {
+	if !hasBundledVoice {
+		return "", fmt.Errorf("this binary has no bundled voice; build with -tags embedvoice or set model")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	for _, name := range []string{bundledVoiceName, bundledVoiceName + ".json"} {
+		data, err := fs.ReadFile(bundledVoice, "voices/"+name)
+		if err != nil {
+			return "", err
+		}
+		if err := writeVerified(filepath.Join(dir, name), data); err != nil {
+			return "", fmt.Errorf("bundled voice: %w", err)
+		}
+	}
+	return filepath.Join(dir, bundledVoiceName), nil
+}
+
+// writeVerified leaves path alone when it already holds data, and otherwise
+// replaces it atomically
+func writeVerified(path string, data []byte) error {
+	want := sha256.Sum256(data)
+	if existing, err := os.ReadFile(path); err == nil && sha256.Sum256(existing) == want {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".partial-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil { // Readable by engines sandboxed as another user
+		return err
+	}
+	written, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if sha256.Sum256(written) != want {
+		return fmt.Errorf("%s: checksum mismatch after writing", filepath.Base(path))
+	}
+	return os.Rename(tmp.Name(), path)
+}
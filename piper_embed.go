@@ -0,0 +1,19 @@
+//go:build embedvoice
+
+package main
+
+import "embed"
+
+// Put a Piper voice at voices/default.onnx, with its default.onnx.json, and
+// build with -tags embedvoice to bundle it; see piper.go. The voice is not
+// in the repository, so this file does not compile until it is there:
+// scripts/fetch-voice.sh downloads it and checks it against the sums you
+// give it, e.g.
+//
+//	VOICE_SHA256=... VOICE_CONFIG_SHA256=... scripts/fetch-voice.sh
+//	go build -tags embedvoice
+
+//go:embed voices/default.onnx voices/default.onnx.json
+var bundledVoice embed.FS
+
+const hasBundledVoice = true
@@ -0,0 +1,10 @@
+//go:build !embedvoice
+
+package main
+
+import "embed"
+
+// Without -tags embedvoice there is no bundled voice; see piper.go
+var bundledVoice embed.FS
+
+const hasBundledVoice = false
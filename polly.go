@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// POST /v1/speech is shaped like Amazon Polly's SynthesizeSpeech, so Polly
+// client code works against this server by pointing its endpoint here. The
+// request runs through handleSpeak as a /v1/speak request:
+//
+//	Text, TextType     text, or ssml when TextType is ssml
+//	LanguageCode       lang; en with per-sentence detection when omitted, as
+//	                   VoiceId is accepted and ignored (see mixedlang.go)
+//	Engine             engine, when it names one; ignored otherwise (standard, neural, ...)
+//	OutputFormat       mp3, ogg_vorbis, ogg_opus, pcm (16-bit mono little-endian) or json
+//	SampleRate         sample_rate, as a string as in Polly's API
+//	SpeechMarkTypes    sentence and word, with OutputFormat json
+//
+// Polly's SDKs sign requests with SigV4; the signature is not checked, but an
+// access key ID that is an API key authenticates as that key, so clients set
+// up with the key as their access key work unchanged. Speech marks are one
+// JSON object per line, as Polly sends them. Their times are estimated from
+// the audio's duration, as in sessions (see duration.go), and start and end
+// are byte offsets into Text. Errors use Polly's shape and exception names.
+
+var pollyOutputFormats = map[string]string{"mp3": "mp3", "ogg_vorbis": "ogg", "ogg_opus": "opus", "pcm": "wav", "json": "wav"}
+
+var pollyOutputFormatNames = []string{"mp3", "ogg_vorbis", "ogg_opus", "pcm", "json"}
+
+var pollySpeechMarkTypes = []string{"sentence", "word"}
+
+type PollySynthesizeRequest struct {
+	Engine          string   `json:"Engine"`
+	LanguageCode    string   `json:"LanguageCode"`
+	LexiconNames    []string `json:"LexiconNames"` // Ignored; tenant lexicons apply as usual
+	OutputFormat    string   `json:"OutputFormat"`
+	SampleRate      string   `json:"SampleRate"`
+	SpeechMarkTypes []string `json:"SpeechMarkTypes"`
+	Text            string   `json:"Text"`
+	TextType        string   `json:"TextType"`
+	VoiceId         string   `json:"VoiceId"`
+}
+
+type PollySpeechMark struct {
+	Time  int64  `json:"time"` // Milliseconds from the start of the audio
+	Type  string `json:"type"`
+	Start int    `json:"start"` // Byte offsets into Text
+	End   int    `json:"end"`
+	Value string `json:"value"`
+}
+
+type PollyErrorResponse struct {
+	Message string `json:"message"`
+	Type    string `json:"__type"`
+}
+
+// pollyException names the Polly exception closest to problem
+func pollyException(problem *Problem) string {
+	switch {
+	case problem.Code == codeTextTooLong:
+		return "TextLengthExceededException"
+	case problem.Code == codeUnsupportedLanguage:
+		return "LanguageNotSupportedException"
+	case problem.Pointer == "/ssml":
+		return "InvalidSsmlException"
+	case problem.Pointer == "/sample_rate":
+		return "InvalidSampleRateException"
+	case problem.Status == http.StatusUnauthorized || problem.Status == http.StatusForbidden:
+		return "UnrecognizedClientException"
+	case problem.Status == http.StatusTooManyRequests || problem.Status == http.StatusPaymentRequired:
+		return "ThrottlingException"
+	case problem.Status >= 500:
+		return "ServiceFailureException"
+	}
+	return "ValidationException"
+}
+
+// writePollyError answers problem in Polly's error shape
+func writePollyError(w http.ResponseWriter, r *http.Request, problem *Problem) {
+	exception := pollyException(problem)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Amzn-ErrorType", exception)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(PollyErrorResponse{Message: problem.Detail, Type: exception})
+}
+
+// apiKeyFromSigV4 moves the access key ID of a SigV4 Authorization header to
+// X-API-Key before authentication when it is a known API key
+func (s *server) apiKeyFromSigV4(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if params, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "); ok && r.Header.Get("X-API-Key") == "" {
+			for _, param := range strings.Split(params, ",") {
+				if credential, ok := strings.CutPrefix(strings.TrimSpace(param), "Credential="); ok {
+					accessKey, _, _ := strings.Cut(credential, "/")
+					if _, known := s.keys.lookup(accessKey); known {
+						r.Header.Set("X-API-Key", accessKey)
+						r.Header.Del("Authorization")
+					}
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) handlePollySynthesize(w http.ResponseWriter, r *http.Request) {
+	var req PollySynthesizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Text is required", Pointer: "/text"})
+		return
+	}
+	format, ok := pollyOutputFormats[req.OutputFormat]
+	if !ok {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "OutputFormat must be one of " + strings.Join(pollyOutputFormatNames, ", "), Pointer: "/format", Supported: pollyOutputFormatNames})
+		return
+	}
+	marks := req.OutputFormat == "json"
+	if marks != (len(req.SpeechMarkTypes) > 0) {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "SpeechMarkTypes must be given with OutputFormat json, and only with it"})
+		return
+	}
+	for _, markType := range req.SpeechMarkTypes {
+		if !containsString(pollySpeechMarkTypes, markType) {
+			writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Unsupported speech mark type " + markType, Supported: pollySpeechMarkTypes})
+			return
+		}
+	}
+	payload := RequestPayload{Lang: req.LanguageCode, Format: format}
+	if req.TextType == "ssml" {
+		payload.SSML = req.Text
+	} else {
+		payload.Text = req.Text
+	}
+	if req.SampleRate != "" && !marks {
+		rate, err := strconv.Atoi(req.SampleRate)
+		if err != nil {
+			writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "SampleRate must be a number of hertz", Pointer: "/sample_rate"})
+			return
+		}
+		payload.SampleRate = rate
+	}
+	if _, exists := s.engineFor(req.Engine); exists && req.Engine != "" {
+		payload.Engine = req.Engine
+	}
+	if payload.Lang == "" {
+		payload.Lang, payload.DetectLanguages = "en", payload.SSML == ""
+	} else {
+		payload.Lang = s.baseLanguage(payload.Engine, payload.Lang)
+	}
+	speakReq, err := speakRequest(r, payload)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to build the speak request")
+		return
+	}
+	rec := &jobRecorder{header: make(http.Header), status: http.StatusOK}
+	s.handleSpeak(rec, speakReq)
+	if rec.status != http.StatusOK {
+		rec.replay(w)
+		return
+	}
+
+	w.Header().Set("X-Amzn-RequestCharacters", strconv.Itoa(utf8.RuneCountInString(req.Text)))
+	audio := rec.body.Bytes()
+	switch req.OutputFormat {
+	case "json":
+		spoken := req.Text
+		if payload.SSML != "" {
+			if doc, err := parseSSML(payload.SSML); err == nil {
+				spoken = doc.text()
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-json-stream")
+		encoder := json.NewEncoder(w)
+		for _, mark := range pollySpeechMarks(req.Text, spoken, audioDuration(audio, "wav").Milliseconds(), req.SpeechMarkTypes) {
+			encoder.Encode(mark)
+		}
+	case "pcm":
+		pcm, ok := pcmFromWAV(audio)
+		if !ok {
+			writeError(w, r, http.StatusInternalServerError, codeSynthesisFailed, "Failed to generate audio")
+			return
+		}
+		w.Header().Set("Content-Type", "audio/pcm")
+		w.Write(pcm)
+	default:
+		w.Header().Set("Content-Type", rec.header.Get("Content-Type"))
+		w.Write(audio)
+	}
+}
+
+// pollySpeechMarks times the sentences and words of spoken over durationMS,
+// locating each in source, which is spoken itself or the SSML it came from
+func pollySpeechMarks(source, spoken string, durationMS int64, types []string) []PollySpeechMark {
+	timings := wordTimings(spoken, time.Duration(durationMS)*time.Millisecond)
+	var marks []PollySpeechMark
+	cursor, word := 0, 0
+	for text := spoken; strings.TrimSpace(text) != ""; {
+		end := sentenceEnd(text)
+		if end < 0 {
+			end = len(text)
+		}
+		sentence := strings.TrimSpace(text[:end])
+		text = text[end:]
+		words := strings.Fields(sentence)
+		if len(words) == 0 {
+			continue
+		}
+		if containsString(types, "sentence") && word < len(timings) {
+			if start := strings.Index(source[cursor:], words[0]); start >= 0 {
+				mark := PollySpeechMark{Time: timings[word].StartMS, Type: "sentence", Start: cursor + start, End: cursor + start + len(sentence), Value: sentence}
+				if last := strings.Index(source[cursor+start:], words[len(words)-1]); last >= 0 {
+					mark.End = cursor + start + last + len(words[len(words)-1])
+				}
+				marks = append(marks, mark)
+			}
+		}
+		for _, w := range words {
+			start := strings.Index(source[cursor:], w)
+			if start >= 0 {
+				start += cursor
+				cursor = start + len(w)
+			}
+			value := strings.TrimFunc(w, unicode.IsPunct)
+			if containsString(types, "word") && start >= 0 && value != "" && word < len(timings) {
+				offset := strings.Index(w, value)
+				marks = append(marks, PollySpeechMark{Time: timings[word].StartMS, Type: "word", Start: start + offset, End: start + offset + len(value), Value: value})
+			}
+			word++
+		}
+	}
+	return marks
+}
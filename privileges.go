@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Minimal containers start processes as root. The service only needs root,
+// if at all, to bind a port below 1024, so it binds first and then switches
+// to an unprivileged user for good; the kernel clears the capabilities of a
+// process that gives up uid 0. Running on as root must be asked for.
+
+// lookupUser resolves a user name or numeric uid
+func lookupUser(name string) (uid, gid uint32, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return 0, 0, fmt.Errorf("user %q: %w", name, err)
+		}
+	}
+	uid64, _ := strconv.ParseUint(u.Uid, 10, 32)
+	gid64, _ := strconv.ParseUint(u.Gid, 10, 32)
+	return uint32(uid64), uint32(gid64), nil
+}
+
+// dropPrivileges switches a root process to name, or refuses to carry on as
+// root unless allowRoot is set. Processes not running as root are left alone.
+func dropPrivileges(name string, allowRoot bool) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	if name == "" {
+		if !allowRoot {
+			return errors.New("refusing to run as root; set -user to an unprivileged user, or -allow-root")
+		}
+		slog.Warn("Running as root")
+		return nil
+	}
+	uid, gid, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+	if uid == 0 {
+		return fmt.Errorf("user %q is root", name)
+	}
+	// Groups first: they can only be changed while still root
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(int(gid)); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(int(uid)); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	if syscall.Setuid(0) == nil {
+		return errors.New("root privileges could be regained after switching users")
+	}
+	slog.Info("Dropped root privileges", "user", name, "uid", uid, "gid", gid)
+	return nil
+}
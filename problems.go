@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Problem is an RFC 7807 error body. Code is stable and safe to match on;
+// Detail is for humans and may change.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// Extension members, set by the errors that need them
+	Pointer   string   `json:"pointer,omitempty"`   // JSON pointer of the invalid field
+	Limit     int64    `json:"limit,omitempty"`     // The limit that was exceeded
+	Supported []string `json:"supported,omitempty"` // Valid values for the rejected field
+}
+
+// Stable error codes
+const (
+	codeInvalidPayload       = "invalid_payload"
+	codeBodyTooLarge         = "body_too_large"
+	codeTextTooLong          = "text_too_long"
+	codeUnknownEngine        = "unknown_engine"
+	codeUnsupportedLanguage  = "unsupported_language"
+	codeUnauthorized         = "unauthorized"
+	codeInvalidAPIKey        = "invalid_api_key"
+	codeInvalidToken         = "invalid_token"
+	codeInvalidSignature     = "invalid_signature"
+	codeRateLimited          = "rate_limited"
+	codeDailyQuota           = "daily_quota_exceeded"
+	codeMonthlyQuota         = "monthly_quota_exceeded"
+	codeSynthesisFailed      = "synthesis_failed"
+	codeTimeout              = "synthesis_timeout"
+	codeEngineUnavailable    = "engine_unavailable"
+	codeQueueFull            = "queue_full"
+	codeMaintenance          = "maintenance"
+	codeNotCached            = "not_cached"
+	codeUpstreamFailed       = "upstream_failed"
+	codeWorkspaceFull        = "workspace_full"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codeForbidden            = "forbidden"
+	codeLexiconFull          = "lexicon_full"
+	codeProfanity            = "profanity"
+	codeContentPolicy        = "content_policy"
+	codeGuardrailUnavailable = "guardrail_unavailable"
+	codeInternal             = "internal_error"
+)
+
+// writeProblem sends p as application/problem+json, filling in the defaults
+func writeProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Type == "" {
+		p.Type = "/problems/" + p.Code
+	}
+	p.RequestID = requestIDFrom(r.Context())
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeError is shorthand for problems without extension members
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	writeProblem(w, r, Problem{Status: status, Code: code, Detail: detail})
+}
+
+// problemWriter holds back a problem, for rewriteProblems
+type problemWriter struct {
+	http.ResponseWriter
+	held *jobRecorder
+}
+
+func (p *problemWriter) WriteHeader(status int) {
+	if strings.HasPrefix(p.Header().Get("Content-Type"), "application/problem+json") {
+		p.held = &jobRecorder{header: make(http.Header), status: status}
+		return
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *problemWriter) Write(b []byte) (int, error) {
+	if p.held != nil {
+		return p.held.Write(b)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (p *problemWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// rewriteProblems lets endpoints compatible with other APIs answer the
+// problems of next, including those of the middleware in front of their
+// handlers, in the error shape of that API. Headers such as Retry-After are
+// kept.
+func rewriteProblems(next http.Handler, write func(w http.ResponseWriter, r *http.Request, problem *Problem)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := &problemWriter{ResponseWriter: w}
+		next.ServeHTTP(p, r)
+		if p.held != nil {
+			write(w, r, p.held.problem())
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Operators exposing the endpoint to user-generated content can filter
+// profanity before it is spoken. Words from the built-in list of the request's
+// language, plus any configured ones, are masked (spoken as a beep word),
+// dropped, or make the request fail with 422. Matching ignores case and only
+// takes whole words, so "class" is not caught by "ass". Both text and SSML
+// are filtered, before lexicon replacements unless the request's pipeline
+// orders them otherwise (see pipeline.go).
+
+const (
+	profanityMask   = "mask"
+	profanityDrop   = "drop"
+	profanityReject = "reject"
+)
+
+var profanityModes = []string{profanityMask, profanityDrop, profanityReject}
+
+// Words under this key apply to every language
+const profanityAnyLanguage = "*"
+
+var errProfanity = errors.New("text contains words that are not allowed")
+
+type ProfanityConfig struct {
+	Mode  string              `json:"mode"`  // mask, drop or reject; empty disables the filter
+	Mask  string              `json:"mask"`  // Spoken instead of masked words; "beep" when empty
+	Words map[string][]string `json:"words"` // Extra words by base language, or "*" for all
+}
+
+// Built-in word lists by base language; deliberately short and unambiguous
+var profanityWords = map[string][]string{
+	"en": {"fuck", "fucking", "fucker", "motherfucker", "shit", "bullshit", "bitch", "asshole", "bastard", "cunt", "dickhead", "prick", "wanker", "twat", "slut", "whore"},
+	"id": {"anjing", "bangsat", "bajingan", "kontol", "memek", "ngentot", "jancuk", "brengsek", "tai", "goblok", "keparat", "pelacur"},
+	"es": {"mierda", "joder", "puta", "puto", "cabrón", "coño", "gilipollas", "pendejo", "chingada", "culero", "hijo de puta"},
+	"fr": {"merde", "putain", "connard", "connasse", "salope", "enculé", "bordel", "pute", "fils de pute", "ta gueule"},
+	"de": {"scheiße", "scheisse", "arschloch", "fotze", "wichser", "hurensohn", "schlampe", "fick", "ficken", "verdammt"},
+}
+
+// ProfanityFilter applies the configured mode; nil when filtering is disabled
+type ProfanityFilter struct {
+	mode     string
+	mask     string
+	patterns map[string]*regexp.Regexp // By base language, with profanityAnyLanguage for the rest
+}
+
+func NewProfanityFilter(cfg ProfanityConfig) (*ProfanityFilter, error) {
+	if cfg.Mode == "" {
+		return nil, nil
+	}
+	if !containsString(profanityModes, cfg.Mode) {
+		return nil, fmt.Errorf("profanity mode must be one of %v", profanityModes)
+	}
+	f := &ProfanityFilter{mode: cfg.Mode, mask: cfg.Mask, patterns: make(map[string]*regexp.Regexp)}
+	if f.mask == "" {
+		f.mask = "beep"
+	}
+	extra := make(map[string][]string)
+	for lang, words := range cfg.Words {
+		lang = strings.ToLower(lang)
+		extra[lang] = append(extra[lang], words...)
+	}
+	langs := map[string]bool{profanityAnyLanguage: true}
+	for lang := range profanityWords {
+		langs[lang] = true
+	}
+	for lang := range extra {
+		langs[lang] = true
+	}
+	for lang := range langs {
+		words := append(append([]string{}, profanityWords[lang]...), extra[profanityAnyLanguage]...)
+		if lang != profanityAnyLanguage {
+			words = append(words, extra[lang]...)
+		}
+		if pattern := profanityPattern(words); pattern != nil {
+			f.patterns[lang] = pattern
+		}
+	}
+	return f, nil
+}
+
+// profanityPattern matches any of words, longest first; nil without words
+func profanityPattern(words []string) *regexp.Regexp {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	sort.Slice(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
+
+// apply masks or drops profanity in text, or returns errProfanity when
+// the mode is reject and text contains any
+func (f *ProfanityFilter) apply(text, lang string) (string, error) {
+	if f == nil {
+		return text, nil
+	}
+	base, _, _ := strings.Cut(strings.ToLower(lang), "-")
+	pattern, exists := f.patterns[base]
+	if !exists {
+		if pattern = f.patterns[profanityAnyLanguage]; pattern == nil {
+			return text, nil
+		}
+	}
+	var out strings.Builder
+	last := 0
+	for _, match := range pattern.FindAllStringIndex(text, -1) {
+		start, end := match[0], match[1]
+		if !wordBoundary(text, start, end) {
+			continue
+		}
+		if f.mode == profanityReject {
+			return "", errProfanity
+		}
+		out.WriteString(text[last:start])
+		if f.mode == profanityMask {
+			out.WriteString(f.mask)
+		}
+		last = end
+	}
+	if last == 0 {
+		return text, nil
+	}
+	out.WriteString(text[last:])
+	text = repeatedSpaces.ReplaceAllString(out.String(), " ")
+	if !strings.ContainsFunc(text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+		return "", nil // Only punctuation is left of dropped words
+	}
+	return strings.TrimSpace(spaceBeforePunct.ReplaceAllString(text, "$1")), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// gTTS speaks every sentence with the same flat delivery. With expressive
+// set, punctuation and capitals stand in for the markup clients would
+// otherwise have to write: questions are raised in pitch and slowed a
+// little, exclamations are louder, and words in ALL CAPS are emphasized like
+// <emphasis level="strong"> and lowercased, so they are read as words rather
+// than spelled out. Short capitalized words are taken for acronyms unless
+// they are part of a shouted run. The result is rendered like SSML.
+
+// Marks expressive sources in cache keys so they never collide with the same text spoken flat
+const expressiveCachePrefix = "\x00expressive:"
+
+// Capitalized words at least this long are emphasized on their own
+const shoutedWordLetters = 5
+
+const (
+	questionPitch  = 1.5 // Semitones
+	questionRate   = 0.97
+	exclaimVolume  = 2 // Decibels
+	emphasisRate   = 0.9
+	emphasisVolume = 3
+)
+
+// Languages whose tones carry meaning, so questions are not raised in pitch
+var tonalLanguages = map[string]bool{"zh": true, "yue": true, "vi": true, "th": true, "lo": true, "my": true, "pa": true, "yo": true}
+
+// Question marks by language, for those not marking questions with "?"
+var questionMarks = map[string]string{
+	"el": ";", // The Greek question mark looks like a semicolon
+	"ar": "؟", "fa": "؟", "ur": "؟",
+	"zh": "？", "ja": "？",
+}
+
+// expressiveDocument returns text as a document with heuristic prosody, and
+// whether any of it differs from a flat reading
+func expressiveDocument(text, lang string) (ssmlDocument, bool) {
+	base, _, _ := strings.Cut(strings.ToLower(lang), "-")
+	var doc ssmlDocument
+	expressive := false
+	add := func(text string, rate, pitch, volume float64) {
+		if rate != 1 || pitch != 0 || volume != 0 {
+			expressive = true
+		}
+		if n := len(doc); n > 0 && doc[n-1].rate == rate && doc[n-1].pitch == pitch && doc[n-1].volume == volume {
+			doc[n-1].text += " " + text
+			return
+		}
+		doc = append(doc, ssmlSegment{text: text, rate: rate, pitch: pitch, volume: volume})
+	}
+
+	for _, sentence := range splitSentences(text) {
+		rate, pitch, volume := 1.0, 0.0, 0.0
+		last, _ := utf8.DecodeLastRuneInString(strings.TrimRightFunc(sentence, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.Is(unicode.Pf, r) || r == '"' || r == '\'' || r == ')'
+		}))
+		switch {
+		case last == '?' || strings.ContainsRune(questionMarks[base], last):
+			rate = questionRate
+			if !tonalLanguages[base] {
+				pitch = questionPitch
+			}
+		case last == '!' || last == '！':
+			volume = exclaimVolume
+		}
+
+		words := strings.Fields(sentence)
+		shouted := make([]bool, len(words))
+		for i, word := range words {
+			shouted[i] = capitalLetters(word) >= shoutedWordLetters
+		}
+		for i, word := range words { // Shorter words count within a run
+			if !shouted[i] && capitalLetters(word) >= 2 && (i > 0 && shouted[i-1] || i+1 < len(words) && capitalLetters(words[i+1]) >= 2) {
+				shouted[i] = true
+			}
+		}
+		for start := 0; start < len(words); {
+			end := start + 1
+			for end < len(words) && shouted[end] == shouted[start] {
+				end++
+			}
+			run := strings.Join(words[start:end], " ")
+			if shouted[start] {
+				add(strings.ToLower(run), rate*emphasisRate, pitch, volume+emphasisVolume)
+			} else {
+				add(run, rate, pitch, volume)
+			}
+			start = end
+		}
+	}
+	return doc, expressive
+}
+
+// capitalLetters returns how many letters word has when all of them are
+// capitals, and 0 otherwise
+func capitalLetters(word string) int {
+	letters := 0
+	for _, r := range word {
+		if unicode.IsLetter(r) {
+			if !unicode.IsUpper(r) {
+				return 0
+			}
+			letters++
+		}
+	}
+	return letters
+}
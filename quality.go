@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quality scoring decodes a sample of freshly synthesized outputs and rates
+// them on a 1-5 MOS-like scale. With a command configured (for example a
+// DNSMOS or NISQA wrapper) the WAV is piped to it and the first number it
+// prints is the score. Otherwise a built-in heuristic is used: it does not
+// predict naturalness, but it reliably flags the encoder problems that matter
+// here, such as clipping, silent output, very low levels, and lost bandwidth.
+// Scores are exported per engine at /metrics as tts_quality_score, and low
+// ones counted in tts_quality_low_total, so alerts need not poll the report.
+
+type QualityConfig struct {
+	SampleRate    float64  `json:"sample_rate"`    // Fraction of fresh syntheses to score, 0..1
+	Command       []string `json:"command"`        // External predictor reading WAV on stdin and printing a score
+	AlertBelow    float64  `json:"alert_below"`    // Scores under this count as low
+	MaxConcurrent int      `json:"max_concurrent"` // Scoring beyond this is skipped
+}
+
+// signalStats are the measurements the heuristic score is built from
+type signalStats struct {
+	ClippingRatio float64 `json:"clipping_ratio"`
+	SilenceRatio  float64 `json:"silence_ratio"`
+	LevelDBFS     float64 `json:"level_dbfs"`
+	Brightness    float64 `json:"brightness"` // Energy of the first difference relative to the signal, a bandwidth proxy
+}
+
+type engineQuality struct {
+	Engine    string      `json:"engine"`
+	Scored    int64       `json:"scored"`
+	Low       int64       `json:"low"`
+	Errors    int64       `json:"errors"`
+	Mean      float64     `json:"mean"`
+	Min       float64     `json:"min"`
+	Max       float64     `json:"max"`
+	Last      float64     `json:"last"`
+	LastStats signalStats `json:"last_stats"`
+	total     float64
+}
+
+// QualityScorer rates a sample of outputs in the background
+type QualityScorer struct {
+	cfg   QualityConfig
+	slots chan struct{}
+	mu    sync.Mutex
+	stats map[string]*engineQuality
+}
+
+// NewQualityScorer returns nil when scoring is disabled
+func NewQualityScorer(cfg QualityConfig) *QualityScorer {
+	if cfg.SampleRate <= 0 {
+		return nil
+	}
+	if cfg.AlertBelow <= 0 {
+		cfg.AlertBelow = 3
+	}
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = 1
+	}
+	return &QualityScorer{cfg: cfg, slots: make(chan struct{}, cfg.MaxConcurrent), stats: make(map[string]*engineQuality)}
+}
+
+func (q *QualityScorer) maybeScore(engine string, audio []byte) {
+	if q == nil || rand.Float64() >= q.cfg.SampleRate {
+		return
+	}
+	select {
+	case q.slots <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-q.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		score, stats, err := q.score(ctx, audio)
+		if err != nil {
+			slog.Warn("Quality scoring failed", "engine", engine, "error", err)
+		}
+		q.record(engine, score, stats, err)
+	}()
+}
+
+func (q *QualityScorer) score(ctx context.Context, audio []byte) (float64, signalStats, error) {
+	if len(q.cfg.Command) > 0 {
+		wav, err := decodeAudio(ctx, audio, "wav")
+		if err != nil {
+			return 0, signalStats{}, err
+		}
+		score, err := runPredictor(ctx, q.cfg.Command, wav)
+		return score, signalStats{}, err
+	}
+	pcm, err := decodeAudio(ctx, audio, "s16le")
+	if err != nil {
+		return 0, signalStats{}, err
+	}
+	stats := measureSignal(pcm)
+	return heuristicScore(stats), stats, nil
+}
+
+// decodeAudio converts encoded audio to 16 kHz mono in the given ffmpeg format
+func decodeAudio(ctx context.Context, audio []byte, format string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", "pipe:0", "-ac", "1", "-ar", "16000", "-f", format, "pipe:1")
+	cmd.Stdin = bytes.NewReader(audio)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := runTimed(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+func runPredictor(ctx context.Context, argv []string, wav []byte) (float64, error) {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(wav)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := runTimed(ctx, cmd); err != nil {
+		return 0, fmt.Errorf("%s: %w", argv[0], err)
+	}
+	for _, field := range strings.Fields(out.String()) {
+		if score, err := strconv.ParseFloat(field, 64); err == nil {
+			return score, nil
+		}
+	}
+	return 0, fmt.Errorf("%s printed no score", argv[0])
+}
+
+// measureSignal analyses 16-bit little-endian mono PCM at 16 kHz
+func measureSignal(pcm []byte) signalStats {
+	n := len(pcm) / 2
+	if n == 0 {
+		return signalStats{SilenceRatio: 1, LevelDBFS: -96}
+	}
+	const frame = 320 // 20 ms
+	var energy, diffEnergy float64
+	var clipped, frames, silentFrames int
+	var frameEnergy float64
+	prev := 0.0
+	for i := 0; i < n; i++ {
+		sample := float64(int16(binary.LittleEndian.Uint16(pcm[2*i:])))
+		if math.Abs(sample) >= 32700 {
+			clipped++
+		}
+		energy += sample * sample
+		diffEnergy += (sample - prev) * (sample - prev)
+		prev = sample
+		frameEnergy += sample * sample
+		if (i+1)%frame == 0 {
+			frames++
+			if 10*math.Log10(frameEnergy/frame/(32768*32768)+1e-12) < -50 {
+				silentFrames++
+			}
+			frameEnergy = 0
+		}
+	}
+	stats := signalStats{
+		ClippingRatio: float64(clipped) / float64(n),
+		LevelDBFS:     10 * math.Log10(energy/float64(n)/(32768*32768)+1e-12),
+	}
+	if frames > 0 {
+		stats.SilenceRatio = float64(silentFrames) / float64(frames)
+	}
+	if energy > 0 {
+		stats.Brightness = diffEnergy / energy
+	}
+	return stats
+}
+
+// heuristicScore maps signal measurements onto a 1-5 scale
+func heuristicScore(stats signalStats) float64 {
+	score := 4.5
+	score -= math.Min(2, stats.ClippingRatio*200) // 1% clipped samples costs two points
+	if stats.SilenceRatio > 0.6 {
+		score -= (stats.SilenceRatio - 0.6) * 5
+	}
+	if stats.LevelDBFS < -35 {
+		score -= math.Min(1.5, (-35-stats.LevelDBFS)/10)
+	}
+	if stats.Brightness < 0.02 { // Speech normally sits well above this; low values mean muffled output
+		score -= 1
+	}
+	return math.Max(1, math.Min(5, score))
+}
+
+func (q *QualityScorer) record(engine string, score float64, stats signalStats, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, exists := q.stats[engine]
+	if !exists {
+		s = &engineQuality{Engine: engine, Min: math.Inf(1)}
+		q.stats[engine] = s
+	}
+	if err != nil {
+		s.Errors++
+		return
+	}
+	s.Scored++
+	s.total += score
+	s.Mean = s.total / float64(s.Scored)
+	s.Min = math.Min(s.Min, score)
+	s.Max = math.Max(s.Max, score)
+	s.Last = score
+	s.LastStats = stats
+	metrics.qualityScores.observe(labels("engine", engine), score)
+	if score < q.cfg.AlertBelow {
+		s.Low++
+		metrics.qualityLow.add(labels("engine", engine), 1)
+		slog.Warn("Low quality output", "engine", engine, "score", score, "alert_below", q.cfg.AlertBelow, "stats", stats)
+	}
+}
+
+// report returns per-engine quality; Min is 0 for engines without a successful score
+func (q *QualityScorer) report() []engineQuality {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	result := []engineQuality{}
+	for _, s := range q.stats {
+		copied := *s
+		if copied.Scored == 0 {
+			copied.Min = 0
+		}
+		result = append(result, copied)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Engine < result[j].Engine })
+	return result
+}
+
+func (s *server) handleQualityReport(w http.ResponseWriter, r *http.Request) {
+	if s.quality == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Quality scoring is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.quality.report())
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// RateLimiter is a token-bucket limiter keyed by client IP
+type RateLimiter struct {
+	rate           float64
+	burst          float64
+	idleTimeout    time.Duration
+	trustedProxies []*net.IPNet
+	mu             sync.Mutex
+	buckets        map[string]*tokenBucket
+}
+
+// NewRateLimiter creates a limiter refilling rate tokens per second up to burst
+func NewRateLimiter(cfg RateLimitConfig) (*RateLimiter, error) {
+	proxies, err := parseNetworks(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	limiter := &RateLimiter{
+		rate:           cfg.RequestsPerSecond,
+		burst:          math.Max(float64(cfg.Burst), 1),
+		idleTimeout:    time.Duration(cfg.IdleTimeout),
+		trustedProxies: proxies,
+		buckets:        make(map[string]*tokenBucket),
+	}
+	if limiter.idleTimeout > 0 {
+		go limiter.evictIdleBuckets()
+	}
+	return limiter, nil
+}
+
+// parseNetworks accepts plain IPs as well as CIDRs
+func parseNetworks(specs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			if ip := net.ParseIP(spec); ip != nil && ip.To4() != nil {
+				spec += "/32"
+			} else {
+				spec += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (l *RateLimiter) evictIdleBuckets() {
+	for {
+		time.Sleep(l.idleTimeout)
+		l.mu.Lock()
+		for ip, bucket := range l.buckets {
+			if time.Since(bucket.lastSeen) > l.idleTimeout {
+				delete(l.buckets, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// allow takes a token for the client, or reports how long until one is available
+func (l *RateLimiter) allow(ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	bucket, exists := l.buckets[ip]
+	if !exists {
+		bucket = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[ip] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*l.rate)
+	bucket.lastSeen = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+func (l *RateLimiter) isTrusted(ip net.IP) bool {
+	for _, network := range l.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the remote address, walking X-Forwarded-For from the right
+// only while the hops are trusted proxies so clients cannot spoof it
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !l.isTrusted(ip) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		host = hop.String()
+		if !l.isTrusted(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// Rate limiting middleware responding 429 with Retry-After when a client is over its budget
+func (l *RateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.rate <= 0 || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := l.allow(l.clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests, codeRateLimited, "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
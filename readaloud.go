@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The read-aloud endpoint serves browser extensions that split a page into
+// chunks and play them back in order. Chunks are synthesized concurrently and
+// returned sorted by index, each independently playable.
+
+type ReadAloudRequest struct {
+	Lang          string           `json:"lang"`
+	Engine        string           `json:"engine,omitempty"`
+	PreNormalized bool             `json:"pre_normalized,omitempty"` // Skip spelling out numbers, dates and abbreviations; see textnorm.go
+	Symbols       string           `json:"symbols,omitempty"`        // keep, speak or strip emoji and symbols; see symbols.go
+	Pipeline      string           `json:"pipeline,omitempty"`       // Preprocessing pipeline; see pipeline.go
+	Speed         float64          `json:"speed,omitempty"`          // Speaking rate multiplier
+	Pitch         float64          `json:"pitch,omitempty"`          // Shift in semitones
+	GainDB        float64          `json:"gain_db,omitempty"`
+	Limit         bool             `json:"limit,omitempty"`
+	Normalize     bool             `json:"normalize,omitempty"`
+	TrimSilence   bool             `json:"trim_silence,omitempty"`
+	PadStartMS    int              `json:"pad_start_ms,omitempty"`
+	PadEndMS      int              `json:"pad_end_ms,omitempty"`
+	Slow          bool             `json:"slow,omitempty"` // The engine's slow mode
+	TLD           string           `json:"tld,omitempty"`  // gtts accent, e.g. co.uk
+	Format        string           `json:"format,omitempty"`
+	SampleRate    int              `json:"sample_rate,omitempty"`
+	Channels      int              `json:"channels,omitempty"`
+	Output        string           `json:"output,omitempty"` // json, the default, zip or tar; see archive.go
+	Chunks        []ReadAloudChunk `json:"chunks"`
+
+	Consent *ConsentMetadata `json:"consent,omitempty"` // Kept with the request's usage record; see consent.go
+}
+
+type ReadAloudChunk struct {
+	Index int    `json:"index"`
+	Text  string `json:"text"`
+	Name  string `json:"name,omitempty"` // Audio file name in archives, without extension
+}
+
+type ReadAloudResponse struct {
+	Codec  string           `json:"codec"`
+	Chunks []ReadAloudAudio `json:"chunks"`
+}
+
+type ReadAloudAudio struct {
+	Index int    `json:"index"`
+	Bytes int    `json:"bytes"`
+	Audio string `json:"audio"` // Base64 encoded audio data
+}
+
+// Chunks synthesized at the same time for one request
+const readAloudConcurrency = 4
+
+func (s *server) handleReadAloud(w http.ResponseWriter, r *http.Request) {
+	var payload ReadAloudRequest
+	if err := s.decodeValidated(r, "readaloud", &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if payload.Output != "" && !containsString(readAloudOutputs, payload.Output) {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: unsupported output", Pointer: "/output", Supported: readAloudOutputs})
+		return
+	}
+	archive := payload.Output == outputZip || payload.Output == outputTar
+	var names []string
+	if archive {
+		var valid bool
+		if names, valid = archiveNames(w, r, payload.Chunks); !valid {
+			return
+		}
+	}
+	engine, lang, ok := s.resolveEngine(w, r, payload.Engine, payload.Lang)
+	if !ok {
+		return
+	}
+	pipeline, ok := s.resolvePipeline(w, r, payload.Pipeline)
+	if !ok {
+		return
+	}
+	pipeline.lang, pipeline.symbols, pipeline.normalize = lang, payload.Symbols, !payload.PreNormalized
+
+	var chars int64
+	var texts []string
+	seen := make(map[int]bool)
+	for i, chunk := range payload.Chunks {
+		if seen[chunk.Index] {
+			writeProblem(w, r, Problem{
+				Status:  http.StatusBadRequest,
+				Code:    codeInvalidPayload,
+				Detail:  fmt.Sprintf("Invalid request payload: /chunks/%d/index: duplicate index %d", i, chunk.Index),
+				Pointer: fmt.Sprintf("/chunks/%d/index", i),
+			})
+			return
+		}
+		seen[chunk.Index] = true
+		n := int64(utf8.RuneCountInString(chunk.Text))
+		if s.cfg.MaxTextChars > 0 && n > int64(s.cfg.MaxTextChars) {
+			writeLimitError(w, r, codeTextTooLong, fmt.Sprintf("Chunk %d is %d characters long", chunk.Index, n), int64(s.cfg.MaxTextChars))
+			return
+		}
+		chars += n
+		texts = append(texts, chunk.Text)
+	}
+	setRequestText(r.Context(), strings.Join(texts, "\n"))
+	p := principalFrom(r.Context())
+	if err := s.keys.charge(p.key, chars); err != nil {
+		writeQuotaError(w, r, err)
+		return
+	}
+	s.usage.record(r.Context(), r.URL.Path, engine.Name(), lang, chars, payload.Consent)
+
+	format := payload.Format
+	if format == "" {
+		format = defaultFormat(r.Header.Get("User-Agent"))
+	}
+	opts := AudioOptions{Format: format, Speed: payload.Speed, Pitch: payload.Pitch, GainDB: payload.GainDB, Limit: payload.Limit, Normalize: payload.Normalize, TrimSilence: payload.TrimSilence, PadStartMS: payload.PadStartMS, PadEndMS: payload.PadEndMS, Slow: payload.Slow, Voice: payload.TLD, SampleRate: payload.SampleRate, Channels: payload.Channels}
+	if !checkEngineOptions(w, r, engine, opts) {
+		s.keys.refund(p.key, chars)
+		return
+	}
+	spoken := make([]string, len(payload.Chunks))
+	for i := range payload.Chunks {
+		var err error
+		if payload.Chunks[i].Text, err = s.screen(r.Context(), GuardrailInput{Text: payload.Chunks[i].Text, Lang: lang, Engine: engine.Name(), Source: "readaloud"}); err != nil {
+			s.keys.refund(p.key, chars)
+			writeGuardrailError(w, r, err, fmt.Sprintf("/chunks/%d/text", i))
+			return
+		}
+		if spoken[i], err = s.preprocess(pipeline, payload.Chunks[i].Text, nil); err != nil {
+			s.keys.refund(p.key, chars)
+			writeProblem(w, r, Problem{Status: http.StatusUnprocessableEntity, Code: codeProfanity, Detail: "Text contains words that are not allowed", Pointer: fmt.Sprintf("/chunks/%d/text", i)})
+			return
+		}
+	}
+	results := make([]ReadAloudAudio, len(payload.Chunks))
+	audio := make([][]byte, len(payload.Chunks))
+	errs := make([]error, len(payload.Chunks))
+	slots := make(chan struct{}, readAloudConcurrency)
+	var wg sync.WaitGroup
+	for i, chunk := range payload.Chunks {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, chunk ReadAloudChunk) {
+			defer func() { <-slots; wg.Done() }()
+			text := spoken[i]
+			if text == "" { // Nothing but stripped symbols
+				results[i] = ReadAloudAudio{Index: chunk.Index}
+				return
+			}
+			data, cached, err := getOrGenerateAudio(r.Context(), engine, text, lang, s.cache, opts)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			s.costs.record(engine.Name(), int64(utf8.RuneCountInString(chunk.Text)), !cached)
+			audio[i] = data
+			if !archive {
+				results[i] = ReadAloudAudio{Index: chunk.Index, Bytes: len(data), Audio: base64.StdEncoding.EncodeToString(data)}
+			}
+		}(i, chunk)
+	}
+	wg.Wait()
+	annotate(r.Context(), "engine", engine.Name(), "lang", lang, "text_length", chars, "chunks", len(payload.Chunks))
+	for _, err := range errs {
+		if err != nil {
+			annotate(r.Context(), "error", err.Error())
+			s.keys.refund(p.key, chars)
+			s.writeSynthesisError(w, r, engine, err)
+			return
+		}
+	}
+
+	if archive {
+		manifest := archiveManifest{Engine: engine.Name(), Lang: lang, Codec: opts.codec(), CreatedAt: time.Now().UTC()}
+		files := make(map[string][]byte)
+		for i, chunk := range payload.Chunks {
+			record := archiveRecord{Index: chunk.Index, Name: names[i], Text: chunk.Text, Bytes: len(audio[i])}
+			if audio[i] != nil {
+				record.File = names[i] + "." + audioExtensions[opts.codec()]
+				files[record.File] = audio[i]
+			}
+			manifest.Files = append(manifest.Files, record)
+		}
+		writeArchive(w, r, payload.Output, manifest, files)
+		return
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+	writeJSON(w, http.StatusOK, ReadAloudResponse{Codec: opts.codec(), Chunks: results})
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The realtime profile serves game dialogue prototyping, where an answer in
+// under half a second matters more than quality. It returns uncompressed PCM
+// in a WAV container, picks the engine that has been fastest so far, gives up
+// after a short deadline, and keeps gtts-cli and ffmpeg processes started
+// ahead of time so requests skip their startup cost.
+
+type RealtimeConfig struct {
+	Timeout    Duration `json:"timeout"`     // Requests still synthesizing after this fail with 504
+	SampleRate int      `json:"sample_rate"` // Of the PCM output, in Hz
+	Prewarm    int      `json:"prewarm"`     // Idle processes kept started per command; 0 disables pre-warming
+	Languages  []string `json:"languages"`   // Languages gtts-cli processes are pre-warmed for
+}
+
+type RealtimeRequest struct {
+	Text   string `json:"text"`
+	Lang   string `json:"lang"`
+	Engine string `json:"engine,omitempty"` // Defaults to the fastest engine supporting lang
+}
+
+// latencyTracker keeps a moving average of each engine's synthesis time
+type latencyTracker struct {
+	mu  sync.Mutex
+	avg map[string]time.Duration
+}
+
+var engineLatency = &latencyTracker{avg: make(map[string]time.Duration)}
+
+func (l *latencyTracker) observe(engine string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if prev, exists := l.avg[engine]; exists {
+		d = prev + (d-prev)/5
+	}
+	l.avg[engine] = d
+}
+
+func (l *latencyTracker) get(engine string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.avg[engine]
+}
+
+// fastestEngine returns the engine with the lowest average latency that
+// supports lang. Engines not measured yet count as fastest so they get tried.
+func (s *server) fastestEngine(lang string) (Engine, string, bool) {
+	var best Engine
+	var bestLang string
+	for _, name := range s.engineNames() {
+		engine := s.engines[name]
+		canonical, supported := s.canonicalLanguage(engine, lang)
+		if !supported || !engineGates.available(name) {
+			continue
+		}
+		if best == nil || engineLatency.get(name) < engineLatency.get(best.Name()) {
+			best, bestLang = engine, canonical
+		}
+	}
+	return best, bestLang, best != nil
+}
+
+// WarmPool keeps processes started and waiting for their stdin, keyed by argv
+type WarmPool struct {
+	size int
+	mu   sync.Mutex
+	idle map[string][]*warmProcess
+	argv map[string][]string // Commands the pool keeps warm
+}
+
+type warmProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout bytes.Buffer
+}
+
+// NewWarmPool returns nil when pre-warming is disabled; a nil pool starts every process on demand
+func NewWarmPool(cfg RealtimeConfig, engines map[string]Engine) *WarmPool {
+	if cfg.Prewarm <= 0 {
+		return nil
+	}
+	p := &WarmPool{size: cfg.Prewarm, idle: make(map[string][]*warmProcess), argv: make(map[string][]string)}
+	p.register(pcmArgs(cfg.SampleRate))
+	for _, engine := range engines {
+		if _, ok := engine.(*gttsEngine); ok {
+			for _, lang := range cfg.Languages {
+				p.register(gttsStdinArgs(lang))
+			}
+			break
+		}
+	}
+	return p
+}
+
+func (p *WarmPool) register(argv []string) {
+	p.argv[strings.Join(argv, "\x00")] = argv
+}
+
+// idleCount reports how many started processes are waiting for work
+func (p *WarmPool) idleCount() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, idle := range p.idle {
+		n += len(idle)
+	}
+	return n
+}
+
+// start fills the pool; call once the server is about to serve
+func (p *WarmPool) start() {
+	if p == nil {
+		return
+	}
+	for _, argv := range p.argv {
+		go p.fill(argv)
+	}
+}
+
+func (p *WarmPool) fill(argv []string) {
+	key := strings.Join(argv, "\x00")
+	for {
+		p.mu.Lock()
+		full := len(p.idle[key]) >= p.size
+		p.mu.Unlock()
+		if full {
+			return
+		}
+		proc, err := startWarmProcess(context.Background(), argv, nil)
+		if err != nil {
+			slog.Warn("Pre-warming process failed", "command", argv[0], "error", err)
+			return
+		}
+		p.mu.Lock()
+		p.idle[key] = append(p.idle[key], proc)
+		p.mu.Unlock()
+	}
+}
+
+// startWarmProcess starts argv tagged with the request in ctx, if any;
+// pre-warmed processes start before their request is known and carry no tags
+func startWarmProcess(ctx context.Context, argv []string, span *Span) (*warmProcess, error) {
+	proc := &warmProcess{cmd: exec.Command(argv[0], argv[1:]...)}
+	tagProcess(ctx, proc.cmd, span)
+	proc.cmd.Stdout = &proc.stdout
+	stdin, err := proc.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	proc.stdin = stdin
+	release, err := sandboxProcess(proc.cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := proc.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return proc, nil
+}
+
+// run feeds input to a warm process for argv, or a freshly started one when
+// none is idle, and returns what it wrote to stdout
+func (p *WarmPool) run(ctx context.Context, argv []string, input []byte) ([]byte, error) {
+	command := filepath.Base(argv[0])
+	_, span := startSpan(ctx, command, "process.command", command)
+	start := time.Now()
+
+	var proc *warmProcess
+	if p != nil {
+		key := strings.Join(argv, "\x00")
+		p.mu.Lock()
+		if idle := p.idle[key]; len(idle) > 0 {
+			proc, p.idle[key] = idle[len(idle)-1], idle[:len(idle)-1]
+		}
+		p.mu.Unlock()
+		if _, warm := p.argv[key]; warm {
+			go p.fill(argv)
+		}
+	}
+	span.set("process.prewarmed", proc != nil)
+	if proc == nil {
+		var err error
+		if proc, err = startWarmProcess(ctx, argv, span); err != nil {
+			span.end(err)
+			return nil, err
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		proc.stdin.Write(input) // A process that fails to read its input reports it through Wait
+		proc.stdin.Close()
+		done <- proc.cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		proc.cmd.Process.Kill()
+		<-done
+		err = ctx.Err()
+	}
+	metrics.subprocess.observe(labels("command", command), time.Since(start).Seconds())
+	span.end(err)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", command, err)
+	}
+	return proc.stdout.Bytes(), nil
+}
+
+// gttsStdinArgs runs gtts-cli reading the text from stdin, so it can be started before the text is known
+func gttsStdinArgs(lang string) []string {
+	return []string{"gtts-cli", "--lang", lang, "--nocheck", "-"}
+}
+
+// pcmArgs decodes engine output to mono signed 16-bit little-endian PCM
+func pcmArgs(sampleRate int) []string {
+	return []string{"ffmpeg", "-loglevel", "error", "-i", "pipe:0", "-ac", "1", "-ar", strconv.Itoa(sampleRate), "-f", "s16le", "pipe:1"}
+}
+
+// realtimeAudio returns PCM at rate for text, using pre-warmed processes where it can
+func (s *server) realtimeAudio(ctx context.Context, engine Engine, text, lang string, rate int) ([]byte, bool, error) {
+	cacheKey, legacyKey := cacheKeys(engine.Name(), text, lang, fmt.Sprintf("pcm%d", rate))
+	if pcm, exists := s.cache.lookup(cacheKey, legacyKey); exists {
+		return pcm, true, nil
+	}
+
+	var raw []byte
+	var err error
+	if _, ok := engine.(*gttsEngine); ok {
+		if readOnlyReplica {
+			return nil, false, errReplicaMiss
+		}
+		if err := maintenance.admit(ctx); err != nil {
+			return nil, false, err
+		}
+		release, queueErr := synthesisQueue.acquire(ctx, engine.Name())
+		if queueErr != nil {
+			return nil, false, queueErr
+		}
+		gateCtx, done, gateErr := engineGates.enter(ctx, engine.Name())
+		if gateErr != nil {
+			release()
+			return nil, false, fmt.Errorf("%s: %w", engine.Name(), gateErr)
+		}
+		metrics.inFlight.Add(1)
+		start := time.Now()
+		raw, err = s.warm.run(gateCtx, gttsStdinArgs(lang), []byte(text))
+		metrics.inFlight.Add(-1)
+		done()
+		release()
+		if err == nil {
+			engineLatency.observe(engine.Name(), time.Since(start))
+		}
+	} else {
+		raw, err = synthesize(ctx, engine, SynthesisRequest{Text: text, Lang: lang})
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	pcm, err := s.warm.run(ctx, pcmArgs(rate), raw)
+	if err != nil {
+		return nil, false, err
+	}
+	s.cache.set(cacheKey, pcm)
+	return pcm, false, nil
+}
+
+// writeWAV writes a canonical 44-byte WAV header for 16-bit PCM, followed by the samples
+func writeWAV(w io.Writer, pcm []byte, sampleRate, channels int) error {
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, uint32(36 + len(pcm)), [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16), uint16(1), uint16(channels), // PCM
+		uint32(sampleRate), uint32(sampleRate * channels * 2), uint16(channels * 2), uint16(16), // Byte rate, block align, bits per sample
+		[4]byte{'d', 'a', 't', 'a'}, uint32(len(pcm)),
+	}
+	for _, field := range header {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(pcm)
+	return err
+}
+
+// pcmFromWAV returns the samples of a WAV writeWAV wrote
+func pcmFromWAV(wav []byte) ([]byte, bool) {
+	if len(wav) < 44 || string(wav[:4]) != "RIFF" || string(wav[36:40]) != "data" {
+		return nil, false
+	}
+	return wav[44:], true
+}
+
+func (s *server) handleRealtime(w http.ResponseWriter, r *http.Request) {
+	var payload RealtimeRequest
+	if err := s.decodeValidated(r, "realtime", &payload); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	var engine Engine
+	var lang string
+	if payload.Engine != "" {
+		var ok bool
+		if engine, lang, ok = s.resolveEngine(w, r, payload.Engine, payload.Lang); !ok {
+			return
+		}
+	} else if fastest, canonical, ok := s.fastestEngine(payload.Lang); ok {
+		engine, lang = fastest, canonical
+	} else {
+		engine, _ = s.engineFor("")
+		s.writeLanguageError(w, r, engine, payload.Lang)
+		return
+	}
+	setRequestText(r.Context(), payload.Text)
+
+	chars := int64(utf8.RuneCountInString(payload.Text))
+	if s.cfg.MaxTextChars > 0 && chars > int64(s.cfg.MaxTextChars) {
+		writeLimitError(w, r, codeTextTooLong, fmt.Sprintf("Text is %d characters long", chars), int64(s.cfg.MaxTextChars))
+		return
+	}
+	text, err := s.screen(r.Context(), GuardrailInput{Text: payload.Text, Lang: lang, Engine: engine.Name(), Source: "realtime"})
+	if err != nil {
+		writeGuardrailError(w, r, err, "/text")
+		return
+	}
+	p := principalFrom(r.Context())
+	if err := s.keys.charge(p.key, chars); err != nil {
+		writeQuotaError(w, r, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(s.cfg.Realtime.Timeout))
+	defer cancel()
+	pcm, cached, err := s.realtimeAudio(ctx, engine, text, lang, s.cfg.Realtime.SampleRate)
+	annotate(r.Context(), "engine", engine.Name(), "lang", lang, "text_length", chars, "cache_hit", cached)
+	setRequestSource(r.Context(), cached)
+	if err != nil {
+		s.keys.refund(p.key, chars)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		annotate(r.Context(), "error", err.Error())
+		writeError(w, r, http.StatusGatewayTimeout, codeTimeout, "Audio was not ready within "+time.Duration(s.cfg.Realtime.Timeout).String())
+		return
+	} else if err != nil {
+		annotate(r.Context(), "error", err.Error())
+		s.writeSynthesisError(w, r, engine, err)
+		return
+	}
+	s.costs.record(engine.Name(), chars, !cached)
+
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("X-TTS-Engine", engine.Name())
+	writeWAV(w, pcm, s.cfg.Realtime.SampleRate, 1)
+}
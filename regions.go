@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Command engines wrapping a cloud TTS API can list several regions or
+// endpoints in regions; each is passed to the command as {region}. Syntheses
+// go to the first healthy region in configured order and fail over to the
+// next when the command fails, so one region's incident does not stop
+// synthesis. A failed region is skipped for a cooldown that doubles with each
+// consecutive failure; when every region is cooling down they are still
+// tried, soonest to recover first. Health is kept in memory and shown in
+// GET /admin/engines.
+
+const (
+	regionCooldown    = 30 * time.Second
+	maxRegionCooldown = 5 * time.Minute
+)
+
+type RegionState struct {
+	Name      string     `json:"name"`
+	Healthy   bool       `json:"healthy"`
+	Failures  int        `json:"consecutive_failures"`
+	LastError string     `json:"last_error,omitempty"`
+	DownUntil *time.Time `json:"down_until,omitempty"`
+}
+
+type regionHealth struct {
+	name      string
+	failures  int
+	lastError string
+	downUntil time.Time
+}
+
+// regionSet tracks the health of an engine's regions; nil for engines without any
+type regionSet struct {
+	engine  string
+	mu      sync.Mutex
+	regions []*regionHealth
+}
+
+func newRegionSet(engine string, names []string) *regionSet {
+	if len(names) == 0 {
+		return nil
+	}
+	set := &regionSet{engine: engine}
+	for _, name := range names {
+		set.regions = append(set.regions, &regionHealth{name: name})
+	}
+	return set
+}
+
+// order returns the regions to try: healthy ones in configured order, then
+// those cooling down, soonest to recover first
+func (s *regionSet) order() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var healthy []string
+	var down []*regionHealth
+	for _, region := range s.regions {
+		if region.downUntil.After(now) {
+			down = append(down, region)
+		} else {
+			healthy = append(healthy, region.name)
+		}
+	}
+	sort.SliceStable(down, func(i, j int) bool { return down[i].downUntil.Before(down[j].downUntil) })
+	for _, region := range down {
+		healthy = append(healthy, region.name)
+	}
+	return healthy
+}
+
+func (s *regionSet) report(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, region := range s.regions {
+		if region.name != name {
+			continue
+		}
+		if err == nil {
+			if region.failures > 0 {
+				slog.Info("Engine region recovered", "engine", s.engine, "region", name)
+			}
+			region.failures, region.lastError, region.downUntil = 0, "", time.Time{}
+			return
+		}
+		region.failures++
+		region.lastError = err.Error()
+		cooldown := min(regionCooldown<<min(region.failures-1, 10), maxRegionCooldown)
+		region.downUntil = time.Now().Add(cooldown)
+		slog.Warn("Engine region failed", "engine", s.engine, "region", name, "failures", region.failures, "cooldown", cooldown, "error", err)
+	}
+}
+
+func (s *regionSet) view() []RegionState {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	states := make([]RegionState, len(s.regions))
+	for i, region := range s.regions {
+		states[i] = RegionState{Name: region.name, Healthy: !region.downUntil.After(now), Failures: region.failures, LastError: region.lastError}
+		if !states[i].Healthy {
+			until := region.downUntil.UTC()
+			states[i].DownUntil = &until
+		}
+	}
+	return states
+}
+
+// failover runs attempt against each region in order until one succeeds;
+// cancellation ends it without blaming the region
+func (s *regionSet) failover(ctx context.Context, attempt func(region string) ([]byte, error)) ([]byte, error) {
+	if s == nil {
+		return attempt("")
+	}
+	var err error
+	for _, region := range s.order() {
+		var audio []byte
+		if audio, err = attempt(region); err == nil || ctx.Err() != nil {
+			if err == nil {
+				s.report(region, nil)
+			}
+			return audio, err
+		}
+		s.report(region, err)
+	}
+	return nil, err
+}
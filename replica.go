@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Instances can share a cache directory, e.g. a network volume: audio is
+// written there as it is cached and read from there on an in-memory miss, so
+// what one instance synthesized is served by all of them. A read-only replica
+// (replica) serves from the shared directory and its own memory but never
+// synthesizes, so cheap edge nodes need no engines; misses are forwarded to
+// the upstream when one is configured (see upstream.go) and otherwise fail
+// with a 503 that a load balancer can retry elsewhere. Replicas do not write
+// to the shared directory, and files older than the cache expiration are
+// ignored.
+
+var errReplicaMiss = errors.New("replica serves cached audio only")
+
+// readOnlyReplica is set from the replica setting when the server starts
+var readOnlyReplica bool
+
+type SharedCacheConfig struct {
+	Dir string `json:"dir"` // Directory shared by the instances; empty disables the shared cache
+}
+
+// sharedCache stores cache entries as files named by the hash of their key;
+// nil when disabled
+type sharedCache struct {
+	dir        string
+	expiration time.Duration
+	readOnly   bool
+}
+
+func newSharedCache(cfg SharedCacheConfig, expiration time.Duration, readOnly bool) *sharedCache {
+	if cfg.Dir == "" {
+		return nil
+	}
+	return &sharedCache{dir: cfg.Dir, expiration: expiration, readOnly: readOnly}
+}
+
+func (s *sharedCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+// read returns the entry for key unless it is missing or expired
+func (s *sharedCache) read(key string) ([]byte, bool) {
+	if s == nil {
+		return nil, false
+	}
+	path := s.path(key)
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > s.expiration {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("Failed to read shared cache entry", "path", path, "error", err)
+		return nil, false
+	}
+	return data, true
+}
+
+// write stores an entry for the other instances; replicas and full disks skip it
+func (s *sharedCache) write(key string, data []byte) {
+	if s == nil || s.readOnly || diskGuard.low(s.dir) {
+		return
+	}
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		slog.Warn("Failed to write shared cache entry", "path", path, "error", err)
+		return
+	}
+	// Written aside and renamed, so other instances never read a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		slog.Warn("Failed to write shared cache entry", "path", path, "error", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		slog.Warn("Failed to write shared cache entry", "path", path, "error", err)
+	}
+}
+
+func writeReplicaMiss(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	writeError(w, r, http.StatusServiceUnavailable, codeNotCached, "This replica serves cached audio only, and the audio is not cached")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os/exec"
+)
+
+// validRequestID accepts short IDs made of characters safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// Request ID middleware: reuses a well-formed incoming X-Request-ID or generates one, and echoes it back
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// tagProcess puts the request ID and, when the request is traced, a W3C
+// TRACEPARENT naming span into the subprocess environment, so process listings
+// and whatever the process leaves behind can be traced back to the request
+func tagProcess(ctx context.Context, cmd *exec.Cmd, span *Span) {
+	var env []string
+	if id := requestIDFrom(ctx); id != "" {
+		env = append(env, "TTS_REQUEST_ID="+id)
+	}
+	if traceparent := span.traceparent(); traceparent != "" {
+		env = append(env, "TRACEPARENT="+traceparent)
+	}
+	if env != nil {
+		cmd.Env = append(cmd.Environ(), env...)
+	}
+}
+
+// metadataArgs has ffmpeg record the request ID in the output's comment tag;
+// formats without tags, such as ADTS and raw PCM, drop it
+func metadataArgs(ctx context.Context) []string {
+	id := requestIDFrom(ctx)
+	if id == "" {
+		return nil
+	}
+	return []string{"-metadata", "comment=request_id=" + id}
+}
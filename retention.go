@@ -0,0 +1,248 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Generated audio and request history are kept only as long as configured:
+// a janitor periodically deletes narrations past their age or beyond the
+// size budget, shadow comparisons, analytics of texts no longer requested
+// and quota usage of idle keys. Admins can also purge everything kept about
+// one tenant at once, e.g. when a customer leaves. The access log is written
+// to a file or stdout and is left to the log pipeline's own retention.
+
+type RetentionConfig struct {
+	Interval          Duration `json:"interval"`            // How often the janitor runs; hourly when zero
+	NarrationMaxAge   Duration `json:"narration_max_age"`   // Feed audio older than this is deleted; 0 keeps it
+	NarrationMaxBytes int64    `json:"narration_max_bytes"` // Oldest feed audio is deleted while all of it takes up more; 0 is unlimited
+	ShadowMaxAge      Duration `json:"shadow_max_age"`      // Shadow audio pairs and their results.jsonl lines
+	HistoryMaxAge     Duration `json:"history_max_age"`     // Analytics of texts not requested for this long
+	UsageMaxAge       Duration `json:"usage_max_age"`       // Quota usage of keys idle this long, the current month's always kept, and usage records older than this
+}
+
+func (c RetentionConfig) enabled() bool {
+	return c.NarrationMaxAge > 0 || c.NarrationMaxBytes > 0 || c.ShadowMaxAge > 0 || c.HistoryMaxAge > 0 || c.UsageMaxAge > 0
+}
+
+// retentionReport counts what one janitor run or purge deleted
+type retentionReport struct {
+	Narrations     int   `json:"narrations"`
+	NarrationBytes int64 `json:"narration_bytes"`
+	ShadowRuns     int   `json:"shadow_runs"`
+	HistoryTexts   int   `json:"history_texts"`
+	UsageRecords   int   `json:"usage_records"`
+}
+
+// runJanitor enforces the retention config until the process exits
+func (s *server) runJanitor(cfg RetentionConfig) {
+	if !cfg.enabled() {
+		return
+	}
+	interval := time.Duration(cfg.Interval)
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	for {
+		report := s.enforceRetention(cfg, time.Now().UTC())
+		if report != (retentionReport{}) {
+			slog.Info("Retention janitor deleted expired data", "report", report)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (s *server) enforceRetention(cfg RetentionConfig, now time.Time) retentionReport {
+	var report retentionReport
+	cutoff := func(age Duration) time.Time {
+		if age <= 0 {
+			return time.Time{}
+		}
+		return now.Add(-time.Duration(age))
+	}
+	report.Narrations, report.NarrationBytes = s.feeds.expire(cutoff(cfg.NarrationMaxAge), cfg.NarrationMaxBytes)
+	if cfg.ShadowMaxAge > 0 {
+		report.ShadowRuns = s.shadow.prune(cutoff(cfg.ShadowMaxAge))
+	}
+	if cfg.HistoryMaxAge > 0 {
+		report.HistoryTexts = s.analytics.forget("", cutoff(cfg.HistoryMaxAge))
+	}
+	if cfg.UsageMaxAge > 0 {
+		report.UsageRecords = s.keys.forgetUsage("", cutoff(cfg.UsageMaxAge)) + s.usage.forget("", cutoff(cfg.UsageMaxAge))
+	}
+	return report
+}
+
+// expire deletes the audio and manifests of narrations updated before
+// cutoff, then of the oldest ones while all audio takes up more than
+// maxBytes. Records stay, marked expired, so polled items are not narrated
+// again.
+func (m *FeedManager) expire(cutoff time.Time, maxBytes int64) (int, int64) {
+	if m == nil || cutoff.IsZero() && maxBytes <= 0 {
+		return 0, 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var kept []*Narration
+	var total int64
+	for _, n := range m.narrations {
+		if n.File != "" {
+			kept = append(kept, n)
+			total += int64(n.Bytes)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].UpdatedAt.Before(kept[j].UpdatedAt) })
+
+	expired, freed := 0, int64(0)
+	for _, n := range kept {
+		if !n.UpdatedAt.Before(cutoff) && (maxBytes <= 0 || total <= maxBytes) {
+			break
+		}
+		for _, file := range []string{n.File, n.Manifest, strings.TrimSuffix(n.Manifest, ".json") + ".sig"} {
+			if file == "" || file == ".sig" {
+				continue
+			}
+			if err := os.Remove(filepath.Join(m.audioDir, file)); err != nil && !os.IsNotExist(err) {
+				slog.Warn("Failed to delete expired narration", "file", file, "error", err)
+			}
+		}
+		total -= int64(n.Bytes)
+		freed += int64(n.Bytes)
+		expired++
+		n.File, n.Manifest, n.Bytes, n.Expired = "", "", 0, true
+		if err := m.db.put(bucketNarrations, n.ID, n); err != nil {
+			slog.Error("Failed to persist narration", "feed", n.Feed, "error", err)
+		}
+	}
+	return expired, freed
+}
+
+// prune deletes shadow runs from before cutoff, both their audio
+// directories and their lines in results.jsonl
+func (s *ShadowRunner) prune(cutoff time.Time) int {
+	if s == nil || s.cfg.OutputDir == "" {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruned := 0
+	entries, _ := os.ReadDir(s.cfg.OutputDir)
+	for _, entry := range entries {
+		// Directories are named after the run's time; see store
+		stamp, _, _ := strings.Cut(entry.Name(), "-")
+		at, err := time.Parse("20060102T150405.000", stamp)
+		if !entry.IsDir() || err != nil || !at.Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.cfg.OutputDir, entry.Name())); err != nil {
+			slog.Warn("Failed to delete shadow run", "dir", entry.Name(), "error", err)
+			continue
+		}
+		pruned++
+	}
+
+	path := filepath.Join(s.cfg.OutputDir, "results.jsonl")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return pruned
+	}
+	var kept []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var result shadowResult
+		if json.Unmarshal([]byte(line), &result) == nil && result.Time.Before(cutoff) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if len(kept) == 0 {
+		os.Remove(path)
+		return pruned
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(kept, "\n")+"\n"), 0o644); err != nil {
+		slog.Warn("Failed to prune shadow results", "error", err)
+		return pruned
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		slog.Warn("Failed to prune shadow results", "error", err)
+	}
+	return pruned
+}
+
+// forget drops the tenant's texts last requested before cutoff, or all of
+// them when cutoff is zero; an empty tenant means every tenant
+func (a *TextAnalytics) forget(tenant string, cutoff time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	forgotten := 0
+	for name, stats := range a.byTenant {
+		if tenant != "" && name != tenant {
+			continue
+		}
+		for hash, stat := range stats {
+			if cutoff.IsZero() || stat.LastSeen.Before(cutoff) {
+				delete(stats, hash)
+				forgotten++
+			}
+		}
+		if len(stats) == 0 {
+			delete(a.byTenant, name)
+		}
+	}
+	return forgotten
+}
+
+// forgetUsage drops quota usage of the tenant's key when it was last used
+// before cutoff, or regardless when cutoff is zero; an empty tenant means
+// every key. Usage from the current month is kept for the age-based sweep,
+// so monthly quotas still hold.
+func (s *KeyStore) forgetUsage(tenant string, cutoff time.Time) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	month := time.Now().UTC().Format("2006-01")
+	forgotten := 0
+	for id, usage := range s.usage {
+		if tenant != "" && id != tenant {
+			continue
+		}
+		if !cutoff.IsZero() {
+			lastUsed, err := time.Parse("2006-01-02", usage.Day)
+			if usage.Month == month || err == nil && !lastUsed.Before(cutoff) {
+				continue
+			}
+		}
+		if err := s.db.delete(bucketKeyUsage, id); err != nil {
+			slog.Warn("Failed to delete API key usage", "key", id, "error", err)
+			continue
+		}
+		delete(s.usage, id)
+		forgotten++
+	}
+	return forgotten
+}
+
+// handlePurgeTenant deletes the request history and quota usage kept about
+// the {tenant} path value. Keys, lexicon entries and narrations are not
+// request history and stay; they have their own endpoints.
+func (s *server) handlePurgeTenant(w http.ResponseWriter, r *http.Request) {
+	tenant := r.PathValue("tenant")
+	report := retentionReport{
+		HistoryTexts: s.analytics.forget(tenant, time.Time{}),
+		UsageRecords: s.keys.forgetUsage(tenant, time.Time{}) + s.usage.forget(tenant, time.Time{}),
+	}
+	slog.Info("Purged tenant data", "tenant", tenant, "report", report)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleRunRetention runs the janitor now instead of waiting for its interval
+func (s *server) handleRunRetention(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.enforceRetention(s.cfg.Retention, time.Now().UTC()))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Connector narrates .txt objects under a prefix. Requests are signed with
+// AWS Signature V4 when AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are set and
+// sent anonymously otherwise. Path-style URLs keep it compatible with MinIO
+// and other S3-compatible stores.
+type s3Connector struct {
+	endpoint string
+	bucket   string
+	prefix   string
+	region   string
+}
+
+// Objects larger than this are skipped
+const maxS3ObjectBytes = 1 << 20
+
+func newS3Connector(cfg FeedConfig) *s3Connector {
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := cfg.URL
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	return &s3Connector{endpoint: strings.TrimSuffix(endpoint, "/"), bucket: cfg.Bucket, prefix: cfg.Prefix, region: region}
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		ETag string `xml:"ETag"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (c *s3Connector) Poll(ctx context.Context) ([]FeedItem, error) {
+	var items []FeedItem
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {c.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := c.get(ctx, "", query)
+		if err != nil {
+			return nil, err
+		}
+		var list s3ListResult
+		if err := xml.Unmarshal(body, &list); err != nil {
+			return nil, fmt.Errorf("s3 list: %w", err)
+		}
+		for _, object := range list.Contents {
+			if !strings.HasSuffix(object.Key, ".txt") || object.Size > maxS3ObjectBytes {
+				continue
+			}
+			data, err := c.get(ctx, object.Key, nil)
+			if err != nil {
+				return items, err
+			}
+			// The ETag changes with the content, so edited objects are narrated again
+			items = append(items, FeedItem{ID: object.Key + "@" + strings.Trim(object.ETag, `"`), Title: object.Key, Text: strings.TrimSpace(string(data))})
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return items, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+// get fetches a bucket listing (empty key) or an object
+func (c *s3Connector) get(ctx context.Context, key string, query url.Values) ([]byte, error) {
+	path := "/" + c.bucket
+	if key != "" {
+		path += "/" + s3EscapePath(key)
+	}
+	rawURL := c.endpoint + path
+	if len(query) > 0 {
+		rawURL += "?" + s3CanonicalQuery(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	signS3Request(req, path, c.region, time.Now().UTC())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxS3ObjectBytes+1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3 GET %s: %s", path, resp.Status)
+	}
+	return body, nil
+}
+
+// s3Escape percent-encodes everything except RFC 3986 unreserved characters
+func s3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3Request adds AWS Signature V4 headers for a GET without a body
+func signS3Request(req *http.Request, canonicalPath, region string, now time.Time) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return
+	}
+	const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), day)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Subprocesses can be sandboxed to contain an exploit of the media toolchain
+// through crafted text or audio. Dropping to another user only needs the
+// service to run as root; network isolation, a read-only filesystem and
+// seccomp filters run the program under bubblewrap (bwrap), which must be
+// installed. Sandboxes apply to a program wherever the service starts it, so
+// pre-warmed processes and realtime synthesis are covered too.
+
+type SandboxConfig struct {
+	User      string `json:"user"`       // Run as this user name or uid; the service must start as root
+	NoNetwork bool   `json:"no_network"` // Give the process a network namespace of its own, with no interfaces
+	ReadOnly  bool   `json:"read_only"`  // Mount everything read-only except a fresh /tmp and the process's working directory
+	Seccomp   string `json:"seccomp"`    // Compiled BPF seccomp filter loaded by bwrap, e.g. from a Docker profile
+}
+
+func (c SandboxConfig) enabled() bool {
+	return c.User != "" || c.NoNetwork || c.ReadOnly || c.Seccomp != ""
+}
+
+// Sandbox confines the processes of one program
+type Sandbox struct {
+	cfg        SandboxConfig
+	credential *syscall.Credential
+	bwrap      string // Empty when only the user changes
+	filter     []byte
+}
+
+// NewSandbox returns nil when cfg asks for no confinement
+func NewSandbox(cfg SandboxConfig) (*Sandbox, error) {
+	if !cfg.enabled() {
+		return nil, nil
+	}
+	s := &Sandbox{cfg: cfg}
+	if cfg.User != "" {
+		uid, gid, err := lookupUser(cfg.User)
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: %w", err)
+		}
+		if os.Geteuid() != 0 && uint32(os.Geteuid()) != uid {
+			return nil, fmt.Errorf("sandbox user %q: the service must run as root to switch users", cfg.User)
+		}
+		s.credential = &syscall.Credential{Uid: uid, Gid: gid, Groups: []uint32{}}
+	}
+	if cfg.NoNetwork || cfg.ReadOnly || cfg.Seccomp != "" {
+		path, err := exec.LookPath("bwrap")
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: bubblewrap is required for no_network, read_only and seccomp: %w", err)
+		}
+		s.bwrap = path
+	}
+	if cfg.Seccomp != "" {
+		filter, err := os.ReadFile(cfg.Seccomp)
+		if err != nil {
+			return nil, fmt.Errorf("sandbox seccomp filter: %w", err)
+		}
+		s.filter = filter
+	}
+	return s, nil
+}
+
+// Sandboxes by program base name, e.g. "ffmpeg" or "gtts-cli"; set up by
+// newServer before anything starts a process
+var sandboxes = map[string]*Sandbox{}
+
+// buildSandboxes creates the sandboxes of ffmpeg and the engines' programs
+func buildSandboxes(ffmpeg SandboxConfig, engines []EngineConfig) (map[string]*Sandbox, error) {
+	configs := map[string]SandboxConfig{"ffmpeg": ffmpeg}
+	owners := map[string]string{"ffmpeg": "ffmpeg_sandbox"}
+	for _, engine := range engines {
+		var program string
+		switch {
+		case engine.Type == "gtts":
+			program = "gtts-cli"
+		case len(engine.Command) > 0:
+			program = filepath.Base(engine.Command[0])
+		default:
+			continue
+		}
+		if other, exists := configs[program]; exists && other != engine.Sandbox {
+			return nil, fmt.Errorf("engine %q: %s is also run by %s with a different sandbox", engine.Name, program, owners[program])
+		} else if !exists {
+			configs[program], owners[program] = engine.Sandbox, fmt.Sprintf("engine %q", engine.Name)
+		}
+	}
+	built := make(map[string]*Sandbox)
+	for program, cfg := range configs {
+		sandbox, err := NewSandbox(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", owners[program], err)
+		}
+		if sandbox != nil {
+			built[program] = sandbox
+		}
+	}
+	return built, nil
+}
+
+// sandboxProcess confines cmd according to its program's sandbox, if any.
+// Call release once the process has started.
+func sandboxProcess(cmd *exec.Cmd) (release func(), err error) {
+	s := sandboxes[filepath.Base(cmd.Args[0])]
+	if s == nil {
+		return func() {}, nil
+	}
+	if s.credential != nil {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Credential = s.credential
+		if cmd.Dir != "" {
+			if err := os.Chown(cmd.Dir, int(s.credential.Uid), int(s.credential.Gid)); err != nil {
+				return nil, fmt.Errorf("sandbox: %w", err)
+			}
+		}
+	}
+	if s.bwrap == "" {
+		return func() {}, nil
+	}
+
+	args := []string{s.bwrap, "--die-with-parent", "--new-session"}
+	if s.cfg.ReadOnly {
+		args = append(args, "--ro-bind", "/", "/", "--dev", "/dev", "--unshare-pid", "--proc", "/proc", "--tmpfs", "/tmp")
+		if cmd.Dir != "" {
+			args = append(args, "--bind", cmd.Dir, cmd.Dir) // After /tmp, which may contain it
+		}
+	} else {
+		args = append(args, "--dev-bind", "/", "/")
+	}
+	if s.cfg.NoNetwork {
+		args = append(args, "--unshare-net")
+	}
+	release = func() {}
+	if s.filter != nil {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: %w", err)
+		}
+		go func() {
+			w.Write(s.filter) // bwrap reports a truncated filter itself
+			w.Close()
+		}()
+		args = append(args, "--seccomp", strconv.Itoa(3+len(cmd.ExtraFiles)))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		release = func() { r.Close() }
+	}
+	cmd.Args = append(append(args, "--", cmd.Path), cmd.Args[1:]...)
+	cmd.Path = s.bwrap
+	return release, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Request bodies are checked against the JSON Schemas published under
+// /v1/schemas. In strict mode unknown fields and wrong types are rejected; in
+// lenient mode unknown fields are dropped and scalars are coerced to the
+// declared type where that is unambiguous ("1.5" -> 1.5, "true" -> true).
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+const (
+	validationStrict  = "strict"
+	validationLenient = "lenient"
+)
+
+// Schema is the subset of JSON Schema the validator understands
+type Schema struct {
+	Type                 string             `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	Enum                 []any              `json:"enum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+}
+
+// ValidationError carries the JSON pointer of the offending value
+type ValidationError struct {
+	Pointer string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	pointer := e.Pointer
+	if pointer == "" {
+		pointer = "/"
+	}
+	return pointer + ": " + e.Message
+}
+
+var schemas = mustLoadSchemas()
+
+func mustLoadSchemas() map[string]*Schema {
+	entries, err := schemaFiles.ReadDir("schemas")
+	if err != nil {
+		panic(err)
+	}
+	loaded := make(map[string]*Schema)
+	for _, entry := range entries {
+		data, err := schemaFiles.ReadFile("schemas/" + entry.Name())
+		if err != nil {
+			panic(err)
+		}
+		var schema Schema
+		if err := json.Unmarshal(data, &schema); err != nil {
+			panic(fmt.Sprintf("schema %s: %v", entry.Name(), err))
+		}
+		loaded[strings.TrimSuffix(entry.Name(), ".json")] = &schema
+	}
+	return loaded
+}
+
+// schemaEnum returns the allowed values of a string property, for checking
+// values that arrive outside a JSON body against the same list
+func schemaEnum(schema, property string) []string {
+	var values []string
+	for _, value := range schemas[schema].Properties[property].Enum {
+		values = append(values, value.(string))
+	}
+	return values
+}
+
+// escapePointer escapes a property name for use in a JSON pointer (RFC 6901)
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+func jsonTypeOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// coerce converts scalars to the wanted type in lenient mode
+func coerce(v any, want string) (any, bool) {
+	switch want {
+	case "number", "integer":
+		if s, ok := v.(string); ok {
+			if n, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+				return n, true
+			}
+		}
+	case "boolean":
+		switch v {
+		case "true", "1", float64(1):
+			return true, true
+		case "false", "0", float64(0):
+			return false, true
+		}
+	case "string":
+		switch t := v.(type) {
+		case float64:
+			return strconv.FormatFloat(t, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(t), true
+		}
+	}
+	return v, false
+}
+
+// validate checks v against the schema, returning the possibly coerced value
+func (s *Schema) validate(v any, pointer string, mode string) (any, error) {
+	if s.Type != "" {
+		got := jsonTypeOf(v)
+		if s.Type == "integer" && got == "number" && v.(float64) != float64(int64(v.(float64))) {
+			return nil, &ValidationError{pointer, "expected integer"}
+		}
+		if got != s.Type && !(s.Type == "integer" && got == "number") {
+			coerced, ok := v, false
+			if mode == validationLenient {
+				coerced, ok = coerce(v, s.Type)
+			}
+			if !ok {
+				return nil, &ValidationError{pointer, fmt.Sprintf("expected %s, got %s", s.Type, got)}
+			}
+			v = coerced
+		}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if allowed == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, &ValidationError{pointer, fmt.Sprintf("must be one of %v", s.Enum)}
+		}
+	}
+
+	switch t := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(t)
+		if s.MinLength != nil && n < *s.MinLength {
+			if *s.MinLength == 1 {
+				return nil, &ValidationError{pointer, "must not be empty"}
+			}
+			return nil, &ValidationError{pointer, fmt.Sprintf("must be at least %d characters", *s.MinLength)}
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return nil, &ValidationError{pointer, fmt.Sprintf("must be at most %d characters", *s.MaxLength)}
+		}
+	case float64:
+		if s.Minimum != nil && t < *s.Minimum {
+			return nil, &ValidationError{pointer, fmt.Sprintf("must be >= %v", *s.Minimum)}
+		}
+		if s.Maximum != nil && t > *s.Maximum {
+			return nil, &ValidationError{pointer, fmt.Sprintf("must be <= %v", *s.Maximum)}
+		}
+	case []any:
+		if s.MinItems != nil && len(t) < *s.MinItems {
+			if *s.MinItems == 1 {
+				return nil, &ValidationError{pointer, "must not be empty"}
+			}
+			return nil, &ValidationError{pointer, fmt.Sprintf("must have at least %d items", *s.MinItems)}
+		}
+		if s.MaxItems != nil && len(t) > *s.MaxItems {
+			return nil, &ValidationError{pointer, fmt.Sprintf("must have at most %d items", *s.MaxItems)}
+		}
+		if s.Items != nil {
+			for i, item := range t {
+				coerced, err := s.Items.validate(item, pointer+"/"+strconv.Itoa(i), mode)
+				if err != nil {
+					return nil, err
+				}
+				t[i] = coerced
+			}
+		}
+	case map[string]any:
+		return s.validateObject(t, pointer, mode)
+	}
+	return v, nil
+}
+
+func (s *Schema) validateObject(obj map[string]any, pointer string, mode string) (any, error) {
+	for _, name := range s.Required {
+		if _, exists := obj[name]; !exists {
+			return nil, &ValidationError{pointer + "/" + escapePointer(name), "is required"}
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names) // Report problems in a stable order
+	for _, name := range names {
+		child := pointer + "/" + escapePointer(name)
+		prop, known := s.Properties[name]
+		if !known {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				if mode == validationStrict {
+					return nil, &ValidationError{child, "unknown field"}
+				}
+				delete(obj, name)
+			}
+			continue
+		}
+		coerced, err := prop.validate(obj[name], child, mode)
+		if err != nil {
+			return nil, err
+		}
+		obj[name] = coerced
+	}
+	return obj, nil
+}
+
+// validationMode picks the configured mode unless the client asks for another via X-Validation
+func (s *server) validationMode(r *http.Request) string {
+	switch mode := r.Header.Get("X-Validation"); mode {
+	case validationStrict, validationLenient:
+		return mode
+	}
+	return s.cfg.Validation
+}
+
+// decodeValidated reads a JSON body, validates it against the named schema, and decodes it into out
+func (s *server) decodeValidated(r *http.Request, schemaName string, out any) error {
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return err
+	} else if err != nil {
+		return &ValidationError{"", "could not read body"}
+	}
+	var raw any
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return &ValidationError{"", "body is not valid JSON"}
+	}
+	validated, err := schemas[schemaName].validate(raw, "", s.validationMode(r))
+	if err != nil {
+		return err
+	}
+	normalized, err := json.Marshal(validated)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(normalized, out)
+}
+
+// Serves the published request schemas
+func serveSchema(w http.ResponseWriter, r *http.Request) {
+	data, err := schemaFiles.ReadFile("schemas/" + r.PathValue("name"))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Unknown schema")
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(data)
+}
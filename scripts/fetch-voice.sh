@@ -0,0 +1,30 @@
+#!/bin/sh
+# Fetches the Piper voice bundled by -tags embedvoice into voices/, checking
+# both files against their SHA-256 before anything is kept; see piper_embed.go.
+#
+#   VOICE_URL=https://.../en_US-lessac-medium.onnx \
+#   VOICE_SHA256=<sha256 of the .onnx> VOICE_CONFIG_SHA256=<sha256 of the .onnx.json> \
+#   scripts/fetch-voice.sh
+#
+# The config is fetched from VOICE_URL.json. Piper voices and their sums are
+# listed at https://huggingface.co/rhasspy/piper-voices; pin a tag or commit
+# in VOICE_URL so the sums keep matching.
+set -eu
+
+: "${VOICE_URL:=https://huggingface.co/rhasspy/piper-voices/resolve/v1.0.0/en/en_US/lessac/medium/en_US-lessac-medium.onnx}"
+if [ -z "${VOICE_SHA256:-}" ] || [ -z "${VOICE_CONFIG_SHA256:-}" ]; then
+	echo "fetch-voice: set VOICE_SHA256 and VOICE_CONFIG_SHA256 to the published sums of $VOICE_URL and its .json" >&2
+	exit 1
+fi
+
+dir="$(dirname "$0")/../voices"
+mkdir -p "$dir"
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+curl -fsSL -o "$tmp/default.onnx" "$VOICE_URL"
+curl -fsSL -o "$tmp/default.onnx.json" "$VOICE_URL.json"
+printf '%s  %s\n%s  %s\n' \
+	"$VOICE_SHA256" "$tmp/default.onnx" \
+	"$VOICE_CONFIG_SHA256" "$tmp/default.onnx.json" | sha256sum -c -
+mv "$tmp/default.onnx" "$tmp/default.onnx.json" "$dir/"
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Templated texts ("Your order number is 4711. Thank you for shopping with
+// us.") mostly repeat sentences the service has spoken before. With sentence
+// caching on, a text that misses the cache as a whole is spoken sentence by
+// sentence, each sentence's audio cached as PCM on its own, so only the
+// sentences that changed reach the engine. Clients sending templated texts
+// can ask for it per request with sentence_cache when the server does not
+// enable it for everyone.
+
+// splitSentences splits text at sentence ends, dropping empty sentences
+func splitSentences(text string) []string {
+	var sentences []string
+	for text != "" {
+		end := sentenceEnd(text)
+		if end < 0 {
+			end = len(text)
+		}
+		if sentence := strings.TrimSpace(text[:end]); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		text = text[end:]
+	}
+	return sentences
+}
+
+// cacheableSentences returns the sentences of text when the server or the
+// request asks for it to be spoken sentence by sentence, or nil. Wrapping engines such as SSML and voices are
+// keyed by text that is not what they speak, so only plain engines qualify.
+func (c *AudioCache) cacheableSentences(engine Engine, text string, opts AudioOptions) []string {
+	if !c.sentences && !opts.Sentences {
+		return nil
+	}
+	switch engine.(type) {
+	case *gttsEngine, *commandEngine:
+	default:
+		return nil
+	}
+	if sentences := splitSentences(text); len(sentences) > 1 {
+		return sentences
+	}
+	return nil
+}
+
+// sentenceCacheKey identifies the PCM of one sentence; it covers everything
+// the engine is asked for, while output options are applied after joining
+func sentenceCacheKey(engine Engine, req SynthesisRequest) (string, string) {
+	return cacheKeys(engine.Name(), req.Text, req.Lang, fmt.Sprintf("sentence%d:%s:%t", ssmlSampleRate, req.Voice, req.Slow))
+}
+
+// generateFromSentences speaks sentences through the sentence cache and
+// encodes the joined audio like generateAudioData
+func generateFromSentences(ctx context.Context, engine Engine, sentences []string, lang string, cache *AudioCache, opts AudioOptions) ([]byte, error) {
+	ctx, span := startSpan(ctx, "synthesize.sentences", "tts.sentences", len(sentences))
+	wav, cached, err := speakPieces(ctx, engine, pieceRequests(opts.synthesisRequest("", lang), sentences), cache)
+	span.set("tts.sentences_cached", cached)
+	span.end(err)
+	if err != nil {
+		return nil, err
+	}
+	return transcodeAudio(ctx, wav, opts)
+}
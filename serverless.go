@@ -0,0 +1,63 @@
+package main
+
+import "os"
+
+// With serverless set, the same binary runs as a function for spiky,
+// low-volume workloads: on Cloud Run, or on AWS Lambda behind the Lambda Web
+// Adapter, which forwards invocations to an HTTP server on $PORT. Instances
+// come and go with traffic and are frozen between requests, so nothing may
+// depend on a long-lived goroutine or on work after the response:
+//
+//   - the cache expires entries on read (see lazy_expiry), rate limit buckets
+//     are never swept and realtime processes are not pre-warmed
+//   - jobs, feeds, chat clips, shadowing, quality scoring, disk guard,
+//     tracing and the retention janitor are unavailable; run retention
+//     from a scheduler with POST /admin/retention/run instead
+//   - a new instance starts with an empty memory cache, so shared_cache.dir,
+//     on a mounted bucket or volume, or upstream.url is required
+//
+// $PORT, when set, overrides addr, since the platform assigns the port.
+
+// serverless is set from the serverless setting when the server starts
+var serverless bool
+
+// adaptForServerless turns off what would keep a goroutine running
+func (c *Config) adaptForServerless() {
+	c.LazyExpiry = true
+	c.RateLimit.IdleTimeout = 0
+	c.Realtime.Prewarm = 0
+	if port := os.Getenv("PORT"); port != "" {
+		c.Addr = ":" + port
+	}
+}
+
+// checkServerless reports settings that serverless instances cannot honor
+func (c *Config) checkServerless(report func(pointer, format string, args ...any)) {
+	if c.SharedCache.Dir == "" && c.Upstream.URL == "" {
+		report("/serverless", "requires /shared_cache/dir or /upstream/url, since instances start with an empty cache")
+	}
+	if c.Role == roleWorker {
+		report("/role", "workers run continuously, so they cannot be serverless")
+	}
+	if len(c.Feeds.Sources) > 0 {
+		report("/feeds/sources", "feeds are polled in the background, which serverless instances cannot do")
+	}
+	if c.Chat.SlackSigningSecret != "" || c.Chat.TeamsSecret != "" {
+		report("/chat", "chat clips are expired in the background, which serverless instances cannot do")
+	}
+	if c.DiskGuard.MinFreeBytes > 0 {
+		report("/disk_guard/min_free_bytes", "the disk guard runs in the background, which serverless instances cannot do")
+	}
+	if c.Shadow.Engine != "" && c.Shadow.SampleRate > 0 {
+		report("/shadow/engine", "shadow syntheses run after the response, which serverless instances cannot do")
+	}
+	if c.Quality.SampleRate > 0 {
+		report("/quality/sample_rate", "audio is scored after the response, which serverless instances cannot do")
+	}
+	if c.GRPC.Addr != "" {
+		report("/grpc/addr", "the platform forwards a single HTTP port, so the gRPC API cannot be served")
+	}
+	if c.Tracing.Endpoint != "" {
+		report("/tracing/endpoint", "spans are exported in the background, which serverless instances cannot do")
+	}
+}
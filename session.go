@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Streaming sessions serve voice-assistant backends that speak an LLM's answer
+// while it is still being generated. The client opens a WebSocket to
+// GET /v1/sessions?lang=en (optionally &flush=... and &flush_chars=..., see
+// flushPolicy, &metadata=true, &pre_normalized=true to skip textnorm.go,
+// &symbols=speak or strip, see symbols.go, &pipeline=... to choose the
+// preprocessing pipeline, see pipeline.go, and the voice settings of
+// parseSessionVoice)
+// and sends JSON text messages:
+//
+//	{"type":"text","text":"..."}  a fragment of the answer, any size
+//	{"type":"flush"}              speak what is buffered even without a sentence end
+//	{"type":"end"}                flush, then close once all audio is sent
+//	{"type":"interrupt"}          barge-in: drop everything not yet sent; may carry new text
+//
+// Buffered text is synthesized a sentence at a time, in order, all with the
+// voice, style, speed and pitch the session was opened with. For each
+// sentence the server sends an "audio" event followed by a binary message with
+// the audio; problems are reported as "error" events, and "done" follows "end".
+// An interrupt is answered with an "interrupted" event: audio received before
+// it belongs to the old text and should be stopped, audio after it is new.
+//
+// With metadata=true each audio event is preceded by "chunk_start", giving the
+// chunk's position on the session's audio timeline (offset_ms, reset by an
+// interrupt), its duration_ms and estimated word timings, and the binary
+// message is followed by "chunk_end" with remaining_ms, an estimate of how
+// much speech the text received but not yet sent will take.
+
+// How long a session may stay silent before it is closed
+const sessionIdleTimeout = 2 * time.Minute
+
+// Text buffered without a sentence end is cut at a word boundary past this length
+const sessionMaxPending = 400
+
+// Chunk length of the "chars" flush policy when flush_chars is not given
+const defaultFlushChars = 100
+
+// flushPolicy decides when buffered text is sent for synthesis, trading
+// latency against prosody: longer chunks sound more natural but start later.
+//
+//	punctuation  at sentence ends, once at least chars characters are buffered (the default, with chars 0)
+//	chars        about every chars characters, at a word boundary
+//	explicit     only on flush and end messages
+type flushPolicy struct {
+	mode  string
+	chars int
+	limit int // Forced cut for explicit mode, so the buffer stays bounded
+}
+
+var flushModes = []string{"punctuation", "chars", "explicit"}
+
+func parseFlushPolicy(mode, chars string, limit int) (flushPolicy, error) {
+	policy := flushPolicy{mode: mode, limit: limit}
+	if policy.mode == "" {
+		policy.mode = "punctuation"
+	}
+	if !containsString(flushModes, policy.mode) {
+		return policy, errors.New("unknown flush policy")
+	}
+	if chars != "" {
+		n, err := strconv.Atoi(chars)
+		if err != nil || n < 1 {
+			return policy, errors.New("flush_chars must be a positive integer")
+		}
+		policy.chars = n
+	} else if policy.mode == "chars" {
+		policy.chars = defaultFlushChars
+	}
+	if policy.limit <= 0 {
+		policy.limit = 5000
+	}
+	return policy, nil
+}
+
+// chunkEnd returns the index just past the next chunk to synthesize, or -1 to keep buffering
+func (f flushPolicy) chunkEnd(text string) int {
+	switch f.mode {
+	case "chars":
+		if utf8.RuneCountInString(text) >= f.chars {
+			return cutAtSpace(text, runeOffset(text, f.chars))
+		}
+	case "explicit":
+		if utf8.RuneCountInString(text) > f.limit {
+			return cutAtSpace(text, runeOffset(text, f.limit))
+		}
+	default:
+		for offset := 0; ; {
+			end := sentenceEnd(text[offset:])
+			if end < 0 {
+				break
+			}
+			offset += end
+			if utf8.RuneCountInString(text[:offset]) >= f.chars {
+				return offset
+			}
+		}
+		if len(text) > sessionMaxPending {
+			return cutAtSpace(text, sessionMaxPending)
+		}
+	}
+	return -1
+}
+
+// runeOffset returns the byte offset of the nth rune of text
+func runeOffset(text string, n int) int {
+	for i := range text {
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return len(text)
+}
+
+// cutAtSpace returns the last word boundary at or before limit, or limit
+// itself moved back to the start of a rune when there is none
+func cutAtSpace(text string, limit int) int {
+	if next, _ := utf8.DecodeRuneInString(text[limit:]); limit == len(text) || unicode.IsSpace(next) {
+		return limit
+	}
+	if end := strings.LastIndexFunc(text[:limit], unicode.IsSpace); end > 0 {
+		return end
+	}
+	for limit > 0 && limit < len(text) && !utf8.RuneStart(text[limit]) {
+		limit--
+	}
+	return limit
+}
+
+// Sentences waiting for synthesis before reading from the client pauses
+const sessionQueueSize = 32
+
+type SessionMessage struct {
+	Type string `json:"type"` // "text", "flush", "end" or "interrupt"
+	Text string `json:"text,omitempty"`
+}
+
+type SessionEvent struct {
+	Type        string       `json:"type"`             // "ready", "chunk_start", "audio", "chunk_end", "interrupted", "error" or "done"
+	Seq         int          `json:"seq,omitempty"`    // Of the audio event, counting from 1
+	Text        string       `json:"text,omitempty"`   // Sentence the audio speaks
+	Codec       string       `json:"codec,omitempty"`  // Of the binary message that follows
+	Flush       string       `json:"flush,omitempty"`  // Flush policy in effect, in the "ready" event
+	Voice       string       `json:"voice,omitempty"`  // Voice in effect, in the "ready" event
+	Smooth      bool         `json:"smooth,omitempty"` // Whether prosody is smoothed across sentences, in the "ready" event
+	Bytes       int          `json:"bytes,omitempty"`
+	OffsetMS    int64        `json:"offset_ms,omitempty"`    // Where the chunk starts (chunk_start) or ends (chunk_end)
+	DurationMS  int64        `json:"duration_ms,omitempty"`  // Of the chunk's audio
+	RemainingMS int64        `json:"remaining_ms,omitempty"` // Estimated speech still to come
+	Words       []WordTiming `json:"words,omitempty"`
+	Code        string       `json:"code,omitempty"` // Stable error code, as in problem responses
+	Detail      string       `json:"detail,omitempty"`
+}
+
+type session struct {
+	s       *server
+	conn    *wsConn
+	ctx     context.Context
+	cancel  context.CancelFunc
+	key     *APIKey
+	engine  Engine
+	lang    string
+	opts    AudioOptions
+	text    textPipeline // Preprocessing; see pipeline.go
+	voice   sessionVoice
+	flush   flushPolicy
+	pending strings.Builder
+	queue   chan queuedSentence
+	seq     int
+	raw     bool // Plain text in and bare audio out; see wsspeak.go
+
+	// Backchannel metadata; elapsed and the spoken totals are guarded by genMu
+	metadata     bool
+	elapsed      time.Duration // Audio sent in the current generation
+	spokenChars  int64
+	spokenTime   time.Duration
+	backlogChars atomic.Int64 // Queued, plus buffered as of the last message
+	pendingChars int64        // Buffered chars counted into backlogChars
+
+	// Each interrupt starts a new generation; work from older ones is dropped
+	genMu     sync.Mutex
+	gen       int
+	genCtx    context.Context
+	genCancel context.CancelFunc
+}
+
+type queuedSentence struct {
+	gen  int
+	text string
+}
+
+func (s *server) handleSession(w http.ResponseWriter, r *http.Request) {
+	s.openSession(w, r, false)
+}
+
+func (s *server) openSession(w http.ResponseWriter, r *http.Request, raw bool) {
+	query := r.URL.Query()
+	if query.Get("lang") == "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request: lang is required", Pointer: "/lang"})
+		return
+	}
+	engine, lang, ok := s.resolveEngine(w, r, query.Get("engine"), query.Get("lang"))
+	if !ok {
+		return
+	}
+	flush, err := parseFlushPolicy(query.Get("flush"), query.Get("flush_chars"), s.cfg.MaxTextChars)
+	if err != nil {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request: " + err.Error(), Supported: flushModes})
+		return
+	}
+	voice, err := parseSessionVoice(query, engineFeatures(engine))
+	if err != nil {
+		var invalid *ValidationError
+		errors.As(err, &invalid)
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request: " + err.Error(), Pointer: invalid.Pointer})
+		return
+	}
+	metadata, preNormalized := false, false
+	if value := query.Get("metadata"); value != "" {
+		if metadata, err = strconv.ParseBool(value); err != nil {
+			writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request: metadata must be true or false", Pointer: "/metadata"})
+			return
+		}
+	}
+	if value := query.Get("pre_normalized"); value != "" {
+		if preNormalized, err = strconv.ParseBool(value); err != nil {
+			writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request: pre_normalized must be true or false", Pointer: "/pre_normalized"})
+			return
+		}
+	}
+	symbols := query.Get("symbols")
+	if symbols != "" && !containsString(symbolModes, symbols) {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request: unsupported symbols", Pointer: "/symbols", Supported: symbolModes})
+		return
+	}
+	pipeline, ok := s.resolvePipeline(w, r, query.Get("pipeline"))
+	if !ok {
+		return
+	}
+	pipeline.lang, pipeline.symbols, pipeline.normalize = lang, symbols, !preNormalized
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidPayload, "Invalid request: "+err.Error())
+		return
+	}
+
+	format := "opus"
+	if query.Get("codec") == "aac" {
+		format = "aac"
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	sess := &session{
+		s:        s,
+		conn:     conn,
+		ctx:      ctx,
+		cancel:   cancel,
+		key:      principalFrom(r.Context()).key,
+		engine:   engine,
+		lang:     lang,
+		opts:     AudioOptions{Format: format, Speed: voice.speed, Pitch: voice.pitch},
+		voice:    voice,
+		flush:    flush,
+		metadata: metadata,
+		text:     pipeline,
+		queue:    make(chan queuedSentence, sessionQueueSize),
+		raw:      raw,
+	}
+	sess.genCtx, sess.genCancel = context.WithCancel(ctx)
+	sentences := sess.run()
+	annotate(r.Context(), "engine", engine.Name(), "lang", lang, "sentences", sentences)
+}
+
+// run serves the session until it ends and returns how many sentences were spoken
+func (sess *session) run() int {
+	defer sess.cancel()
+	done := make(chan struct{})
+	go func() {
+		sess.synthesizeQueued()
+		close(done)
+	}()
+	sess.conn.writeJSON(SessionEvent{Type: "ready", Codec: sess.opts.codec(), Flush: sess.flush.mode, Voice: sess.voice.voice, Smooth: sess.voice.smooth})
+
+	ended := false
+	for !ended {
+		opcode, data, err := sess.conn.readMessage(sessionIdleTimeout)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				sess.conn.close(wsClosePolicy, "idle timeout")
+			} else {
+				sess.conn.close(wsCloseNormal, "")
+			}
+			sess.cancel()
+			break
+		}
+		if opcode != wsText {
+			sess.conn.close(wsCloseUnsupported, "expected text messages")
+			sess.cancel()
+			break
+		}
+		var msg SessionMessage
+		if sess.raw {
+			msg = rawSessionMessage(data)
+		} else if err := json.Unmarshal(data, &msg); err != nil {
+			sess.sendError(codeInvalidPayload, "Message is not valid JSON")
+			continue
+		}
+		switch msg.Type {
+		case "text":
+			sess.pending.WriteString(msg.Text)
+			sess.queueSentences(false)
+		case "flush":
+			sess.queueSentences(true)
+		case "end":
+			sess.queueSentences(true)
+			ended = true
+		case "interrupt":
+			sess.interrupt()
+			sess.pending.WriteString(msg.Text)
+			sess.queueSentences(false)
+		default:
+			sess.sendError(codeInvalidPayload, "Unknown message type "+msg.Type)
+		}
+		sess.notePending()
+	}
+
+	close(sess.queue)
+	<-done
+	if ended && sess.ctx.Err() == nil {
+		sess.conn.writeJSON(SessionEvent{Type: "done"})
+		sess.conn.close(wsCloseNormal, "")
+	}
+	return sess.seq
+}
+
+// queueSentences moves chunks the flush policy considers complete from the
+// buffer to the synthesis queue, and with all set whatever is left as well
+func (sess *session) queueSentences(all bool) {
+	for {
+		text := sess.pending.String()
+		end := sess.flush.chunkEnd(text)
+		if end < 0 && all {
+			end = len(text)
+		}
+		if end <= 0 {
+			return
+		}
+		sentence := strings.TrimSpace(text[:end])
+		sess.pending.Reset()
+		sess.pending.WriteString(text[end:])
+		if sentence != "" {
+			sess.genMu.Lock()
+			gen := sess.gen
+			sess.genMu.Unlock()
+			chars := int64(utf8.RuneCountInString(sentence))
+			sess.backlogChars.Add(chars)
+			select {
+			case sess.queue <- queuedSentence{gen: gen, text: sentence}:
+			case <-sess.ctx.Done():
+				sess.backlogChars.Add(-chars)
+				return
+			}
+		}
+	}
+}
+
+// interrupt stops the sentence being synthesized, drops queued and buffered
+// text and tells the client to stop playback
+func (sess *session) interrupt() {
+	sess.pending.Reset()
+	for drained := false; !drained; {
+		select {
+		case queued := <-sess.queue:
+			sess.backlogChars.Add(-int64(utf8.RuneCountInString(queued.text)))
+		default:
+			drained = true
+		}
+	}
+	sess.genMu.Lock()
+	defer sess.genMu.Unlock()
+	sess.genCancel()
+	sess.gen++
+	sess.genCtx, sess.genCancel = context.WithCancel(sess.ctx)
+	sess.elapsed = 0
+	sess.conn.writeJSON(SessionEvent{Type: "interrupted", Seq: sess.seq})
+}
+
+// current returns the context of generation gen, or nil once it was interrupted
+func (sess *session) current(gen int) context.Context {
+	sess.genMu.Lock()
+	defer sess.genMu.Unlock()
+	if gen != sess.gen {
+		return nil
+	}
+	return sess.genCtx
+}
+
+// sentenceEnd returns the index just past the first sentence in text, or -1.
+// Latin punctuation only counts once followed by a space, since the next
+// fragment may continue a number or an abbreviation.
+func sentenceEnd(text string) int {
+	for i, r := range text {
+		next := i + utf8.RuneLen(r)
+		switch r {
+		case '\n', '。', '！', '？':
+			return next
+		case '.', '!', '?', ';', '…':
+			if after, _ := utf8.DecodeRuneInString(text[next:]); unicode.IsSpace(after) {
+				return next
+			}
+		}
+	}
+	return -1
+}
+
+// synthesizeQueued speaks queued sentences in order until the queue is closed
+func (sess *session) synthesizeQueued() {
+	s := sess.s
+	var previous string // Last sentence spoken, within the generation of previousGen
+	previousGen := 0
+	for queued := range sess.queue {
+		sentence := queued.text
+		sess.backlogChars.Add(-int64(utf8.RuneCountInString(sentence)))
+		ctx := sess.current(queued.gen)
+		if ctx == nil || ctx.Err() != nil {
+			continue
+		}
+		chars := int64(utf8.RuneCountInString(sentence))
+		if s.cfg.MaxTextChars > 0 && chars > int64(s.cfg.MaxTextChars) {
+			sess.sendError(codeTextTooLong, "Sentence is longer than the text limit")
+			continue
+		}
+		spoken, err := s.screen(ctx, GuardrailInput{Text: sentence, Lang: sess.lang, Engine: sess.engine.Name(), Source: "session"})
+		if err != nil {
+			if errors.Is(err, errGuardrailDenied) {
+				sess.sendError(codeContentPolicy, "Sentence was denied by the content policy")
+			} else {
+				sess.sendError(codeGuardrailUnavailable, "The content policy check is unavailable")
+			}
+			continue
+		}
+		if spoken, err = s.preprocess(sess.text, spoken, nil); err != nil {
+			sess.sendError(codeProfanity, "Sentence contains words that are not allowed")
+			continue
+		}
+		if err := s.keys.charge(sess.key, chars); err != nil {
+			code := codeMonthlyQuota
+			if errors.Is(err, errDailyQuota) {
+				code = codeDailyQuota
+			}
+			sess.sendError(code, "Character quota exceeded")
+			sess.conn.close(wsClosePolicy, "quota exceeded")
+			sess.cancel()
+			continue
+		}
+		if spoken == "" { // Nothing but stripped symbols
+			continue
+		}
+		engine := voicedEngine{Engine: sess.engine, text: spoken, voice: sess.voice.voice, style: sess.voice.style}
+		if sess.voice.smooth && queued.gen == previousGen {
+			engine.previous = previous
+		}
+		audio, cached, err := getOrGenerateAudio(ctx, engine, engine.cacheText(), sess.lang, s.cache, sess.opts)
+		if err != nil {
+			s.keys.refund(sess.key, chars)
+			if ctx.Err() == nil {
+				slog.Warn("Session synthesis failed", "request_id", requestIDFrom(sess.ctx), "error", err)
+				if errors.Is(err, errMaintenance) {
+					sess.sendError(codeMaintenance, "The service is in maintenance mode; only cached audio is available")
+				} else if errors.As(err, new(*queueFullError)) {
+					sess.sendError(codeQueueFull, "Too many syntheses are waiting; try again later")
+				} else if errors.Is(err, errReplicaMiss) {
+					sess.sendError(codeNotCached, "This replica serves cached audio only, and the audio is not cached")
+				} else {
+					sess.sendError(codeSynthesisFailed, "Failed to generate audio")
+				}
+			}
+			continue
+		}
+		s.costs.record(sess.engine.Name(), chars, !cached)
+		previous, previousGen = sentence, queued.gen
+		sess.send(queued.gen, sentence, audio, cached)
+	}
+}
+
+// send delivers a sentence's audio unless an interrupt made it stale. Holding
+// genMu keeps it from interleaving with an "interrupted" event.
+func (sess *session) send(gen int, sentence string, audio []byte, cached bool) {
+	sess.genMu.Lock()
+	defer sess.genMu.Unlock()
+	if gen != sess.gen {
+		return
+	}
+	sess.seq++
+	if sess.raw {
+		sess.conn.writeAudio(wsBinary, audio, cached)
+		return
+	}
+	if !sess.metadata {
+		sess.conn.writeJSON(SessionEvent{Type: "audio", Seq: sess.seq, Text: sentence, Codec: sess.opts.codec(), Bytes: len(audio)})
+		sess.conn.writeAudio(wsBinary, audio, cached)
+		return
+	}
+
+	chars := int64(utf8.RuneCountInString(sentence))
+	duration := audioDuration(audio, sess.opts.codec())
+	if duration > 0 {
+		sess.spokenChars += chars
+		sess.spokenTime += duration
+	} else {
+		duration = time.Duration(chars) * sess.charDuration()
+	}
+	start := sess.elapsed
+	sess.elapsed += duration
+	sess.conn.writeJSON(SessionEvent{Type: "chunk_start", Seq: sess.seq, Text: sentence, OffsetMS: start.Milliseconds(), DurationMS: duration.Milliseconds(), Words: wordTimings(sentence, duration)})
+	sess.conn.writeJSON(SessionEvent{Type: "audio", Seq: sess.seq, Text: sentence, Codec: sess.opts.codec(), Bytes: len(audio)})
+	sess.conn.writeAudio(wsBinary, audio, cached)
+	remaining := time.Duration(sess.backlogChars.Load()) * sess.charDuration()
+	sess.conn.writeJSON(SessionEvent{Type: "chunk_end", Seq: sess.seq, OffsetMS: sess.elapsed.Milliseconds(), RemainingMS: remaining.Milliseconds()})
+}
+
+// charDuration is the session's measured speaking time per character; genMu must be held
+func (sess *session) charDuration() time.Duration {
+	if sess.spokenChars == 0 {
+		return defaultCharDuration
+	}
+	return sess.spokenTime / time.Duration(sess.spokenChars)
+}
+
+// notePending counts buffered text into the backlog behind remaining_ms. It is
+// called by the reading goroutine, which owns the buffer.
+func (sess *session) notePending() {
+	chars := int64(utf8.RuneCountInString(sess.pending.String()))
+	sess.backlogChars.Add(chars - sess.pendingChars)
+	sess.pendingChars = chars
+}
+
+func (sess *session) sendError(code, detail string) {
+	sess.conn.writeJSON(SessionEvent{Type: "error", Code: code, Detail: detail})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type ShadowConfig struct {
+	Engine        string   `json:"engine"`         // Engine to compare against production; empty disables shadowing
+	SampleRate    float64  `json:"sample_rate"`    // Fraction of requests to shadow, 0..1
+	OutputDir     string   `json:"output_dir"`     // Where audio pairs and results.jsonl are written
+	MaxConcurrent int      `json:"max_concurrent"` // Shadow work beyond this is dropped, never queued
+	Timeout       Duration `json:"timeout"`
+}
+
+// shadowResult is one line of results.jsonl
+type shadowResult struct {
+	Time             time.Time `json:"time"`
+	Hash             string    `json:"hash"`
+	Lang             string    `json:"lang"`
+	Chars            int       `json:"chars"`
+	PrimaryEngine    string    `json:"primary_engine"`
+	ShadowEngine     string    `json:"shadow_engine"`
+	PrimaryLatencyMs int64     `json:"primary_latency_ms,omitempty"` // Zero when production was served from cache
+	ShadowLatencyMs  int64     `json:"shadow_latency_ms"`
+	PrimaryBytes     int       `json:"primary_bytes"`
+	ShadowBytes      int       `json:"shadow_bytes"`
+	SizeRatio        float64   `json:"size_ratio,omitempty"`
+	Error            string    `json:"error,omitempty"`
+}
+
+type shadowSummary struct {
+	Engine           string  `json:"engine"`
+	Runs             int64   `json:"runs"`
+	Errors           int64   `json:"errors"`
+	Dropped          int64   `json:"dropped"`
+	AvgShadowLatency float64 `json:"avg_shadow_latency_ms"`
+	AvgSizeRatio     float64 `json:"avg_size_ratio"`
+}
+
+// ShadowRunner synthesizes a sample of production requests with a second
+// engine in the background. Shadow output is never served or cached.
+type ShadowRunner struct {
+	cfg    ShadowConfig
+	engine Engine
+	slots  chan struct{}
+
+	mu                sync.Mutex
+	summary           shadowSummary
+	totalShadowMs     int64
+	totalRatio        float64
+	ratioObservations int64
+}
+
+// NewShadowRunner returns nil when shadowing is disabled
+func NewShadowRunner(cfg ShadowConfig, engines map[string]Engine) (*ShadowRunner, error) {
+	if cfg.Engine == "" || cfg.SampleRate <= 0 {
+		return nil, nil
+	}
+	engine, exists := engines[cfg.Engine]
+	if !exists {
+		return nil, fmt.Errorf("shadow engine %q is not defined", cfg.Engine)
+	}
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = 2
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = Duration(time.Minute)
+	}
+	if cfg.OutputDir != "" {
+		if err := os.MkdirAll(cfg.OutputDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &ShadowRunner{
+		cfg:     cfg,
+		engine:  engine,
+		slots:   make(chan struct{}, cfg.MaxConcurrent),
+		summary: shadowSummary{Engine: cfg.Engine},
+	}, nil
+}
+
+// maybeRun shadows the request with probability SampleRate
+func (s *ShadowRunner) maybeRun(primary Engine, text, lang string, opts AudioOptions, primaryAudio []byte, primaryLatency time.Duration) {
+	if s == nil || primary.Name() == s.engine.Name() || rand.Float64() >= s.cfg.SampleRate {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.mu.Lock()
+		s.summary.Dropped++
+		s.mu.Unlock()
+		return
+	}
+	go func() {
+		defer func() { <-s.slots }()
+		s.run(primary, text, lang, opts, primaryAudio, primaryLatency)
+	}()
+}
+
+func (s *ShadowRunner) run(primary Engine, text, lang string, opts AudioOptions, primaryAudio []byte, primaryLatency time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.Timeout))
+	defer cancel()
+
+	start := time.Now()
+	shadowAudio, err := generateAudioData(ctx, s.engine, text, lang, opts)
+	result := shadowResult{
+		Time:             start.UTC(),
+		Hash:             textHash(text, lang),
+		Lang:             lang,
+		Chars:            len([]rune(text)),
+		PrimaryEngine:    primary.Name(),
+		ShadowEngine:     s.engine.Name(),
+		PrimaryLatencyMs: primaryLatency.Milliseconds(),
+		ShadowLatencyMs:  time.Since(start).Milliseconds(),
+		PrimaryBytes:     len(primaryAudio),
+		ShadowBytes:      len(shadowAudio),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	} else if len(primaryAudio) > 0 {
+		result.SizeRatio = float64(len(shadowAudio)) / float64(len(primaryAudio))
+	}
+
+	s.mu.Lock()
+	s.summary.Runs++
+	if err != nil {
+		s.summary.Errors++
+	} else {
+		s.totalShadowMs += result.ShadowLatencyMs
+		if result.SizeRatio > 0 {
+			s.totalRatio += result.SizeRatio
+			s.ratioObservations++
+		}
+	}
+	s.mu.Unlock()
+
+	if s.cfg.OutputDir != "" && !diskGuard.low(s.cfg.OutputDir) {
+		if err := s.store(result, primaryAudio, shadowAudio, opts); err != nil {
+			slog.Error("Failed to store shadow result", "error", err)
+		}
+	}
+}
+
+// store writes the audio pair next to a results.jsonl line describing it
+func (s *ShadowRunner) store(result shadowResult, primaryAudio, shadowAudio []byte, opts AudioOptions) error {
+	ext := opts.codec() // Format names double as file extensions, except for G.711 in WAV
+	if g711Tags[ext] != 0 {
+		ext = "wav"
+	}
+	dir := filepath.Join(s.cfg.OutputDir, result.Time.Format("20060102T150405.000")+"-"+result.Hash)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "primary."+ext), primaryAudio, 0o644); err != nil {
+		return err
+	}
+	if len(shadowAudio) > 0 {
+		if err := os.WriteFile(filepath.Join(dir, "shadow."+ext), shadowAudio, 0o644); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(s.cfg.OutputDir, "results.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func (s *ShadowRunner) report() shadowSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary := s.summary
+	if ok := summary.Runs - summary.Errors; ok > 0 {
+		summary.AvgShadowLatency = float64(s.totalShadowMs) / float64(ok)
+	}
+	if s.ratioObservations > 0 {
+		summary.AvgSizeRatio = s.totalRatio / float64(s.ratioObservations)
+	}
+	return summary
+}
+
+func (s *server) handleShadowReport(w http.ResponseWriter, r *http.Request) {
+	if s.shadow == nil {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Shadow mode is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.shadow.report())
+}
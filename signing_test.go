@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyRequestSignature(t *testing.T) {
+	const secret = "s3cret"
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	body := `{"text":"hello","lang":"en"}`
+	sign := func(timestamp, method, path, query, body string) string {
+		return "sha256=" + signRequest(secret, timestamp, method, path, query, []byte(body))
+	}
+
+	tests := []struct {
+		name      string
+		target    string
+		body      string
+		timestamp string
+		signature string
+		wantErr   error
+	}{
+		{name: "valid", target: "/v1/speak", body: body, timestamp: now, signature: sign(now, "POST", "/v1/speak", "", body)},
+		{name: "valid with query", target: "/v1/jobs?wait=10s", body: body, timestamp: now, signature: sign(now, "POST", "/v1/jobs", "wait=10s", body)},
+		{name: "uppercase hex", target: "/v1/speak", body: body, timestamp: now, signature: "sha256=" + strings.ToUpper(signRequest(secret, now, "POST", "/v1/speak", "", []byte(body)))},
+		{name: "missing timestamp", target: "/v1/speak", body: body, signature: sign(now, "POST", "/v1/speak", "", body), wantErr: errSignatureMissing},
+		{name: "missing prefix", target: "/v1/speak", body: body, timestamp: now, signature: sign(now, "POST", "/v1/speak", "", body)[7:], wantErr: errSignatureMissing},
+		{name: "stale", target: "/v1/speak", body: body, timestamp: stale, signature: sign(stale, "POST", "/v1/speak", "", body), wantErr: errSignatureStale},
+		{name: "bad timestamp", target: "/v1/speak", body: body, timestamp: "soon", signature: sign("soon", "POST", "/v1/speak", "", body), wantErr: errSignatureStale},
+		{name: "other secret", target: "/v1/speak", body: body, timestamp: now, signature: "sha256=" + signRequest("other", now, "POST", "/v1/speak", "", []byte(body)), wantErr: errSignatureInvalid},
+		{name: "altered body", target: "/v1/speak", body: body + " ", timestamp: now, signature: sign(now, "POST", "/v1/speak", "", body), wantErr: errSignatureInvalid},
+		{name: "altered path", target: "/v1/jobs", body: body, timestamp: now, signature: sign(now, "POST", "/v1/speak", "", body), wantErr: errSignatureInvalid},
+		{name: "added query", target: "/v1/jobs?callback_url=https://evil.example", body: body, timestamp: now, signature: sign(now, "POST", "/v1/jobs", "", body), wantErr: errSignatureInvalid},
+		{name: "altered query", target: "/v1/jobs?wait=30s", body: body, timestamp: now, signature: sign(now, "POST", "/v1/jobs", "wait=10s", body), wantErr: errSignatureInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body))
+			if tt.timestamp != "" {
+				r.Header.Set("X-Timestamp", tt.timestamp)
+			}
+			r.Header.Set("X-Signature", tt.signature)
+			err := verifyRequestSignature(r, secret, 5*time.Minute)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("verifyRequestSignature() = %v, want %v", err, tt.wantErr)
+			}
+			if rest, _ := io.ReadAll(r.Body); string(rest) != tt.body {
+				t.Errorf("body left as %q, want %q", rest, tt.body)
+			}
+		})
+	}
+}
+
+func TestDeliverCallbackIsVerifiable(t *testing.T) {
+	const secret = "job-secret"
+	var verified error
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verified = verifyRequestSignature(r, secret, time.Minute)
+	}))
+	defer receiver.Close()
+	if err := deliverCallback(context.Background(), newCallbackClient(true), receiver.URL+"/hooks/tts?job=1", secret, []byte(`{"status":"done"}`)); err != nil {
+		t.Fatalf("deliverCallback: %v", err)
+	}
+	if verified != nil {
+		t.Errorf("receiver could not verify the callback: %v", verified)
+	}
+}
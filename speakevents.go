@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// POST /v1/speak/events takes a /v1/speak request and answers with a
+// Server-Sent Events stream, so UIs can show a progress bar while a long
+// text is spoken in chunks (see longtext.go):
+//
+//	event: progress  {"chunk": 3, "chunks": 10, "bytes": 96000}
+//	event: audio     {"index": 0, "content_type": "audio/wav", "audio": "<base64>"}
+//	event: done      {"content_type": "audio/aac", "bytes": 52011, "audio": "<base64>"}
+//	event: error     a problem, as /v1/speak would have returned it
+//
+// audio events, one per chunk in order, are only sent with ?audio=chunks,
+// so playback can start before the rest is spoken; bytes counts the PCM
+// spoken so far. Like a job, the request runs through handleSpeak against a
+// recorder, so it is validated, charged and cached exactly like one.
+// Failures before the first chunk is spoken are plain error responses.
+
+// Long texts outlive the server's write timeout
+const speakEventsTimeout = jobTimeout
+
+type speakProgressEvent struct {
+	Chunk  int `json:"chunk"`
+	Chunks int `json:"chunks"`
+	Bytes  int `json:"bytes"`
+}
+
+type speakAudioEvent struct {
+	Index       int    `json:"index"`
+	ContentType string `json:"content_type"`
+	Audio       string `json:"audio"`
+}
+
+type speakDoneEvent struct {
+	ContentType string `json:"content_type"`
+	Bytes       int    `json:"bytes"`
+	Audio       string `json:"audio"`
+}
+
+// speakUpdate is a spoken piece, or with rec set the finished request
+type speakUpdate struct {
+	piece int
+	pcm   []byte
+	rec   *jobRecorder
+}
+
+func (s *server) handleSpeakEvents(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if !s.checkSpeakBody(w, r, body) {
+		return
+	}
+	streamAudio := r.URL.Query().Get("audio") == "chunks"
+
+	ctx, cancel := context.WithTimeout(r.Context(), speakEventsTimeout)
+	defer cancel()
+	updates, progress := s.startSpeak(ctx, r, body)
+
+	rc := http.NewResponseController(w)
+	started := false
+	start := func() {
+		rc.SetWriteDeadline(time.Now().Add(speakEventsTimeout))
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		started = true
+	}
+	send := func(event string, data any) {
+		payload, _ := json.Marshal(data)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		rc.Flush()
+	}
+
+	order := pieceOrder{pending: make(map[int][]byte)}
+	spokenBytes := 0
+	for {
+		var update speakUpdate
+		select {
+		case update = <-updates:
+		case <-ctx.Done():
+			return
+		}
+		if rec := update.rec; rec != nil {
+			if !started && rec.status != http.StatusOK {
+				rec.replay(w)
+				return
+			}
+			if !started {
+				start()
+			}
+			if rec.status != http.StatusOK {
+				send("error", rec.problem())
+				return
+			}
+			send("done", speakDoneEvent{ContentType: rec.header.Get("Content-Type"), Bytes: rec.body.Len(), Audio: base64.StdEncoding.EncodeToString(rec.body.Bytes())})
+			return
+		}
+		if !started {
+			start()
+		}
+		spokenBytes += len(update.pcm)
+		send("progress", speakProgressEvent{Chunk: int(progress.done.Load()), Chunks: int(progress.total.Load()), Bytes: spokenBytes})
+		if !streamAudio || update.pcm == nil {
+			continue
+		}
+		order.add(update.piece, update.pcm, func(index int, wav []byte) {
+			send("audio", speakAudioEvent{Index: index, ContentType: "audio/wav", Audio: base64.StdEncoding.EncodeToString(wav)})
+		})
+	}
+}
+
+// startSpeak runs body as a speak request against a recorder until ctx is
+// done, sending each spoken piece and finally the finished request
+func (s *server) startSpeak(ctx context.Context, r *http.Request, body []byte) (<-chan speakUpdate, *jobProgress) {
+	updates := make(chan speakUpdate, longTextConcurrency)
+	progress := &jobProgress{observe: func(piece int, pcm []byte) {
+		select {
+		case updates <- speakUpdate{piece: piece, pcm: pcm}:
+		case <-ctx.Done():
+		}
+	}}
+	req := r.Clone(context.WithValue(ctx, progressContextKey{}, progress))
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.Header.Set("X-Response-Envelope", envelopeBare)
+	go func() {
+		rec := &jobRecorder{header: make(http.Header), status: http.StatusOK}
+		s.handleSpeak(rec, req)
+		select {
+		case updates <- speakUpdate{rec: rec}:
+		case <-ctx.Done():
+		}
+	}()
+	return updates, progress
+}
+
+// pieceOrder releases spoken pieces as WAV in the order of the text
+type pieceOrder struct {
+	pending map[int][]byte // Spoken ahead of the next one
+	next    int
+}
+
+func (o *pieceOrder) add(piece int, pcm []byte, emit func(index int, wav []byte)) {
+	o.pending[piece] = pcm
+	for pcm, ok := o.pending[o.next]; ok; pcm, ok = o.pending[o.next] {
+		var wav bytes.Buffer
+		if err := writeWAV(&wav, pcm, ssmlSampleRate, 1); err == nil {
+			emit(o.next, wav.Bytes())
+		}
+		delete(o.pending, o.next)
+		o.next++
+	}
+}
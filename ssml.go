@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSML support covers the subset engines can be made to honor through
+// post-processing: <break>, <emphasis>, <prosody rate/pitch/volume>, <say-as>
+// and <sub>. Other elements are ignored and their text is spoken. The
+// document is split into segments of uniform prosody; each is synthesized on
+// its own, shaped with ffmpeg filters, and the results are joined as PCM.
+
+// Sample rate segments are decoded to before they are joined
+const ssmlSampleRate = 24000
+
+// Longest <break> honored
+const ssmlMaxBreak = 10 * time.Second
+
+// Marks SSML sources in cache keys so they never collide with the same string sent as text
+const ssmlCachePrefix = "\x00ssml:"
+
+// ssmlSegment is either a pause or text spoken with one set of prosody settings
+type ssmlSegment struct {
+	text   string
+	pause  time.Duration
+	rate   float64 // Tempo multiplier
+	pitch  float64 // Semitones
+	volume float64 // Decibels
+}
+
+type ssmlDocument []ssmlSegment
+
+// text returns what the document speaks, for quotas and analytics
+func (d ssmlDocument) text() string {
+	var parts []string
+	for _, seg := range d {
+		if seg.text != "" {
+			parts = append(parts, seg.text)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+type ssmlState struct {
+	rate, pitch, volume float64
+	sayAs               string
+	skip                bool // Inside <sub>, whose alias replaces the content
+}
+
+var (
+	ssmlRates     = map[string]float64{"x-slow": 0.6, "slow": 0.8, "medium": 1, "fast": 1.25, "x-fast": 1.5, "default": 1}
+	ssmlPitches   = map[string]float64{"x-low": -6, "low": -3, "medium": 0, "high": 3, "x-high": 6, "default": 0}
+	ssmlVolumes   = map[string]float64{"silent": -60, "x-soft": -12, "soft": -6, "medium": 0, "loud": 6, "x-loud": 12, "default": 0}
+	ssmlStrengths = map[string]time.Duration{"none": 0, "x-weak": 100 * time.Millisecond, "weak": 250 * time.Millisecond, "medium": 400 * time.Millisecond, "strong": 700 * time.Millisecond, "x-strong": 1200 * time.Millisecond}
+)
+
+// parseSSML reads an SSML document; a missing <speak> root is tolerated
+func parseSSML(source string) (ssmlDocument, error) {
+	if !strings.HasPrefix(strings.TrimSpace(source), "<speak") {
+		source = "<speak>" + source + "</speak>"
+	}
+	decoder := xml.NewDecoder(strings.NewReader(source))
+	stack := []ssmlState{{rate: 1}}
+	var doc ssmlDocument
+	addText := func(text string) {
+		top := stack[len(stack)-1]
+		text = strings.Join(strings.Fields(text), " ")
+		if text == "" {
+			return
+		}
+		if n := len(doc); n > 0 && doc[n-1].text != "" && doc[n-1].rate == top.rate && doc[n-1].pitch == top.pitch && doc[n-1].volume == top.volume {
+			doc[n-1].text += " " + text
+			return
+		}
+		doc = append(doc, ssmlSegment{text: text, rate: top.rate, pitch: top.pitch, volume: top.volume})
+	}
+
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, &ValidationError{"/ssml", "is not well-formed: " + err.Error()}
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			state := stack[len(stack)-1]
+			attr := func(name string) string {
+				for _, a := range token.Attr {
+					if a.Name.Local == name {
+						return strings.TrimSpace(a.Value)
+					}
+				}
+				return ""
+			}
+			switch token.Name.Local {
+			case "break":
+				pause, err := parseSSMLBreak(attr("time"), attr("strength"))
+				if err != nil {
+					return nil, &ValidationError{"/ssml", err.Error()}
+				}
+				if pause > 0 {
+					doc = append(doc, ssmlSegment{pause: pause})
+				}
+			case "emphasis":
+				switch attr("level") {
+				case "strong":
+					state.rate, state.volume = state.rate*0.9, state.volume+3
+				case "", "moderate":
+					state.rate, state.volume = state.rate*0.95, state.volume+1.5
+				case "reduced":
+					state.rate, state.volume = state.rate*1.05, state.volume-3
+				}
+			case "prosody":
+				if value := attr("rate"); value != "" {
+					rate, err := parseSSMLRate(value)
+					if err != nil {
+						return nil, &ValidationError{"/ssml", err.Error()}
+					}
+					state.rate *= rate
+				}
+				if value := attr("pitch"); value != "" {
+					pitch, err := parseSSMLPitch(value)
+					if err != nil {
+						return nil, &ValidationError{"/ssml", err.Error()}
+					}
+					state.pitch += pitch
+				}
+				if value := attr("volume"); value != "" {
+					volume, err := parseSSMLVolume(value)
+					if err != nil {
+						return nil, &ValidationError{"/ssml", err.Error()}
+					}
+					state.volume += volume
+				}
+			case "say-as":
+				state.sayAs = attr("interpret-as")
+			case "sub":
+				addText(attr("alias"))
+				state.skip = true
+			}
+			state.rate = math.Max(0.25, math.Min(4, state.rate))
+			state.pitch = math.Max(-12, math.Min(12, state.pitch))
+			stack = append(stack, state)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			state := stack[len(stack)-1]
+			if !state.skip {
+				addText(sayAs(string(token), state.sayAs))
+			}
+		}
+	}
+	if len(doc) == 0 {
+		return nil, &ValidationError{"/ssml", "contains no text"}
+	}
+	return doc, nil
+}
+
+// sayAs rewrites text so engines read it as interpret-as asks; unknown
+// interpretations leave it to the engine
+func sayAs(text, interpretAs string) string {
+	switch interpretAs {
+	case "characters", "spell-out", "letters":
+		return strings.Join(strings.Split(strings.Join(strings.Fields(text), ""), ""), " ")
+	case "digits":
+		var digits []string
+		for _, r := range text {
+			if r >= '0' && r <= '9' {
+				digits = append(digits, string(r))
+			}
+		}
+		return strings.Join(digits, " ")
+	}
+	return text
+}
+
+func parseSSMLBreak(timeAttr, strength string) (time.Duration, error) {
+	if timeAttr != "" {
+		pause, err := time.ParseDuration(timeAttr)
+		if err != nil || pause < 0 {
+			return 0, fmt.Errorf("break time %q must be like 500ms or 2s", timeAttr)
+		}
+		return min(pause, ssmlMaxBreak), nil
+	}
+	if strength == "" {
+		strength = "medium"
+	}
+	pause, known := ssmlStrengths[strength]
+	if !known {
+		return 0, fmt.Errorf("unknown break strength %q", strength)
+	}
+	return pause, nil
+}
+
+// parseSSMLRate accepts a keyword or a percentage of the normal rate, e.g. 150%
+func parseSSMLRate(value string) (float64, error) {
+	if rate, known := ssmlRates[value]; known {
+		return rate, nil
+	}
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		if p, err := strconv.ParseFloat(percent, 64); err == nil && p > 0 {
+			return p / 100, nil
+		}
+	}
+	return 0, fmt.Errorf("prosody rate %q must be a keyword or a percentage", value)
+}
+
+// parseSSMLPitch accepts a keyword, semitones (+2st) or a relative percentage (-10%)
+func parseSSMLPitch(value string) (float64, error) {
+	if pitch, known := ssmlPitches[value]; known {
+		return pitch, nil
+	}
+	if st, ok := strings.CutSuffix(value, "st"); ok {
+		if p, err := strconv.ParseFloat(st, 64); err == nil {
+			return p, nil
+		}
+	}
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		if p, err := strconv.ParseFloat(percent, 64); err == nil && p > -100 {
+			return 12 * math.Log2(1+p/100), nil
+		}
+	}
+	return 0, fmt.Errorf("prosody pitch %q must be a keyword, semitones like +2st or a percentage", value)
+}
+
+// parseSSMLVolume accepts a keyword or a change in decibels, e.g. +6dB
+func parseSSMLVolume(value string) (float64, error) {
+	if volume, known := ssmlVolumes[value]; known {
+		return volume, nil
+	}
+	if db, ok := strings.CutSuffix(value, "dB"); ok {
+		if v, err := strconv.ParseFloat(db, 64); err == nil {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("prosody volume %q must be a keyword or decibels like +6dB", value)
+}
+
+// prosodyFilters builds the ffmpeg filter chain for a segment
+func (seg ssmlSegment) prosodyFilters() []string {
+	filters := []string{"aresample=" + strconv.Itoa(ssmlSampleRate)}
+	tempo := seg.rate
+	if seg.pitch != 0 {
+		shift, correction := pitchFilters(seg.pitch)
+		filters = append(filters, shift...)
+		tempo *= correction
+	}
+	filters = append(filters, atempoFilters(tempo)...)
+	if seg.volume != 0 {
+		filters = append(filters, fmt.Sprintf("volume=%.1fdB", seg.volume))
+	}
+	return filters
+}
+
+// ssmlEngine renders a parsed document with an underlying engine. It stands
+// in for that engine, so caching, ladders and metrics work as for plain text.
+type ssmlEngine struct {
+	Engine
+	doc ssmlDocument
+}
+
+func (e ssmlEngine) Features() EngineFeatures { return engineFeatures(e.Engine) }
+
+// Synthesize ignores req.Text, which only carries the source for cache keys,
+// and returns the rendered document as WAV
+func (e ssmlEngine) Synthesize(ctx context.Context, req SynthesisRequest) ([]byte, error) {
+	var pcm bytes.Buffer
+	for _, seg := range e.doc {
+		if seg.pause > 0 {
+			pcm.Write(make([]byte, int(seg.pause.Seconds()*ssmlSampleRate)*2))
+			continue
+		}
+		raw, err := e.Engine.Synthesize(ctx, SynthesisRequest{Text: seg.text, Lang: req.Lang, Voice: req.Voice, Slow: req.Slow})
+		if err != nil {
+			return nil, err
+		}
+		cmd := exec.CommandContext(ctx, "ffmpeg", "-loglevel", "error", "-i", "pipe:0",
+			"-af", strings.Join(seg.prosodyFilters(), ","),
+			"-ac", "1", "-ar", strconv.Itoa(ssmlSampleRate), "-f", "s16le", "pipe:1")
+		cmd.Stdin = bytes.NewReader(raw)
+		cmd.Stdout = &pcm
+		if err := runTimed(ctx, cmd); err != nil {
+			return nil, fmt.Errorf("ffmpeg: %w", err)
+		}
+	}
+	var wav bytes.Buffer
+	if err := writeWAV(&wav, pcm.Bytes(), ssmlSampleRate, 1); err != nil {
+		return nil, err
+	}
+	return wav.Bytes(), nil
+}
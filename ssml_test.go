@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSSML(t *testing.T) {
+	tests := []struct {
+		name, source string
+		want         ssmlDocument
+	}{
+		{"plain text", "Hello   world", ssmlDocument{{text: "Hello world", rate: 1}}},
+		{"speak root", "<speak>Hello</speak>", ssmlDocument{{text: "Hello", rate: 1}}},
+		{"break time", `One<break time="500ms"/>two`, ssmlDocument{{text: "One", rate: 1}, {pause: 500 * time.Millisecond}, {text: "two", rate: 1}}},
+		{"break strength", `One<break strength="strong"/>two`, ssmlDocument{{text: "One", rate: 1}, {pause: 700 * time.Millisecond}, {text: "two", rate: 1}}},
+		{"break none", `One<break strength="none"/>two`, ssmlDocument{{text: "One two", rate: 1}}},
+		{"break capped", `One<break time="1m"/>`, ssmlDocument{{text: "One", rate: 1}, {pause: ssmlMaxBreak}}},
+		{"prosody", `Normal <prosody rate="150%" pitch="+2st" volume="-6dB">changed</prosody> normal`, ssmlDocument{
+			{text: "Normal", rate: 1}, {text: "changed", rate: 1.5, pitch: 2, volume: -6}, {text: "normal", rate: 1},
+		}},
+		{"nested prosody", `<prosody rate="x-slow"><prosody rate="200%">fast</prosody></prosody>`, ssmlDocument{{text: "fast", rate: 1.2}}},
+		{"rate clamped", `<prosody rate="x-fast"><prosody rate="400%">fast</prosody></prosody>`, ssmlDocument{{text: "fast", rate: 4}}},
+		{"strong emphasis", `<emphasis level="strong">Now</emphasis>`, ssmlDocument{{text: "Now", rate: 0.9, volume: 3}}},
+		{"say-as characters", `<say-as interpret-as="characters">AB C</say-as>`, ssmlDocument{{text: "A B C", rate: 1}}},
+		{"say-as digits", `<say-as interpret-as="digits">12-3</say-as>`, ssmlDocument{{text: "1 2 3", rate: 1}}},
+		{"sub", `<sub alias="World Wide Web">WWW</sub> site`, ssmlDocument{{text: "World Wide Web site", rate: 1}}},
+		{"unknown element", `<p><s>Kept</s></p>`, ssmlDocument{{text: "Kept", rate: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSSML(tt.source)
+			if err != nil {
+				t.Fatalf("parseSSML(%q): %v", tt.source, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSSML(%q) = %+v, want %+v", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSSMLErrors(t *testing.T) {
+	tests := []struct {
+		source, message string
+	}{
+		{"<speak>Unclosed", "is not well-formed"},
+		{`<break time="soon"/>text`, "break time"},
+		{`<break strength="huge"/>text`, "unknown break strength"},
+		{`<prosody rate="-50%">text</prosody>`, "prosody rate"},
+		{`<prosody pitch="up">text</prosody>`, "prosody pitch"},
+		{`<prosody volume="6">text</prosody>`, "prosody volume"},
+		{"<speak> </speak>", "contains no text"},
+	}
+	for _, tt := range tests {
+		_, err := parseSSML(tt.source)
+		var validation *ValidationError
+		if !errors.As(err, &validation) || validation.Pointer != "/ssml" || !strings.Contains(validation.Message, tt.message) {
+			t.Errorf("parseSSML(%q) error = %v, want a /ssml error containing %q", tt.source, err, tt.message)
+		}
+	}
+}
+
+func TestSSMLDocumentText(t *testing.T) {
+	doc, err := parseSSML(`One<break time="1s"/><prosody rate="slow">two</prosody> three`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := doc.text(), "One two three"; got != want {
+		t.Errorf("text() = %q, want %q", got, want)
+	}
+}
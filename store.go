@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store persists server state in an embedded BoltDB file. A nil *Store is
+// valid and turns every write into a no-op, for deployments without -db.
+type Store struct {
+	db *bolt.DB
+}
+
+var bucketAPIKeys = []byte("api_keys")
+
+func OpenStore(path string) (*Store, error) {
+	if path == "" {
+		return nil, nil
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketAPIKeys, bucketNarrations, bucketLexicon, bucketUsageRecords, bucketJobs, bucketKeyUsage} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) put(bucket []byte, key string, value any) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+func (s *Store) delete(bucket []byte, key string) error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+// forEach passes every raw record in the bucket to fn
+func (s *Store) forEach(bucket []byte, fn func(key string, data []byte) error) error {
+	if s == nil {
+		return nil
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Engines read emoji and many symbols as garbage ("smiling face with
+// smiling eyes" in the wrong language) or drop them along with their
+// meaning. The symbols option says what to do with them instead: speak
+// describes common emoji and symbols in the request's language, strip removes
+// every emoji and symbol, and keep, the default, leaves text as it is.
+// Emoji without a description are stripped when speaking, too. Currency
+// signs and "%" after numbers are left to textnorm.go.
+
+const (
+	symbolsKeep  = "keep"
+	symbolsSpeak = "speak"
+	symbolsStrip = "strip"
+)
+
+var symbolModes = []string{symbolsKeep, symbolsSpeak, symbolsStrip}
+
+var (
+	repeatedSpaces   = regexp.MustCompile(`[ \t]{2,}`)
+	spaceBeforePunct = regexp.MustCompile(` +([,.;:!?])`)
+)
+
+// symbolWords describes emoji and symbols per base language. Variation
+// selectors and skin tones are ignored, so "❤️" and "👍🏽" are found by their
+// first rune.
+var symbolWords = map[string]map[rune]string{
+	"en": {
+		'😀': "grinning face", '😂': "tears of joy", '😊': "smiling face", '🙂': "slight smile", '😉': "wink",
+		'😍': "heart eyes", '😎': "cool", '😢': "crying face", '😭': "sobbing", '😡': "angry face", '🤔': "thinking face",
+		'❤': "red heart", '👍': "thumbs up", '👎': "thumbs down", '👏': "applause", '🙏': "thank you", '👋': "waving hand",
+		'🎉': "celebration", '🔥': "fire", '⭐': "star", '✅': "check mark", '❌': "cross mark", '🚀': "rocket", '💯': "one hundred",
+		'&': "and", '@': "at", '+': "plus", '=': "equals", '°': "degrees", '©': "copyright", '®': "registered", '™': "trademark",
+		'→': "to", '×': "times", '÷': "divided by", '#': "hashtag", '%': "percent", '§': "section",
+	},
+	"id": {
+		'😀': "wajah gembira", '😂': "tertawa terbahak-bahak", '😊': "wajah tersenyum", '🙂': "senyum", '😉': "berkedip",
+		'😍': "jatuh cinta", '😎': "keren", '😢': "wajah menangis", '😭': "menangis tersedu-sedu", '😡': "wajah marah", '🤔': "berpikir",
+		'❤': "hati merah", '👍': "jempol", '👎': "jempol ke bawah", '👏': "tepuk tangan", '🙏': "terima kasih", '👋': "melambaikan tangan",
+		'🎉': "perayaan", '🔥': "api", '⭐': "bintang", '✅': "tanda centang", '❌': "tanda silang", '🚀': "roket", '💯': "seratus",
+		'&': "dan", '@': "at", '+': "tambah", '=': "sama dengan", '°': "derajat", '©': "hak cipta", '®': "merek terdaftar", '™': "merek dagang",
+		'→': "ke", '×': "kali", '÷': "bagi", '#': "tagar", '%': "persen", '§': "pasal",
+	},
+	"es": {
+		'😀': "cara sonriente", '😂': "lágrimas de risa", '😊': "cara feliz", '🙂': "sonrisa", '😉': "guiño",
+		'😍': "enamorado", '😎': "genial", '😢': "cara triste", '😭': "llanto", '😡': "cara enfadada", '🤔': "pensativo",
+		'❤': "corazón rojo", '👍': "pulgar arriba", '👎': "pulgar abajo", '👏': "aplausos", '🙏': "gracias", '👋': "saludo",
+		'🎉': "celebración", '🔥': "fuego", '⭐': "estrella", '✅': "marca de verificación", '❌': "cruz", '🚀': "cohete", '💯': "cien",
+		'&': "y", '@': "arroba", '+': "más", '=': "igual a", '°': "grados", '©': "derechos de autor", '®': "marca registrada", '™': "marca comercial",
+		'→': "a", '×': "por", '÷': "entre", '#': "almohadilla", '%': "por ciento", '§': "sección",
+	},
+	"fr": {
+		'😀': "visage souriant", '😂': "larmes de joie", '😊': "visage heureux", '🙂': "sourire", '😉': "clin d'œil",
+		'😍': "yeux en cœur", '😎': "cool", '😢': "visage qui pleure", '😭': "sanglots", '😡': "visage en colère", '🤔': "visage pensif",
+		'❤': "cœur rouge", '👍': "pouce levé", '👎': "pouce baissé", '👏': "applaudissements", '🙏': "merci", '👋': "salut de la main",
+		'🎉': "fête", '🔥': "feu", '⭐': "étoile", '✅': "coche", '❌': "croix", '🚀': "fusée", '💯': "cent",
+		'&': "et", '@': "arobase", '+': "plus", '=': "égale", '°': "degrés", '©': "copyright", '®': "marque déposée", '™': "marque commerciale",
+		'→': "vers", '×': "fois", '÷': "divisé par", '#': "dièse", '%': "pour cent", '§': "paragraphe",
+	},
+	"de": {
+		'😀': "grinsendes Gesicht", '😂': "Freudentränen", '😊': "lächelndes Gesicht", '🙂': "Lächeln", '😉': "Zwinkern",
+		'😍': "verliebt", '😎': "cool", '😢': "weinendes Gesicht", '😭': "Schluchzen", '😡': "wütendes Gesicht", '🤔': "nachdenklich",
+		'❤': "rotes Herz", '👍': "Daumen hoch", '👎': "Daumen runter", '👏': "Applaus", '🙏': "danke", '👋': "winkende Hand",
+		'🎉': "Feier", '🔥': "Feuer", '⭐': "Stern", '✅': "Häkchen", '❌': "Kreuz", '🚀': "Rakete", '💯': "hundert",
+		'&': "und", '@': "at", '+': "plus", '=': "gleich", '°': "Grad", '©': "Copyright", '®': "eingetragene Marke", '™': "Marke",
+		'→': "nach", '×': "mal", '÷': "geteilt durch", '#': "Hashtag", '%': "Prozent", '§': "Paragraf",
+	},
+}
+
+// emojiPart reports runes that only modify or join emoji
+func emojiPart(r rune) bool {
+	return r == '\u200d' || r == '\u20e3' || unicode.Is(unicode.Variation_Selector, r) || r >= 0x1f3fb && r <= 0x1f3ff
+}
+
+// isEmoji reports pictographs and other symbols that engines cannot read
+func isEmoji(r rune) bool {
+	return unicode.Is(unicode.So, r) || r >= 0x1f000 && r <= 0x1faff
+}
+
+// verbalizeSymbols applies a symbols mode to text written in lang
+func verbalizeSymbols(text, lang, mode string) string {
+	if mode == "" || mode == symbolsKeep {
+		return text
+	}
+	base, _, _ := strings.Cut(strings.ToLower(lang), "-")
+	words := symbolWords[base]
+	var out strings.Builder
+	changed := false
+	for i, r := range text {
+		switch {
+		case emojiPart(r):
+			changed = true
+		case mode == symbolsSpeak && words[r] != "" && !numberSymbol(text, i, r):
+			out.WriteString(" " + words[r] + " ")
+			changed = true
+		case isEmoji(r) || mode == symbolsStrip && words[r] != "" && !numberSymbol(text, i, r):
+			out.WriteByte(' ')
+			changed = true
+		default:
+			out.WriteRune(r)
+		}
+	}
+	if !changed {
+		return text
+	}
+	text = repeatedSpaces.ReplaceAllString(out.String(), " ")
+	return strings.TrimSpace(spaceBeforePunct.ReplaceAllString(text, "$1"))
+}
+
+// numberSymbol reports symbols that belong to a number, like the "%" of
+// "50%" or the "+" of "+62", which textnorm.go reads or the engine knows
+func numberSymbol(text string, i int, r rune) bool {
+	before, _ := utf8.DecodeLastRuneInString(strings.TrimRight(text[:i], " "))
+	after, _ := utf8.DecodeRuneInString(text[i+utf8.RuneLen(r):])
+	switch r {
+	case '%':
+		return unicode.IsDigit(before)
+	case '+':
+		return unicode.IsDigit(after) && !unicode.IsDigit(before)
+	}
+	return false
+}
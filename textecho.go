@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// With echo_text, /v1/speak also returns the text the engine was given, so
+// content teams can see why something was pronounced the way it was: the
+// text after the preprocessing pipeline (see pipeline.go), and the chunks it
+// was spoken in, each with its language, as long-text chunking, the sentence
+// cache, mixed languages and SSML split it. The JSON envelopes carry it as
+// transformed_text; bare responses only carry the text, percent-encoded, in
+// X-Transformed-Text. Cached audio is echoed the same way, as the text that
+// would be spoken now.
+
+type TransformedText struct {
+	Text   string        `json:"text"`
+	Chunks []EngineChunk `json:"chunks"` // One per call to the engine, in order
+}
+
+type EngineChunk struct {
+	Text string `json:"text"`
+	Lang string `json:"lang"`
+}
+
+// transformedText describes how engine speaks text; plain is false when
+// engine wraps the text, so only its chunks are what is spoken
+func transformedText(engine Engine, text, lang string, plain bool, cache *AudioCache, opts AudioOptions) *TransformedText {
+	echo := &TransformedText{Text: text, Chunks: engineChunks(engine, text, lang, cache, opts)}
+	if !plain {
+		texts := make([]string, len(echo.Chunks))
+		for i, chunk := range echo.Chunks {
+			texts[i] = chunk.Text
+		}
+		echo.Text = strings.Join(texts, " ")
+	}
+	return echo
+}
+
+// engineChunks follows how synthesis splits text into calls to the engine
+func engineChunks(engine Engine, text, lang string, cache *AudioCache, opts AudioOptions) []EngineChunk {
+	var chunks []EngineChunk
+	switch e := engine.(type) {
+	case ssmlEngine:
+		for _, seg := range e.doc {
+			if seg.text != "" {
+				chunks = append(chunks, EngineChunk{Text: seg.text, Lang: lang})
+			}
+		}
+		return chunks
+	case mixedEngine:
+		for _, span := range e.spans {
+			chunks = append(chunks, engineChunks(e.Engine, span.text, span.lang, nil, opts)...)
+		}
+		return chunks
+	}
+	if cache != nil {
+		if sentences := cache.cacheableSentences(engine, text, opts); sentences != nil {
+			for _, sentence := range sentences {
+				chunks = append(chunks, engineChunks(engine, sentence, lang, nil, opts)...)
+			}
+			return chunks
+		}
+	}
+	if _, ok := engine.(*gttsEngine); ok && utf8.RuneCountInString(text) > longTextChunkChars {
+		for _, chunk := range chunkText(text, longTextChunkChars) {
+			chunks = append(chunks, EngineChunk{Text: chunk, Lang: lang})
+		}
+		return chunks
+	}
+	return []EngineChunk{{Text: text, Lang: lang}}
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Engines read digits, dates and abbreviations inconsistently: "Dr." may come
+// out as "drive", "3/4" as "three slash four" and "Rp 10.000" as ten rupiah.
+// Text is therefore normalized before synthesis: abbreviations, ISO dates,
+// amounts of money, percentages, fractions and numbers are spelled out in the
+// request's language, reading separators the way that locale writes them.
+// Languages without a locale here pass through unchanged. Callers that
+// normalize text themselves set pre_normalized to skip this stage.
+
+// Larger numbers are read digit by digit
+const maxSpokenNumber = 999_999_999_999_999
+
+var (
+	spacedPattern   = regexp.MustCompile(`\d{1,3}(?:[ \x{a0}\x{202f}]\d{3})+`)
+	isoDatePattern  = regexp.MustCompile(`(\d{4})-(\d{2})-(\d{2})`)
+	moneyPattern    = regexp.MustCompile(`(Rp\.?|US\$|\$|€|£) ?(\d[\d.,]*\d|\d)|(\d[\d.,]*\d|\d) ?(€|£)`)
+	percentPattern  = regexp.MustCompile(`(\d[\d.,]*\d|\d) ?%`)
+	fractionPattern = regexp.MustCompile(`(\d{1,3})/(\d{1,3})`)
+	negativePattern = regexp.MustCompile(`-(\d[\d.,]*\d|\d)`)
+	numberPattern   = regexp.MustCompile(`\d[\d.,]*\d|\d`)
+)
+
+type currencyWords struct {
+	one, many           string
+	minorOne, minorMany string // Empty for currencies without a minor unit in use, like the rupiah
+}
+
+// textLocale spells out numbers and expands abbreviations for one language
+type textLocale struct {
+	decimal, thousands rune
+	spaceGrouping      bool                 // Thousands may also be grouped with spaces, "80 000"
+	words              func(n int64) string // Cardinal number, 0 <= n <= maxSpokenNumber
+	beforeNoun         func(string) string  // Form of a number before a noun ("un euro"); nil when unchanged
+	point              string               // Read between the whole and the decimal digits
+	minus              string
+	percent            string
+	and                string // Between units and cents; empty to just list them
+	currencies         map[string]currencyWords
+	date               func(year, month, day int) string
+	fraction           func(num, den int64) string // 0 < num < den
+
+	titles        map[string]string // Precede names, so never end a sentence
+	abbreviations map[string]string
+	pattern       *regexp.Regexp // Matches every title and abbreviation, longest first
+}
+
+// compile builds the abbreviation pattern; locales are only used compiled
+func (l *textLocale) compile() *textLocale {
+	var keys []string
+	for key := range l.titles {
+		keys = append(keys, regexp.QuoteMeta(key))
+	}
+	for key := range l.abbreviations {
+		keys = append(keys, regexp.QuoteMeta(key))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	l.pattern = regexp.MustCompile(strings.Join(keys, "|"))
+	return l
+}
+
+// Locales by base language code
+var textLocales = map[string]*textLocale{
+	"en": (&textLocale{
+		decimal: '.', thousands: ',',
+		words: englishNumber, point: "point", minus: "minus", percent: "percent", and: "and",
+		currencies: map[string]currencyWords{
+			"$":  {"dollar", "dollars", "cent", "cents"},
+			"€":  {"euro", "euros", "cent", "cents"},
+			"£":  {"pound", "pounds", "penny", "pence"},
+			"Rp": {"rupiah", "rupiah", "", ""},
+		},
+		date: func(year, month, day int) string {
+			return englishMonths[month-1] + " " + englishOrdinal(int64(day)) + ", " + englishYear(year)
+		},
+		fraction: func(num, den int64) string {
+			var unit string
+			switch den {
+			case 2:
+				unit = "half"
+			case 4:
+				unit = "quarter"
+			default:
+				unit = englishOrdinal(den)
+			}
+			switch {
+			case num > 1 && den == 2:
+				unit = "halves"
+			case num > 1:
+				unit += "s"
+			}
+			return englishNumber(num) + " " + unit
+		},
+		titles: map[string]string{
+			"Mr.": "Mister", "Mrs.": "Missus", "Ms.": "Miz", "Dr.": "Doctor", "Prof.": "Professor",
+		},
+		abbreviations: map[string]string{
+			"etc.": "et cetera", "e.g.": "for example", "i.e.": "that is", "vs.": "versus",
+			"approx.": "approximately", "Jr.": "Junior", "Sr.": "Senior", "Inc.": "Incorporated", "Ltd.": "Limited",
+		},
+	}).compile(),
+	"id": (&textLocale{
+		decimal: ',', thousands: '.',
+		words: indonesianNumber, point: "koma", minus: "minus", percent: "persen",
+		currencies: map[string]currencyWords{
+			"Rp": {"rupiah", "rupiah", "", ""},
+			"$":  {"dolar", "dolar", "sen", "sen"},
+			"€":  {"euro", "euro", "sen", "sen"},
+			"£":  {"pound", "pound", "pence", "pence"},
+		},
+		date: func(year, month, day int) string {
+			return indonesianNumber(int64(day)) + " " + indonesianMonths[month-1] + " " + indonesianNumber(int64(year))
+		},
+		fraction: func(num, den int64) string {
+			switch {
+			case num == 1 && den == 2:
+				return "setengah"
+			case num == 1:
+				return "seper" + indonesianNumber(den)
+			}
+			return indonesianNumber(num) + " per " + indonesianNumber(den)
+		},
+		titles: map[string]string{
+			"Bpk.": "Bapak", "Bp.": "Bapak", "Sdr.": "Saudara", "Sdri.": "Saudari", "Dr.": "Doktor", "dr.": "dokter",
+			"Prof.": "Profesor", "Jl.": "Jalan", "No.": "nomor", "Yth.": "Yang terhormat", "yth.": "yang terhormat",
+		},
+		abbreviations: map[string]string{
+			"dll.": "dan lain-lain", "dsb.": "dan sebagainya", "dst.": "dan seterusnya", "tsb.": "tersebut",
+			"tgl.": "tanggal",
+		},
+	}).compile(),
+	"es": (&textLocale{
+		decimal: ',', thousands: '.',
+		words: spanishNumber, beforeNoun: spanishApocope, point: "coma", minus: "menos", percent: "por ciento", and: "con",
+		currencies: map[string]currencyWords{
+			"$":  {"dólar", "dólares", "centavo", "centavos"},
+			"€":  {"euro", "euros", "céntimo", "céntimos"},
+			"£":  {"libra", "libras", "penique", "peniques"},
+			"Rp": {"rupia", "rupias", "", ""},
+		},
+		date: func(year, month, day int) string {
+			dayWords := spanishNumber(int64(day))
+			if day == 1 {
+				dayWords = "primero"
+			}
+			return dayWords + " de " + spanishMonths[month-1] + " de " + spanishNumber(int64(year))
+		},
+		fraction: func(num, den int64) string {
+			if den > 10 {
+				return spanishNumber(num) + " sobre " + spanishNumber(den)
+			}
+			unit := spanishPartitives[den-2]
+			if num > 1 {
+				unit += "s"
+			}
+			return spanishApocope(spanishNumber(num)) + " " + unit
+		},
+		titles: map[string]string{
+			"Sr.": "señor", "Sra.": "señora", "Srta.": "señorita", "Dr.": "doctor", "Dra.": "doctora", "Lic.": "licenciado", "pág.": "página",
+		},
+		abbreviations: map[string]string{
+			"etc.": "etcétera", "aprox.": "aproximadamente", "Ud.": "usted", "Uds.": "ustedes",
+		},
+	}).compile(),
+	"fr": (&textLocale{
+		decimal: ',', thousands: '.', spaceGrouping: true,
+		words: frenchNumber, point: "virgule", minus: "moins", percent: "pour cent", and: "et",
+		currencies: map[string]currencyWords{
+			"$":  {"dollar", "dollars", "cent", "cents"},
+			"€":  {"euro", "euros", "centime", "centimes"},
+			"£":  {"livre", "livres", "penny", "pence"},
+			"Rp": {"roupie", "roupies", "", ""},
+		},
+		date: func(year, month, day int) string {
+			dayWords := frenchNumber(int64(day))
+			if day == 1 {
+				dayWords = "premier"
+			}
+			return dayWords + " " + frenchMonths[month-1] + " " + frenchNumber(int64(year))
+		},
+		fraction: func(num, den int64) string {
+			var unit string
+			switch den {
+			case 2:
+				unit = "demi"
+			case 3:
+				unit = "tiers"
+			case 4:
+				unit = "quart"
+			default:
+				unit = frenchOrdinal(den)
+			}
+			if num > 1 && den != 3 {
+				unit += "s"
+			}
+			return frenchNumber(num) + " " + unit
+		},
+		titles: map[string]string{
+			"M.": "Monsieur", "MM.": "Messieurs", "Mme": "Madame", "Mmes": "Mesdames", "Mlle": "Mademoiselle",
+			"Dr": "Docteur", "Dr.": "Docteur", "Pr": "Professeur", "n°": "numéro",
+		},
+		abbreviations: map[string]string{
+			"etc.": "et cetera", "env.": "environ",
+		},
+	}).compile(),
+	"de": (&textLocale{
+		decimal: ',', thousands: '.',
+		words: germanNumber, beforeNoun: germanAttributive, point: "Komma", minus: "minus", percent: "Prozent", and: "und",
+		currencies: map[string]currencyWords{
+			"$":  {"Dollar", "Dollar", "Cent", "Cent"},
+			"€":  {"Euro", "Euro", "Cent", "Cent"},
+			"£":  {"Pfund", "Pfund", "Penny", "Pence"},
+			"Rp": {"Rupiah", "Rupiah", "", ""},
+		},
+		date: func(year, month, day int) string {
+			return germanOrdinal(int64(day)) + " " + germanMonths[month-1] + " " + germanYear(year)
+		},
+		fraction: func(num, den int64) string {
+			var unit string
+			switch {
+			case den == 2 && num == 1:
+				return "ein halb"
+			case den == 2:
+				unit = "Halbe"
+			case den == 3:
+				unit = "Drittel"
+			case den == 7:
+				unit = "Siebtel"
+			case den == 8:
+				unit = "Achtel"
+			case den < 20:
+				unit = capitalize(germanNumber(den)) + "tel"
+			default:
+				unit = capitalize(germanNumber(den)) + "stel"
+			}
+			return germanAttributive(germanNumber(num)) + " " + unit
+		},
+		titles: map[string]string{
+			"Dr.": "Doktor", "Prof.": "Professor", "Hr.": "Herr", "Nr.": "Nummer", "St.": "Sankt",
+		},
+		abbreviations: map[string]string{
+			"z.B.": "zum Beispiel", "z. B.": "zum Beispiel", "d.h.": "das heißt", "usw.": "und so weiter",
+			"bzw.": "beziehungsweise", "ca.": "circa", "u.a.": "unter anderem", "evtl.": "eventuell", "ggf.": "gegebenenfalls",
+		},
+	}).compile(),
+}
+
+// expandText spells out what engines misread in text written in lang
+func expandText(text, lang string) string {
+	base, _, _ := strings.Cut(strings.ToLower(lang), "-")
+	l, exists := textLocales[base]
+	if !exists {
+		return text
+	}
+	text = l.expandAbbreviations(text)
+	if l.spaceGrouping {
+		text = replaceIsolated(text, spacedPattern, ".,", func(groups []string) (string, bool) {
+			return strings.Join(strings.FieldsFunc(groups[0], unicode.IsSpace), string(l.thousands)), true
+		})
+	}
+	text = replaceIsolated(text, isoDatePattern, "-/:", l.expandDate)
+	text = replaceIsolated(text, moneyPattern, "", l.expandMoney)
+	text = replaceIsolated(text, percentPattern, "", func(groups []string) (string, bool) {
+		words, ok := l.spellNumber(groups[1])
+		return words + " " + l.percent, ok
+	})
+	text = replaceIsolated(text, fractionPattern, "/:", func(groups []string) (string, bool) {
+		num, _ := strconv.ParseInt(groups[1], 10, 64)
+		den, _ := strconv.ParseInt(groups[2], 10, 64)
+		if num == 0 || num >= den {
+			return "", false // Scores, ratios and "24/7" read better as they are
+		}
+		return l.fraction(num, den), true
+	})
+	text = replaceIsolated(text, negativePattern, "", func(groups []string) (string, bool) {
+		words, ok := l.spellNumber(groups[1])
+		return l.minus + " " + words, ok
+	})
+	return replaceIsolated(text, numberPattern, ":/_", func(groups []string) (string, bool) {
+		return l.spellNumber(groups[0])
+	})
+}
+
+// replaceIsolated replaces the matches of re that are not part of a longer
+// word, or touch a rune in extra, with what expand returns for their groups
+func replaceIsolated(text string, re *regexp.Regexp, extra string, expand func(groups []string) (string, bool)) string {
+	var out strings.Builder
+	last := 0
+	for _, match := range re.FindAllStringSubmatchIndex(text, -1) {
+		start, end := match[0], match[1]
+		if !isolated(text, start, end, extra) {
+			continue
+		}
+		groups := make([]string, len(match)/2)
+		for i := range groups {
+			if match[2*i] >= 0 {
+				groups[i] = text[match[2*i]:match[2*i+1]]
+			}
+		}
+		words, ok := expand(groups)
+		if !ok {
+			continue
+		}
+		out.WriteString(text[last:start])
+		out.WriteString(words)
+		last = end
+	}
+	if last == 0 {
+		return text
+	}
+	out.WriteString(text[last:])
+	return out.String()
+}
+
+func isolated(text string, start, end int, extra string) bool {
+	joined := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(extra, r) }
+	if before, _ := utf8.DecodeLastRuneInString(text[:start]); start > 0 && joined(before) {
+		return false
+	}
+	if after, _ := utf8.DecodeRuneInString(text[end:]); end < len(text) && joined(after) {
+		return false
+	}
+	return true
+}
+
+// expandAbbreviations keeps the period of abbreviations that end a sentence,
+// judged by the next word starting with a capital
+func (l *textLocale) expandAbbreviations(text string) string {
+	var out strings.Builder
+	last := 0
+	for _, match := range l.pattern.FindAllStringIndex(text, -1) {
+		start, end := match[0], match[1]
+		if !wordBoundary(text, start, end) {
+			continue
+		}
+		key := text[start:end]
+		words, title := l.titles[key]
+		if !title {
+			words = l.abbreviations[key]
+			rest := strings.TrimLeftFunc(text[end:], unicode.IsSpace)
+			if next, _ := utf8.DecodeRuneInString(rest); strings.HasSuffix(key, ".") && (rest == "" || unicode.IsUpper(next)) {
+				words += "."
+			}
+		}
+		out.WriteString(text[last:start])
+		out.WriteString(words)
+		last = end
+	}
+	if last == 0 {
+		return text
+	}
+	out.WriteString(text[last:])
+	return out.String()
+}
+
+func (l *textLocale) expandDate(groups []string) (string, bool) {
+	year, _ := strconv.Atoi(groups[1])
+	month, _ := strconv.Atoi(groups[2])
+	day, _ := strconv.Atoi(groups[3])
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return "", false
+	}
+	return l.date(year, month, day), true
+}
+
+func (l *textLocale) expandMoney(groups []string) (string, bool) {
+	symbol, amount := groups[1], groups[2]
+	if symbol == "" {
+		symbol, amount = groups[4], groups[3]
+	}
+	switch symbol {
+	case "Rp.":
+		symbol = "Rp"
+	case "US$":
+		symbol = "$"
+	}
+	currency := l.currencies[symbol]
+	// Without a minor unit any separator groups thousands, as in "Rp 10.000"
+	whole, fraction, ok := l.parseNumber(amount, currency.minorOne == "")
+	if !ok {
+		return "", false
+	}
+	n, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || n > maxSpokenNumber {
+		return "", false
+	}
+	if fraction != "" && len(fraction) != 2 {
+		return l.spell(whole, fraction) + " " + currency.many, true
+	}
+	unit := currency.many
+	if n == 1 {
+		unit = currency.one
+	}
+	words := l.nounNumber(n) + " " + unit
+	if minor, _ := strconv.ParseInt(fraction, 10, 64); minor > 0 {
+		unit = currency.minorMany
+		if minor == 1 {
+			unit = currency.minorOne
+		}
+		if l.and != "" {
+			words += " " + l.and
+		}
+		words += " " + l.nounNumber(minor) + " " + unit
+	}
+	return words, true
+}
+
+func (l *textLocale) nounNumber(n int64) string {
+	if l.beforeNoun == nil {
+		return l.words(n)
+	}
+	return l.beforeNoun(l.words(n))
+}
+
+// parseNumber splits a number as written in the locale into its whole and
+// decimal digits. With wholeOnly, both separators are read as grouping.
+func (l *textLocale) parseNumber(s string, wholeOnly bool) (whole, fraction string, ok bool) {
+	whole = s
+	if i := strings.LastIndexByte(s, byte(l.decimal)); i >= 0 && !wholeOnly {
+		whole, fraction = s[:i], s[i+1:]
+	}
+	if strings.ContainsAny(fraction, ".,") || !wholeOnly && strings.ContainsRune(whole, l.decimal) {
+		return "", "", false
+	}
+	groups := strings.FieldsFunc(whole, func(r rune) bool { return r == '.' || r == ',' })
+	if len(groups) > 1 {
+		if len(groups[0]) > 3 || len(strings.Join(groups, ""))+len(groups)-1 != len(whole) {
+			return "", "", false
+		}
+		for _, group := range groups[1:] {
+			if len(group) != 3 {
+				return "", "", false
+			}
+		}
+	}
+	return strings.Join(groups, ""), fraction, true
+}
+
+// spellNumber spells a number as written in the locale
+func (l *textLocale) spellNumber(s string) (string, bool) {
+	whole, fraction, ok := l.parseNumber(s, false)
+	if !ok {
+		return "", false
+	}
+	return l.spell(whole, fraction), true
+}
+
+// spell reads whole as a number, or digit by digit when it is too long or
+// has leading zeros like a code, followed by the decimal digits one by one
+func (l *textLocale) spell(whole, fraction string) string {
+	var words string
+	if n, err := strconv.ParseInt(whole, 10, 64); err == nil && n <= maxSpokenNumber && (len(whole) == 1 || whole[0] != '0') {
+		words = l.words(n)
+	} else {
+		words = l.digits(whole)
+	}
+	if fraction != "" {
+		words += " " + l.point + " " + l.digits(fraction)
+	}
+	return words
+}
+
+func (l *textLocale) digits(s string) string {
+	words := make([]string, 0, len(s))
+	for _, digit := range s {
+		words = append(words, l.words(int64(digit-'0')))
+	}
+	return strings.Join(words, " ")
+}
+
+// joinWords appends the words for rest to head, unless rest is zero
+func joinWords(head string, rest int64, words func(int64) string) string {
+	if rest == 0 {
+		return head
+	}
+	return head + " " + words(rest)
+}
+
+type numberScale struct {
+	value int64
+	one   string
+	many  string
+}
+
+// scaled spells n at or above the smallest of scales, largest first
+func scaled(n int64, scales []numberScale, words func(int64) string) string {
+	for _, scale := range scales {
+		if n >= scale.value {
+			count := n / scale.value
+			head := scale.one
+			if count > 1 {
+				head = words(count) + " " + scale.many
+			}
+			return joinWords(head, n%scale.value, words)
+		}
+	}
+	return words(n)
+}
+
+func capitalize(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+var (
+	englishOnes = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten",
+		"eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen", "seventeen", "eighteen", "nineteen"}
+	englishTens   = []string{"", "", "twenty", "thirty", "forty", "fifty", "sixty", "seventy", "eighty", "ninety"}
+	englishMonths = []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}
+	englishScales = []numberScale{{1e12, "one trillion", "trillion"}, {1e9, "one billion", "billion"}, {1e6, "one million", "million"}, {1e3, "one thousand", "thousand"}}
+)
+
+func englishNumber(n int64) string {
+	switch {
+	case n < 20:
+		return englishOnes[n]
+	case n < 100:
+		if n%10 == 0 {
+			return englishTens[n/10]
+		}
+		return englishTens[n/10] + "-" + englishOnes[n%10]
+	case n < 1000:
+		return joinWords(englishOnes[n/100]+" hundred", n%100, englishNumber)
+	}
+	return scaled(n, englishScales, englishNumber)
+}
+
+func englishOrdinal(n int64) string {
+	words := englishNumber(n)
+	cut := strings.LastIndexAny(words, " -") + 1
+	last := words[cut:]
+	irregular := map[string]string{"one": "first", "two": "second", "three": "third", "five": "fifth", "eight": "eighth", "nine": "ninth", "twelve": "twelfth"}
+	switch {
+	case irregular[last] != "":
+		last = irregular[last]
+	case strings.HasSuffix(last, "y"):
+		last = strings.TrimSuffix(last, "y") + "ieth"
+	default:
+		last += "th"
+	}
+	return words[:cut] + last
+}
+
+// englishYear reads years in pairs, "nineteen oh five", except 2000 to 2009
+func englishYear(year int) string {
+	n := int64(year)
+	switch {
+	case year < 1100 || year >= 10000 || year%1000 < 10:
+		return englishNumber(n)
+	case year%100 == 0:
+		return englishNumber(n/100) + " hundred"
+	case year%100 < 10:
+		return englishNumber(n/100) + " oh " + englishNumber(n%100)
+	}
+	return englishNumber(n/100) + " " + englishNumber(n%100)
+}
+
+var (
+	indonesianOnes   = []string{"nol", "satu", "dua", "tiga", "empat", "lima", "enam", "tujuh", "delapan", "sembilan", "sepuluh", "sebelas"}
+	indonesianMonths = []string{"Januari", "Februari", "Maret", "April", "Mei", "Juni", "Juli", "Agustus", "September", "Oktober", "November", "Desember"}
+	indonesianScales = []numberScale{{1e12, "satu triliun", "triliun"}, {1e9, "satu miliar", "miliar"}, {1e6, "satu juta", "juta"}}
+)
+
+func indonesianNumber(n int64) string {
+	switch {
+	case n < 12:
+		return indonesianOnes[n]
+	case n < 20:
+		return indonesianOnes[n-10] + " belas"
+	case n < 100:
+		return joinWords(indonesianOnes[n/10]+" puluh", n%10, indonesianNumber)
+	case n < 200:
+		return joinWords("seratus", n%100, indonesianNumber)
+	case n < 1000:
+		return joinWords(indonesianOnes[n/100]+" ratus", n%100, indonesianNumber)
+	case n < 2000:
+		return joinWords("seribu", n%1000, indonesianNumber)
+	case n < 1e6:
+		return joinWords(indonesianNumber(n/1000)+" ribu", n%1000, indonesianNumber)
+	}
+	return scaled(n, indonesianScales, indonesianNumber)
+}
+
+var (
+	spanishOnes = []string{"cero", "uno", "dos", "tres", "cuatro", "cinco", "seis", "siete", "ocho", "nueve", "diez",
+		"once", "doce", "trece", "catorce", "quince", "dieciséis", "diecisiete", "dieciocho", "diecinueve", "veinte",
+		"veintiuno", "veintidós", "veintitrés", "veinticuatro", "veinticinco", "veintiséis", "veintisiete", "veintiocho", "veintinueve"}
+	spanishTens     = []string{"", "", "", "treinta", "cuarenta", "cincuenta", "sesenta", "setenta", "ochenta", "noventa"}
+	spanishHundreds = []string{"", "ciento", "doscientos", "trescientos", "cuatrocientos", "quinientos", "seiscientos", "setecientos", "ochocientos", "novecientos"}
+	spanishMonths   = []string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"}
+	// Denominators 2 to 10
+	spanishPartitives = []string{"medio", "tercio", "cuarto", "quinto", "sexto", "séptimo", "octavo", "noveno", "décimo"}
+)
+
+func spanishNumber(n int64) string {
+	switch {
+	case n < 30:
+		return spanishOnes[n]
+	case n < 100:
+		if n%10 == 0 {
+			return spanishTens[n/10]
+		}
+		return spanishTens[n/10] + " y " + spanishOnes[n%10]
+	case n == 100:
+		return "cien"
+	case n < 1000:
+		return joinWords(spanishHundreds[n/100], n%100, spanishNumber)
+	case n < 2000:
+		return joinWords("mil", n%1000, spanishNumber)
+	case n < 1e6:
+		return joinWords(spanishApocope(spanishNumber(n/1000))+" mil", n%1000, spanishNumber)
+	case n < 1e12: // "mil millones" rather than a word for 10⁹
+		return joinWords(spanishMillions(n/1e6, "millón", "millones"), n%1e6, spanishNumber)
+	}
+	return joinWords(spanishMillions(n/1e12, "billón", "billones"), n%1e12, spanishNumber)
+}
+
+func spanishMillions(count int64, one, many string) string {
+	if count == 1 {
+		return "un " + one
+	}
+	return spanishApocope(spanishNumber(count)) + " " + many
+}
+
+// spanishApocope shortens a final "uno" before a noun: "veintiún euros"
+func spanishApocope(words string) string {
+	if strings.HasSuffix(words, "veintiuno") {
+		return strings.TrimSuffix(words, "veintiuno") + "veintiún"
+	}
+	if words == "uno" || strings.HasSuffix(words, " uno") {
+		return strings.TrimSuffix(words, "uno") + "un"
+	}
+	return words
+}
+
+var (
+	frenchOnes = []string{"zéro", "un", "deux", "trois", "quatre", "cinq", "six", "sept", "huit", "neuf", "dix",
+		"onze", "douze", "treize", "quatorze", "quinze", "seize", "dix-sept", "dix-huit", "dix-neuf"}
+	frenchTens   = []string{"", "", "vingt", "trente", "quarante", "cinquante", "soixante"}
+	frenchMonths = []string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"}
+	frenchScales = []numberScale{{1e12, "un billion", "billions"}, {1e9, "un milliard", "milliards"}, {1e6, "un million", "millions"}}
+)
+
+func frenchNumber(n int64) string {
+	switch {
+	case n < 20:
+		return frenchOnes[n]
+	case n < 70:
+		switch n % 10 {
+		case 0:
+			return frenchTens[n/10]
+		case 1:
+			return frenchTens[n/10] + " et un"
+		}
+		return frenchTens[n/10] + "-" + frenchOnes[n%10]
+	case n == 71:
+		return "soixante et onze"
+	case n < 80:
+		return "soixante-" + frenchOnes[n-60]
+	case n == 80:
+		return "quatre-vingts"
+	case n < 100:
+		return "quatre-vingt-" + frenchOnes[n-80]
+	case n < 200:
+		return joinWords("cent", n%100, frenchNumber)
+	case n < 1000:
+		if n%100 == 0 {
+			return frenchOnes[n/100] + " cents"
+		}
+		return frenchOnes[n/100] + " cent " + frenchNumber(n%100)
+	case n < 2000:
+		return joinWords("mille", n%1000, frenchNumber)
+	case n < 1e6:
+		head := frenchNumber(n / 1000)
+		if strings.HasSuffix(head, "cents") || strings.HasSuffix(head, "vingts") {
+			head = strings.TrimSuffix(head, "s") // Mille is not a noun, so they stay singular
+		}
+		return joinWords(head+" mille", n%1000, frenchNumber)
+	}
+	return scaled(n, frenchScales, frenchNumber)
+}
+
+func frenchOrdinal(n int64) string {
+	words := frenchNumber(n)
+	switch {
+	case strings.HasSuffix(words, "cinq"):
+		words += "u"
+	case strings.HasSuffix(words, "neuf"):
+		words = strings.TrimSuffix(words, "f") + "v"
+	case strings.HasSuffix(words, "e"):
+		words = strings.TrimSuffix(words, "e")
+	}
+	return words + "ième"
+}
+
+var (
+	germanOnes = []string{"null", "eins", "zwei", "drei", "vier", "fünf", "sechs", "sieben", "acht", "neun", "zehn",
+		"elf", "zwölf", "dreizehn", "vierzehn", "fünfzehn", "sechzehn", "siebzehn", "achtzehn", "neunzehn"}
+	germanTens   = []string{"", "", "zwanzig", "dreißig", "vierzig", "fünfzig", "sechzig", "siebzig", "achtzig", "neunzig"}
+	germanMonths = []string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"}
+	germanScales = []numberScale{{1e12, "eine Billion", "Billionen"}, {1e9, "eine Milliarde", "Milliarden"}, {1e6, "eine Million", "Millionen"}}
+)
+
+// germanNumber writes numbers below a million as one word, like German does
+func germanNumber(n int64) string {
+	switch {
+	case n < 20:
+		return germanOnes[n]
+	case n < 100:
+		if n%10 == 0 {
+			return germanTens[n/10]
+		}
+		return germanAttributive(germanOnes[n%10]) + "und" + germanTens[n/10]
+	case n < 1000:
+		return germanAttributive(germanNumber(n/100)) + "hundert" + germanCompound(n%100)
+	case n < 1e6:
+		return germanAttributive(germanNumber(n/1000)) + "tausend" + germanCompound(n%1000)
+	}
+	return scaled(n, germanScales, germanNumber)
+}
+
+func germanCompound(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return germanNumber(n)
+}
+
+// germanAttributive turns a final "eins" into "ein", as before nouns and in compounds
+func germanAttributive(words string) string {
+	if strings.HasSuffix(words, "eins") {
+		return strings.TrimSuffix(words, "s")
+	}
+	return words
+}
+
+func germanOrdinal(n int64) string {
+	switch n {
+	case 1:
+		return "erster"
+	case 3:
+		return "dritter"
+	case 7:
+		return "siebter"
+	case 8:
+		return "achter"
+	}
+	if n < 20 {
+		return germanNumber(n) + "ter"
+	}
+	return germanNumber(n) + "ster"
+}
+
+// germanYear reads 1100 to 1999 in hundreds, "neunzehnhundertneunundneunzig"
+func germanYear(year int) string {
+	if year >= 1100 && year < 2000 {
+		return germanNumber(int64(year/100)) + "hundert" + germanCompound(int64(year%100))
+	}
+	return germanNumber(int64(year))
+}
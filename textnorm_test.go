@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestExpandText(t *testing.T) {
+	tests := []struct {
+		lang, text, want string
+	}{
+		{"en", "Dr. Smith paid $3.50 on 2024-03-01.", "Doctor Smith paid three dollars and fifty cents on March first, twenty twenty-four."},
+		{"en", "It costs 1,234 dollars, i.e. a lot", "It costs one thousand two hundred thirty-four dollars, that is a lot"},
+		{"en", "3/4 of 50% is -12", "three quarters of fifty percent is minus twelve"},
+		{"en", "£1", "one pound"},
+		{"en-GB", "21 Mr. Jones", "twenty-one Mister Jones"},
+		{"en", "Open 24/7, score 3/2", "Open 24/7, score 3/2"},
+		{"en", "Call 10:30 or v1_2", "Call 10:30 or v1_2"},
+		{"en", "1234567890123456789", "one two three four five six seven eight nine zero one two three four five six seven eight nine"},
+		{"id", "Rp 10.000 untuk Bpk. Budi, 2,5 kg", "sepuluh ribu rupiah untuk Bapak Budi, dua koma lima kg"},
+		{"id", "1/2 dan 1/4", "setengah dan seperempat"},
+		{"es", "Sr. García paga 21 € el 2024-01-01", "señor García paga veintiún euros el primero de enero de dos mil veinticuatro"},
+		{"es", "1/3 y 2/3", "un tercio y dos tercios"},
+		{"fr", "M. Dupont a 80 000 €, soit 2,5 %", "Monsieur Dupont a quatre-vingt mille euros, soit deux virgule cinq pour cent"},
+		{"fr", "1/2 et 2/3", "un demi et deux tiers"},
+		{"de", "Dr. Müller zahlt 1,50 €", "Doktor Müller zahlt ein Euro und fünfzig Cent"},
+		{"de", "2024-05-03", "dritter Mai zweitausendvierundzwanzig"},
+		{"de", "1/2 und 3/8", "ein halb und drei Achtel"},
+		{"ja", "3 Dr. 2024-03-01", "3 Dr. 2024-03-01"},
+	}
+	for _, tt := range tests {
+		if got := expandText(tt.text, tt.lang); got != tt.want {
+			t.Errorf("expandText(%q, %q) = %q, want %q", tt.text, tt.lang, got, tt.want)
+		}
+	}
+}
+
+func TestNumberWords(t *testing.T) {
+	tests := []struct {
+		name  string
+		words func(int64) string
+		n     int64
+		want  string
+	}{
+		{"en", englishNumber, 0, "zero"},
+		{"en", englishNumber, 115, "one hundred fifteen"},
+		{"en", englishNumber, 2_000_001, "two million one"},
+		{"en ordinal", englishOrdinal, 22, "twenty-second"},
+		{"id", indonesianNumber, 11, "sebelas"},
+		{"id", indonesianNumber, 1100, "seribu seratus"},
+		{"es", spanishNumber, 21, "veintiuno"},
+		{"es", spanishNumber, 1_000_000, "un millón"},
+		{"fr", frenchNumber, 71, "soixante et onze"},
+		{"fr", frenchNumber, 80, "quatre-vingts"},
+		{"de", germanNumber, 21, "einundzwanzig"},
+		{"de", germanNumber, 1_000_000, "eine Million"},
+	}
+	for _, tt := range tests {
+		if got := tt.words(tt.n); got != tt.want {
+			t.Errorf("%s(%d) = %q, want %q", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
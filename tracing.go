@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing follows the OpenTelemetry data model and exports spans with
+// OTLP/HTTP in its JSON encoding, so any collector or backend that accepts
+// OTLP can receive them. Trace context is taken from and propagated with
+// W3C traceparent headers.
+
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`     // OTLP/HTTP base URL such as http://collector:4318; empty disables tracing
+	ServiceName string            `json:"service_name"` // Reported as the service.name resource attribute
+	SampleRate  float64           `json:"sample_rate"`  // Fraction of new traces recorded; incoming sampled traces are always kept
+	Headers     map[string]string `json:"headers"`      // Extra export headers, e.g. an API key for a hosted backend
+}
+
+// Span kinds and status codes from the OTLP protocol
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	statusOK         = 1
+	statusError      = 2
+)
+
+// Span is a timed operation within a trace. A nil *Span is valid and ignores
+// every call, which is what callers get when the trace is not sampled.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	attrs map[string]any
+}
+
+type finishedSpan struct {
+	span *Span
+	end  time.Time
+	err  error
+}
+
+// Tracer samples traces and exports finished spans in batches
+type Tracer struct {
+	cfg     TracingConfig
+	client  *http.Client
+	pending chan finishedSpan
+}
+
+// tracer is set at startup; while nil, startSpan records nothing
+var tracer *Tracer
+
+type spanContextKey struct{}
+
+// NewTracer returns nil when no endpoint is configured. The standard
+// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_SERVICE_NAME variables fill in
+// anything the config leaves empty.
+func NewTracer(cfg TracingConfig) *Tracer {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = os.Getenv("OTEL_SERVICE_NAME")
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "gtts-service"
+	}
+	if cfg.SampleRate <= 0 {
+		cfg.SampleRate = 1
+	}
+	t := &Tracer{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}, pending: make(chan finishedSpan, 2048)}
+	go t.exportLoop()
+	return t
+}
+
+// startSpan starts a child of the span in ctx. Without a recording parent it
+// returns a nil span, so only requests that were sampled at the edge are traced.
+func startSpan(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	parent, _ := ctx.Value(spanContextKey{}).(*Span)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(name, spanKindInternal, parent.traceID, parent.spanID)
+	span.set(attrs...)
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// startRequestSpan starts the server span for an incoming request, continuing
+// the caller's trace when it sent a traceparent header
+func (t *Tracer) startRequestSpan(r *http.Request, name string) (context.Context, *Span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+	traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent"))
+	if ok && !sampled || !ok && mathrand.Float64() >= t.cfg.SampleRate {
+		return r.Context(), nil
+	}
+	if !ok {
+		rand.Read(traceID[:])
+	}
+	span := t.newSpan(name, spanKindServer, traceID, parentID)
+	return context.WithValue(r.Context(), spanContextKey{}, span), span
+}
+
+func (t *Tracer) newSpan(name string, kind int, traceID [16]byte, parentID [8]byte) *Span {
+	span := &Span{tracer: t, traceID: traceID, parentID: parentID, name: name, kind: kind, start: time.Now(), attrs: make(map[string]any)}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// parseTraceparent reads a W3C traceparent header: version-traceid-parentid-flags
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// set adds attributes given as alternating keys and values
+// traceparent formats the span as a W3C traceparent value; empty for a nil span
+func (s *Span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+func (s *Span) set(attrs ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if key, ok := attrs[i].(string); ok {
+			s.attrs[key] = attrs[i+1]
+		}
+	}
+}
+
+// end finishes the span, marking it failed when err is non-nil
+func (s *Span) end(err error) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.tracer.pending <- finishedSpan{span: s, end: time.Now(), err: err}:
+	default: // Exporter is behind; drop rather than block requests
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var batch []finishedSpan
+	for {
+		select {
+		case span := <-t.pending:
+			batch = append(batch, span)
+			if len(batch) < 512 {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			slog.Warn("Span export failed", "spans", len(batch), "error", err)
+		}
+		batch = nil
+	}
+}
+
+// OTLP JSON encoding of ExportTraceServiceRequest
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 values are strings in OTLP JSON
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(key string, value any) otlpAttribute {
+	var v otlpValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int:
+		s := strconv.Itoa(value)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
+
+func (t *Tracer) export(batch []finishedSpan) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, f := range batch {
+		s := f.span
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(f.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: statusOK},
+		}
+		if s.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if f.err != nil {
+			out.Status = otlpStatus{Code: statusError, Message: f.err.Error()}
+		}
+		s.mu.Lock()
+		for _, key := range sortedKeys(s.attrs) {
+			out.Attributes = append(out.Attributes, otlpAttr(key, s.attrs[key]))
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	scope := otlpScopeSpans{Spans: spans}
+	scope.Scope.Name = "gtts-service"
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpAttribute{otlpAttr("service.name", t.cfg.ServiceName)}
+
+	data, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{resource}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(t.cfg.Endpoint, "/")+"/v1/traces", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
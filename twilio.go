@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// The Twilio integration lets GET /twiml be used directly as a voice
+// webhook. It answers with TwiML that plays the text, as 8 kHz μ-law WAV,
+// from a URL on this server. Twilio fetches that URL without credentials, so
+// the URL carries its own signature instead.
+
+type TwilioConfig struct {
+	AuthToken string `json:"auth_token"` // Enables GET /twiml; Twilio signs its webhooks with it
+	PublicURL string `json:"public_url"` // Base URL Twilio calls, e.g. https://tts.example.com, which signatures cover
+	Lang      string `json:"lang"`       // Language when the webhook URL has no lang parameter
+}
+
+type twimlResponse struct {
+	XMLName xml.Name `xml:"Response"`
+	Play    string   `xml:"Play"`
+}
+
+// twilioAudioOptions is what Twilio plays without transcoding
+var twilioAudioOptions = AudioOptions{Format: "mulaw"}
+
+// verifyTwilioSignature checks X-Twilio-Signature: base64(HMAC-SHA1(url)),
+// where url is the full URL Twilio requested
+func verifyTwilioSignature(fullURL, signature, authToken string) bool {
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(fullURL))
+	return hmac.Equal([]byte(base64.StdEncoding.EncodeToString(mac.Sum(nil))), []byte(signature))
+}
+
+// twimlAudioSignature authorizes an audio URL for one text and language
+func (s *server) twimlAudioSignature(text, lang string) string {
+	mac := hmac.New(sha256.New, []byte(s.cfg.Twilio.AuthToken))
+	mac.Write([]byte("twiml-audio\x00" + lang + "\x00" + text))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *server) twimlAudioURL(text, lang string) string {
+	query := url.Values{"text": {text}, "lang": {lang}, "sig": {s.twimlAudioSignature(text, lang)}}
+	return strings.TrimSuffix(s.cfg.Twilio.PublicURL, "/") + "/twiml/audio?" + query.Encode()
+}
+
+// Answers a Twilio voice webhook with TwiML playing the text. The audio is
+// synthesized before answering, so Twilio's fetch of it is a cache hit.
+func (s *server) handleTwiML(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.Twilio.AuthToken == "" {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Twilio integration is not enabled")
+		return
+	}
+	fullURL := strings.TrimSuffix(s.cfg.Twilio.PublicURL, "/") + r.URL.RequestURI()
+	if !verifyTwilioSignature(fullURL, r.Header.Get("X-Twilio-Signature"), s.cfg.Twilio.AuthToken) {
+		writeError(w, r, http.StatusUnauthorized, codeInvalidSignature, "Invalid Twilio signature")
+		return
+	}
+	text := strings.TrimSpace(r.URL.Query().Get("text"))
+	if text == "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: /text: is required", Pointer: "/text"})
+		return
+	}
+	chars := utf8.RuneCountInString(text)
+	if s.cfg.MaxTextChars > 0 && chars > s.cfg.MaxTextChars {
+		writeLimitError(w, r, codeTextTooLong, fmt.Sprintf("Text is %d characters long", chars), int64(s.cfg.MaxTextChars))
+		return
+	}
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = s.cfg.Twilio.Lang
+	}
+	if lang == "" {
+		lang = "en"
+	}
+	engine, lang, ok := s.resolveEngine(w, r, "", lang)
+	if !ok {
+		return
+	}
+	setRequestText(r.Context(), text)
+	text, err := s.screen(r.Context(), GuardrailInput{Text: text, Lang: lang, Engine: engine.Name(), Source: "twilio"})
+	if err != nil {
+		writeGuardrailError(w, r, err, "/text")
+		return
+	}
+
+	_, cached, err := getOrGenerateAudio(r.Context(), engine, text, lang, s.cache, twilioAudioOptions)
+	annotate(r.Context(), "engine", engine.Name(), "lang", lang, "text_length", chars, "cache_hit", cached)
+	if err != nil {
+		annotate(r.Context(), "error", err.Error())
+		s.writeSynthesisError(w, r, engine, err)
+		return
+	}
+	s.costs.record(engine.Name(), int64(chars), !cached)
+
+	body, err := xml.Marshal(twimlResponse{Play: s.twimlAudioURL(text, lang)})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "Failed to build TwiML")
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+// Serves the audio a TwiML response points at; the URL's signature is the only authorization needed
+func (s *server) handleTwiMLAudio(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	text, lang := query.Get("text"), query.Get("lang")
+	if s.cfg.Twilio.AuthToken == "" || !hmac.Equal([]byte(query.Get("sig")), []byte(s.twimlAudioSignature(text, lang))) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Unknown audio")
+		return
+	}
+	engine, _ := s.engineFor("")
+	// The text was screened when the TwiML was served; screen it again, as
+	// Twilio may fetch the audio after the policy changed
+	text, err := s.screen(r.Context(), GuardrailInput{Text: text, Lang: lang, Engine: engine.Name(), Source: "twilio"})
+	if err != nil {
+		writeGuardrailError(w, r, err, "")
+		return
+	}
+	audio, cached, err := getOrGenerateAudio(r.Context(), engine, text, lang, s.cache, twilioAudioOptions)
+	annotate(r.Context(), "engine", engine.Name(), "lang", lang, "cache_hit", cached)
+	setRequestSource(r.Context(), cached)
+	if err != nil {
+		annotate(r.Context(), "error", err.Error())
+		s.writeSynthesisError(w, r, engine, err)
+		return
+	}
+	if !cached {
+		s.costs.record(engine.Name(), int64(utf8.RuneCountInString(text)), true) // Evicted since the TwiML was served
+	}
+	w.Header().Set("Content-Type", twilioAudioOptions.mimeType())
+	w.Write(audio)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Edge nodes of a two-tier deployment forward /v1/speak cache misses to a
+// central synthesizing instance (upstream) instead of synthesizing, then cache
+// the audio like their own, so the next request for it is served at the
+// edge. The upstream is called with the edge's own API key, for the engine
+// and format the edge resolved, so both tiers agree on the cache key. Combined
+// with replica, an edge node needs no engines at all. Bitrate ladders, read
+// aloud chunks and streaming sessions are not forwarded.
+
+const defaultUpstreamTimeout = 8 * time.Second // Below the server's write timeout
+
+// Largest audio accepted from the upstream
+const maxUpstreamAudioBytes = 64 << 20
+
+var errUpstream = errors.New("upstream request failed")
+
+type UpstreamConfig struct {
+	URL     string   `json:"url"`     // Base URL of a synthesizing instance; empty disables forwarding
+	APIKey  string   `json:"api_key"` // Sent as X-API-Key
+	Timeout Duration `json:"timeout"`
+}
+
+// Upstream forwards cache misses; nil when no upstream is configured
+type Upstream struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func NewUpstream(cfg UpstreamConfig) *Upstream {
+	if cfg.URL == "" {
+		return nil
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	return &Upstream{url: strings.TrimRight(cfg.URL, "/"), apiKey: cfg.APIKey, client: &http.Client{Timeout: timeout}}
+}
+
+// speak asks the upstream for the audio of payload
+func (u *Upstream) speak(ctx context.Context, payload RequestPayload) ([]byte, error) {
+	ctx, span := startSpan(ctx, "upstream.speak", "tts.engine", payload.Engine)
+	audio, err := u.post(ctx, "/v1/speak", payload)
+	span.set("tts.audio_bytes", len(audio))
+	span.end(err)
+	return audio, err
+}
+
+func (u *Upstream) post(ctx context.Context, path string, payload any) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Response-Envelope", envelopeBare)
+	req.Header.Set("X-Request-ID", requestIDFrom(ctx))
+	if u.apiKey != "" {
+		req.Header.Set("X-API-Key", u.apiKey)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUpstream, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamAudioBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUpstream, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var problem Problem
+		json.Unmarshal(data, &problem)
+		return nil, fmt.Errorf("%w: %s %s", errUpstream, resp.Status, problem.Code)
+	}
+	if len(data) > maxUpstreamAudioBytes {
+		return nil, fmt.Errorf("%w: audio is larger than %d bytes", errUpstream, maxUpstreamAudioBytes)
+	}
+	return data, nil
+}
+
+// healthy checks the upstream's /healthz, for readiness probes
+func (u *Upstream) healthy(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream /healthz returned %s", resp.Status)
+	}
+	return nil
+}
+
+type forwardContextKey struct{}
+
+// withForward makes getOrGenerateAudio call forward instead of synthesizing
+func withForward(ctx context.Context, forward func(context.Context) ([]byte, error)) context.Context {
+	return context.WithValue(ctx, forwardContextKey{}, forward)
+}
+
+func forwardFrom(ctx context.Context) func(context.Context) ([]byte, error) {
+	forward, _ := ctx.Value(forwardContextKey{}).(func(context.Context) ([]byte, error))
+	return forward
+}
+
+func writeUpstreamError(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusBadGateway, codeUpstreamFailed, "The upstream instance failed to synthesize the audio")
+}
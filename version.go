@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Build information, injected at build time with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Builds without ldflags fall back to the VCS stamp Go embeds in the binary.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+type VersionInfo struct {
+	Version   string            `json:"version"`
+	Commit    string            `json:"commit"`
+	BuildDate string            `json:"build_date"`
+	GoVersion string            `json:"go_version"`
+	Tools     map[string]string `json:"tools"` // Versions of the external binaries, "unavailable" when missing
+}
+
+var (
+	toolVersionsOnce sync.Once
+	toolVersions     map[string]string
+)
+
+// detectToolVersions asks gtts-cli and ffmpeg for their versions once; the
+// binaries do not change while the process runs
+func detectToolVersions() map[string]string {
+	toolVersionsOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		toolVersions = map[string]string{
+			"gtts-cli": toolVersion(ctx, "gtts-cli", "--version"), // "gtts-cli, version 2.5.1"
+			"ffmpeg":   toolVersion(ctx, "ffmpeg", "-version"),    // "ffmpeg version 6.0 Copyright ..."
+		}
+	})
+	return toolVersions
+}
+
+// toolVersion returns the word after "version" in the command's first line of output
+func toolVersion(ctx context.Context, name, arg string) string {
+	out, err := exec.CommandContext(ctx, name, arg).Output()
+	if err != nil {
+		return "unavailable"
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	fields := strings.Fields(line)
+	for i, field := range fields {
+		if field == "version" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return "unknown"
+	}
+	return line
+}
+
+func buildInfo() VersionInfo {
+	info := VersionInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func (s *server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	info := buildInfo()
+	info.Tools = detectToolVersions()
+	writeJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// EngineFeatures lists the optional SynthesisRequest fields an engine honors
+type EngineFeatures struct {
+	Voice   bool     // gtts maps voices to Google's regional domains, e.g. co.uk
+	Voices  []string // The voices accepted, when the engine has a fixed set
+	Style   bool
+	Context bool // Conditions on the previous sentence, e.g. XTTS, for continuous prosody
+	Slow    bool
+}
+
+// FeatureReporter is implemented by engines that honor optional request fields
+type FeatureReporter interface {
+	Features() EngineFeatures
+}
+
+func engineFeatures(engine Engine) EngineFeatures {
+	if reporter, ok := engine.(FeatureReporter); ok {
+		return reporter.Features()
+	}
+	return EngineFeatures{}
+}
+
+func (e *gttsEngine) Features() EngineFeatures {
+	return EngineFeatures{Voice: true, Voices: gttsTLDs, Slow: true}
+}
+
+// Features of a command engine follow the placeholders its command line uses
+func (e *commandEngine) Features() EngineFeatures {
+	var features EngineFeatures
+	for _, arg := range e.argv {
+		features.Voice = features.Voice || strings.Contains(arg, "{voice}")
+		features.Style = features.Style || strings.Contains(arg, "{style}")
+		features.Context = features.Context || strings.Contains(arg, "{previous}")
+	}
+	return features
+}
+
+// checkEngineOptions writes a 400 and returns false when opts ask for
+// something the engine cannot do
+func checkEngineOptions(w http.ResponseWriter, r *http.Request, engine Engine, opts AudioOptions) bool {
+	features := engineFeatures(engine)
+	unsupported := ""
+	switch {
+	case opts.Slow && !features.Slow:
+		unsupported = "/slow"
+	case opts.Voice != "" && !features.Voice:
+		unsupported = "/tld"
+	}
+	if unsupported != "" {
+		writeProblem(w, r, Problem{Status: http.StatusBadRequest, Code: codeInvalidPayload, Detail: "Invalid request payload: " + unsupported + ": is not supported by engine " + engine.Name(), Pointer: unsupported})
+		return false
+	}
+	return true
+}
+
+// Voice and style names end up on engine command lines
+var voiceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// sessionVoice is what a streaming session keeps constant across fragments
+type sessionVoice struct {
+	voice  string
+	style  string
+	speed  float64
+	pitch  float64
+	smooth bool // Pass the previous sentence to engines that condition on it
+}
+
+// parseSessionVoice reads voice, style, speed, pitch and smooth from a session
+// URL. Engines with a fixed set of voices, gtts's regional domains, accept only
+// those; smooth is quietly dropped for engines without context support.
+func parseSessionVoice(query url.Values, features EngineFeatures) (sessionVoice, error) {
+	var v sessionVoice
+	for _, field := range []struct {
+		name      string
+		supported bool
+		value     *string
+	}{{"voice", features.Voice, &v.voice}, {"style", features.Style, &v.style}} {
+		value := query.Get(field.name)
+		if value == "" {
+			continue
+		}
+		if !field.supported {
+			return v, &ValidationError{"/" + field.name, "is not supported by this engine"}
+		}
+		if !voiceNamePattern.MatchString(value) {
+			return v, &ValidationError{"/" + field.name, "must be letters, digits, dots, dashes or underscores"}
+		}
+		if field.name == "voice" && len(features.Voices) > 0 && !slices.Contains(features.Voices, value) {
+			return v, &ValidationError{"/voice", "must be one of " + strings.Join(features.Voices, ", ")}
+		}
+		*field.value = value
+	}
+	for _, field := range []struct {
+		name     string
+		min, max float64
+		value    *float64
+	}{{"speed", 0.5, 4, &v.speed}, {"pitch", -12, 12, &v.pitch}} {
+		value := query.Get(field.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || n < field.min || n > field.max {
+			return v, &ValidationError{"/" + field.name, fmt.Sprintf("must be a number from %g to %g", field.min, field.max)}
+		}
+		*field.value = n
+	}
+	if value := query.Get("smooth"); value != "" {
+		smooth, err := strconv.ParseBool(value)
+		if err != nil {
+			return v, &ValidationError{"/smooth", "must be true or false"}
+		}
+		v.smooth = smooth && features.Context
+	}
+	return v, nil
+}
+
+// voicedEngine synthesizes one sentence with a session's voice, style and
+// context. Like ssmlEngine it stands in for the underlying engine; its cache
+// text folds those settings in, so Synthesize speaks text instead of req.Text.
+type voicedEngine struct {
+	Engine
+	text     string
+	voice    string
+	style    string
+	previous string
+}
+
+func (e voicedEngine) Features() EngineFeatures { return engineFeatures(e.Engine) }
+
+func (e voicedEngine) Synthesize(ctx context.Context, req SynthesisRequest) ([]byte, error) {
+	return e.Engine.Synthesize(ctx, SynthesisRequest{Text: e.text, Lang: req.Lang, Voice: e.voice, Style: e.style, Previous: e.previous, Slow: req.Slow})
+}
+
+// cacheText identifies the sentence with its settings; plain sentences keep their own text
+func (e voicedEngine) cacheText() string {
+	if e.voice == "" && e.style == "" && e.previous == "" {
+		return e.text
+	}
+	return strings.Join([]string{"\x00voice", e.voice, e.style, e.previous, e.text}, "\x00")
+}
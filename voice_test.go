@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseSessionVoice(t *testing.T) {
+	gtts := (&gttsEngine{}).Features()
+	command := EngineFeatures{Voice: true, Style: true}
+	tests := []struct {
+		name, query string
+		features    EngineFeatures
+		want        sessionVoice
+		wantPointer string
+	}{
+		{"gtts accent", "voice=co.uk", gtts, sessionVoice{voice: "co.uk"}, ""},
+		{"gtts unknown accent", "voice=example.com", gtts, sessionVoice{}, "/voice"},
+		{"gtts flag", "voice=-x", gtts, sessionVoice{}, "/voice"},
+		{"gtts style", "style=cheerful", gtts, sessionVoice{}, "/style"},
+		{"command voice", "voice=en_US-amy&style=cheerful", command, sessionVoice{voice: "en_US-amy", style: "cheerful"}, ""},
+		{"speed", "speed=1.5&pitch=-2", command, sessionVoice{speed: 1.5, pitch: -2}, ""},
+		{"speed out of range", "speed=9", command, sessionVoice{}, "/speed"},
+		{"smooth without context", "smooth=true", command, sessionVoice{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			got, err := parseSessionVoice(query, tt.features)
+			if tt.wantPointer != "" {
+				var invalid *ValidationError
+				if !errors.As(err, &invalid) || invalid.Pointer != tt.wantPointer {
+					t.Fatalf("parseSessionVoice(%q) error = %v, want one at %s", tt.query, err, tt.wantPointer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSessionVoice(%q): %v", tt.query, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseSessionVoice(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+// The tld enum is repeated in each schema that accepts it
+func TestSchemasShareGTTSTLDs(t *testing.T) {
+	if len(gttsTLDs) == 0 {
+		t.Fatal("speak schema lists no tld values")
+	}
+	if got := schemaEnum("readaloud", "tld"); !reflect.DeepEqual(got, gttsTLDs) {
+		t.Errorf("readaloud tld enum = %q, want %q as in speak", got, gttsTLDs)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal server side of the WebSocket protocol (RFC 6455): the opening
+// handshake, masked client frames, fragmented messages and the ping and close
+// control frames. Extensions such as compression are not negotiated.
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// Close status codes
+const (
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsClosePolicy      = 1008
+	wsCloseTooBig      = 1009
+)
+
+// Largest message accepted from a client
+const wsMaxMessage = 64 << 10
+
+var errWSClosed = errors.New("websocket closed")
+
+type wsConn struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	fields *requestFields // Of the upgraded request, which counts the bytes sent
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the connection
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !headerContainsToken(r.Header.Get("Connection"), "upgrade") {
+		return nil, errors.New("expected a WebSocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	// net/http writes the 101 itself, so the status reaches the middleware
+	// that logs and counts responses, and flushes it on Hijack
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	w.Header().Set("Upgrade", "websocket")
+	w.Header().Set("Connection", "Upgrade")
+	w.Header().Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(sum[:]))
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{}) // Drop the server's HTTP timeouts
+	return &wsConn{conn: conn, rw: rw, fields: fieldsFrom(r.Context())}, nil
+}
+
+func headerContainsToken(header, token string) bool {
+	for _, part := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text or binary message, answering pings and
+// reassembling fragments on the way. A close from the peer is answered and
+// reported as errWSClosed. idle bounds the wait for each frame.
+func (c *wsConn) readMessage(idle time.Duration) (int, []byte, error) {
+	var opcode int
+	var message []byte
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(idle))
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		if op >= wsClose && (!fin || len(payload) > 125) {
+			c.close(wsCloseProtocol, "control frames must be unfragmented and short")
+			return 0, nil, errWSClosed
+		}
+		switch op {
+		case wsPing:
+			if err := c.write(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.close(code, "")
+			return 0, nil, errWSClosed
+		case wsContinuation:
+			if opcode == 0 {
+				c.close(wsCloseProtocol, "unexpected continuation frame")
+				return 0, nil, errWSClosed
+			}
+		case wsText, wsBinary:
+			if opcode != 0 {
+				c.close(wsCloseProtocol, "expected a continuation frame")
+				return 0, nil, errWSClosed
+			}
+			opcode = op
+		default:
+			c.close(wsCloseProtocol, "unknown opcode")
+			return 0, nil, errWSClosed
+		}
+		if len(message)+len(payload) > wsMaxMessage {
+			c.close(wsCloseTooBig, "message too large")
+			return 0, nil, errWSClosed
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	opcode = int(head[0] & 0x0F)
+	if head[1]&0x80 == 0 {
+		c.close(wsCloseProtocol, "client frames must be masked")
+		return false, 0, nil, errWSClosed
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessage {
+		c.close(wsCloseTooBig, "message too large")
+		return false, 0, nil, errWSClosed
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// write sends one unfragmented frame; it is safe for concurrent use
+func (c *wsConn) write(opcode int, payload []byte) error {
+	return c.writeFrom(egressOther, opcode, payload)
+}
+
+// writeAudio sends audio, counted as egress from the cache or a synthesis
+func (c *wsConn) writeAudio(opcode int, payload []byte, cached bool) error {
+	return c.writeFrom(egressSource(cached), opcode, payload)
+}
+
+func (c *wsConn) writeFrom(source string, opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return errWSClosed
+	}
+	head := []byte{0x80 | byte(opcode)}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xFFFF:
+		head = append(head, 126)
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.rw.Write(head)
+	c.rw.Write(payload)
+	if c.fields != nil {
+		c.fields.mu.Lock()
+		if c.fields.frames == nil {
+			c.fields.frames = make(map[string]int64)
+		}
+		c.fields.frames[source] += int64(len(head) + len(payload))
+		c.fields.mu.Unlock()
+	}
+	return c.rw.Flush()
+}
+
+func (c *wsConn) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.write(wsText, data)
+}
+
+// close sends a close frame, once, and closes the connection
+func (c *wsConn) close(code int, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	c.write(wsClose, append(payload, reason...))
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.conn.Close()
+	}
+}
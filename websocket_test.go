@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientFrame encodes a frame the way a client must send it, masked
+func clientFrame(fin bool, opcode int, payload []byte) []byte {
+	head := byte(opcode)
+	if fin {
+		head |= 0x80
+	}
+	frame := []byte{head}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xFFFF:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(n))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+type wsFrame struct {
+	opcode  int
+	payload []byte
+}
+
+// readServerFrames collects the unmasked frames the server sends until the connection closes
+func readServerFrames(conn net.Conn) <-chan []wsFrame {
+	done := make(chan []wsFrame, 1)
+	go func() {
+		var frames []wsFrame
+		r := bufio.NewReader(conn)
+		for {
+			var head [2]byte
+			if _, err := io.ReadFull(r, head[:]); err != nil {
+				break
+			}
+			length := int(head[1] & 0x7F)
+			switch length {
+			case 126:
+				var ext [2]byte
+				io.ReadFull(r, ext[:])
+				length = int(binary.BigEndian.Uint16(ext[:]))
+			case 127:
+				var ext [8]byte
+				io.ReadFull(r, ext[:])
+				length = int(binary.BigEndian.Uint64(ext[:]))
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				break
+			}
+			frames = append(frames, wsFrame{int(head[0] & 0x0F), payload})
+		}
+		done <- frames
+	}()
+	return done
+}
+
+func TestWebSocketReadMessage(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 300)
+	half := bytes.Repeat([]byte("b"), wsMaxMessage/2+1)
+	tests := []struct {
+		name        string
+		frames      [][]byte
+		wantOpcode  int
+		wantMessage []byte
+		wantClose   int      // Close code the server sends, when the read fails
+		wantPongs   []string // Payloads of the pongs sent before the message
+	}{
+		{name: "text", frames: [][]byte{clientFrame(true, wsText, []byte("hello"))}, wantOpcode: wsText, wantMessage: []byte("hello")},
+		{name: "16-bit length", frames: [][]byte{clientFrame(true, wsBinary, long)}, wantOpcode: wsBinary, wantMessage: long},
+		{name: "fragmented", frames: [][]byte{
+			clientFrame(false, wsBinary, []byte("ab")),
+			clientFrame(false, wsContinuation, []byte("cd")),
+			clientFrame(true, wsContinuation, []byte("ef")),
+		}, wantOpcode: wsBinary, wantMessage: []byte("abcdef")},
+		{name: "ping between fragments", frames: [][]byte{
+			clientFrame(false, wsText, []byte("a")),
+			clientFrame(true, wsPing, []byte("p1")),
+			clientFrame(true, wsContinuation, []byte("b")),
+		}, wantOpcode: wsText, wantMessage: []byte("ab"), wantPongs: []string{"p1"}},
+		{name: "pong ignored", frames: [][]byte{
+			clientFrame(true, wsPong, nil),
+			clientFrame(true, wsText, []byte("x")),
+		}, wantOpcode: wsText, wantMessage: []byte("x")},
+		{name: "unmasked", frames: [][]byte{{0x81, 0x01, 'x'}}, wantClose: wsCloseProtocol},
+		{name: "frame too large", frames: [][]byte{clientFrame(true, wsBinary, make([]byte, wsMaxMessage+1))}, wantClose: wsCloseTooBig},
+		{name: "message too large", frames: [][]byte{
+			clientFrame(false, wsBinary, half),
+			clientFrame(true, wsContinuation, half),
+		}, wantClose: wsCloseTooBig},
+		{name: "continuation first", frames: [][]byte{clientFrame(true, wsContinuation, []byte("x"))}, wantClose: wsCloseProtocol},
+		{name: "new message mid-fragment", frames: [][]byte{
+			clientFrame(false, wsText, []byte("a")),
+			clientFrame(true, wsText, []byte("b")),
+		}, wantClose: wsCloseProtocol},
+		{name: "unknown opcode", frames: [][]byte{clientFrame(true, 0x3, nil)}, wantClose: wsCloseProtocol},
+		{name: "fragmented ping", frames: [][]byte{clientFrame(false, wsPing, nil)}, wantClose: wsCloseProtocol},
+		{name: "long ping", frames: [][]byte{clientFrame(true, wsPing, make([]byte, 126))}, wantClose: wsCloseProtocol},
+		{name: "close", frames: [][]byte{clientFrame(true, wsClose, binary.BigEndian.AppendUint16(nil, 1001))}, wantClose: 1001},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			c := &wsConn{conn: server, rw: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))}
+			sent := readServerFrames(client)
+			go func() {
+				for _, frame := range tt.frames {
+					if _, err := client.Write(frame); err != nil {
+						return
+					}
+				}
+			}()
+
+			opcode, message, err := c.readMessage(5 * time.Second)
+			server.Close()
+			frames := <-sent
+			if tt.wantClose != 0 {
+				if !errors.Is(err, errWSClosed) {
+					t.Fatalf("readMessage() error = %v, want errWSClosed", err)
+				}
+				if len(frames) == 0 {
+					t.Fatalf("no close frame sent, want code %d", tt.wantClose)
+				}
+				last := frames[len(frames)-1]
+				if last.opcode != wsClose || int(binary.BigEndian.Uint16(last.payload)) != tt.wantClose {
+					t.Errorf("last frame sent = %d %q, want a close with code %d", last.opcode, last.payload, tt.wantClose)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readMessage(): %v", err)
+			}
+			if opcode != tt.wantOpcode || !bytes.Equal(message, tt.wantMessage) {
+				t.Errorf("readMessage() = %d %.20q, want %d %.20q", opcode, message, tt.wantOpcode, tt.wantMessage)
+			}
+			var pongs []string
+			for _, frame := range frames {
+				if frame.opcode == wsPong {
+					pongs = append(pongs, string(frame.payload))
+				}
+			}
+			if len(pongs) != len(tt.wantPongs) || len(pongs) > 0 && pongs[0] != tt.wantPongs[0] {
+				t.Errorf("pongs sent = %q, want %q", pongs, tt.wantPongs)
+			}
+		})
+	}
+}
+
+func TestWebSocketWriteLengths(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		server, client := net.Pipe()
+		c := &wsConn{conn: server, rw: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))}
+		sent := readServerFrames(client)
+		payload := bytes.Repeat([]byte{'z'}, n)
+		if err := c.write(wsBinary, payload); err != nil {
+			t.Fatalf("write(%d bytes): %v", n, err)
+		}
+		server.Close()
+		frames := <-sent
+		if len(frames) != 1 || frames[0].opcode != wsBinary || !bytes.Equal(frames[0].payload, payload) {
+			t.Errorf("write(%d bytes) sent %d frames, want one binary frame with the payload", n, len(frames))
+		}
+		client.Close()
+	}
+}
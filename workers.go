@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// Synthesis and its ffmpeg encoding can run in separate worker processes, so
+// the CPU-heavy tier scales apart from the API tier. With role api, cache
+// misses for plain engine requests are pushed onto a Redis list instead of
+// synthesized, and the API waits on a per-task reply list; with role worker,
+// the same binary, configured with the same engines, pops tasks, synthesizes
+// them and pushes the audio back. Workers serve only /healthz, /readyz and
+// /metrics. Tasks nobody picked up before their deadline are dropped.
+// Requests the API renders itself from engine output, such as SSML, sentence
+// cache pieces, ladders and realtime audio, are still synthesized locally.
+
+const (
+	roleAll    = "all" // Serve the API and synthesize, the default
+	roleAPI    = "api"
+	roleWorker = "worker"
+)
+
+var roles = []string{roleAll, roleAPI, roleWorker}
+
+const (
+	defaultRedisQueue   = "tts:synthesis"
+	defaultTaskTimeout  = 8 * time.Second // Below the server's write timeout
+	workerPollSeconds   = 5
+	taskResultRetention = 60 // Seconds a reply waits for an API that gave up
+)
+
+var errTaskTimeout = errors.New("no worker finished the synthesis in time")
+
+type RedisConfig struct {
+	URL         string   `json:"url"`         // redis://[[user]:password@]host[:port][/db]
+	Queue       string   `json:"queue"`       // List tasks are pushed to; tts:synthesis when empty
+	Timeout     Duration `json:"timeout"`     // How long the API waits for a worker, unless the request has a deadline, like jobs
+	Concurrency int      `json:"concurrency"` // Tasks a worker runs at once; the number of CPUs when 0
+}
+
+// workQueue is set for role api, making generateAudioData dispatch to workers
+var workQueue *WorkQueue
+
+// synthesisTask is what a worker is asked to produce
+type synthesisTask struct {
+	ID        string       `json:"id"`
+	Engine    string       `json:"engine"`
+	Text      string       `json:"text"`
+	Lang      string       `json:"lang"`
+	Options   AudioOptions `json:"options"`
+	RequestID string       `json:"request_id"`
+	Deadline  time.Time    `json:"deadline"`
+}
+
+type taskResult struct {
+	Audio []byte `json:"audio,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type WorkQueue struct {
+	redis   *redisClient
+	queue   string
+	timeout time.Duration
+}
+
+// NewWorkQueue returns the queue for roles api and worker, or nil
+func NewWorkQueue(role string, cfg RedisConfig) (*WorkQueue, error) {
+	if role != roleAPI && role != roleWorker {
+		return nil, nil
+	}
+	client, err := newRedisClient(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	q := &WorkQueue{redis: client, queue: cfg.Queue, timeout: time.Duration(cfg.Timeout)}
+	if q.queue == "" {
+		q.queue = defaultRedisQueue
+	}
+	if q.timeout <= 0 {
+		q.timeout = defaultTaskTimeout
+	}
+	return q, nil
+}
+
+func (q *WorkQueue) replyKey(id string) string {
+	return q.queue + ":reply:" + id
+}
+
+// dispatchable reports whether a worker can synthesize for engine, which
+// only holds for the configured engines themselves, not request wrappers
+func dispatchable(engine Engine) bool {
+	switch engine.(type) {
+	case *gttsEngine, *commandEngine:
+		return true
+	}
+	return false
+}
+
+// synthesize has a worker produce the encoded audio and waits for it
+func (q *WorkQueue) synthesize(ctx context.Context, engine Engine, text, lang string, opts AudioOptions) ([]byte, error) {
+	if err := maintenance.admit(ctx); err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok { // Jobs bring their own
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.timeout)
+		defer cancel()
+	}
+	ctx, span := startSpan(ctx, "worker.synthesize", "tts.engine", engine.Name())
+	id := make([]byte, 12)
+	rand.Read(id)
+	deadline, _ := ctx.Deadline()
+	task := synthesisTask{ID: hex.EncodeToString(id), Engine: engine.Name(), Text: text, Lang: lang, Options: opts, RequestID: requestIDFrom(ctx), Deadline: deadline}
+	audio, err := q.roundTrip(ctx, task)
+	span.set("tts.audio_bytes", len(audio))
+	span.end(err)
+	return audio, err
+}
+
+func (q *WorkQueue) roundTrip(ctx context.Context, task synthesisTask) ([]byte, error) {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := q.redis.do(ctx, "LPUSH", q.queue, string(data)); err != nil {
+		return nil, fmt.Errorf("queueing synthesis: %w", err)
+	}
+	wait := int(time.Until(task.Deadline).Seconds())
+	if wait < 1 {
+		wait = 1
+	}
+	// BRPOP blocks for whole seconds, so the connection gets a little longer
+	replyCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Duration(wait)*time.Second+time.Second)
+	defer cancel()
+	reply, err := q.redis.do(replyCtx, "BRPOP", q.replyKey(task.ID), strconv.Itoa(wait))
+	if err != nil {
+		return nil, fmt.Errorf("waiting for worker: %w", err)
+	}
+	items, ok := reply.([]any)
+	if !ok || len(items) != 2 {
+		return nil, errTaskTimeout
+	}
+	var result taskResult
+	if payload, ok := items[1].(string); !ok || json.Unmarshal([]byte(payload), &result) != nil {
+		return nil, errors.New("worker sent an invalid reply")
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("worker: %s", result.Error)
+	}
+	return result.Audio, nil
+}
+
+// work pops and runs tasks with the given engines until ctx is done
+func (q *WorkQueue) work(ctx context.Context, engines map[string]Engine, concurrency int) {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	slog.Info("Worker started", "queue", q.queue, "concurrency", concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for ctx.Err() == nil {
+				popCtx, cancel := context.WithTimeout(ctx, (workerPollSeconds+2)*time.Second)
+				reply, err := q.redis.do(popCtx, "BRPOP", q.queue, strconv.Itoa(workerPollSeconds))
+				cancel()
+				if err != nil {
+					slog.Warn("Failed to take a task", "queue", q.queue, "error", err)
+					time.Sleep(time.Second)
+					continue
+				}
+				if items, ok := reply.([]any); ok && len(items) == 2 {
+					if payload, ok := items[1].(string); ok {
+						q.run(ctx, engines, payload)
+					}
+				}
+			}
+		}()
+	}
+}
+
+func (q *WorkQueue) run(ctx context.Context, engines map[string]Engine, payload string) {
+	var task synthesisTask
+	if err := json.Unmarshal([]byte(payload), &task); err != nil {
+		slog.Warn("Dropped invalid task", "error", err)
+		return
+	}
+	if time.Now().After(task.Deadline) {
+		slog.Info("Dropped expired task", "request_id", task.RequestID, "task", task.ID)
+		return
+	}
+	ctx, cancel := context.WithDeadline(context.WithValue(ctx, requestIDContextKey, task.RequestID), task.Deadline)
+	defer cancel()
+	var result taskResult
+	if engine, exists := engines[task.Engine]; !exists {
+		result.Error = fmt.Sprintf("engine %q is not configured on the worker", task.Engine)
+	} else if audio, err := generateAudioData(ctx, engine, task.Text, task.Lang, task.Options); err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Audio = audio
+	}
+	if result.Error != "" {
+		slog.Warn("Task failed", "request_id", task.RequestID, "task", task.ID, "engine", task.Engine, "error", result.Error)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	replyCtx, cancelReply := context.WithTimeout(context.WithoutCancel(ctx), redisDialTimeout)
+	defer cancelReply()
+	key := q.replyKey(task.ID)
+	if _, err := q.redis.do(replyCtx, "LPUSH", key, string(data)); err != nil {
+		slog.Warn("Failed to reply to task", "request_id", task.RequestID, "task", task.ID, "error", err)
+		return
+	}
+	q.redis.do(replyCtx, "EXPIRE", key, strconv.Itoa(taskResultRetention))
+}
+
+// workerRoutes serves the probes and metrics of role worker
+func (s *server) workerRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	return mux
+}
+
+// ping checks Redis, for readiness probes
+func (q *WorkQueue) ping(ctx context.Context) error {
+	_, err := q.redis.do(ctx, "PING")
+	return err
+}
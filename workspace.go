@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Command engines run in a directory of their own, which is also their
+// TMPDIR and the {workdir} placeholder, and which is removed when the
+// synthesis ends. Keeping every engine's scratch files in one place lets the
+// service cap their total size and sweep up after engines that crash or
+// leave detached children behind.
+
+type WorkspaceConfig struct {
+	Dir        string   `json:"dir"`         // Parent of the per-synthesis directories; empty uses the system temp dir
+	Tmpfs      bool     `json:"tmpfs"`       // Keep workspaces in memory under /dev/shm instead of dir
+	QuotaBytes int64    `json:"quota_bytes"` // Total size workspaces may take up before new ones are refused; 0 is unlimited
+	MaxAge     Duration `json:"max_age"`     // Leftover directories older than this are swept
+}
+
+const tmpfsDir = "/dev/shm"
+
+var errWorkspaceFull = errors.New("workspace quota exceeded or disk space low")
+
+// Workspaces hands out and cleans up per-synthesis directories
+type Workspaces struct {
+	root   string
+	quota  int64
+	maxAge time.Duration
+}
+
+func NewWorkspaces(cfg WorkspaceConfig) (*Workspaces, error) {
+	parent := cfg.Dir
+	if cfg.Tmpfs {
+		if parent != "" {
+			return nil, errors.New("workspace: set either dir or tmpfs, not both")
+		}
+		parent = tmpfsDir
+	}
+	if parent == "" {
+		parent = os.TempDir()
+	}
+	root := filepath.Join(parent, "gtts-service-workspaces")
+	if err := os.MkdirAll(root, 0o711); err != nil {
+		return nil, fmt.Errorf("workspace: %w", err)
+	}
+	if err := os.Chmod(root, 0o711); err != nil { // Searchable by engines sandboxed as another user, but not listable
+		return nil, fmt.Errorf("workspace: %w", err)
+	}
+	maxAge := time.Duration(cfg.MaxAge)
+	if maxAge <= 0 {
+		maxAge = time.Hour
+	}
+	w := &Workspaces{root: root, quota: cfg.QuotaBytes, maxAge: maxAge}
+	if !serverless {
+		go w.sweep()
+	}
+	return w, nil
+}
+
+// acquire creates a workspace named after the request in ctx, so leftovers
+// can be traced back to it. Call the returned release when done.
+func (w *Workspaces) acquire(ctx context.Context) (string, func(), error) {
+	if w.quota > 0 && w.usage() >= w.quota || diskGuard.low(w.root) {
+		return "", nil, errWorkspaceFull
+	}
+	prefix := "synthesis-"
+	if id := requestIDFrom(ctx); id != "" {
+		prefix = id + "-"
+	}
+	dir, err := os.MkdirTemp(w.root, prefix)
+	if err != nil {
+		return "", nil, fmt.Errorf("workspace: %w", err)
+	}
+	return dir, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Warn("Failed to remove workspace", "dir", dir, "error", err)
+		}
+	}, nil
+}
+
+// usage returns the bytes taken up by every workspace
+func (w *Workspaces) usage() int64 {
+	var total int64
+	filepath.WalkDir(w.root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			if info, err := entry.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil // Workspaces vanish while being walked
+	})
+	return total
+}
+
+// sweep removes workspaces left behind by crashed syntheses or by an earlier process
+func (w *Workspaces) sweep() {
+	for {
+		entries, _ := os.ReadDir(w.root)
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > w.maxAge {
+				slog.Warn("Removing stale workspace", "dir", entry.Name())
+				os.RemoveAll(filepath.Join(w.root, entry.Name()))
+			}
+		}
+		time.Sleep(min(w.maxAge, time.Hour))
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// GET /ws/speak is a streaming session (see session.go) for clients that
+// would rather not frame anything, such as assistants speaking text as it is
+// typed or generated. It takes the same query parameters as /v1/sessions.
+// Every text message is a fragment of the text, spoken a sentence at a time
+// as the flush policy completes them; a message that is exactly a control
+// message of /v1/sessions, such as {"type":"end"}, is taken as one instead.
+// Audio comes back as binary messages only, each a sentence of Ogg Opus
+// (or AAC with codec=aac) in order, with no events around it. The "ready",
+// "interrupted", "error" and "done" events are still sent as JSON text.
+
+var rawControlTypes = []string{"flush", "end", "interrupt"}
+
+func (s *server) handleWSSpeak(w http.ResponseWriter, r *http.Request) {
+	s.openSession(w, r, true)
+}
+
+// rawSessionMessage reads a /ws/speak message as text unless it is a control message
+func rawSessionMessage(data []byte) SessionMessage {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var msg SessionMessage
+		if json.Unmarshal(trimmed, &msg) == nil && containsString(rawControlTypes, msg.Type) {
+			return msg
+		}
+	}
+	return SessionMessage{Type: "text", Text: string(data)}
+}